@@ -15,10 +15,15 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"unicode/utf16"
 )
 
 const (
 	Version = "0.1.0"
+
+	// shellQueueSize is the number of shell messages that can be queued while a message (e.g.: a cell
+	// execution) is being handled. See RunKernel.
+	shellQueueSize = 1024
 )
 
 // RunKernel takes a connected kernel and dispatches the various inputs the appropriate handlers.
@@ -51,7 +56,20 @@ func RunKernel(k *kernel.Kernel, goExec *goexec.State) {
 		}
 		return msg.DeliverInput()
 	})
-	poll(k.Shell(), handleMsg)
+	// Comm messages are handled as soon as they arrive, so they are delivered to the program of the cell
+	// being executed (see gonbui.OpenComm). Other shell messages are queued and handled in order.
+	shellQueue := make(chan kernel.Message, shellQueueSize)
+	poll(k.Shell(), func(msg kernel.Message, goExec *goexec.State) error {
+		if msg.Ok() && isCommMsg(msg) {
+			return handleMsg(msg, goExec)
+		}
+		select {
+		case shellQueue <- msg:
+		case <-k.StoppedChan():
+		}
+		return nil
+	})
+	poll(shellQueue, handleMsg)
 	poll(k.Control(), func(msg kernel.Message, goExec *goexec.State) error {
 		klog.V(2).Infof("Control MessageImpl: %+v", msg.ComposedMsg())
 		return handleMsg(msg, goExec)
@@ -94,6 +112,10 @@ func handleMsg(msg kernel.Message, goExec *goexec.State) (err error) {
 		if err = handleShutdownRequest(msg); err != nil {
 			err = errors.WithMessagef(err, "replying 'shutdown_request'")
 		}
+	case "interrupt_request":
+		if err = handleInterruptRequest(msg); err != nil {
+			err = errors.WithMessagef(err, "replying to 'interrupt_request'")
+		}
 	case "execute_request":
 		if err = handleExecuteRequest(msg, goExec); err != nil {
 			err = errors.WithMessagef(err, "replying to 'execute_request'")
@@ -108,6 +130,14 @@ func handleMsg(msg kernel.Message, goExec *goexec.State) (err error) {
 		if err := handleCompleteRequest(msg, goExec); err != nil {
 			log.Fatal(err)
 		}
+	case "comm_open", "comm_msg", "comm_close":
+		if err = kernel.DeliverComm(msg); err != nil {
+			err = errors.WithMessagef(err, "delivering %q", msg.ComposedMsg().Header.MsgType)
+		}
+	case "comm_info_request":
+		if err = kernel.SendCommInfo(msg); err != nil {
+			err = errors.WithMessagef(err, "replying to 'comm_info_request'")
+		}
 	default:
 		// Log, ignore, and hope for the best.
 		klog.Infof("Unhandled shell-socket message %q", msg.ComposedMsg().Header.MsgType)
@@ -115,6 +145,15 @@ func handleMsg(msg kernel.Message, goExec *goexec.State) (err error) {
 	return
 }
 
+// isCommMsg returns whether msg is a comm message (`comm_open`, `comm_msg` or `comm_close`) sent by the front-end.
+func isCommMsg(msg kernel.Message) bool {
+	switch msg.ComposedMsg().Header.MsgType {
+	case "comm_open", "comm_msg", "comm_close":
+		return true
+	}
+	return false
+}
+
 // handleShutdownRequest sends a "shutdown" message.
 func handleShutdownRequest(msg kernel.Message) error {
 	content := msg.ComposedMsg().Content.(map[string]interface{})
@@ -133,6 +172,19 @@ func handleShutdownRequest(msg kernel.Message) error {
 	return nil
 }
 
+// handleInterruptRequest interrupts the cell currently being executed, if any, and sends an
+// "interrupt_reply" message.
+//
+// Used when Jupyter is configured with `"interrupt_mode": "message"`, instead of sending a SIGINT.
+func handleInterruptRequest(msg kernel.Message) error {
+	klog.Infof("Interrupting in response to interrupt_request")
+	msg.Kernel().Interrupt()
+	if err := msg.Reply("interrupt_reply", map[string]any{}); err != nil {
+		return errors.WithMessagef(err, "replying interrupt_reply")
+	}
+	return nil
+}
+
 type OutErr struct {
 	out io.Writer
 	err io.Writer
@@ -163,16 +215,21 @@ func handleExecuteRequest(msg kernel.Message, goExec *goexec.State) error {
 
 	// Dispatch to various executors.
 	msg.Kernel().Interrupted.Store(false)
+	msg.Kernel().StartCellStdout()
 	lines := strings.Split(code, "\n")
 	usedLines := MakeSet[int]()
 	var executionErr error
 	if err := specialcmd.Parse(msg, goExec, true, lines, usedLines); err != nil {
 		executionErr = errors.WithMessagef(err, "executing special commands in cell")
 	}
-	hasMoreToRun := len(usedLines) < len(lines)
+	hasMoreToRun := len(usedLines) < len(lines) || len(goExec.CellLoadedLines) > 0
 	if executionErr == nil && !msg.Kernel().Interrupted.Load() && hasMoreToRun {
 		executionErr = goExec.ExecuteCell(msg, msg.Kernel().ExecCounter, lines, usedLines)
 	}
+	if capture := msg.Kernel().StopCapture(); capture != nil && goExec.CellCaptureVar != "" {
+		goExec.SetCapturedOutput(goExec.CellCaptureVar, capture.Stdout(), capture.Stderr())
+	}
+	specialcmd.RestoreCellEnv()
 
 	// Final execution result.
 	if executionErr == nil {
@@ -288,7 +345,13 @@ func handleCompleteRequest(msg kernel.Message, goExec *goexec.State) (err error)
 		return
 	}
 	if usedLines.Has(cursorLine) {
-		// No auto-complete for special commands.
+		// Auto-complete special commands.
+		line := lines[cursorLine]
+		matches, replaceLength := specialcmd.Complete(line, cursorCol)
+		if len(matches) > 0 {
+			reply.Matches = matches
+			reply.CursorStart -= len(utf16.Encode([]rune(line[cursorCol-replaceLength : cursorCol])))
+		}
 		return
 	}
 
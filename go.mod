@@ -12,7 +12,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/stretchr/testify v1.8.1
 	golang.org/x/exp v0.0.0-20230213192124-5e25df0256eb
-	golang.org/x/mod v0.7.0
+	golang.org/x/mod v0.12.0
 	k8s.io/klog/v2 v2.100.1
 )
 
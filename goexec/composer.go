@@ -114,9 +114,31 @@ func (d *Declarations) RenderImports(w *WriterWithCursor, fileToCellIdAndLine []
 		return cursor, fileToCellIdAndLine
 	}
 
+	// `import "C"` with a cgo preamble is rendered separately, since the preamble must immediately precede it.
+	cgoImport := d.Imports["C"]
+	if cgoImport != nil && cgoImport.CgoPreamble != "" {
+		fileToCellIdAndLine = w.FillLinesGap(fileToCellIdAndLine)
+		fileToCellIdAndLine = cgoImport.CgoPreambleLines.Append(fileToCellIdAndLine)
+		w.Writef("%s\n", cgoImport.CgoPreamble)
+		fileToCellIdAndLine = w.FillLinesGap(fileToCellIdAndLine)
+		fileToCellIdAndLine = cgoImport.CellLines.Append(fileToCellIdAndLine)
+		if cgoImport.CursorInPath {
+			cursor = w.CursorPlusDelta(cgoImport.Cursor)
+		}
+		w.Writef("import %q\n\n", cgoImport.Path)
+		if len(d.Imports) == 1 {
+			return cursor, fileToCellIdAndLine
+		}
+	} else {
+		cgoImport = nil
+	}
+
 	w.Write("import (\n")
 	for _, key := range SortedKeys(d.Imports) {
 		importDecl := d.Imports[key]
+		if importDecl == cgoImport {
+			continue
+		}
 		fileToCellIdAndLine = w.FillLinesGap(fileToCellIdAndLine)
 		fileToCellIdAndLine = importDecl.CellLines.Append(fileToCellIdAndLine)
 		w.Write("\t")
@@ -329,11 +351,11 @@ func (s *State) createGoFileFromLines(filePath string, lines []string, skipLines
 	w.Write("package main\n\n")
 	var createdFuncMain bool
 	for ii, line := range lines {
-		if strings.HasPrefix(line, "%main") || strings.HasPrefix(line, "%%") {
+		if isMainLine(line) {
 			// Write preamble of func main() and associate to the "%%" line:
 			fileToCellLines[w.Line] = ii
 			fileToCellLines[w.Line+1] = ii
-			w.Write("func main() {\n\tflag.Parse()\n")
+			w.Write(mainPreamble)
 			createdFuncMain = true
 			continue
 		}
@@ -370,6 +392,55 @@ func (s *State) createGoFileFromLines(filePath string, lines []string, skipLines
 	return
 }
 
+// mainPreamble is the beginning of the `func main()` created for the `%%` (or `%main`) special command.
+const mainPreamble = "func main() {\n\tflag.Parse()\n"
+
+// isMainFromCell returns whether mainDecl is a `func main()` created for `%%` (or `%main`), whose statements
+// can be appended to by State.CellMainAppend.
+func isMainFromCell(mainDecl *Function) bool {
+	return strings.HasPrefix(mainDecl.Definition, mainPreamble) && strings.HasSuffix(mainDecl.Definition, "\n}") &&
+		len(mainDecl.Lines) > 0
+}
+
+// appendMain returns a `func main()` with the statements of lastMain followed by the statements of mainDecl.
+// Both must have been created for `%%` (see isMainFromCell). The cell lines of the statements are preserved,
+// so errors are reported in the cells where they were written.
+func appendMain(lastMain, mainDecl *Function) *Function {
+	// Drop the closing "}" (and empty lines before it) of lastMain, and the preamble of mainDecl.
+	head := strings.TrimRight(strings.TrimSuffix(lastMain.Definition, "}"), "\n") + "\n"
+	headNumLines := strings.Count(head, "\n")
+	preambleNumLines := strings.Count(mainPreamble, "\n")
+	merged := *mainDecl
+	merged.Definition = head + strings.TrimPrefix(mainDecl.Definition, mainPreamble)
+
+	ids := lastMain.Ids
+	if len(ids) == 0 {
+		ids = make([]int, len(lastMain.Lines))
+		for ii := range ids {
+			ids[ii] = lastMain.Id
+		}
+	}
+	headNumLines = min(headNumLines, len(lastMain.Lines))
+	preambleNumLines = min(preambleNumLines, len(mainDecl.Lines))
+	merged.Lines = append(append([]int(nil), lastMain.Lines[:headNumLines]...), mainDecl.Lines[preambleNumLines:]...)
+	merged.Ids = append([]int(nil), ids[:headNumLines]...)
+	for range mainDecl.Lines[preambleNumLines:] {
+		merged.Ids = append(merged.Ids, mainDecl.Id)
+	}
+	if merged.HasCursor() {
+		merged.Cursor.Line += headNumLines - preambleNumLines
+	}
+	return &merged
+}
+
+// isMainLine returns whether the line is a `%%` or `%main` special command, which starts
+// a `func main()`. Other special commands that start with `%%` (e.g.: `%%time`) are not
+// considered.
+func isMainLine(line string) bool {
+	fields := strings.Fields(line)
+	return len(fields) > 0 && (fields[0] == "%%" || fields[0] == "%main")
+}
+
 // createMainFileFromDecls creates `main.go` and writes all declarations.
 //
 // It returns the cursor position in the file as well as a mapping from the file lines to to the original cell ids and lines.
@@ -424,6 +495,18 @@ func (s *State) createAlternativeFileFromDecls(decls *Declarations) (err error)
 // It returns the cursor position in the file as well as a mapping from the file lines to the original cell ids and lines.
 func (s *State) createGoContentsFromDecls(writer io.Writer, decls *Declarations, mainDecl *Function) (cursor Cursor, fileToCellIdAndLine []CellIdAndLine, err error) {
 	cursor = NoCursor
+	timeIt := s.CellTimeIt != nil && mainDecl != nil
+	if timeIt {
+		decls = timeItDecls(decls)
+	}
+	profile := s.CellProfile != nil && mainDecl != nil && !timeIt
+	if profile {
+		decls = profileDecls(decls, s.CellProfile.Kind)
+	}
+	display := isDisplayMain(mainDecl) && !timeIt && !profile
+	if display {
+		decls = displayDecls(decls)
+	}
 	w := NewWriterWithCursor(writer)
 	w.Writef("package main\n\n")
 	if err != nil {
@@ -466,7 +549,15 @@ func (s *State) createGoContentsFromDecls(writer io.Writer, decls *Declarations,
 		}
 		fileToCellIdAndLine = w.FillLinesGap(fileToCellIdAndLine)
 		fileToCellIdAndLine = mainDecl.CellLines.Append(fileToCellIdAndLine)
-		w.Writef("%s\n", mainDecl.Definition)
+		if timeIt {
+			s.renderTimeItMain(w, mainDecl.Definition)
+		} else if profile {
+			s.renderProfileMain(w, mainDecl.Definition)
+		} else if display {
+			s.renderDisplayMain(w, mainDecl.Definition)
+		} else {
+			w.Writef("%s\n", mainDecl.Definition)
+		}
 	}
 	return
 }
@@ -63,3 +63,12 @@ func TestCreateGoFileFromLines(t *testing.T) {
 		require.Equalf(t, cellLines[cellLineIdx], newLine, "Line mapping look wrong: file line %d --> cell line %d", ii, cellLineIdx)
 	}
 }
+
+func TestIsMainLine(t *testing.T) {
+	require.True(t, isMainLine("%%"))
+	require.True(t, isMainLine("%% --flag=1"))
+	require.True(t, isMainLine("%main"))
+	require.False(t, isMainLine("%%time"))
+	require.False(t, isMainLine("%mainly"))
+	require.False(t, isMainLine("fmt.Println(\"%%\")"))
+}
@@ -0,0 +1,258 @@
+package goexec
+
+import (
+	"bytes"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/janpfeifer/gonb/kernel"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"k8s.io/klog/v2"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This file implements the display of the value assigned to the DisplayVar variable by the cell's
+// `func main()`: the generated code writes the value to DisplayValuePath, and it is displayed after the
+// program exits.
+//
+// The value is displayed according to its type:
+//
+//   - nil (or not assigned): nothing is displayed.
+//   - image.Image: encoded as PNG.
+//   - []byte: if it is a PNG, JPEG, GIF or WEBP image, it is displayed as such; if it is SVG, as SVG;
+//     otherwise as text.
+//   - string: as SVG if it starts with an `<svg` element (optionally after an XML prolog), otherwise as text.
+//   - fmt.Stringer and error: the text returned by String() or Error().
+//   - Anything else: the text formatted with `fmt.Sprintf("%v")`.
+
+// DisplayVar is the name of the variable, declared by GoNB if the cell's `func main()` refers to it,
+// whose value is displayed after the program exits.
+const DisplayVar = "gonbDisplay"
+
+const (
+	// displayBodyFunc is the name given to the cell's `func main()`, when its DisplayVar is displayed.
+	displayBodyFunc = "gonbDisplayBody"
+
+	// displayAutoFunc is the function that converts the values of the trailing expression displayed by
+	// State.AutoDisplay to the value of DisplayVar, see autoDisplayMain.
+	displayAutoFunc = "gonbAutoDisplay"
+
+	// displayOsAlias, displayImageAlias, displayPngAlias, displayBytesAlias and displayFmtAlias are the aliases
+	// of the packages used by the generated code, chosen not to conflict with the user's imports.
+	displayOsAlias    = "gonbDisplayOs"
+	displayImageAlias = "gonbDisplayImage"
+	displayPngAlias   = "gonbDisplayPng"
+	displayBytesAlias = "gonbDisplayBytes"
+	displayFmtAlias   = "gonbDisplayFmt"
+)
+
+// displayMIMEText and displayMIMEBinary are the "MIME types" written by the generated code for values to be
+// displayed as text, and for []byte values, whose type is detected by displayValueMIMEType.
+const (
+	displayMIMEText   = "text"
+	displayMIMEBinary = "binary"
+)
+
+// reDisplayVar matches code that refers to DisplayVar.
+var reDisplayVar = regexp.MustCompile(`\b` + DisplayVar + `\b`)
+
+// displayMainTemplate is the `func main()` generated to display the value of DisplayVar after running the cell's
+// code. It takes as parameter the quoted path of the file where the value is written (DisplayValuePath).
+var displayMainTemplate = strings.NewReplacer(
+	"OS", displayOsAlias, "IMAGE", displayImageAlias, "PNG", displayPngAlias, "BYTES", displayBytesAlias,
+	"FMT", displayFmtAlias, "BODY", displayBodyFunc, "VAR", DisplayVar, "AUTO", displayAutoFunc,
+	"TEXT", strconv.Quote(displayMIMEText), "BINARY", strconv.Quote(displayMIMEBinary)).Replace(`
+var VAR any
+
+func main() {
+	BODY()
+	var kind string
+	var content []byte
+	switch v := VAR.(type) {
+	case nil:
+		return
+	case IMAGE.Image:
+		var buf BYTES.Buffer
+		if err := PNG.Encode(&buf, v); err != nil {
+			panic(err)
+		}
+		kind, content = "image/png", buf.Bytes()
+	case []byte:
+		kind, content = BINARY, v
+	case string:
+		kind, content = TEXT, []byte(v)
+	case FMT.Stringer:
+		kind, content = TEXT, []byte(v.String())
+	case error:
+		kind, content = TEXT, []byte(v.Error())
+	default:
+		kind, content = TEXT, []byte(FMT.Sprintf("%v", v))
+	}
+	if err := OS.WriteFile(PATH, append([]byte(kind+"\n"), content...), 0600); err != nil {
+		panic(err)
+	}
+}
+
+func AUTO(values ...any) any {
+	if n := len(values); n > 1 {
+		if err, ok := values[n-1].(error); ok {
+			return err
+		} else if values[n-1] == nil {
+			values = values[:n-1]
+		}
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+`)
+
+// DisplayValuePath is the path to the file where the generated code writes the value of DisplayVar.
+func (s *State) DisplayValuePath() string {
+	return path.Join(s.TempDir, "gonb_display")
+}
+
+// isDisplayMain returns whether the `func main()` refers to DisplayVar, in which case its value is displayed.
+func isDisplayMain(mainDecl *Function) bool {
+	return mainDecl != nil && reDisplayVar.MatchString(mainDecl.Definition)
+}
+
+// displayDecls returns a copy of decls with the imports required by the generated `func main()` that
+// displays DisplayVar.
+func displayDecls(decls *Declarations) *Declarations {
+	decls = decls.Copy()
+	for _, imp := range []*Import{NewImport("os", displayOsAlias), NewImport("image", displayImageAlias),
+		NewImport("image/png", displayPngAlias), NewImport("bytes", displayBytesAlias),
+		NewImport("fmt", displayFmtAlias)} {
+		imp.Cursor = NoCursor
+		decls.Imports[imp.Key] = imp
+	}
+	return decls
+}
+
+// renderDisplayMain writes the cell's main function renamed to displayBodyFunc, followed by the declaration
+// of DisplayVar and the `func main()` that writes its value to DisplayValuePath.
+func (s *State) renderDisplayMain(w *WriterWithCursor, mainDef string) {
+	w.Writef("%s\n", strings.Replace(mainDef, "func main()", "func "+displayBodyFunc+"()", 1))
+	w.Writef("%s", strings.Replace(displayMainTemplate, "PATH", strconv.Quote(s.DisplayValuePath()), 1))
+}
+
+// displayValueMIMEType returns the MIME type with which to display the value written by the generated code,
+// and the content to display (a string for text types, or []byte for images).
+func displayValueMIMEType(kind string, content []byte) (mimeType string, value any) {
+	switch kind {
+	case displayMIMEText:
+		if isSVG(content) {
+			return string(protocol.MIMEImageSVG), string(content)
+		}
+		return protocol.MIMETextPlain, string(content)
+	case displayMIMEBinary:
+		detected := http.DetectContentType(content)
+		switch {
+		case detected == "image/png", detected == "image/jpeg", detected == "image/gif", detected == "image/webp":
+			return detected, content
+		case isSVG(content):
+			return string(protocol.MIMEImageSVG), string(content)
+		}
+		return protocol.MIMETextPlain, string(content)
+	}
+	return kind, content
+}
+
+// isSVG returns whether content starts with an `<svg` element, optionally after an XML prolog.
+func isSVG(content []byte) bool {
+	content = bytes.TrimSpace(content)
+	for bytes.HasPrefix(content, []byte("<?")) || bytes.HasPrefix(content, []byte("<!")) {
+		// Skip XML declaration, DOCTYPE and comments.
+		end := bytes.IndexByte(content, '>')
+		if end == -1 {
+			return false
+		}
+		content = bytes.TrimSpace(content[end+1:])
+	}
+	return bytes.HasPrefix(content, []byte("<svg"))
+}
+
+// publishDisplayValue displays the value of DisplayVar written by the last execution (if any), and removes
+// the file.
+func (s *State) publishDisplayValue(msg kernel.Message) {
+	content, err := os.ReadFile(s.DisplayValuePath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Errorf("Failed to read the value of %s: %+v", DisplayVar, err)
+		}
+		return
+	}
+	_ = os.Remove(s.DisplayValuePath())
+	kind, content, _ := bytes.Cut(content, []byte("\n"))
+	mimeType, value := displayValueMIMEType(string(kind), content)
+	err = kernel.PublishDisplayData(msg, kernel.Data{
+		Data:      kernel.MIMEMap{mimeType: value},
+		Metadata:  make(kernel.MIMEMap),
+		Transient: make(kernel.MIMEMap),
+	})
+	if err != nil {
+		klog.Errorf("Failed to display the value of %s: %+v", DisplayVar, err)
+	}
+}
+
+// reNoValueError matches the compiler error for the trailing expression rewritten by autoDisplayMain, if it
+// has no value (e.g.: a call to a function without results).
+var reNoValueError = regexp.MustCompile(`\(no value\) used as value`)
+
+// autoDisplayMain returns a copy of mainDecl where the trailing expression statement, if any, is assigned to
+// DisplayVar, so its value is displayed, or nil if it is not applicable. It implements State.AutoDisplay.
+//
+// It only applies to the `func main()` created with `%%` that don't already refer to DisplayVar, and not to
+// calls to the `fmt.Print*` and `fmt.Fprint*` functions, that already print their values. Expressions with
+// more than one value (e.g.: `strconv.Atoi(s)`) are displayed as a slice of the values, except that if the
+// last one is an error, only it is displayed, or, if it is nil, it is dropped.
+//
+// The expression is kept in the same lines, so the mapping of the lines of main.go to the cell lines is
+// preserved.
+func autoDisplayMain(mainDecl *Function) *Function {
+	if mainDecl == nil || !isMainFromCell(mainDecl) || reDisplayVar.MatchString(mainDecl.Definition) {
+		return nil
+	}
+	const prefix = "package main\n"
+	fileSet := token.NewFileSet()
+	file, err := parser.ParseFile(fileSet, "", prefix+mainDecl.Definition, 0)
+	if err != nil || len(file.Decls) != 1 {
+		return nil
+	}
+	funcDecl, ok := file.Decls[0].(*ast.FuncDecl)
+	if !ok || funcDecl.Body == nil || len(funcDecl.Body.List) == 0 {
+		return nil
+	}
+	exprStmt, ok := funcDecl.Body.List[len(funcDecl.Body.List)-1].(*ast.ExprStmt)
+	if !ok || isFmtPrintCall(exprStmt.X) {
+		return nil
+	}
+	start := fileSet.Position(exprStmt.X.Pos()).Offset - len(prefix)
+	end := fileSet.Position(exprStmt.X.End()).Offset - len(prefix)
+	def := mainDecl.Definition
+	displayMain := *mainDecl
+	displayMain.Definition = def[:start] + DisplayVar + " = " + displayAutoFunc + "(" + def[start:end] + ")" + def[end:]
+	return &displayMain
+}
+
+// isFmtPrintCall returns whether expr is a call to one of the `fmt.Print*` or `fmt.Fprint*` functions.
+func isFmtPrintCall(expr ast.Expr) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	selector, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok {
+		return false
+	}
+	pkg, ok := selector.X.(*ast.Ident)
+	return ok && pkg.Name == "fmt" &&
+		(strings.HasPrefix(selector.Sel.Name, "Print") || strings.HasPrefix(selector.Sel.Name, "Fprint"))
+}
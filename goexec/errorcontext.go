@@ -24,11 +24,12 @@ type errorReport struct {
 type errorLine struct {
 	HasContext bool   // Whether this line has a contextual mouse-over content.
 	Message    string // Error message, what comes after the `file:line_number:col_number`
-	Location   string // `file:line_number:col_number` prefix, only if HasContext == true.
+	Location   string // `file:line_number:col_number` prefix, only if HasContext == true. Rewritten to the cell location, if known.
 	Context    string // Context to display on a mouse-over window, only if HasContext == true.
 
-	HasCellInfo bool
-	CellInfo    string
+	// GeneratedLocation is the original `file:line_number:col_number` prefix in the generated `main.go`,
+	// set only if Location was rewritten to the corresponding cell location.
+	GeneratedLocation string
 }
 
 // To check the standard Jupyter colors to choose from, see:
@@ -68,20 +69,11 @@ var templateErrorReport = template.Must(template.New("error_report").Parse(`
 	background-color: var(--jp-rendermime-error-background);
 	font-weight: bold;
 }
-.gonb-cell-line-info {
-	background: var(--jp-layout-color2);
-	color: #999;
-	margin: 0.1em;
-	border: 1px solid var(--jp-border-color1);
-	padding-left: 0.2em;
-	padding-right: 0.2em;
-}
 </style>
 <div class="lm-Widget p-Widget lm-Panel p-Panel jp-OutputArea-child">
 <div class="lm-Widget p-Widget jp-RenderedText jp-mod-trusted jp-OutputArea-output" data-mime-type="application/vnd.jupyter.stderr" style="font-family: monospace;">
 {{range .Lines}}
-{{if .HasContext}}{{if .HasCellInfo}}<span class="gonb-cell-line-info">{{.CellInfo}}</span>
-{{end}}<span class="gonb-error-location">{{.Location}}</span> {{.Message}}
+{{if .HasContext}}<span class="gonb-error-location"{{if .GeneratedLocation}} title="{{.GeneratedLocation}}"{{end}}>{{.Location}}</span> {{.Message}}
 <div class="gonb-error-context">
 {{.Context}}
 </div>
@@ -141,7 +133,7 @@ func (s *State) DisplayErrorWithContext(msg kernel.Message, fileToCellIdAndLine
 	// reportHTML will be displayed on the deferred function above.
 }
 
-var reFileLinePrefix = regexp.MustCompile(`(^.*main\.go:(\d+):(\d+): )(.+)$`)
+var reFileLinePrefix = regexp.MustCompile(`(^.*main(?:_test)?\.go:(\d+):(\d+): )(.+)$`)
 
 const LinesForErrorContext = 3
 
@@ -178,7 +170,10 @@ func (s *State) parseErrorLine(lineStr string, codeLines []string, fileToCellIdA
 
 	lineNum, _ := strconv.Atoi(matches[2])
 	lineNum -= 1 // Error messages start at line 1 (as opposed to 0)
-	//colNum, _ := strconv.Atoi(matches[3])
+	if cellLocation := cellErrorLocation(fileToCellIdAndLine, lineNum, matches[3]); cellLocation != "" {
+		l.GeneratedLocation = strings.TrimSuffix(l.Location, " ")
+		l.Location = cellLocation + " "
+	}
 	fromLines := lineNum - LinesForErrorContext
 	fromLines = inBetween(fromLines, 0, len(codeLines)-1)
 	toLines := lineNum + LinesForErrorContext
@@ -193,19 +188,25 @@ func (s *State) parseErrorLine(lineStr string, codeLines []string, fileToCellIdA
 		parts = append(parts, part)
 	}
 	l.Context = strings.Join(parts, "")
+	return
+}
 
-	// Gather CellInfo
-	if lineNum > 0 && lineNum < len(fileToCellIdAndLine) && fileToCellIdAndLine[lineNum].Line != NoCursorLine {
-		cell := fileToCellIdAndLine[lineNum]
-		l.HasCellInfo = true
-		// Notice GoNB store lines starting at 0, but Jupyter display lines starting at 1, so we add 1 here.
-		if cell.Id != -1 {
-			l.CellInfo = fmt.Sprintf("Cell[%d]: Line %d", cell.Id, cell.Line+1)
-		} else {
-			l.CellInfo = fmt.Sprintf("Cell Line %d", cell.Line+1)
-		}
+// cellErrorLocation returns the location in the cell, formatted as `Cell[<id>]:<line>:<col>:`, corresponding
+// to the line lineNum (starting at 0) of the generated `main.go`. The column is kept as is, since cell lines
+// are copied verbatim to `main.go`.
+//
+// It returns an empty string if the line was generated by GoNB (e.g.: `func main() {`) and has no
+// corresponding cell line.
+func cellErrorLocation(fileToCellIdAndLine []CellIdAndLine, lineNum int, col string) string {
+	if lineNum < 0 || lineNum >= len(fileToCellIdAndLine) || fileToCellIdAndLine[lineNum].Line == NoCursorLine {
+		return ""
 	}
-	return
+	cell := fileToCellIdAndLine[lineNum]
+	// Notice GoNB store lines starting at 0, but Jupyter display lines starting at 1, so we add 1 here.
+	if cell.Id == -1 {
+		return fmt.Sprintf("Cell:%d:%s:", cell.Line+1, col)
+	}
+	return fmt.Sprintf("Cell[%d]:%d:%s:", cell.Id, cell.Line+1, col)
 }
 
 // readMainGo reads the contents of main.go file.
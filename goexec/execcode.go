@@ -8,11 +8,13 @@ import (
 	"github.com/pkg/errors"
 	"io"
 	"k8s.io/klog/v2"
+	"os"
 	"os/exec"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ExecuteCell takes the contents of a cell, parses it, merges new declarations with the ones
@@ -21,7 +23,24 @@ import (
 //
 // skipLines are lines that should not be considered as Go code. Typically, these are the special
 // commands (like `%%`, `%args`, `%reset`, or bash lines starting with `!`).
+//
+// Lines in State.CellLoadedLines are appended to the cell lines, as if they were part of the cell.
 func (s *State) ExecuteCell(msg kernel.Message, cellId int, lines []string, skipLines Set[int]) error {
+	s.InvalidateQueryCache()
+	if s.CellProfile != nil && (s.CellTimeIt != nil || s.CellIsTest) {
+		return errors.Errorf("`%%%%profile` can't be used with `%%%%timeit`, `%%%%test` or `%%%%benchmark`")
+	}
+	if len(s.CellLoadedLines) > 0 {
+		lines = append(lines[:len(lines):len(lines)], s.CellLoadedLines...)
+	}
+	if s.CellIsTimed {
+		s.cellTiming = &cellTiming{start: time.Now()}
+		defer func() {
+			s.publishCellTiming(msg)
+			s.cellTiming = nil
+		}()
+	}
+
 	// Runs AutoTrack: makes sure redirects in go.mod and use clauses in go.work are tracked.
 	err := s.AutoTrack()
 	if err != nil {
@@ -33,23 +52,58 @@ func (s *State) ExecuteCell(msg kernel.Message, cellId int, lines []string, skip
 		return errors.WithMessagef(err, "in goexec.ExecuteCell()")
 	}
 
+	originalMain := mainDecl
+	if s.AutoDisplay && !s.CellIsTest && s.CellTimeIt == nil && s.CellProfile == nil {
+		if displayMain := autoDisplayMain(mainDecl); displayMain != nil {
+			mainDecl = displayMain
+		}
+	}
+
 	// Exec `goimports` (or the code that implements it) -- it updates `updatedDecls` with
 	// the new imports, if there are any.
 	_, fileToCellIdAndLine, err = s.GoImports(msg, updatedDecls, mainDecl, fileToCellIdAndLine)
 	if err != nil {
 		return errors.WithMessagef(err, "goimports failed")
 	}
+	if err = s.runPreBuild(msg); err != nil {
+		return err
+	}
+
+	if s.CellIsTest {
+		return s.executeCellTests(msg, cellId, updatedDecls, fileToCellIdAndLine)
+	}
 
 	// And then compile it.
-	if err := s.Compile(msg, fileToCellIdAndLine); err != nil {
+	if mainDecl != originalMain {
+		mainDecl, fileToCellIdAndLine, err = s.compileAutoDisplay(msg, updatedDecls, mainDecl, originalMain,
+			fileToCellIdAndLine)
+	} else {
+		err = s.Compile(msg, fileToCellIdAndLine)
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.Vet(msg, fileToCellIdAndLine); err != nil {
 		return err
 	}
 
 	// Compilation successful: save merged declarations into current State.
 	s.Definitions = updatedDecls
+	if isMainFromCell(originalMain) {
+		s.LastMain = originalMain
+	}
+	s.recordHistory(cellId, lines, skipLines)
 
 	// Execute compiled code.
-	return s.Execute(msg, fileToCellIdAndLine)
+	_ = os.Remove(s.DisplayValuePath())
+	if err = s.Execute(msg, fileToCellIdAndLine); err != nil {
+		return err
+	}
+	s.publishDisplayValue(msg)
+	if s.CellProfile != nil {
+		s.publishProfile(msg)
+	}
+	return nil
 }
 
 // BinaryPath is the path to the generated binary file.
@@ -69,9 +123,19 @@ func (s *State) AlternativeDefinitionsPath() string {
 }
 
 func (s *State) Execute(msg kernel.Message, fileToCellIdAndLine []CellIdAndLine) error {
-	return kernel.PipeExecToJupyter(msg, s.BinaryPath(), s.Args...).
+	start := time.Now()
+	builder := kernel.PipeExecToJupyter(msg, s.BinaryPath(), s.Args...).
 		WithStderr(newJupyterStackTraceMapperWriter(msg, "stderr", s.MainPath(), fileToCellIdAndLine)).
-		Exec()
+		WithContext(kernel.InterruptContext(msg)).
+		WithTimeout(s.CellTimeout).
+		WithStdinContent(s.CellStdin)
+	err := builder.Exec()
+	if s.cellTiming != nil {
+		s.cellTiming.executed = true
+		s.cellTiming.runWall = time.Since(start)
+		s.cellTiming.runCPU = cpuTime(builder.ProcessState())
+	}
+	return err
 }
 
 // Compile compiles the currently generate go files in State.TempDir to a binary named State.Package.
@@ -79,24 +143,247 @@ func (s *State) Execute(msg kernel.Message, fileToCellIdAndLine []CellIdAndLine)
 // If errors in compilation happen, linesPos is used to adjust line numbers to their content in the
 // current cell.
 func (s *State) Compile(msg kernel.Message, fileToCellIdAndLines []CellIdAndLine) error {
-	cmd := exec.Command("go", "build", "-o", s.BinaryPath())
-	cmd.Dir = s.TempDir
-	var output []byte
-	output, err := cmd.CombinedOutput()
+	output, err := s.compile()
 	if err != nil {
-		s.DisplayErrorWithContext(msg, fileToCellIdAndLines, string(output))
-		return errors.Wrapf(err, "failed to run %q", cmd.String())
+		s.DisplayErrorWithContext(msg, fileToCellIdAndLines, output)
+		return err
 	}
 	return nil
 }
 
-// GoImports execute `goimports` which adds imports to non-declared imports automatically.
-// It also runs "go get" to download any missing dependencies.
+// compile compiles the currently generated go files in State.TempDir, like Compile, but it doesn't report
+// errors to the cell: it returns the output of the compiler instead.
+func (s *State) compile() (output string, err error) {
+	args := append([]string{"build", "-o", s.BinaryPath()}, s.BuildFlags()...)
+	cmd := s.goCommand(args...)
+	outputBytes, err := cmd.CombinedOutput()
+	s.registerCompileTiming(cmd)
+	if err != nil {
+		err = errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	return string(outputBytes), err
+}
+
+// compileAutoDisplay compiles the cell with displayMain, the `func main()` whose trailing expression is
+// displayed (see autoDisplayMain). If the expression has no value (e.g.: a call to a function without results),
+// it compiles the cell with originalMain instead. It returns the `func main()` compiled, and the updated
+// fileToCellIdAndLine.
+func (s *State) compileAutoDisplay(msg kernel.Message, decls *Declarations, displayMain, originalMain *Function,
+	fileToCellIdAndLine []CellIdAndLine) (*Function, []CellIdAndLine, error) {
+	output, err := s.compile()
+	if err == nil {
+		return displayMain, fileToCellIdAndLine, nil
+	}
+	if !reNoValueError.MatchString(output) {
+		s.DisplayErrorWithContext(msg, fileToCellIdAndLine, output)
+		return nil, nil, err
+	}
+	klog.V(1).Infof("Trailing expression of the cell has no value, not displaying it")
+	_, fileToCellIdAndLine, err = s.GoImports(msg, decls, originalMain, fileToCellIdAndLine)
+	if err != nil {
+		return nil, nil, errors.WithMessagef(err, "goimports failed")
+	}
+	if err = s.Compile(msg, fileToCellIdAndLine); err != nil {
+		return nil, nil, err
+	}
+	return originalMain, fileToCellIdAndLine, nil
+}
+
+// BuildFlags returns the flags to pass to the Go toolchain when building the cells: State.GoBuildFlags
+// with State.BuildTags merged into its `-tags` flag (or into a new one, if there is none), since only the
+// last `-tags` flag is honored by the Go toolchain. If State.Vendor is set, it starts with `-mod=vendor`.
+func (s *State) BuildFlags() []string {
+	flags := make([]string, 0, len(s.GoBuildFlags)+2)
+	if s.Vendor {
+		flags = append(flags, "-mod=vendor")
+	}
+	if len(s.BuildTags) == 0 {
+		return append(flags, s.GoBuildFlags...)
+	}
+	var tags []string
+	for ii := 0; ii < len(s.GoBuildFlags); ii++ {
+		flag := s.GoBuildFlags[ii]
+		name, value, hasValue := strings.Cut(strings.TrimLeft(flag, "-"), "=")
+		if name != "tags" || !strings.HasPrefix(flag, "-") {
+			flags = append(flags, flag)
+			continue
+		}
+		if !hasValue && ii+1 < len(s.GoBuildFlags) {
+			ii++
+			value = s.GoBuildFlags[ii]
+		}
+		// Only the last `-tags` flag is used by the Go toolchain.
+		tags = SplitBuildTags(value)
+	}
+	for _, tag := range s.BuildTags {
+		found := false
+		for _, existing := range tags {
+			if tag == existing {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tags = append(tags, tag)
+		}
+	}
+	return append(flags, "-tags="+strings.Join(tags, ","))
+}
+
+// VendorPath is the path to the directory with the vendored dependencies, see State.Vendor.
+func (s *State) VendorPath() string {
+	return path.Join(s.TempDir, "vendor")
+}
+
+// SetVendor enables or disables building with the vendored dependencies in State.VendorPath (`-mod=vendor`).
+// While enabled, `go get` is not executed, even if State.AutoGet is set.
+//
+// It returns an error if enabling it and there is no `vendor/` directory.
+func (s *State) SetVendor(enabled bool) error {
+	if enabled {
+		if info, err := os.Stat(s.VendorPath()); err != nil || !info.IsDir() {
+			return errors.Errorf("no vendored dependencies in %q: populate it with `!*go mod vendor` first",
+				s.VendorPath())
+		}
+	}
+	s.Vendor = enabled
+	return nil
+}
+
+// SplitBuildTags splits a list of build tags, separated by commas or spaces (e.g.: "linux,cgo"), dropping
+// empty ones.
+func SplitBuildTags(tags string) []string {
+	return strings.FieldsFunc(tags, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+// cellTiming holds the time spent compiling and executing a cell, see State.CellIsTimed.
+type cellTiming struct {
+	start time.Time // When the execution of the cell started.
+
+	compiled, executed      bool
+	compileWall, compileCPU time.Duration
+	runWall, runCPU         time.Duration
+}
+
+// registerCompileTiming registers the time spent compiling the cell with the finished cmd, if the cell is timed.
+func (s *State) registerCompileTiming(cmd *exec.Cmd) {
+	if s.cellTiming == nil {
+		return
+	}
+	s.cellTiming.compiled = true
+	s.cellTiming.compileWall = time.Since(s.cellTiming.start)
+	s.cellTiming.compileCPU = cpuTime(cmd.ProcessState)
+}
+
+// cpuTime returns the user plus system CPU time used by a finished process, or 0 if not available.
+func cpuTime(state *os.ProcessState) time.Duration {
+	if state == nil {
+		return 0
+	}
+	return state.UserTime() + state.SystemTime()
+}
+
+// publishCellTiming reports the timing of the cell execution in the cell's stdout.
+//
+// The compilation wall time includes parsing the cell, running `goimports` and `go get`, while
+// its CPU time accounts only for `go build`.
+func (s *State) publishCellTiming(msg kernel.Message) {
+	t := s.cellTiming
+	var parts []string
+	if t.compiled {
+		parts = append(parts, fmt.Sprintf("Compilation -- CPU time: %s, Wall time: %s", t.compileCPU, t.compileWall))
+	}
+	if t.executed {
+		parts = append(parts, fmt.Sprintf("Execution   -- CPU time: %s, Wall time: %s", t.runCPU, t.runWall))
+	}
+	if len(parts) == 0 {
+		return
+	}
+	err := kernel.PublishWriteStream(msg, kernel.StreamStdout, strings.Join(parts, "\n")+"\n")
+	if err != nil {
+		klog.Errorf("Failed to publish cell timing: %+v", err)
+	}
+}
+
+// GoImports execute `goimports` which adds imports to non-declared imports automatically,
+// and removes the unused ones -- if State.AutoImport is set.
+// It also runs "go get" to download any missing dependencies -- if State.AutoGet is set.
 //
 // It returns the updated cursorInFile and fileToCellIdAndLines that reflect any changes in `main.go`.
 func (s *State) GoImports(msg kernel.Message, decls *Declarations, mainDecl *Function, fileToCellIdAndLine []CellIdAndLine) (cursorInFile Cursor, updatedFileToCellIdAndLine []CellIdAndLine, err error) {
 	klog.V(2).Infof("GoImports():")
 	cursorInFile = NoCursor
+	var newDecls *Declarations
+	if s.AutoImport {
+		newDecls, err = s.runGoImports(msg, decls, fileToCellIdAndLine)
+		if err != nil {
+			return
+		}
+	} else {
+		newDecls = decls.Copy()
+		if _, found := newDecls.Imports["flag"]; !found && strings.Contains(mainDecl.Definition, "flag.") {
+			// The `func main()` generated by GoNB calls `flag.Parse()`.
+			newDecls.Imports["flag"] = NewImport("flag", "")
+		}
+	}
+
+	delete(newDecls.Functions, "main")
+	dropGeneratedDecls(newDecls)
+	cursorInFile, updatedFileToCellIdAndLine, err = s.createMainFileFromDecls(newDecls, mainDecl)
+	if err != nil {
+		err = errors.WithMessagef(err, "while composing main.go with all declarations")
+		return
+	}
+	klog.V(2).Infof("GoImports(): cursorInFile=%s", cursorInFile)
+
+	// Download missing dependencies: not when using vendored dependencies, since `go get` would update
+	// go.mod and make it inconsistent with `vendor/modules.txt`.
+	if !s.AutoGet || s.Vendor {
+		return
+	}
+	cmd := s.goCommand("get")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		err = errors.Wrapf(err, "failed to run %q", cmd.String())
+		strOutput := fmt.Sprintf("%v\n\n%s", err, output)
+		strOutput = s.filterGoGetError(strOutput)
+		s.DisplayErrorWithContext(msg, fileToCellIdAndLine, strOutput)
+		return
+	}
+	return
+}
+
+// dropGeneratedDecls removes from decls the declarations generated by GoNB around the cell's `func main()` (see
+// renderTimeItMain, renderProfileMain and renderDisplayMain), parsed back from `main.go` by runGoImports: they
+// are generated again when `main.go` is rendered.
+func dropGeneratedDecls(decls *Declarations) {
+	for _, name := range []string{timeItBodyFunc, profileBodyFunc, displayBodyFunc, displayAutoFunc} {
+		delete(decls.Functions, name)
+	}
+	delete(decls.Variables, DisplayVar)
+}
+
+// GetModules downloads the modules needed by the memorized imports -- or, if packages is not empty, the given
+// packages -- with `go get`, without compiling or executing anything. The progress reported by `go get` (e.g.:
+// "go: downloading ...") is streamed to the cell.
+//
+// It returns an error if `go get` fails, or if building with vendored dependencies (see State.Vendor).
+func (s *State) GetModules(msg kernel.Message, packages []string) error {
+	if s.Vendor {
+		return errors.Errorf("`go get` is disabled while building with vendored dependencies (`%%vendor`)")
+	}
+	if len(packages) == 0 {
+		// `go get` without arguments fetches the dependencies of the package in the current directory.
+		if _, _, err := s.createMainFileFromDecls(s.Definitions, nil); err != nil {
+			return errors.WithMessagef(err, "while composing main.go with all declarations")
+		}
+	}
+	return s.pipeGoCommand(msg, append([]string{"get"}, packages...)...)
+}
+
+// runGoImports executes `goimports` on `main.go`, and returns decls with only the imports
+// found to be used, plus the ones it added.
+func (s *State) runGoImports(msg kernel.Message, decls *Declarations, fileToCellIdAndLine []CellIdAndLine) (newDecls *Declarations, err error) {
 	goimportsPath, err := exec.LookPath("goimports")
 	if err != nil {
 		_ = kernel.PublishWriteStream(msg, kernel.StreamStderr, `
@@ -121,7 +408,6 @@ can install it from the notebook with:
 	}
 
 	// Parse declarations in created `main.go` file.
-	var newDecls *Declarations
 	newDecls, err = s.parseFromMainGo(msg, -1, NoCursor, nil)
 	newDecls.DropFuncInit() // These may be generated, we don't want to memorize these.
 	if err != nil {
@@ -144,29 +430,6 @@ can install it from the notebook with:
 			delete(newDecls.Imports, key)
 		}
 	}
-
-	delete(newDecls.Functions, "main")
-	cursorInFile, updatedFileToCellIdAndLine, err = s.createMainFileFromDecls(newDecls, mainDecl)
-	if err != nil {
-		err = errors.WithMessagef(err, "while composing main.go with all declarations")
-		return
-	}
-	klog.V(2).Infof("GoImports(): cursorInFile=%s", cursorInFile)
-
-	// Download missing dependencies.
-	if !s.AutoGet {
-		return
-	}
-	cmd = exec.Command("go", "get")
-	cmd.Dir = s.TempDir
-	output, err = cmd.CombinedOutput()
-	if err != nil {
-		err = errors.Wrapf(err, "failed to run %q", cmd.String())
-		strOutput := fmt.Sprintf("%v\n\n%s", err, output)
-		strOutput = s.filterGoGetError(strOutput)
-		s.DisplayErrorWithContext(msg, fileToCellIdAndLine, strOutput)
-		return
-	}
 	return
 }
 
@@ -215,6 +478,10 @@ func (w *jupyterStackTraceMapperWriter) Write(p []byte) (int, error) {
 			return match
 		}
 		cellId, cellLineNum := w.fileToCellIdAndLine[lineNum].Id, w.fileToCellIdAndLine[lineNum].Line
+		if cellLineNum == NoCursorLine {
+			// Line automatically generated by GoNB (e.g.: `func main() {`), it has no corresponding cell line.
+			return match
+		}
 		var cellText []byte
 		const invertColor = "\033[7m"
 		const resetColor = "\033[0m"
@@ -0,0 +1,601 @@
+package goexec
+
+import (
+	"bytes"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestJupyterStackTraceMapperWriter(t *testing.T) {
+	mainPath := "/tmp/gonb_test/main.go"
+	fileToCellIdAndLine := []CellIdAndLine{
+		{Id: 1, Line: 3},
+		{Id: 2, Line: 0},
+		{Id: NoCursorLine, Line: NoCursorLine},
+	}
+	w := newJupyterStackTraceMapperWriter(nil, "stderr", mainPath, fileToCellIdAndLine).(*jupyterStackTraceMapperWriter)
+	var buf bytes.Buffer
+	w.jupyterWriter = &buf
+
+	input := "main.f()\n\t/tmp/gonb_test/main.go:1 +0x1d\nmain.main()\n\t/tmp/gonb_test/main.go:2 +0x2e\n" +
+		"\t/tmp/gonb_test/main.go:3 +0x3f\n\t/tmp/gonb_test/main.go:10 +0x4f\n"
+	n, err := w.Write([]byte(input))
+	require.NoError(t, err)
+	assert.Equal(t, len(input), n)
+	got := buf.String()
+	assert.Contains(t, got, "[[ Cell [1] Line 4 ]]\033[0m /tmp/gonb_test/main.go:1 ")
+	assert.Contains(t, got, "[[ Cell [2] Line 1 ]]\033[0m /tmp/gonb_test/main.go:2 ")
+
+	// Lines automatically generated, or out-of-range, are left as is.
+	assert.Contains(t, got, "\t/tmp/gonb_test/main.go:3 +0x3f\n")
+	assert.Contains(t, got, "\t/tmp/gonb_test/main.go:10 +0x4f\n")
+}
+
+func TestParseErrorLine(t *testing.T) {
+	s := &State{}
+	codeLines := []string{"package main", "", "func main() {", "\tx := 1", "}"}
+	fileToCellIdAndLine := []CellIdAndLine{
+		{Id: NoCursorLine, Line: NoCursorLine},
+		{Id: NoCursorLine, Line: NoCursorLine},
+		{Id: NoCursorLine, Line: NoCursorLine},
+		{Id: 7, Line: 0},
+		{Id: NoCursorLine, Line: NoCursorLine},
+	}
+	l := s.parseErrorLine("./main.go:4:2: declared and not used: x", codeLines, fileToCellIdAndLine)
+	require.True(t, l.HasContext)
+	assert.Equal(t, "Cell[7]:1:2: ", l.Location)
+	assert.Equal(t, "./main.go:4:2:", l.GeneratedLocation)
+	assert.Equal(t, "declared and not used: x", l.Message)
+	assert.Contains(t, l.Context, "<div class=\"gonb-error-line\">\tx := 1\n</div>")
+
+	// Lines generated by GoNB keep the location in main.go.
+	l = s.parseErrorLine("./main.go:3:1: some error", codeLines, fileToCellIdAndLine)
+	assert.Equal(t, "./main.go:3:1: ", l.Location)
+	assert.Empty(t, l.GeneratedLocation)
+
+	// Lines not referring to main.go are kept as is.
+	l = s.parseErrorLine("# gonb_test", codeLines, fileToCellIdAndLine)
+	assert.False(t, l.HasContext)
+	assert.Equal(t, "# gonb_test", l.Message)
+
+	// Lines of cells without id.
+	fileToCellIdAndLine[3] = CellIdAndLine{Id: -1, Line: 4}
+	l = s.parseErrorLine("./main.go:4:2: declared and not used: x", codeLines, fileToCellIdAndLine)
+	assert.Equal(t, "Cell:5:2: ", l.Location)
+}
+
+func TestAutoImport(t *testing.T) {
+	if _, err := exec.LookPath("goimports"); err != nil {
+		t.Skipf("goimports not installed, skipping test")
+	}
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+
+	// No explicit import of "fmt".
+	err := s.ExecuteCell(nil, 1, []string{"%%", `fmt.Println("Hello")`}, MakeSet[int]())
+	require.NoError(t, err)
+	_, err = os.Stat(s.BinaryPath())
+	require.NoError(t, err)
+}
+
+func TestNoAutoImport(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+
+	// Explicit imports: "flag", used by the generated `func main()`, is included automatically.
+	err := s.ExecuteCell(nil, 1, []string{`import "fmt"`, "%%", `fmt.Println("Hello")`}, MakeSet[int]())
+	require.NoError(t, err)
+
+	// Without imports it fails to compile.
+	err = s.ExecuteCell(nil, 2, []string{"%%", `strings.ToUpper("Hello")`}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestTimeIt(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	s.CellTimeIt = &TimeIt{Iterations: 10, Repeats: 2}
+	err := s.ExecuteCell(nil, 1, []string{"%%", "x := 0", "x++"}, MakeSet[int]())
+	require.NoError(t, err)
+	content, err := os.ReadFile(s.MainPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "func "+timeItBodyFunc+"() {")
+
+	// Run the binary and check the report.
+	output, err := exec.Command(s.BinaryPath()).Output()
+	require.NoError(t, err)
+	assert.Contains(t, string(output), " per loop (mean of 2 runs, 10 loops each; min ")
+}
+
+func TestProfile(t *testing.T) {
+	for _, kind := range []string{ProfileCPU, ProfileMem} {
+		t.Run(kind, func(t *testing.T) {
+			s := newEmptyState(t)
+			defer func() { require.NoError(t, s.Finalize()) }()
+			s.AutoGet = false
+			s.AutoImport = false
+			s.CellProfile = &Profile{Kind: kind, TopN: 5}
+			err := s.ExecuteCell(nil, 1, []string{"%%",
+				"x := make([]int, 0)",
+				"for ii := 0; ii < 100_000; ii++ { x = append(x, ii) }",
+			}, MakeSet[int]())
+			require.NoError(t, err)
+			content, err := os.ReadFile(s.MainPath())
+			require.NoError(t, err)
+			assert.Contains(t, string(content), "func "+profileBodyFunc+"() {")
+			info, err := os.Stat(s.ProfilePath())
+			require.NoError(t, err)
+			assert.Greater(t, info.Size(), int64(0))
+
+			report, err := s.ProfileReport()
+			require.NoError(t, err)
+			assert.Contains(t, report, "flat%")
+		})
+	}
+
+	// Not allowed with %%timeit.
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.CellProfile = &Profile{Kind: ProfileCPU, TopN: 5}
+	s.CellTimeIt = &TimeIt{Iterations: 1, Repeats: 1}
+	require.Error(t, s.ExecuteCell(nil, 1, []string{"%%", "x := 1", "_ = x"}, MakeSet[int]()))
+}
+
+func TestCellTests(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	s.CellIsTest = true
+	s.CellTestArgs = []string{"-run", "TestAdd"}
+	err := s.ExecuteCell(nil, 1, []string{
+		`import "testing"`,
+		"func add(a, b int) int { return a + b }",
+		"func TestAdd(t *testing.T) {",
+		"  if add(1, 2) != 3 { t.Fatal(\"wrong\") }",
+		"}",
+		"func TestFail(t *testing.T) { t.Fatal(\"fails\") }",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.FileExists(t, s.MainPath())
+	assert.NoFileExists(t, s.TestMainPath())
+	assert.Contains(t, s.Definitions.Functions, "add")
+	assert.NotContains(t, s.Definitions.Functions, "TestAdd", "Test functions should not be memorized")
+
+	// Failing tests are reported in the output, like a failing program.
+	s.CellTestArgs = nil
+	err = s.ExecuteCell(nil, 2, []string{
+		`import "testing"`,
+		"func TestFail(t *testing.T) { t.Fatal(\"fails\") }",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+
+	// Compilation errors.
+	err = s.ExecuteCell(nil, 3, []string{"func TestX(t *testing.T) { undefinedFunc() }"}, MakeSet[int]())
+	require.Error(t, err)
+	assert.FileExists(t, s.MainPath())
+}
+
+func TestCellTestHelpers(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	s.CellIsTest = true
+	err := s.ExecuteCell(nil, 1, []string{
+		`import "testing"`,
+		`func TestdataPath() string { return "testdata" }`,
+		"func TestPath(t *testing.T) {",
+		`  if TestdataPath() != "testdata" { t.Fatal("wrong path") }`,
+		"}",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.NotContains(t, s.Definitions.Functions, "TestPath", "Test functions should not be memorized")
+	assert.Contains(t, s.Definitions.Functions, "TestdataPath", "Helper functions should be memorized")
+
+	// The helper can be used by following cells (the memorized "testing" import must also be used, since
+	// AutoImport is disabled).
+	s.CellIsTest = false
+	require.NoError(t, s.ExecuteCell(nil, 2, []string{"%%", "_ = TestdataPath()", "_ = testing.Short"},
+		MakeSet[int]()))
+
+	for name, want := range map[string]bool{"Test": true, "TestX": true, "Test_x": true, "Test1": true,
+		"Testify": false, "TestdataPath": false, "T~TestX": false, "Benchmark": true, "BenchmarkAlloc": true,
+		"Benchmarks": false} {
+		assert.Equal(t, want, isTestFunction(&Function{Key: name}), "isTestFunction(%q)", name)
+	}
+}
+
+func TestTestBinaryArgs(t *testing.T) {
+	assert.Equal(t, []string{"-test.run", "TestA", "-test.v", "--test.count=2", "x"},
+		testBinaryArgs([]string{"-run", "TestA", "-v", "--test.count=2", "x"}))
+}
+
+func TestCellBenchmarks(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	s.CellIsTest = true
+	s.CellTestArgs = []string{"-run=^$", "-bench=.", "-benchmem", "-benchtime=10x"}
+	err := s.ExecuteCell(nil, 1, []string{
+		`import "testing"`,
+		"func BenchmarkAlloc(b *testing.B) {",
+		"  for i := 0; i < b.N; i++ { _ = make([]byte, 1024) }",
+		"}",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.NotContains(t, s.Definitions.Functions, "BenchmarkAlloc", "Benchmark functions should not be memorized")
+
+	// Run the test binary and check the report.
+	output, err := exec.Command(s.TestBinaryPath(), testBinaryArgs(s.CellTestArgs)...).Output()
+	require.NoError(t, err)
+	assert.Contains(t, string(output), "BenchmarkAlloc")
+	assert.Contains(t, string(output), " ns/op")
+	assert.Contains(t, string(output), " allocs/op")
+}
+
+func TestVet(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	s.GoVet = true
+	cell := []string{`import "fmt"`, "func badFormat() { fmt.Printf(\"%d\\n\", \"x\") }", "%%", "badFormat()"}
+
+	// Warnings don't block execution.
+	require.NoError(t, s.ExecuteCell(nil, 1, cell, MakeSet[int]()))
+	assert.Contains(t, s.Definitions.Functions, "badFormat")
+
+	// Unless in strict mode.
+	s.GoVetStrict = true
+	s.Reset()
+	require.Error(t, s.ExecuteCell(nil, 2, cell, MakeSet[int]()))
+	assert.NotContains(t, s.Definitions.Functions, "badFormat")
+
+	// Code without warnings.
+	require.NoError(t, s.ExecuteCell(nil, 3, []string{"%%", "x := 1", "_ = x"}, MakeSet[int]()))
+}
+
+func TestBuildFlags(t *testing.T) {
+	s := &State{GoBuildFlags: []string{"-race"}}
+	assert.Equal(t, []string{"-race"}, s.BuildFlags())
+	s.BuildTags = []string{"a", "b"}
+	assert.Equal(t, []string{"-race", "-tags=a,b"}, s.BuildFlags())
+	s.GoBuildFlags = []string{"-tags=b,c", "-race"}
+	assert.Equal(t, []string{"-race", "-tags=b,c,a"}, s.BuildFlags())
+	s.GoBuildFlags = []string{"--tags", "c", "-v"}
+	assert.Equal(t, []string{"-v", "-tags=c,a,b"}, s.BuildFlags())
+}
+
+func TestBuildTagsCell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	s.GoBuildFlags = []string{"-tags=a"}
+	s.BuildTags = []string{"b", "c"}
+	require.NoError(t, s.ExecuteCell(nil, 1, []string{"%%", "x := 1", "_ = x"}, MakeSet[int]()))
+	assert.FileExists(t, s.BinaryPath())
+}
+
+func TestCgoCell(t *testing.T) {
+	if _, err := exec.LookPath("gcc"); err != nil {
+		t.Skipf("gcc not installed, skipping test")
+	}
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	s.CgoEnabled = "0" // %%cgo and memorized `import "C"` take precedence.
+	s.CellIsCgo = true
+	err := s.ExecuteCell(nil, 1, []string{
+		"/*",
+		"static int add(int a, int b) { return a + b; }",
+		"*/",
+		`import "C"`,
+		"",
+		"func addC(a, b int) int { return int(C.add(C.int(a), C.int(b))) }",
+		"%%",
+		`if addC(1, 2) != 3 { panic("wrong sum") }`,
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	require.Contains(t, s.Definitions.Imports, "C")
+	assert.Contains(t, s.Definitions.Imports["C"].CgoPreamble, "static int add(int a, int b)")
+
+	// Following cells use the memorized preamble.
+	s.CellIsCgo = false
+	require.NoError(t, s.ExecuteCell(nil, 2, []string{"%%", `if addC(3, 4) != 7 { panic("wrong sum") }`}, MakeSet[int]()))
+
+	// C compilation errors.
+	s.CellIsCgo = true
+	err = s.ExecuteCell(nil, 3, []string{"// static int bad() { return undefined_c_var; }", `import "C"`, "%%", "_ = C.bad()"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestCellStdin(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	outputPath := path.Join(t.TempDir(), "stdin.txt")
+	s.CellStdin = "hello\nworld\n"
+	err := s.ExecuteCell(nil, 1, []string{
+		`import ("io"; "os")`,
+		"%%",
+		"content, err := io.ReadAll(os.Stdin)",
+		"if err != nil { panic(err) }",
+		"if err = os.WriteFile(" + strconv.Quote(outputPath) + ", content, 0644); err != nil { panic(err) }",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	content, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\nworld\n", string(content))
+}
+
+func TestPreBuild(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+
+	// `go generate ./...` in a separate module.
+	genDir := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(genDir, "go.mod"), []byte("module example.com/gen\n\ngo 1.20\n"), 0644))
+	require.NoError(t, os.WriteFile(path.Join(genDir, "gen.go"),
+		[]byte("package gen\n\n//go:generate sh -c \"echo generated > generated.txt\"\n"), 0644))
+	s.CellGenerateDirs = []string{genDir}
+
+	// Commands registered with `%prebuild`.
+	s.PreBuildCommands = []PreBuildCommand{
+		{Command: "echo prebuild > prebuild.txt", Args: []string{"sh", "-c", "echo prebuild > prebuild.txt"}, Dir: s.TempDir},
+	}
+	require.NoError(t, s.ExecuteCell(nil, 1, []string{"func main() {}"}, MakeSet[int]()))
+	content, err := os.ReadFile(path.Join(genDir, "generated.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "generated\n", string(content))
+	content, err = os.ReadFile(path.Join(s.TempDir, "prebuild.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "prebuild\n", string(content))
+
+	// A failing command prevents the compilation.
+	s.CellGenerateDirs = nil
+	s.PreBuildCommands = []PreBuildCommand{{Command: "exit 3", Args: []string{"sh", "-c", "exit 3"}}}
+	require.NoError(t, os.Remove(s.BinaryPath()))
+	err = s.ExecuteCell(nil, 2, []string{"func main() {}"}, MakeSet[int]())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exit code 3")
+	_, err = os.Stat(s.BinaryPath())
+	assert.True(t, os.IsNotExist(err), "binary should not have been compiled")
+}
+
+func TestGetModules(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	t.Setenv("GOPROXY", "off")
+
+	require.NoError(t, s.ExecuteCell(nil, 1, []string{`import "strings"`, `var x = strings.ToUpper("x")`}, MakeSet[int]()))
+	require.NoError(t, os.Remove(s.BinaryPath()))
+	require.NoError(t, s.GetModules(nil, nil))
+	_, err := os.Stat(s.BinaryPath())
+	assert.True(t, os.IsNotExist(err), "binary should not have been compiled")
+
+	// Packages that can't be fetched.
+	err = s.GetModules(nil, []string{"example.com/does/not/exist"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "exit code")
+
+	// `go get` is executed with the environment of the Go toolchain, see State.GoCommandEnv.
+	recordPath := path.Join(t.TempDir(), "record")
+	goBinPath := path.Join(t.TempDir(), "go")
+	require.NoError(t, os.WriteFile(goBinPath,
+		[]byte("#!/bin/sh\necho \"$CGO_ENABLED\" > "+recordPath+"\n"), 0755))
+	t.Setenv(protocol.GONB_GO_BIN_ENV, goBinPath)
+	t.Setenv("CGO_ENABLED", "1")
+	s.CgoEnabled = "0"
+	require.NoError(t, s.GetModules(nil, []string{"example.com/some/pkg"}))
+	record, err := os.ReadFile(recordPath)
+	require.NoError(t, err)
+	assert.Equal(t, "0\n", string(record))
+
+	// Not available with vendored dependencies.
+	s.Vendor = true
+	require.Error(t, s.GetModules(nil, nil))
+}
+
+func TestMainAppend(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+
+	require.NoError(t, s.ExecuteCell(nil, 1, []string{`import "fmt"`, "%%", "x := 1", "fmt.Println(x)"}, MakeSet[int]()))
+	require.NotNil(t, s.LastMain)
+
+	// Statements appended use the variables of the previous cell.
+	s.CellMainAppend = true
+	require.NoError(t, s.ExecuteCell(nil, 2, []string{"%% --append", "y := x + 1", "fmt.Println(y)"}, MakeSet[int]()))
+	content, err := os.ReadFile(s.MainPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "\tx := 1\n\tfmt.Println(x)\n\ty := x + 1\n\tfmt.Println(y)\n")
+	assert.Equal(t, []int{1, 1, 1, 1, 2, 2, 2, 2}, s.LastMain.Ids)
+
+	// Errors are reported in the cell where the statement was written.
+	fileToCellIdAndLine := s.LastMain.CellLines.Append(nil)
+	assert.Equal(t, CellIdAndLine{Id: 1, Line: 2}, fileToCellIdAndLine[2])
+	assert.Equal(t, CellIdAndLine{Id: 2, Line: 1}, fileToCellIdAndLine[4])
+
+	// Without --append, main is replaced.
+	s.CellMainAppend = false
+	require.NoError(t, s.ExecuteCell(nil, 3, []string{"%%", "z := 3", "fmt.Println(z)"}, MakeSet[int]()))
+	content, err = os.ReadFile(s.MainPath())
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "x := 1")
+
+	// Reset discards it.
+	s.Reset()
+	assert.Nil(t, s.LastMain)
+}
+
+func TestHistoryAndReplayCell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+
+	require.NoError(t, s.ExecuteCell(nil, 1, []string{"func double(x int) int { return 2*x }"}, MakeSet[int]()))
+	// Cells without definitions are not recorded.
+	require.NoError(t, s.ExecuteCell(nil, 2, []string{"%%", "_ = double(1)"}, MakeSet[int]()))
+	require.NoError(t, s.ExecuteCell(nil, 3, []string{"const ten = 10", "%%", "_ = double(ten)"}, MakeSet[int]()))
+	require.Len(t, s.History, 2)
+	assert.Equal(t, 1, s.History[0].Id)
+	assert.Equal(t, 3, s.History[1].Id)
+
+	s.Reset()
+	require.Empty(t, s.Definitions.Functions)
+	for _, cell := range s.History {
+		require.NoError(t, s.ReplayCell(nil, cell))
+	}
+	assert.Contains(t, s.Definitions.Functions, "double")
+	assert.Contains(t, s.Definitions.Constants, "ten")
+	assert.NotContains(t, s.Definitions.Functions, "main")
+	require.Len(t, s.History, 2)
+
+	// Replaying a cell that depends on definitions that are gone fails.
+	s.Reset()
+	require.Error(t, s.ReplayCell(nil, s.History[1]))
+}
+
+func TestDisplayVar(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+
+	require.NoError(t, s.ExecuteCell(nil, 1, []string{
+		`import "image"`,
+		"%%",
+		"gonbDisplay = image.NewRGBA(image.Rect(0, 0, 2, 2))",
+	}, MakeSet[int]()))
+	// The value is displayed, and the file removed.
+	_, err := os.Stat(s.DisplayValuePath())
+	require.True(t, os.IsNotExist(err))
+
+	// Run the program again to check the value written.
+	require.NoError(t, exec.Command(s.BinaryPath()).Run())
+	content, err := os.ReadFile(s.DisplayValuePath())
+	require.NoError(t, err)
+	kind, data, _ := bytes.Cut(content, []byte("\n"))
+	mimeType, value := displayValueMIMEType(string(kind), data)
+	assert.Equal(t, string(protocol.MIMEImagePNG), mimeType)
+	assert.True(t, bytes.HasPrefix(value.([]byte), []byte("\x89PNG")))
+
+	// Cells that don't refer to gonbDisplay don't display anything.
+	require.NoError(t, s.ExecuteCell(nil, 2, []string{"%%", "_ = image.Pt(0, 0)"}, MakeSet[int]()))
+	require.NoError(t, exec.Command(s.BinaryPath()).Run())
+	_, err = os.Stat(s.DisplayValuePath())
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDisplayValueMIMEType(t *testing.T) {
+	mimeType, value := displayValueMIMEType(displayMIMEText, []byte("hello"))
+	assert.Equal(t, protocol.MIMETextPlain, mimeType)
+	assert.Equal(t, "hello", value)
+
+	svg := `<?xml version="1.0"?><!-- comment --><svg width="10"></svg>`
+	mimeType, value = displayValueMIMEType(displayMIMEText, []byte(svg))
+	assert.Equal(t, string(protocol.MIMEImageSVG), mimeType)
+	assert.Equal(t, svg, value)
+	mimeType, _ = displayValueMIMEType(displayMIMEBinary, []byte(svg))
+	assert.Equal(t, string(protocol.MIMEImageSVG), mimeType)
+
+	mimeType, _ = displayValueMIMEType(displayMIMEBinary, []byte("GIF89a..."))
+	assert.Equal(t, protocol.MIMEImageGIF, mimeType)
+	mimeType, value = displayValueMIMEType(displayMIMEBinary, []byte("some text"))
+	assert.Equal(t, protocol.MIMETextPlain, mimeType)
+	assert.Equal(t, "some text", value)
+}
+
+func TestDropGeneratedDecls(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	mainDecl := &Function{Key: "main", Name: "main", Definition: "func main() {\n\tgonbDisplay = 1\n}",
+		CellLines: CellLines{Lines: []int{0, 1, 2}}}
+	_, _, err := s.createMainFileFromDecls(NewDeclarations(), mainDecl)
+	require.NoError(t, err)
+
+	// Parsing back the generated main.go, as done after running goimports, yields the generated declarations.
+	decls, err := s.parseFromMainGo(nil, -1, NoCursor, nil)
+	require.NoError(t, err)
+	require.Contains(t, decls.Functions, displayBodyFunc)
+	require.Contains(t, decls.Variables, DisplayVar)
+	dropGeneratedDecls(decls)
+	assert.NotContains(t, decls.Functions, displayBodyFunc)
+	assert.NotContains(t, decls.Variables, DisplayVar)
+}
+
+func TestAutoDisplayMain(t *testing.T) {
+	newMain := func(body string) *Function {
+		def := mainPreamble + body + "\n}"
+		return &Function{Key: "main", Name: "main", Definition: def,
+			CellLines: CellLines{Lines: make([]int, strings.Count(def, "\n")+1)}}
+	}
+	displayMain := autoDisplayMain(newMain("\tx := 2\n\tx *\n\t\t3"))
+	require.NotNil(t, displayMain)
+	assert.Equal(t, mainPreamble+"\tx := 2\n\tgonbDisplay = gonbAutoDisplay(x *\n\t\t3)\n}", displayMain.Definition)
+
+	// Not applicable.
+	assert.Nil(t, autoDisplayMain(newMain("\tx := 2\n\t_ = x")))
+	assert.Nil(t, autoDisplayMain(newMain("\tfmt.Println(1)")))
+	assert.Nil(t, autoDisplayMain(newMain("\tgonbDisplay = 1\n\tgonbDisplay")))
+	assert.Nil(t, autoDisplayMain(&Function{Key: "main", Name: "main", Definition: "func main() {\n\t1\n}",
+		CellLines: CellLines{Lines: []int{0, 1, 2}}}))
+	assert.Nil(t, autoDisplayMain(nil))
+}
+
+func TestAutoDisplay(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	s.AutoDisplay = true
+
+	readDisplayed := func() string {
+		require.NoError(t, exec.Command(s.BinaryPath()).Run())
+		content, err := os.ReadFile(s.DisplayValuePath())
+		require.NoError(t, err)
+		require.NoError(t, os.Remove(s.DisplayValuePath()))
+		return string(content)
+	}
+	require.NoError(t, s.ExecuteCell(nil, 1, []string{`import "strconv"`, "%%", "_ = strconv.Itoa", "x := 20", "x + 1"}, MakeSet[int]()))
+	assert.Equal(t, "text\n21", readDisplayed())
+	require.NoError(t, s.ExecuteCell(nil, 2, []string{"%%", `strconv.Atoi("12")`}, MakeSet[int]()))
+	assert.Equal(t, "text\n12", readDisplayed())
+	require.NoError(t, s.ExecuteCell(nil, 3, []string{"%%", `strconv.Atoi("x")`}, MakeSet[int]()))
+	assert.Contains(t, readDisplayed(), "invalid syntax")
+
+	// Expressions without value are not displayed.
+	require.NoError(t, s.ExecuteCell(nil, 4, []string{"func f() {}", "%%", "_ = strconv.Itoa", "f()"}, MakeSet[int]()))
+	require.NoError(t, exec.Command(s.BinaryPath()).Run())
+	_, err := os.Stat(s.DisplayValuePath())
+	require.True(t, os.IsNotExist(err))
+	assert.NotContains(t, s.LastMain.Definition, "gonbDisplay")
+
+	// Other compilation errors are still reported.
+	require.Error(t, s.ExecuteCell(nil, 5, []string{"%%", "undefinedVar + 1"}, MakeSet[int]()))
+}
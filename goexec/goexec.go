@@ -15,6 +15,7 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
+	"time"
 )
 
 const (
@@ -42,12 +43,116 @@ type State struct {
 	Args    []string // Args to be passed to the program, after being executed.
 	AutoGet bool     // Whether to do a "go get" before compiling, to fetch missing external modules.
 
+	// AutoImport indicates whether to run `goimports` before compiling, to add missing imports and
+	// remove unused ones.
+	AutoImport bool
+
+	// AutoDisplay indicates whether the value of a trailing expression of the `func main()` created with `%%` is
+	// displayed, see autoDisplayMain. Set with `%autodisplay` and `%noautodisplay`.
+	AutoDisplay bool
+
+	// AutoTrackAfterShell indicates whether to run AutoTrack after each shell command (`!`) of a cell, in
+	// case it changed `go.mod` or `go.work`. Set with `%autotrack` and `%noautotrack`.
+	AutoTrackAfterShell bool
+
+	// GoBuildFlags are extra flags passed to `go build` when compiling the cells (e.g.: `-race` or
+	// `-tags=integration`). Set with `%goflags`.
+	GoBuildFlags []string
+
+	// BuildTags are build tags (e.g.: `integration` or `netgo`) passed with `-tags` to the Go toolchain,
+	// merged with any `-tags` in GoBuildFlags. Set with `%buildtags`.
+	BuildTags []string
+
+	// Vendor indicates whether to build with the vendored dependencies (`-mod=vendor`), see SetVendor.
+	// Set with `%vendor`.
+	Vendor bool
+
+	// CgoEnabled, if set, is the value of CGO_ENABLED ("1" or "0") used when invoking the Go toolchain.
+	// If empty, it's taken from the environment. Set with `%cgo`.
+	CgoEnabled string
+
+	// GoVet indicates whether to run `go vet` on the cells after they are compiled. Warnings are reported,
+	// but only block the execution of the cell if GoVetStrict is also set. Set with `%govet` and `%nogovet`.
+	GoVet, GoVetStrict bool
+
+	// PreBuildCommands are run, in order, before each compilation of the cells. Set with `%prebuild`.
+	PreBuildCommands []PreBuildCommand
+
+	// CellGenerateDirs are the directories where `go generate ./...` is run before compiling the current cell.
+	// It is set by the `%generate` special command, and reset at every cell.
+	CellGenerateDirs []string
+
+	// CellIsTimed enables the timing of the compilation and execution of the current cell, reported
+	// at the end of its execution. It is set by the `%%time` special command, and reset at every cell.
+	CellIsTimed bool
+
+	// CellTimeIt, if set, benchmarks the `func main()` of the current cell, instead of running it
+	// once. It is set by the `%%timeit` special command, and reset at every cell.
+	CellTimeIt *TimeIt
+
+	// CellProfile, if set, runs the `func main()` of the current cell under `pprof`, and reports a summary
+	// of the profile after its execution. It is set by the `%%profile` special command, and reset at every cell.
+	CellProfile *Profile
+
+	// CellIsTest indicates the `func TestXxx(t *testing.T)` (and benchmarks) of the current cell are to be
+	// compiled and executed with `go test`, instead of running `func main()`. CellTestArgs are the flags passed
+	// to the tests (e.g.: `-run`, `-v`, `-bench`). They are set by the `%%test` and `%%benchmark` special
+	// commands, and reset at every cell.
+	CellIsTest   bool
+	CellTestArgs []string
+
+	// CellTimeout, if > 0, is the maximum time the Go program and each shell command of the current cell
+	// can run, before they are interrupted. It is set by the `%timeout` special command, and reset at every cell.
+	CellTimeout time.Duration
+
+	// CellStdin is fed to the stdin of the Go program and of the shell commands of the current cell. It is set
+	// by the `%stdin` special command, and reset at every cell.
+	CellStdin string
+
+	// cellTiming holds the timing of the cell being executed, if CellIsTimed is set.
+	cellTiming *cellTiming
+
+	// CellIsCgo indicates the current cell uses cgo (`import "C"`), and forces CGO_ENABLED=1 when building it.
+	// Later cells are also built with CGO_ENABLED=1 while the "C" import is memorized. It is set by the `%%cgo`
+	// special command, and reset at every cell.
+	CellIsCgo bool
+
+	// CellLoadedLines are lines of Go code loaded (with `%load`) to be executed along with the
+	// current cell: they are appended to the cell lines. It is reset at every cell.
+	CellLoadedLines []string
+
+	// CellCaptureVar is the name of the variable that will hold the output captured from the current
+	// cell (see `%%capture`), or empty if the output is not being captured. It is reset at every cell.
+	CellCaptureVar string
+
+	// CellMainAppend indicates the statements of the `func main()` of the current cell (created with `%%` or
+	// `%main`) are to be appended to the ones of LastMain, instead of replacing them. It is set by
+	// `%% --append` (or `%main --append`), and reset at every cell.
+	CellMainAppend bool
+
+	// LastMain is the `func main()` of the last cell successfully executed with `%%` (or `%main`), including the
+	// statements appended by CellMainAppend. It is cleared by Reset.
+	LastMain *Function
+
+	// DirStack holds the directories saved by `%pushd`, to be restored by `%popd`.
+	DirStack []string
+
+	// PreviousDir is the directory before the last `%cd`, to be restored by `%cd -`.
+	PreviousDir string
+
 	// Global elements defined mapped by their keys.
 	Definitions *Declarations
 
+	// History of the cells that produced definitions, oldest first, see HistoryCell. It is not cleared by
+	// Reset, so the definitions can be rebuilt with `%replay`.
+	History []HistoryCell
+
 	// gopls client
 	gopls *goplsclient.Client
 
+	// queryCache holds the results of the last inspect and auto-complete requests, see QueryCacheTTL.
+	queryCache queryCache
+
 	// trackingInfo is everything related to tracking.
 	trackingInfo *trackingInfo
 
@@ -81,7 +186,10 @@ func New(uniqueID string) (*State, error) {
 		Package:      "gonb_" + uniqueID,
 		Definitions:  NewDeclarations(),
 		AutoGet:      true,
+		AutoImport:   true,
 		trackingInfo: newTrackingInfo(),
+
+		AutoTrackAfterShell: true,
 	}
 
 	// Create directory.
@@ -103,12 +211,11 @@ func New(uniqueID string) (*State, error) {
 			err = nil
 		}
 	}
-	err = os.Setenv(protocol.GONB_TMP_DIR_ENV, s.TempDir)
-	if err != nil {
-		klog.Errorf("Failed to set environment variable %q: %+v", protocol.GONB_TMP_DIR_ENV, err)
-		err = nil
-	}
+	s.ExportTempDir()
 
+	if err = applyGoToolchainEnv(); err != nil {
+		return nil, err
+	}
 	if err = s.GoModInit(); err != nil {
 		return nil, err
 	}
@@ -145,8 +252,7 @@ func (s *State) GoModInit() error {
 		return errors.Wrapf(err, "failed to remove go.mod")
 	}
 	// Exec `go mod init` on given directory.
-	cmd := exec.Command("go", "mod", "init", s.Package)
-	cmd.Dir = s.TempDir
+	cmd := s.goCommand("mod", "init", s.Package)
 	var output []byte
 	output, err = cmd.CombinedOutput()
 	if err != nil {
@@ -156,6 +262,56 @@ func (s *State) GoModInit() error {
 	return nil
 }
 
+// ResetTempDir removes and recreates the temporary directory (State.TempDir) where the cells are
+// compiled, discarding build artifacts and any files created there (e.g.: by `!*` commands).
+// It then re-initializes `go.mod`, restarts `gopls` and re-tracks the tracked files.
+//
+// It returns the names of the entries removed from the temporary directory.
+func (s *State) ResetTempDir() (removed []string, err error) {
+	entries, err := os.ReadDir(s.TempDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read temporary directory %q", s.TempDir)
+	}
+	for _, entry := range entries {
+		removed = append(removed, entry.Name())
+	}
+
+	hadGopls := s.gopls != nil
+	if hadGopls {
+		s.gopls.Shutdown()
+		s.gopls = nil
+	}
+	if err = os.RemoveAll(s.TempDir); err != nil {
+		return nil, errors.Wrapf(err, "failed to remove temporary directory %q", s.TempDir)
+	}
+	if err = os.Mkdir(s.TempDir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to re-create temporary directory %q", s.TempDir)
+	}
+	if err = s.GoModInit(); err != nil {
+		return nil, err
+	}
+	if hadGopls {
+		s.gopls = goplsclient.New(s.TempDir)
+		if err = s.gopls.Start(); err != nil {
+			klog.Errorf("Failed to restart `gopls`: %v", err)
+			err = nil
+		}
+	}
+	if err = s.retrackAll(); err != nil {
+		return nil, errors.WithMessagef(err, "failed to re-track files after resetting %q", s.TempDir)
+	}
+	s.ExportTempDir()
+	return removed, nil
+}
+
+// ExportTempDir sets the environment variable GONB_TMP_DIR to the temporary directory (TempDir), so the Go
+// programs and shell commands can reference it.
+func (s *State) ExportTempDir() {
+	if err := os.Setenv(protocol.GONB_TMP_DIR_ENV, s.TempDir); err != nil {
+		klog.Errorf("Failed to set environment variable %q: %+v", protocol.GONB_TMP_DIR_ENV, err)
+	}
+}
+
 // Finalize stops gopls and removes temporary files and directories.
 func (s *State) Finalize() error {
 	if s.gopls != nil {
@@ -172,6 +328,19 @@ func (s *State) Finalize() error {
 	return nil
 }
 
+// SetCapturedOutput declares (or re-declares) the variable `name` holding the output captured from a
+// cell (see `%%capture`), so it can be used by the following cells. The variable is a struct with the
+// fields `Stdout` and `Stderr`.
+func (s *State) SetCapturedOutput(name, stdout, stderr string) {
+	s.Definitions.Variables[name] = &Variable{
+		Cursor:          NoCursor,
+		CellLines:       CellLines{Id: NoCursorLine},
+		Key:             name,
+		Name:            name,
+		ValueDefinition: fmt.Sprintf("struct{ Stdout, Stderr string }{Stdout: %q, Stderr: %q}", stdout, stderr),
+	}
+}
+
 func NewDeclarations() *Declarations {
 	return &Declarations{
 		Imports:   make(map[string]*Import),
@@ -294,13 +463,21 @@ type CellLines struct {
 	//
 	// If Id is -1, Lines will be nil, which indicates the content didn't come from any cell.
 	Lines []int
+
+	// Ids, if set, has the id of the cell of each line, for declarations spanning more than one cell
+	// (see State.LastMain). Otherwise, all lines come from the cell Id.
+	Ids []int
 }
 
 // Append id and line numbers to fileToCellIdAndLine, a slice of `CellIdAndLine`. This is used when
 // rendering a declaration to a file.
 func (c CellLines) Append(fileToCellIdAndLine []CellIdAndLine) []CellIdAndLine {
-	for _, lineNum := range c.Lines {
-		fileToCellIdAndLine = append(fileToCellIdAndLine, CellIdAndLine{Id: c.Id, Line: lineNum})
+	for ii, lineNum := range c.Lines {
+		id := c.Id
+		if ii < len(c.Ids) {
+			id = c.Ids[ii]
+		}
+		fileToCellIdAndLine = append(fileToCellIdAndLine, CellIdAndLine{Id: id, Line: lineNum})
 	}
 	return fileToCellIdAndLine
 }
@@ -358,6 +535,11 @@ type Import struct {
 	Key                         string
 	Path, Alias                 string
 	CursorInPath, CursorInAlias bool
+
+	// CgoPreamble is the comment preceding `import "C"` with the C code used by cgo (including the comment
+	// delimiters), and CgoPreambleLines its lines in the cell. Only set for the "C" import.
+	CgoPreamble      string
+	CgoPreambleLines CellLines
 }
 
 var reDefaultImportPathAlias = regexp.MustCompile(`^.*?(\w[\w0-9_]*)\s*$`)
@@ -368,4 +550,6 @@ var reDefaultImportPathAlias = regexp.MustCompile(`^.*?(\w[\w0-9_]*)\s*$`)
 // It is connected to the special command `%reset`.
 func (s *State) Reset() {
 	s.Definitions = NewDeclarations()
+	s.LastMain = nil
+	s.InvalidateQueryCache()
 }
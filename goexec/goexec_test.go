@@ -1,11 +1,20 @@
 package goexec
 
 import (
+	"context"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/goexec/goplsclient"
 	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/janpfeifer/gonb/kernel"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestDirEnv(t *testing.T) {
@@ -17,3 +26,219 @@ func TestDirEnv(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, pwd, os.Getenv(protocol.GONB_DIR_ENV))
 }
+
+func TestSaveLoadState(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+	err := s.ExecuteCell(nil, 1, []string{
+		`import "strings"`,
+		"const (",
+		"  A = iota",
+		"  B",
+		")",
+		"type T struct{ X int }",
+		"var v = T{X: 1}",
+		"func (t T) Get() int { return t.X }",
+		"func f() string { return strings.Repeat(\"x\", B) }",
+		"%%",
+		"_ = f()",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	filePath := path.Join(t.TempDir(), "state.json")
+	require.NoError(t, s.SaveState(filePath))
+
+	s2 := newEmptyState(t)
+	defer func() { require.NoError(t, s2.Finalize()) }()
+	s2.AutoGet = false
+	s2.AutoImport = false
+	require.NoError(t, s2.LoadState(filePath))
+	assert.Equal(t, SortedKeys(s.Definitions.Imports), SortedKeys(s2.Definitions.Imports))
+	assert.Equal(t, SortedKeys(s.Definitions.Functions), SortedKeys(s2.Definitions.Functions))
+	assert.Equal(t, SortedKeys(s.Definitions.Variables), SortedKeys(s2.Definitions.Variables))
+	assert.Equal(t, SortedKeys(s.Definitions.Types), SortedKeys(s2.Definitions.Types))
+	require.Equal(t, []string{"A", "B"}, SortedKeys(s2.Definitions.Constants))
+	assert.Equal(t, s2.Definitions.Constants["B"], s2.Definitions.Constants["A"].Next)
+	goMod, err := os.ReadFile(path.Join(s2.TempDir, "go.mod"))
+	require.NoError(t, err)
+	assert.Contains(t, string(goMod), "module "+s2.Package+"\n")
+
+	// Restored declarations can be used by new cells.
+	err = s2.ExecuteCell(nil, 2, []string{"%%", "_ = f() + strings.ToUpper(\"y\")", "_ = v.Get()"}, MakeSet[int]())
+	require.NoError(t, err)
+
+	// Files from a newer version are rejected.
+	require.NoError(t, os.WriteFile(filePath, []byte(`{"version": 1000}`), 0644))
+	require.Error(t, s2.LoadState(filePath))
+}
+
+func TestGoRoot(t *testing.T) {
+	// Environment variables changed by SetGoRoot are restored at the end of the test.
+	for _, name := range []string{protocol.GONB_GOROOT_ENV, protocol.GONB_GO_BIN_ENV, "GOROOT", "PATH"} {
+		t.Setenv(name, os.Getenv(name))
+	}
+	require.NoError(t, os.Unsetenv(protocol.GONB_GOROOT_ENV))
+	require.NoError(t, os.Unsetenv(protocol.GONB_GO_BIN_ENV))
+	assert.Equal(t, "go", GoBinary())
+	require.NoError(t, os.Setenv(protocol.GONB_GOROOT_ENV, "/opt/go"))
+	assert.Equal(t, "/opt/go/bin/go", GoBinary())
+	require.NoError(t, os.Setenv(protocol.GONB_GO_BIN_ENV, "/usr/local/bin/go1.20"))
+	assert.Equal(t, "/usr/local/bin/go1.20", GoBinary())
+
+	s := &State{}
+	require.Error(t, s.SetGoRoot(t.TempDir()))
+	assert.Equal(t, "/usr/local/bin/go1.20", GoBinary(), "toolchain changed by an invalid GOROOT")
+
+	goRoot := runtime.GOROOT()
+	if _, err := os.Stat(filepath.Join(goRoot, "bin", "go")); err != nil {
+		t.Skipf("Go toolchain not found in GOROOT %q", goRoot)
+	}
+	require.NoError(t, s.SetGoRoot(goRoot))
+	assert.Equal(t, filepath.Join(goRoot, "bin", "go"), GoBinary())
+	version, err := GoVersion()
+	require.NoError(t, err)
+	assert.Contains(t, version, "go version")
+}
+
+func TestGoBinDir(t *testing.T) {
+	goPath := t.TempDir()
+	t.Setenv("GOPATH", goPath+string(os.PathListSeparator)+t.TempDir())
+	t.Setenv("GOBIN", "")
+	binDir, err := GoBinDir()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(goPath, "bin"), binDir)
+
+	goBin := t.TempDir()
+	t.Setenv("GOBIN", goBin)
+	binDir, err = GoBinDir()
+	require.NoError(t, err)
+	assert.Equal(t, goBin, binDir)
+
+	// Empty GOPATH: without HOME, `go env GOPATH` prints an empty line.
+	t.Setenv("GOBIN", "")
+	t.Setenv("GOPATH", "")
+	t.Setenv("HOME", "")
+	_, err = GoBinDir()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "neither GOBIN nor GOPATH are set")
+
+	exe := ""
+	if runtime.GOOS == "windows" {
+		exe = ".exe"
+	}
+	assert.Equal(t, "stringer"+exe, InstalledBinaryName("golang.org/x/tools/cmd/stringer@latest"))
+	assert.Equal(t, "gopls"+exe, InstalledBinaryName("golang.org/x/tools/gopls@v0.14.2"))
+	assert.Equal(t, "migrate"+exe, InstalledBinaryName("github.com/golang-migrate/migrate/v4@v4.17.0"))
+	assert.Equal(t, "tool"+exe, InstalledBinaryName("./tool"))
+}
+
+func TestAutoTrackModuleFiles(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	updatedFiles := func() (files []string) {
+		require.NoError(t, s.AutoTrack())
+		require.NoError(t, s.EnumerateUpdatedFiles(func(filePath string) error {
+			files = append(files, filePath)
+			return nil
+		}))
+		return
+	}
+	goSumPath := path.Join(s.TempDir, "go.sum")
+	modulesPath := path.Join(s.VendorPath(), "modules.txt")
+	_ = updatedFiles()
+
+	require.NoError(t, os.WriteFile(goSumPath, []byte("example.com/x v1.0.0 h1:abc=\n"), 0644))
+	assert.Equal(t, []string{goSumPath}, updatedFiles())
+	assert.Empty(t, updatedFiles(), "no changes since last check")
+
+	require.NoError(t, os.WriteFile(goSumPath, []byte("example.com/x v1.0.0 h1:abc=\nexample.com/y v1.0.0 h1:def=\n"), 0644))
+	require.NoError(t, os.Mkdir(s.VendorPath(), 0755))
+	require.NoError(t, os.WriteFile(modulesPath, []byte("# example.com/x v1.0.0\n"), 0644))
+	assert.Equal(t, []string{goSumPath, modulesPath}, updatedFiles())
+
+	require.NoError(t, os.Remove(goSumPath))
+	assert.Equal(t, []string{goSumPath}, updatedFiles())
+}
+
+func TestCompletionTypesMetadata(t *testing.T) {
+	matches := []goplsclient.CompletionMatch{
+		{Text: "Println", Kind: "function", Detail: "func(a ...any) (n int, err error)",
+			Documentation: "Println formats using the default formats for its operands and writes to standard output."},
+		{Text: "Stringer", Kind: "interface"},
+	}
+	metadata := completionTypesMetadata(matches, 10, 12)
+	require.Len(t, metadata, 2)
+	assert.Equal(t, map[string]any{
+		"start": 10, "end": 12, "text": "Println", "type": "function",
+		"signature":     "func(a ...any) (n int, err error)",
+		"documentation": "Println formats using the default formats for its operands and writes to standard output.",
+	}, metadata[0])
+	assert.Equal(t, map[string]any{"start": 10, "end": 12, "text": "Stringer", "type": "interface"}, metadata[1])
+}
+
+func TestQueryCache(t *testing.T) {
+	lines := []string{"%%", "fmt.Println(x)"}
+	skipLines := MakeSet[int]()
+	skipLines.Insert(0)
+	key := queryCacheKey(lines, skipLines, 1, 5)
+	assert.Equal(t, key, queryCacheKey([]string{"%%", "fmt.Println(x)"}, skipLines, 1, 5))
+	assert.NotEqual(t, key, queryCacheKey(lines, skipLines, 1, 6), "Different cursor")
+	assert.NotEqual(t, key, queryCacheKey([]string{"%%", "fmt.Println(y)"}, skipLines, 1, 5), "Cell edited")
+	assert.NotEqual(t, key, queryCacheKey(lines, MakeSet[int](), 1, 5), "Different special command lines")
+
+	var c queryCache
+	_, found := c.get(completeQueryKind, key)
+	assert.False(t, found)
+	c.set(completeQueryKind, key, 1)
+	value, found := c.get(completeQueryKind, key)
+	require.True(t, found)
+	assert.Equal(t, 1, value)
+	_, found = c.get(inspectQueryKind, key)
+	assert.False(t, found, "Kinds of requests are cached separately")
+
+	// Invalidated.
+	c.invalidate()
+	_, found = c.get(completeQueryKind, key)
+	assert.False(t, found)
+
+	// Expired.
+	defer func(ttl time.Duration) { QueryCacheTTL = ttl }(QueryCacheTTL)
+	QueryCacheTTL = 10 * time.Millisecond
+	c.set(completeQueryKind, key, 1)
+	time.Sleep(2 * QueryCacheTTL)
+	_, found = c.get(completeQueryKind, key)
+	assert.False(t, found)
+}
+
+// BenchmarkAutoComplete measures the latency of repeated identical auto-complete requests, with and without
+// the cache of query results (see QueryCacheTTL). It requires `gopls`.
+func BenchmarkAutoComplete(b *testing.B) {
+	if _, err := exec.LookPath("gopls"); err != nil {
+		b.Skip("`gopls` is not installed")
+	}
+	s := newEmptyState(b)
+	defer func() { require.NoError(b, s.Finalize()) }()
+	s.AutoGet = false
+	require.True(b, s.gopls.WaitConnection(context.Background()))
+	lines := []string{`import "strings"`, "%%", "strings.To"}
+	skipLines := MakeSet[int]()
+	skipLines.Insert(1)
+	complete := func() {
+		reply := &kernel.CompleteReply{CursorStart: len(lines[2]), CursorEnd: len(lines[2]), Metadata: make(kernel.MIMEMap)}
+		require.NoError(b, s.AutoCompleteOptionsInCell(lines, skipLines, 2, len(lines[2]), reply))
+	}
+	b.Run("uncached", func(b *testing.B) {
+		for ii := 0; ii < b.N; ii++ {
+			s.InvalidateQueryCache()
+			complete()
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		defer func(ttl time.Duration) { QueryCacheTTL = ttl }(QueryCacheTTL)
+		QueryCacheTTL = time.Hour
+		for ii := 0; ii < b.N; ii++ {
+			complete()
+		}
+	})
+}
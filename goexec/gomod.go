@@ -0,0 +1,183 @@
+package goexec
+
+import (
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/pkg/errors"
+	"golang.org/x/mod/modfile"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// This file implements editing `go.mod` and `go.work` directly from the notebook, see `%%go.mod`,
+// `%%go.work` and `%goworkuse`.
+
+// GoModPath is the path to the `go.mod` of the module where the cells are compiled.
+func (s *State) GoModPath() string {
+	return path.Join(s.TempDir, "go.mod")
+}
+
+// SetGoMod replaces the contents of `go.mod` with content, or, if appendContent is true, appends content to
+// the current `go.mod`. The module name is always set to State.Package, and a `module` directive in content
+// can be omitted.
+//
+// The resulting `go.mod` is validated before being written: syntax errors are returned with their line
+// number in content, and the current `go.mod` is kept. Afterwards the files referred to by `replace` rules
+// are re-tracked, see State.AutoTrack.
+func (s *State) SetGoMod(content string, appendContent bool) error {
+	// Parse content by itself first, so errors report line numbers relative to content.
+	if _, err := modfile.Parse("go.mod", []byte(content), nil); err != nil {
+		return errors.Wrapf(err, "invalid go.mod contents")
+	}
+	if appendContent {
+		current, err := os.ReadFile(s.GoModPath())
+		if err != nil {
+			return errors.Wrapf(err, "failed to read current go.mod")
+		}
+		content = string(current) + "\n" + content
+	}
+	modFile, err := modfile.Parse("go.mod", []byte(content), nil)
+	if err != nil {
+		return errors.Wrapf(err, "invalid go.mod contents")
+	}
+	if err = modFile.AddModuleStmt(s.Package); err != nil {
+		return errors.Wrapf(err, "failed to set module name to %q in go.mod", s.Package)
+	}
+	modFile.Cleanup()
+	formatted, err := modFile.Format()
+	if err != nil {
+		return errors.Wrapf(err, "failed to format go.mod")
+	}
+	if err = os.WriteFile(s.GoModPath(), formatted, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write go.mod")
+	}
+	return s.AutoTrack()
+}
+
+// GoWorkPath is the path to the `go.work` of the notebook, if one is set up.
+func (s *State) GoWorkPath() string {
+	return path.Join(s.TempDir, "go.work")
+}
+
+// SetGoWork replaces the contents of `go.work` with content.
+//
+// Since `go.work` lives in State.TempDir, `use` paths are resolved relative to the current directory
+// (with `~` replaced by the home directory) and written as absolute paths, except "." which refers to the
+// notebook's module itself, and is added if missing. It returns an error, and keeps the current `go.work`,
+// if content has syntax errors or if any of the `use` directories doesn't exist.
+func (s *State) SetGoWork(content string) error {
+	workFile, err := modfile.ParseWork("go.work", []byte(content), nil)
+	if err != nil {
+		return errors.Wrapf(err, "invalid go.work contents")
+	}
+	uses := append([]*modfile.Use(nil), workFile.Use...)
+	hasCurrentModule := false
+	for _, use := range uses {
+		if use.Path == "." {
+			hasCurrentModule = true
+			continue
+		}
+		dir, err := resolveGoWorkDir(use.Path)
+		if err != nil {
+			return err
+		}
+		if err = workFile.DropUse(use.Path); err != nil {
+			return errors.Wrapf(err, "failed to update `use %s` in go.work", use.Path)
+		}
+		if err = workFile.AddUse(dir, use.ModulePath); err != nil {
+			return errors.Wrapf(err, "failed to add `use %s` to go.work", dir)
+		}
+	}
+	if !hasCurrentModule {
+		if err = workFile.AddUse(".", ""); err != nil {
+			return errors.Wrapf(err, "failed to add `use .` to go.work")
+		}
+	}
+	return s.writeGoWork(workFile)
+}
+
+// GoWorkUse adds a `use` directive for dir to `go.work`, creating it if it doesn't exist yet. dir is
+// resolved as in SetGoWork, and it returns an error if it doesn't exist.
+func (s *State) GoWorkUse(dir string) error {
+	dir, err := resolveGoWorkDir(dir)
+	if err != nil {
+		return err
+	}
+	workFile, err := s.readOrCreateGoWork()
+	if err != nil {
+		return err
+	}
+	if err = workFile.AddUse(dir, ""); err != nil {
+		return errors.Wrapf(err, "failed to add `use %s` to go.work", dir)
+	}
+	return s.writeGoWork(workFile)
+}
+
+// GoWorkModules returns a map of the modules in the `use` directives of `go.work` to their local directories,
+// excluding the notebook's module itself. It returns nil if there is no `go.work`.
+func (s *State) GoWorkModules() (modToPath map[string]string, err error) {
+	if err = s.AutoTrack(); err != nil {
+		return
+	}
+	return s.findGoWorkModules()
+}
+
+// resolveGoWorkDir returns the absolute path of the `use` directory dir, and checks that it exists.
+func resolveGoWorkDir(dir string) (string, error) {
+	if dir == "" {
+		return "", errors.Errorf("empty `use` directory for go.work")
+	}
+	absDir, err := filepath.Abs(ReplaceTildeInDir(dir))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid `use` directory %q for go.work", dir)
+	}
+	info, err := os.Stat(absDir)
+	if err != nil || !info.IsDir() {
+		return "", errors.Errorf("`use` directory %q for go.work doesn't exist or is not a directory", dir)
+	}
+	return absDir, nil
+}
+
+// readOrCreateGoWork parses the current `go.work` or, if it doesn't exist, creates a new one using the
+// notebook's module (`use .`), and the Go version of its `go.mod`.
+func (s *State) readOrCreateGoWork() (*modfile.WorkFile, error) {
+	content, err := os.ReadFile(s.GoWorkPath())
+	if err == nil {
+		workFile, err := modfile.ParseWork(s.GoWorkPath(), content, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse current go.work")
+		}
+		return workFile, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "failed to read current go.work")
+	}
+
+	workFile := &modfile.WorkFile{Syntax: &modfile.FileSyntax{}}
+	goModContent, err := os.ReadFile(s.GoModPath())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read go.mod")
+	}
+	modFile, err := modfile.ParseLax(s.GoModPath(), goModContent, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse go.mod")
+	}
+	if modFile.Go != nil {
+		if err = workFile.AddGoStmt(modFile.Go.Version); err != nil {
+			return nil, errors.Wrapf(err, "failed to set Go version in go.work")
+		}
+	}
+	if err = workFile.AddUse(".", ""); err != nil {
+		return nil, errors.Wrapf(err, "failed to add `use .` to go.work")
+	}
+	return workFile, nil
+}
+
+// writeGoWork formats and writes workFile to `go.work`.
+func (s *State) writeGoWork(workFile *modfile.WorkFile) error {
+	workFile.Cleanup()
+	if err := os.WriteFile(s.GoWorkPath(), modfile.Format(workFile.Syntax), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write go.work")
+	}
+	return nil
+}
@@ -97,6 +97,42 @@ func (c *Client) Start() error {
 	return nil
 }
 
+// Status of the `gopls` server managed by a Client, as returned by Client.Status.
+type Status struct {
+	Running      bool   // Whether `gopls` was started by the Client and is still running.
+	Connected    bool   // Whether the Client is connected to `gopls`.
+	Connecting   bool   // Whether the Client is still trying to connect to a recently started `gopls`.
+	Address      string // Address used to connect to `gopls`.
+	TrackedFiles int    // Number of files sent to `gopls`.
+}
+
+// Status returns the current status of the `gopls` server and of the connection to it.
+func (c *Client) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Status{
+		Running:      c.goplsExec != nil,
+		Connected:    c.conn != nil,
+		Connecting:   c.waitConnecting,
+		Address:      c.address,
+		TrackedFiles: len(c.fileVersions),
+	}
+}
+
+// Version returns the output of `gopls version` for the `gopls` binary in the PATH.
+func Version() (string, error) {
+	goplsPath, err := exec.LookPath("gopls")
+	if err != nil {
+		return "", errors.Wrapf(err, "cannot file `gopls` binary in path")
+	}
+	cmd := exec.Command(goplsPath, "version")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
 // Stop current `gopls` execution.
 func (c *Client) Stop() {
 	c.mu.Lock()
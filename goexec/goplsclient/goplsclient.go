@@ -25,6 +25,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -142,10 +143,25 @@ func (c *Client) Definition(ctx context.Context, filePath string, line, col int)
 	return hover.Contents.Value, nil
 }
 
-// Complete request auto-complete suggestions from `gopls`. It returns the text
-// of the matches and the number of characters before the cursor position that should
+// CompletionMatch is one of the auto-complete suggestions returned by Client.Complete.
+type CompletionMatch struct {
+	// Text to insert, replacing the characters before the cursor, see Client.Complete.
+	Text string
+
+	// Kind of the suggestion in lower case (e.g.: "function", "variable", "module"), or empty if not known.
+	Kind string
+
+	// Detail is usually the type or the signature of the suggestion (e.g.: `func(a ...any) (n int, err error)`).
+	Detail string
+
+	// Documentation of the suggestion, if available.
+	Documentation string
+}
+
+// Complete request auto-complete suggestions from `gopls`. It returns the
+// matches and the number of characters before the cursor position that should
 // be replaced by the matches (the same value for every entry).
-func (c *Client) Complete(ctx context.Context, filePath string, line, col int) (matches []string, replaceLength int, err error) {
+func (c *Client) Complete(ctx context.Context, filePath string, line, col int) (matches []CompletionMatch, replaceLength int, err error) {
 	klog.V(2).Infof("goplsclient.Complete(ctx, %s, %d, %d)", filePath, line, col)
 	err = c.NotifyDidOpenOrChange(ctx, filePath)
 	if err != nil {
@@ -180,7 +196,15 @@ func (c *Client) Complete(ctx context.Context, filePath string, line, col int) (
 			continue
 		}
 		replaceLength = newReplaceLength
-		matches = append(matches, edit.NewText)
+		match := CompletionMatch{
+			Text:          edit.NewText,
+			Detail:        item.Detail,
+			Documentation: documentationText(item.Documentation),
+		}
+		if item.Kind != 0 {
+			match.Kind = strings.ToLower(item.Kind.String())
+		}
+		matches = append(matches, match)
 	}
 	if len(items.Items) != len(matches) {
 		klog.Infof("Complete found %d items, used only %d", len(items.Items), len(matches))
@@ -188,6 +212,26 @@ func (c *Client) Complete(ctx context.Context, filePath string, line, col int) (
 	return
 }
 
+// documentationText returns the text of the documentation of a completion item, which can either be a
+// string or a `MarkupContent` (decoded as a map, or as lsp.MarkupContent).
+func documentationText(documentation any) string {
+	switch doc := documentation.(type) {
+	case string:
+		return doc
+	case lsp.MarkupContent:
+		return doc.Value
+	case *lsp.MarkupContent:
+		if doc != nil {
+			return doc.Value
+		}
+	case map[string]any:
+		if value, ok := doc["value"].(string); ok {
+			return value
+		}
+	}
+	return ""
+}
+
 // Span returns the text spanning the given location (`lsp.Location` represents a range).
 func (c *Client) Span(loc lsp.Location) (string, error) {
 	fileData, _, err := c.FileData(loc.URI.Filename())
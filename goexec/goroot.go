@@ -0,0 +1,303 @@
+package goexec
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/janpfeifer/gonb/goexec/goplsclient"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// This file implements the selection of the Go toolchain used to compile and run the cells.
+
+// GoBinary returns the `go` binary used for all `go` commands (`go build`, `go get`, `go mod init`, etc.):
+// the one given by the environment variable GONB_GO_BIN, or the one in GONB_GOROOT, or otherwise
+// simply `go` from the PATH.
+func GoBinary() string {
+	if goBin := os.Getenv(protocol.GONB_GO_BIN_ENV); goBin != "" {
+		return goBin
+	}
+	if goRoot := os.Getenv(protocol.GONB_GOROOT_ENV); goRoot != "" {
+		return filepath.Join(goRoot, "bin", "go")
+	}
+	return "go"
+}
+
+// GoRoot returns the GOROOT of the Go toolchain returned by GoBinary, as reported by `go env GOROOT`.
+func GoRoot() (string, error) {
+	cmd := exec.Command(GoBinary(), "env", "GOROOT")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// GoVersion returns the output of `go version` for the Go toolchain returned by GoBinary.
+func GoVersion() (string, error) {
+	cmd := exec.Command(GoBinary(), "version")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// GoBinDir returns the directory where `go install` installs binaries: GOBIN if set, otherwise the `bin`
+// subdirectory of the first entry of GOPATH, as reported by the Go toolchain returned by GoBinary.
+func GoBinDir() (string, error) {
+	cmd := exec.Command(GoBinary(), "env", "GOBIN", "GOPATH")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	lines := strings.Split(string(output), "\n")
+	if goBin := strings.TrimSpace(lines[0]); goBin != "" {
+		return goBin, nil
+	}
+	var goPath string
+	if len(lines) > 1 {
+		if list := filepath.SplitList(strings.TrimSpace(lines[1])); len(list) > 0 {
+			goPath = strings.TrimSpace(list[0])
+		}
+	}
+	if goPath == "" {
+		return "", errors.Errorf("neither GOBIN nor GOPATH are set (`%s`)", cmd.String())
+	}
+	return filepath.Join(goPath, "bin"), nil
+}
+
+// reMajorVersionSuffix matches the major version suffix of a module path (e.g.: "v2").
+var reMajorVersionSuffix = regexp.MustCompile(`^v[0-9]+$`)
+
+// InstalledBinaryName returns the name of the binary installed by `go install <pkg>[@<version>]`: the last
+// element of the package path, skipping a major version suffix (e.g.: "v2"), plus ".exe" on Windows.
+func InstalledBinaryName(pkg string) string {
+	pkg, _, _ = strings.Cut(pkg, "@")
+	pkg = strings.TrimSuffix(pkg, "/")
+	name := path.Base(pkg)
+	if reMajorVersionSuffix.MatchString(name) && path.Dir(pkg) != "." {
+		name = path.Base(path.Dir(pkg))
+	}
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// GoInstall runs `go install` for each of the packages (usually in the form `<pkg>@<version>`), streaming
+// its output to the cell, and returns the paths of the installed binaries, see GoBinDir.
+func (s *State) GoInstall(msg kernel.Message, packages []string) (binPaths []string, err error) {
+	binDir, err := GoBinDir()
+	if err != nil {
+		return nil, err
+	}
+	if err = s.pipeGoCommand(msg, append([]string{"install"}, packages...)...); err != nil {
+		return nil, err
+	}
+	for _, pkg := range packages {
+		binPaths = append(binPaths, filepath.Join(binDir, InstalledBinaryName(pkg)))
+	}
+	return binPaths, nil
+}
+
+// ModVerify runs `go mod verify` in the temporary directory, streaming its output to the cell, to check that
+// the dependencies of the notebook's module in the module cache were not modified since downloaded.
+//
+// It returns an error if the verification fails.
+func (s *State) ModVerify(msg kernel.Message) error {
+	return s.pipeGoCommand(msg, "mod", "verify")
+}
+
+// ModWhy runs `go mod why` with the given arguments (packages, or modules with `-m`) in the temporary directory,
+// streaming its output to the cell, to explain why the packages are needed by the memorized imports.
+func (s *State) ModWhy(msg kernel.Message, args []string) error {
+	// `go mod why` analyzes the imports of the packages of the module, so main.go needs the memorized imports.
+	if _, _, err := s.createMainFileFromDecls(s.Definitions, nil); err != nil {
+		return errors.WithMessagef(err, "while composing main.go with all declarations")
+	}
+	return s.pipeGoCommand(msg, append([]string{"mod", "why"}, args...)...)
+}
+
+// pipeGoCommand runs the Go toolchain (see GoBinary) with the given arguments in the temporary directory,
+// and the environment returned by GoCommandEnv, streaming its output to the cell. It returns an error if it
+// fails to execute or exits with a non-zero code.
+func (s *State) pipeGoCommand(msg kernel.Message, args ...string) error {
+	builder := kernel.PipeExecToJupyter(msg, GoBinary(), args...).InDir(s.TempDir).
+		WithEnv(s.GoCommandEnv()).WithContext(kernel.InterruptContext(msg))
+	if err := builder.Exec(); err != nil {
+		return err
+	}
+	if exitCode := builder.ExitCode(); exitCode != 0 {
+		return errors.Errorf("`go %s` failed with exit code %d", strings.Join(args, " "), exitCode)
+	}
+	return nil
+}
+
+// goCommand returns a command to run the Go toolchain (see GoBinary) with the given arguments in
+// State.TempDir, and the environment returned by GoCommandEnv.
+func (s *State) goCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(GoBinary(), args...)
+	cmd.Dir = s.TempDir
+	cmd.Env = s.GoCommandEnv()
+	return cmd
+}
+
+// GoCommandEnv returns the environment, as "KEY=value" entries, passed to the Go toolchain subprocesses:
+// the environment of the kernel, with CGO_ENABLED overridden by State.CgoEnabled, if set, or set to 1 for cgo
+// cells (see State.CellIsCgo).
+func (s *State) GoCommandEnv() []string {
+	env := os.Environ()
+	cgoEnabled := s.CgoEnabled
+	if s.CellIsCgo || (s.Definitions != nil && s.Definitions.Imports["C"] != nil) {
+		cgoEnabled = "1"
+	}
+	if cgoEnabled == "" {
+		return env
+	}
+	filtered := env[:0]
+	for _, keyValue := range env {
+		if !strings.HasPrefix(keyValue, "CGO_ENABLED=") {
+			filtered = append(filtered, keyValue)
+		}
+	}
+	return append(filtered, "CGO_ENABLED="+cgoEnabled)
+}
+
+// GoEnv returns the values of the given Go environment variables (e.g.: GOPATH, GOMODCACHE) as seen by the
+// Go toolchain subprocesses, as reported by `go env`. It includes the defaults of the variables not set in
+// the environment.
+func (s *State) GoEnv(names ...string) (map[string]string, error) {
+	cmd := s.goCommand(append([]string{"env", "-json"}, names...)...)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	values := make(map[string]string, len(names))
+	if err = json.Unmarshal(output, &values); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse the output of %q", cmd.String())
+	}
+	return values, nil
+}
+
+// CgoEffective returns the effective value of CGO_ENABLED ("1" or "0") used to build the cells: the one
+// set by State.CgoEnabled, or otherwise the Go toolchain's default for the current environment.
+func (s *State) CgoEffective() (string, error) {
+	cmd := s.goCommand("env", "CGO_ENABLED")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// SetGoRoot selects the Go toolchain installed in goRoot to compile and run the cells. It sets
+// GONB_GOROOT (and clears GONB_GO_BIN), and restarts `gopls` so it also uses the new toolchain.
+//
+// It returns an error, and keeps the current toolchain, if goRoot doesn't have a `bin/go` binary.
+func (s *State) SetGoRoot(goRoot string) error {
+	goRoot, err := filepath.Abs(goRoot)
+	if err != nil {
+		return errors.Wrapf(err, "invalid GOROOT %q", goRoot)
+	}
+	if info, err := os.Stat(goRoot); err != nil || !info.IsDir() {
+		return errors.Errorf("GOROOT %q is not a directory", goRoot)
+	}
+	if _, err = exec.LookPath(filepath.Join(goRoot, "bin", "go")); err != nil {
+		return errors.Wrapf(err, "GOROOT %q has no `bin/go` binary", goRoot)
+	}
+	if err = os.Setenv(protocol.GONB_GOROOT_ENV, goRoot); err != nil {
+		return errors.Wrapf(err, "failed to set %s", protocol.GONB_GOROOT_ENV)
+	}
+	if err = os.Unsetenv(protocol.GONB_GO_BIN_ENV); err != nil {
+		return errors.Wrapf(err, "failed to unset %s", protocol.GONB_GO_BIN_ENV)
+	}
+	if err = setGoToolchainEnv(goRoot); err != nil {
+		return err
+	}
+	s.restartGopls()
+	return nil
+}
+
+// applyGoToolchainEnv makes the Go toolchain selected with GONB_GO_BIN or GONB_GOROOT (if any)
+// the default one for other programs, like `gopls`, by setting GOROOT and prepending it to PATH.
+func applyGoToolchainEnv() error {
+	if os.Getenv(protocol.GONB_GO_BIN_ENV) == "" && os.Getenv(protocol.GONB_GOROOT_ENV) == "" {
+		return nil
+	}
+	goRoot, err := GoRoot()
+	if err != nil {
+		return errors.WithMessagef(err, "failed to find GOROOT of the Go toolchain selected with %s or %s",
+			protocol.GONB_GO_BIN_ENV, protocol.GONB_GOROOT_ENV)
+	}
+	return setGoToolchainEnv(goRoot)
+}
+
+// setGoToolchainEnv sets GOROOT to goRoot, and prepends its `bin` directory to PATH.
+func setGoToolchainEnv(goRoot string) error {
+	if err := os.Setenv("GOROOT", goRoot); err != nil {
+		return errors.Wrapf(err, "failed to set GOROOT")
+	}
+	binDir := filepath.Join(goRoot, "bin")
+	pathEnv := os.Getenv("PATH")
+	if pathEnv != binDir && !strings.HasPrefix(pathEnv, binDir+string(os.PathListSeparator)) {
+		pathEnv = binDir + string(os.PathListSeparator) + pathEnv
+	}
+	if err := os.Setenv("PATH", pathEnv); err != nil {
+		return errors.Wrapf(err, "failed to set PATH")
+	}
+	klog.V(1).Infof("Using Go toolchain in %q", goRoot)
+	return nil
+}
+
+// RestartGopls stops `gopls` and closes the connection to it, if it is running, and starts a new one,
+// waiting for the new connection. Use it if `gopls` stops responding (e.g.: auto-complete no longer works).
+//
+// It returns an error if `gopls` is not installed, or if it fails to start or to connect.
+func (s *State) RestartGopls() error {
+	if s.gopls != nil {
+		s.gopls.Shutdown()
+		s.gopls = nil
+	}
+	if _, err := exec.LookPath("gopls"); err != nil {
+		return errors.Wrapf(err, "`gopls` is not installed, install it with `!go install golang.org/x/tools/gopls@latest`")
+	}
+	s.gopls = goplsclient.New(s.TempDir)
+	if err := s.gopls.Start(); err != nil {
+		return errors.WithMessagef(err, "failed to restart `gopls`")
+	}
+	if !s.gopls.WaitConnection(context.Background()) {
+		return errors.Errorf("`gopls` was restarted, but failed to connect to it in %s", goplsclient.StartTimeout)
+	}
+	return nil
+}
+
+// GoplsStatus returns the status of `gopls`, or nil if it is not being used (e.g.: if it is not installed).
+func (s *State) GoplsStatus() *goplsclient.Status {
+	if s.gopls == nil {
+		return nil
+	}
+	status := s.gopls.Status()
+	return &status
+}
+
+// restartGopls stops `gopls`, if it is running, and starts a new one.
+func (s *State) restartGopls() {
+	if s.gopls == nil {
+		return
+	}
+	s.gopls.Shutdown()
+	s.gopls = goplsclient.New(s.TempDir)
+	if err := s.gopls.Start(); err != nil {
+		klog.Errorf("Failed to restart `gopls`: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package goexec
+
+import (
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os/exec"
+)
+
+// This file implements the optional `go vet` of the cells, see `%govet`.
+
+// Vet runs `go vet` on the currently generated go files in State.TempDir, if State.GoVet is set.
+// It should be called after a successful compilation.
+//
+// Warnings are published to the cell's stderr, with the references to main.go mapped to the
+// corresponding cell lines with fileToCellIdAndLine. Warnings only return an error (and hence block
+// the execution of the cell) if State.GoVetStrict is set.
+func (s *State) Vet(msg kernel.Message, fileToCellIdAndLine []CellIdAndLine) error {
+	if !s.GoVet {
+		return nil
+	}
+	args := append([]string{"vet"}, s.BuildFlags()...)
+	cmd := s.goCommand(args...)
+	output, err := cmd.CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	if _, isExitErr := err.(*exec.ExitError); !isExitErr {
+		return errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	if msg != nil {
+		w := newJupyterStackTraceMapperWriter(msg, "stderr", "main.go", fileToCellIdAndLine)
+		if _, writeErr := w.Write(output); writeErr != nil {
+			klog.Errorf("Failed to publish `go vet` warnings: %+v", writeErr)
+		}
+	} else {
+		klog.Infof("`go vet` warnings:\n%s", output)
+	}
+	if s.GoVetStrict {
+		return errors.Errorf("`go vet` reported issues, and `%%govet --strict` is set")
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package goexec
+
+import (
+	"fmt"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+)
+
+// This file implements the history of the cells that produced definitions, used by `%replay` to rebuild
+// the memorized definitions, e.g. after a `%reset`.
+
+// MaxHistory is the maximum number of cells kept in State.History: older cells are dropped.
+const MaxHistory = 1000
+
+// HistoryCell is a cell successfully compiled that produced definitions (functions, types, variables, etc.),
+// recorded in State.History.
+type HistoryCell struct {
+	// Id is the execution id of the cell.
+	Id int
+
+	// Lines of the cell, including the lines loaded with `%load`, and SkipLines are the ones that are not
+	// Go code (the special commands).
+	Lines     []string
+	SkipLines Set[int]
+}
+
+// recordHistory appends the cell to State.History, if it produced any of the memorized definitions.
+func (s *State) recordHistory(cellId int, lines []string, skipLines Set[int]) {
+	if !hasDefinitionsFromCell(s.Definitions, cellId) {
+		return
+	}
+	cell := HistoryCell{Id: cellId, Lines: lines, SkipLines: MakeSet[int](len(skipLines))}
+	for lineNum := range skipLines {
+		cell.SkipLines.Insert(lineNum)
+	}
+	s.History = append(s.History, cell)
+	if len(s.History) > MaxHistory {
+		s.History = s.History[len(s.History)-MaxHistory:]
+	}
+}
+
+// hasDefinitionsFromCell returns whether any of the declarations in decls was defined in the cell cellId.
+func hasDefinitionsFromCell(decls *Declarations, cellId int) bool {
+	return anyFromCell(decls.Functions, cellId) || anyFromCell(decls.Variables, cellId) ||
+		anyFromCell(decls.Types, cellId) || anyFromCell(decls.Imports, cellId) ||
+		anyFromCell(decls.Constants, cellId)
+}
+
+// anyFromCell returns whether any of the values of m was defined in the cell cellId.
+func anyFromCell[K comparable, V interface{ cellId() int }](m map[K]V, cellId int) bool {
+	for _, v := range m {
+		if v.cellId() == cellId {
+			return true
+		}
+	}
+	return false
+}
+
+// cellId returns the id of the cell where the declaration was defined.
+func (c CellLines) cellId() int { return c.Id }
+
+// ReplayCell re-compiles the cell from the History, and memorizes its definitions, as if it had been executed
+// again -- but its `func main()`, if any, is not executed.
+func (s *State) ReplayCell(msg kernel.Message, cell HistoryCell) error {
+	s.InvalidateQueryCache()
+	updatedDecls, mainDecl, _, fileToCellIdAndLine, err := s.parseLinesAndComposeMain(
+		msg, cell.Id, cell.Lines, cell.SkipLines, NoCursor)
+	if err != nil {
+		return errors.WithMessagef(err, "in goexec.ReplayCell()")
+	}
+	_, fileToCellIdAndLine, err = s.GoImports(msg, updatedDecls, mainDecl, fileToCellIdAndLine)
+	if err != nil {
+		return errors.WithMessagef(err, "goimports failed")
+	}
+	if err = s.Compile(msg, fileToCellIdAndLine); err != nil {
+		return err
+	}
+	s.Definitions = updatedDecls
+	return nil
+}
+
+// String implements fmt.Stringer, with the cell id as displayed by Jupyter.
+func (c HistoryCell) String() string {
+	return fmt.Sprintf("Cell [%d]", c.Id)
+}
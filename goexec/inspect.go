@@ -3,6 +3,7 @@ package goexec
 import (
 	"context"
 	"github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/goexec/goplsclient"
 	"github.com/janpfeifer/gonb/gonbui/protocol"
 	"github.com/janpfeifer/gonb/kernel"
 	"github.com/pkg/errors"
@@ -53,6 +54,18 @@ func (s *State) InspectIdentifierInCell(lines []string, skipLines map[int]struct
 		return
 	}
 
+	// Reuse the result of an identical request made just before, see QueryCacheTTL.
+	cacheKey := queryCacheKey(lines, skipLines, cursorLine, cursorCol)
+	if cached, found := s.queryCache.get(inspectQueryKind, cacheKey); found {
+		klog.V(2).Infof("InspectIdentifierInCell: reusing cached result")
+		return cached.(kernel.MIMEMap), nil
+	}
+	defer func() {
+		if err == nil {
+			s.queryCache.set(inspectQueryKind, cacheKey, mimeMap)
+		}
+	}()
+
 	// Runs AutoTrack: makes sure redirects in go.mod and use clauses in go.work are tracked.
 	err = s.AutoTrack()
 	if err != nil {
@@ -118,6 +131,11 @@ func (s *State) InspectIdentifierInCell(lines []string, skipLines map[int]struct
 		return kernel.MIMEMap{protocol.MIMETextPlain: strings.Join(parts, "\n\n")}, nil
 	}
 
+	if strings.TrimSpace(desc) == "" {
+		// No identifier under the cursor: an empty MIMEMap is reported as "not found".
+		return make(kernel.MIMEMap), nil
+	}
+
 	// Return MIMEMap with markdown.
 	mimeMap = kernel.MIMEMap{protocol.MIMETextMarkdown: desc}
 	return
@@ -137,6 +155,51 @@ func (s *State) AutoCompleteOptionsInCell(cellLines []string, skipLines map[int]
 		return
 	}
 
+	// Reuse the result of an identical request made just before, see QueryCacheTTL.
+	cacheKey := queryCacheKey(cellLines, skipLines, cursorLine, cursorCol)
+	var result completeResult
+	if cached, found := s.queryCache.get(completeQueryKind, cacheKey); found {
+		klog.V(2).Infof("AutoCompleteOptionsInCell: reusing cached result")
+		result = cached.(completeResult)
+	} else {
+		result, err = s.completeWithGopls(cellLines, skipLines, cursorLine, cursorCol)
+		if err != nil {
+			return
+		}
+		s.queryCache.set(completeQueryKind, cacheKey, result)
+	}
+
+	if result.replaceLength > 0 {
+		replaceStr := cellLines[cursorLine][cursorCol-result.replaceLength : cursorCol]
+		replaceLengthUTF16 := len(utf16.Encode([]rune(replaceStr)))
+		reply.CursorStart -= replaceLengthUTF16
+	}
+	if len(result.matches) > 0 {
+		reply.Matches = make([]string, 0, len(result.matches))
+		for _, match := range result.matches {
+			reply.Matches = append(reply.Matches, match.Text)
+		}
+		reply.Metadata[JupyterTypesMetadataKey] = completionTypesMetadata(result.matches, reply.CursorStart, reply.CursorEnd)
+	}
+	return
+}
+
+// Kinds of requests cached in State.queryCache.
+const (
+	inspectQueryKind  = "inspect"
+	completeQueryKind = "complete"
+)
+
+// completeResult is the result of auto-complete by `gopls`, cached in State.queryCache.
+type completeResult struct {
+	matches       []goplsclient.CompletionMatch
+	replaceLength int
+}
+
+// completeWithGopls updates `main.go` (and maybe `other.go`) with the contents of the cell, and queries `gopls`
+// for the auto-complete options at the cursor. It is used by AutoCompleteOptionsInCell.
+func (s *State) completeWithGopls(cellLines []string, skipLines map[int]struct{}, cursorLine, cursorCol int) (
+	result completeResult, err error) {
 	// Runs AutoTrack: makes sure redirects in go.mod and use clauses in go.work are tracked.
 	err = s.AutoTrack()
 	if err != nil {
@@ -184,25 +247,41 @@ func (s *State) AutoCompleteOptionsInCell(cellLines []string, skipLines map[int]
 	if err != nil {
 		return
 	}
-	_ = cursorInFile
-	var matches []string
-	var replaceLength int
-	matches, replaceLength, err = s.gopls.Complete(ctx, s.MainPath(), cursorInFile.Line, cursorInFile.Col)
+	result.matches, result.replaceLength, err = s.gopls.Complete(ctx, s.MainPath(), cursorInFile.Line, cursorInFile.Col)
 	if err != nil {
 		err = errors.Cause(err)
 		return
 	}
-	if replaceLength > 0 {
-		replaceStr := cellLines[cursorLine][cursorCol-replaceLength : cursorCol]
-		replaceLengthUTF16 := len(utf16.Encode([]rune(replaceStr)))
-		reply.CursorStart -= replaceLengthUTF16
-	}
-	if len(matches) > 0 {
-		reply.Matches = matches
-	}
 	return
 }
 
+// JupyterTypesMetadataKey is the key in the metadata of a `complete_reply` with the type, signature and
+// documentation of each match, used by JupyterLab to display them alongside the suggestions.
+const JupyterTypesMetadataKey = "_jupyter_types_experimental"
+
+// completionTypesMetadata returns the metadata of the auto-complete matches, to be included under
+// JupyterTypesMetadataKey: one entry per match, in the same order, replacing the text from start to end
+// (cursor positions in UTF-16 units, as in the `complete_reply`).
+func completionTypesMetadata(matches []goplsclient.CompletionMatch, start, end int) []map[string]any {
+	metadata := make([]map[string]any, 0, len(matches))
+	for _, match := range matches {
+		entry := map[string]any{
+			"start": start,
+			"end":   end,
+			"text":  match.Text,
+			"type":  match.Kind,
+		}
+		if match.Detail != "" {
+			entry["signature"] = match.Detail
+		}
+		if match.Documentation != "" {
+			entry["documentation"] = match.Documentation
+		}
+		metadata = append(metadata, entry)
+	}
+	return metadata
+}
+
 // runeIndicesForLine returns the start of each rune in the line (encoded as UTF-8).
 func runeIndicesForLine(line string, col int) (runeIndices []int, colIdx int) {
 	runeIndices = make([]int, 0, len(line))
@@ -124,7 +124,8 @@ func (s *State) parseFromMainGo(msg kernel.Message, cellId int, cursor Cursor, f
 		fileToCellIdAndLine: fileToCellIdAndLine,
 	}
 	var packages map[string]*ast.Package
-	packages, err = parser.ParseDir(pi.fileSet, s.TempDir, nil, parser.SkipObjectResolution) // |parser.AllErrors
+	// Comments are needed for the cgo preamble, see ParseCgoPreamble.
+	packages, err = parser.ParseDir(pi.fileSet, s.TempDir, nil, parser.SkipObjectResolution|parser.ParseComments) // |parser.AllErrors
 	if err != nil {
 		if msg != nil {
 			s.DisplayErrorWithContext(msg, fileToCellIdAndLine, err.Error())
@@ -165,7 +166,8 @@ func (s *State) parseFromMainGo(msg kernel.Message, cellId int, cursor Cursor, f
 					pi.ParseFuncEntry(decls, typedDecl)
 				case *ast.GenDecl:
 					if typedDecl.Tok == token.IMPORT {
-						// Imports are handled above.
+						// Imports are handled above, except for the cgo preamble.
+						pi.ParseCgoPreamble(decls, typedDecl)
 						continue
 					} else if typedDecl.Tok == token.VAR {
 						pi.ParseVarEntry(decls, typedDecl)
@@ -227,6 +229,29 @@ func (pi *parseInfo) ParseImportEntry(decls *Declarations, entry *ast.ImportSpec
 	decls.Imports[importEntry.Key] = importEntry
 }
 
+// ParseCgoPreamble registers the comment preceding `import "C"`, if any, in the "C" import entry. This comment
+// holds the C code used by cgo. See State.parseFromMainGo.
+func (pi *parseInfo) ParseCgoPreamble(decls *Declarations, genDecl *ast.GenDecl) {
+	for _, spec := range genDecl.Specs {
+		importSpec, ok := spec.(*ast.ImportSpec)
+		if !ok || importSpec.Path.Value != `"C"` {
+			continue
+		}
+		// Same rules as cgo: the comment of the import spec, or of the declaration if it has only one spec.
+		doc := importSpec.Doc
+		if doc == nil && len(genDecl.Specs) == 1 {
+			doc = genDecl.Doc
+		}
+		importEntry, found := decls.Imports["C"]
+		if doc == nil || !found {
+			return
+		}
+		importEntry.CgoPreamble = pi.extractContentOfNode(doc)
+		importEntry.CgoPreambleLines = pi.calculateCellLines(doc)
+		return
+	}
+}
+
 // ParseFuncEntry registers a new `func` declaration based on the ast.FuncDecl. See State.parseFromMainGo
 func (pi *parseInfo) ParseFuncEntry(decls *Declarations, funcDecl *ast.FuncDecl) {
 	// Incorporate functions.
@@ -406,6 +431,9 @@ func (s *State) parseLinesAndComposeMain(msg kernel.Message, cellId int, lines [
 		// Remove "main" from newDecls: this should not be stored from one cell execution from
 		// another.
 		delete(newDecls.Functions, "main")
+		if s.CellMainAppend && s.LastMain != nil && isMainFromCell(mainDecl) {
+			mainDecl = appendMain(s.LastMain, mainDecl)
+		}
 	} else {
 		// Declare a stub main function, just so we can try to compile the final code.
 		mainDecl = &Function{
@@ -12,7 +12,7 @@ import (
 )
 
 // newEmptyState returns an empty state with a temporary directory created.
-func newEmptyState(t *testing.T) *State {
+func newEmptyState(t testing.TB) *State {
 	uuidTmp, _ := uuid.NewV7()
 	uuidStr := uuidTmp.String()
 	uniqueID := uuidStr[len(uuidStr)-8:]
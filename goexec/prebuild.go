@@ -0,0 +1,55 @@
+package goexec
+
+import (
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+)
+
+// This file implements running code generators and other commands before the cells are compiled, see
+// `%generate` and `%prebuild`.
+
+// PreBuildCommand is a command run before each compilation of the cells, registered with `%prebuild`.
+type PreBuildCommand struct {
+	// Command as given by the user, used to display it.
+	Command string
+
+	// Args are the program to execute and its arguments (e.g.: `/bin/bash -c <Command>`).
+	Args []string
+
+	// Dir where to run the command, or "" for the current directory.
+	Dir string
+}
+
+// runPreBuild runs `go generate ./...` in each of State.CellGenerateDirs, and then each of
+// State.PreBuildCommands, in order, streaming their output to the cell. It is called by ExecuteCell
+// after the Go files are written, and before they are compiled.
+//
+// It returns an error, and the cell is not compiled, if any of the commands fails.
+func (s *State) runPreBuild(msg kernel.Message) error {
+	for _, dir := range s.CellGenerateDirs {
+		args := append(append([]string{"generate"}, s.BuildFlags()...), "./...")
+		if err := s.execPreBuild(msg, "go generate ./...", append([]string{GoBinary()}, args...), dir); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range s.PreBuildCommands {
+		if err := s.execPreBuild(msg, cmd.Command, cmd.Args, cmd.Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// execPreBuild executes one of the commands of runPreBuild.
+func (s *State) execPreBuild(msg kernel.Message, command string, args []string, dir string) error {
+	builder := kernel.PipeExecToJupyter(msg, args[0], args[1:]...).InDir(dir).
+		WithContext(kernel.InterruptContext(msg)).
+		WithTimeout(s.CellTimeout)
+	if err := builder.Exec(); err != nil {
+		return errors.WithMessagef(err, "pre-build command %q failed", command)
+	}
+	if exitCode := builder.ExitCode(); exitCode != 0 {
+		return errors.Errorf("pre-build command %q failed with exit code %d, cell not compiled", command, exitCode)
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package goexec
+
+import (
+	"fmt"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"path"
+	"strings"
+)
+
+// This file implements the code generation for `%%profile`, which runs the cell's `func main()` under `pprof`.
+
+// Profile configures the profiling of a cell, see State.CellProfile.
+type Profile struct {
+	// Kind of profile: ProfileCPU or ProfileMem.
+	Kind string
+
+	// TopN is the number of entries of the summary (`go tool pprof -top`) reported after the execution.
+	TopN int
+}
+
+const (
+	// ProfileCPU is the Profile.Kind for CPU profiling.
+	ProfileCPU = "cpu"
+
+	// ProfileMem is the Profile.Kind for memory (heap allocations) profiling.
+	ProfileMem = "mem"
+
+	// DefaultProfileTopN is the default number of entries of the `%%profile` summary.
+	DefaultProfileTopN = 20
+)
+
+const (
+	// profileBodyFunc is the name given to the cell's `func main()`, when it is profiled.
+	profileBodyFunc = "gonbProfileBody"
+
+	// profileOsAlias, profileRuntimeAlias and profilePprofAlias are the aliases of the packages used by the
+	// generated `func main()`, chosen not to conflict with the user's imports.
+	profileOsAlias      = "gonbProfileOs"
+	profileRuntimeAlias = "gonbProfileRuntime"
+	profilePprofAlias   = "gonbProfilePprof"
+)
+
+// profileMainTemplates are the `func main()` generated to profile the cell's code, per kind of profile. They
+// take as parameter the path of the profile file.
+var profileMainTemplates = map[string]string{
+	ProfileCPU: `
+func main() {
+	f, err := OS.Create(%q)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := PPROF.StartCPUProfile(f); err != nil {
+		panic(err)
+	}
+	defer PPROF.StopCPUProfile()
+	BODY()
+}
+`,
+	ProfileMem: `
+func main() {
+	RUNTIME.MemProfileRate = 4096
+	BODY()
+	RUNTIME.GC()
+	f, err := OS.Create(%q)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	if err := PPROF.WriteHeapProfile(f); err != nil {
+		panic(err)
+	}
+}
+`,
+}
+
+// ProfilePath is the path to the profile file written by the cell being profiled, see State.CellProfile.
+func (s *State) ProfilePath() string {
+	return path.Join(s.TempDir, s.CellProfile.Kind+".pprof")
+}
+
+// profileDecls returns a copy of decls with the imports required by the profiling `func main()` for the
+// kind of profile.
+func profileDecls(decls *Declarations, kind string) *Declarations {
+	decls = decls.Copy()
+	imports := []*Import{NewImport("os", profileOsAlias), NewImport("runtime/pprof", profilePprofAlias)}
+	if kind == ProfileMem {
+		imports = append(imports, NewImport("runtime", profileRuntimeAlias))
+	}
+	for _, imp := range imports {
+		imp.Cursor = NoCursor
+		decls.Imports[imp.Key] = imp
+	}
+	return decls
+}
+
+// renderProfileMain writes the cell's main function renamed to profileBodyFunc, followed by the
+// `func main()` that profiles it.
+func (s *State) renderProfileMain(w *WriterWithCursor, mainDef string) {
+	w.Writef("%s\n", strings.Replace(mainDef, "func main()", "func "+profileBodyFunc+"()", 1))
+	template := strings.NewReplacer("OS", profileOsAlias, "RUNTIME", profileRuntimeAlias,
+		"PPROF", profilePprofAlias, "BODY", profileBodyFunc).Replace(profileMainTemplates[s.CellProfile.Kind])
+	w.Writef(template, s.ProfilePath())
+}
+
+// ProfileReport returns the summary of the profile written by the last execution of a profiled cell, as
+// reported by `go tool pprof -top`.
+func (s *State) ProfileReport() (string, error) {
+	args := []string{"tool", "pprof", "-top", fmt.Sprintf("-nodecount=%d", s.CellProfile.TopN)}
+	if s.CellProfile.Kind == ProfileMem {
+		args = append(args, "-sample_index=alloc_space")
+	}
+	args = append(args, s.BinaryPath(), s.ProfilePath())
+	cmd := s.goCommand(args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to run %q: %s", cmd.String(), output)
+	}
+	return string(output), nil
+}
+
+// publishProfile reports the path of the profile file and its summary in the cell's stdout.
+func (s *State) publishProfile(msg kernel.Message) {
+	report, err := s.ProfileReport()
+	if err != nil {
+		klog.Errorf("Failed to generate profile report: %+v", err)
+		report = fmt.Sprintf("Failed to generate profile report: %v\n", err)
+	}
+	content := fmt.Sprintf("%s profile saved in %s\n%s", strings.ToUpper(s.CellProfile.Kind), s.ProfilePath(), report)
+	if err = kernel.PublishWriteStream(msg, kernel.StreamStdout, content); err != nil {
+		klog.Errorf("Failed to publish profile report: %+v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package goexec
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	. "github.com/janpfeifer/gonb/common"
+	"sync"
+	"time"
+)
+
+// This file implements a short-lived cache of the results of `inspect_request` and `complete_request`, so
+// repeated identical requests (e.g.: when typing quickly) don't regenerate `main.go` and query `gopls` again.
+
+// QueryCacheTTL is for how long the results of an inspect or auto-complete request are reused for identical
+// requests, that is, for the same cell contents and cursor position.
+var QueryCacheTTL = 500 * time.Millisecond
+
+// queryCache holds the result of the last request of each kind (inspect or auto-complete). It is safe for
+// concurrent use.
+type queryCache struct {
+	mu      sync.Mutex
+	entries map[string]queryCacheEntry // Kind of request to its last result.
+}
+
+type queryCacheEntry struct {
+	key     string
+	created time.Time
+	value   any
+}
+
+// queryCacheKey returns the key for a request on the cell contents and cursor given. Special command lines
+// (skipLines) are included since they change the generated `main.go`.
+func queryCacheKey(lines []string, skipLines Set[int], cursorLine, cursorCol int) string {
+	h := sha256.New()
+	var buf [8]byte
+	writeInt := func(v int) {
+		binary.LittleEndian.PutUint64(buf[:], uint64(v))
+		h.Write(buf[:])
+	}
+	writeInt(cursorLine)
+	writeInt(cursorCol)
+	writeInt(len(lines))
+	for ii, line := range lines {
+		if skipLines.Has(ii) {
+			writeInt(-1)
+		} else {
+			writeInt(len(line))
+		}
+		h.Write([]byte(line))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// get returns the cached value for the kind of request and key, if it was stored less than QueryCacheTTL ago.
+func (c *queryCache) get(kind, key string) (value any, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[kind]
+	if !found || entry.key != key || time.Since(entry.created) > QueryCacheTTL {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// set stores the value for the kind of request and key, replacing the previous one of the same kind.
+func (c *queryCache) set(kind, key string, value any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]queryCacheEntry)
+	}
+	c.entries[kind] = queryCacheEntry{key: key, created: time.Now(), value: value}
+}
+
+// invalidate discards all cached values.
+func (c *queryCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// InvalidateQueryCache discards the cached results of inspect and auto-complete requests. It should be called
+// whenever something that affects them changes, e.g.: the memorized declarations or `go.mod`.
+//
+// ExecuteCell and Reset call it automatically.
+func (s *State) InvalidateQueryCache() {
+	s.queryCache.invalidate()
+}
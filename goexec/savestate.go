@@ -0,0 +1,192 @@
+package goexec
+
+import (
+	"encoding/json"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os"
+	"path"
+	"regexp"
+)
+
+// This file implements saving and loading of the memorized declarations and of `go.mod`, so
+// work can be resumed after a kernel restart. See `%savestate` and `%loadstate`.
+
+// SavedStateVersion is the version of the format written by SaveState. It should be incremented
+// whenever the format changes, and LoadState should migrate files from older versions.
+const SavedStateVersion = 1
+
+// savedState is the contents of the file written by SaveState, in JSON.
+type savedState struct {
+	Version int    `json:"version"`
+	GoMod   string `json:"go_mod"`
+	GoSum   string `json:"go_sum,omitempty"`
+
+	Imports   []savedImport   `json:"imports,omitempty"`
+	Functions []savedFunction `json:"functions,omitempty"`
+	Variables []savedVariable `json:"variables,omitempty"`
+	Types     []savedType     `json:"types,omitempty"`
+
+	// Constants are saved as blocks, since each constant may depend on the previous one in its block.
+	Constants [][]savedConstant `json:"constants,omitempty"`
+}
+
+type savedImport struct {
+	Key, Path, Alias string
+	CgoPreamble      string `json:",omitempty"`
+}
+
+type savedFunction struct {
+	Key, Name, Receiver, Definition string
+}
+
+type savedVariable struct {
+	Key, Name, TypeDefinition, ValueDefinition string
+}
+
+type savedType struct {
+	Key, TypeDefinition string
+}
+
+type savedConstant struct {
+	Key, TypeDefinition, ValueDefinition string
+}
+
+// SaveState saves the memorized declarations (imports, constants, types, variables and functions) and
+// the `go.mod` (and `go.sum`, if present) of the kernel to filePath, so they can be restored with LoadState.
+func (s *State) SaveState(filePath string) error {
+	saved := &savedState{Version: SavedStateVersion}
+	goMod, err := os.ReadFile(path.Join(s.TempDir, "go.mod"))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read go.mod")
+	}
+	saved.GoMod = string(goMod)
+	goSum, err := os.ReadFile(path.Join(s.TempDir, "go.sum"))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to read go.sum")
+	}
+	saved.GoSum = string(goSum)
+
+	d := s.Definitions
+	for _, key := range SortedKeys(d.Imports) {
+		i := d.Imports[key]
+		saved.Imports = append(saved.Imports, savedImport{Key: i.Key, Path: i.Path, Alias: i.Alias, CgoPreamble: i.CgoPreamble})
+	}
+	for _, key := range SortedKeys(d.Functions) {
+		f := d.Functions[key]
+		saved.Functions = append(saved.Functions,
+			savedFunction{Key: f.Key, Name: f.Name, Receiver: f.Receiver, Definition: f.Definition})
+	}
+	for _, key := range SortedKeys(d.Variables) {
+		v := d.Variables[key]
+		saved.Variables = append(saved.Variables,
+			savedVariable{Key: v.Key, Name: v.Name, TypeDefinition: v.TypeDefinition, ValueDefinition: v.ValueDefinition})
+	}
+	for _, key := range SortedKeys(d.Types) {
+		t := d.Types[key]
+		saved.Types = append(saved.Types, savedType{Key: t.Key, TypeDefinition: t.TypeDefinition})
+	}
+	for _, key := range SortedKeys(d.Constants) {
+		c := d.Constants[key]
+		if c.Prev != nil {
+			// Only start from the first constant of each block.
+			continue
+		}
+		var block []savedConstant
+		for ; c != nil; c = c.Next {
+			block = append(block,
+				savedConstant{Key: c.Key, TypeDefinition: c.TypeDefinition, ValueDefinition: c.ValueDefinition})
+		}
+		saved.Constants = append(saved.Constants, block)
+	}
+
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to serialize state")
+	}
+	if err = os.WriteFile(filePath, content, 0644); err != nil {
+		return errors.Wrapf(err, "failed to write state to %q", filePath)
+	}
+	return nil
+}
+
+// reGoModModule matches the `module` directive of a `go.mod` file.
+var reGoModModule = regexp.MustCompile(`(?m)^module\s+\S+\s*$`)
+
+// LoadState restores the declarations and the `go.mod` saved with SaveState. Loaded declarations
+// are merged into the current ones, replacing those with the same key. The `go.mod` (and `go.sum`)
+// replace the current ones, with the module renamed to the current State.Package.
+func (s *State) LoadState(filePath string) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read state from %q", filePath)
+	}
+	saved := &savedState{}
+	if err = json.Unmarshal(content, saved); err != nil {
+		return errors.Wrapf(err, "failed to parse state in %q", filePath)
+	}
+	switch {
+	case saved.Version <= 0:
+		return errors.Errorf("state in %q has no valid version, is it a file saved with `%%savestate`?", filePath)
+	case saved.Version > SavedStateVersion:
+		return errors.Errorf("state in %q has version %d, but this version of GoNB only supports up to version %d",
+			filePath, saved.Version, SavedStateVersion)
+	}
+	// Migrations from older versions go here, once there are any.
+
+	goMod := reGoModModule.ReplaceAllString(saved.GoMod, "module "+s.Package)
+	if err = os.WriteFile(path.Join(s.TempDir, "go.mod"), []byte(goMod), 0644); err != nil {
+		return errors.Wrapf(err, "failed to restore go.mod")
+	}
+	goSumPath := path.Join(s.TempDir, "go.sum")
+	if saved.GoSum != "" {
+		err = os.WriteFile(goSumPath, []byte(saved.GoSum), 0644)
+	} else {
+		err = os.Remove(goSumPath)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to restore go.sum")
+	}
+
+	d := NewDeclarations()
+	noCellLines := CellLines{Id: NoCursorLine}
+	for _, i := range saved.Imports {
+		d.Imports[i.Key] = &Import{Cursor: NoCursor, CellLines: noCellLines, Key: i.Key, Path: i.Path, Alias: i.Alias,
+			CgoPreamble: i.CgoPreamble, CgoPreambleLines: noCellLines}
+	}
+	for _, f := range saved.Functions {
+		d.Functions[f.Key] = &Function{Cursor: NoCursor, CellLines: noCellLines,
+			Key: f.Key, Name: f.Name, Receiver: f.Receiver, Definition: f.Definition}
+	}
+	for _, v := range saved.Variables {
+		d.Variables[v.Key] = &Variable{Cursor: NoCursor, CellLines: noCellLines,
+			Key: v.Key, Name: v.Name, TypeDefinition: v.TypeDefinition, ValueDefinition: v.ValueDefinition}
+	}
+	for _, t := range saved.Types {
+		d.Types[t.Key] = &TypeDecl{Cursor: NoCursor, CellLines: noCellLines, Key: t.Key, TypeDefinition: t.TypeDefinition}
+	}
+	for _, block := range saved.Constants {
+		var prev *Constant
+		for _, sc := range block {
+			c := &Constant{Cursor: NoCursor, CellLines: noCellLines,
+				Key: sc.Key, TypeDefinition: sc.TypeDefinition, ValueDefinition: sc.ValueDefinition}
+			c.Prev = prev
+			if prev != nil {
+				prev.Next = c
+			}
+			prev = c
+			d.Constants[c.Key] = c
+		}
+	}
+	s.Definitions.MergeFrom(d)
+
+	// The restored go.mod may have `replace` rules to local directories.
+	if err = s.AutoTrack(); err != nil {
+		klog.Errorf("AutoTrack failed after loading state: %+v", err)
+	}
+	return nil
+}
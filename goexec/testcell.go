@@ -0,0 +1,130 @@
+package goexec
+
+import (
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// This file implements the execution of cells with `%%test` and `%%benchmark`: the cell's
+// `func TestXxx(t *testing.T)` and `func BenchmarkXxx(b *testing.B)` are compiled with `go test -c`
+// and the resulting test binary is executed.
+
+// testMainFile is the name of the file main.go is renamed to while compiling the tests: `go test`
+// only considers test functions in `_test.go` files.
+const testMainFile = "main_test.go"
+
+// TestMainPath is the path to main.go while it's renamed to compile tests, see CompileTests.
+func (s *State) TestMainPath() string {
+	return path.Join(s.TempDir, testMainFile)
+}
+
+// TestBinaryPath is the path to the test binary generated by CompileTests.
+func (s *State) TestBinaryPath() string {
+	return path.Join(s.TempDir, s.Package+".test")
+}
+
+// executeCellTests compiles and runs the tests of the cell, and memorizes the declarations of the cell,
+// except the test and benchmark functions. It's called by ExecuteCell when State.CellIsTest is set, after main.go
+// is written.
+func (s *State) executeCellTests(msg kernel.Message, cellId int, updatedDecls *Declarations, fileToCellIdAndLine []CellIdAndLine) error {
+	if err := s.CompileTests(msg, fileToCellIdAndLine); err != nil {
+		return err
+	}
+	if err := s.Vet(msg, fileToCellIdAndLine); err != nil {
+		return err
+	}
+
+	// Compilation successful: save merged declarations into current State, except the test and benchmark
+	// functions of the cell, which would otherwise be included in the following cells.
+	for key, funcDecl := range updatedDecls.Functions {
+		if funcDecl.CellLines.Id == cellId && isTestFunction(funcDecl) {
+			delete(updatedDecls.Functions, key)
+		}
+	}
+	s.Definitions = updatedDecls
+	return s.ExecuteTests(msg, fileToCellIdAndLine)
+}
+
+// isTestFunction returns whether funcDecl is a `func TestXxx(...)` or a `func BenchmarkXxx(...)`.
+// Methods have keys formatted as `<type>~<method>`, so they are not included.
+func isTestFunction(funcDecl *Function) bool {
+	return !strings.Contains(funcDecl.Key, "~") &&
+		(isTestName(funcDecl.Key, "Test") || isTestName(funcDecl.Key, "Benchmark"))
+}
+
+// isTestName returns whether name is a test (or benchmark) function name for the given prefix, with the same
+// rule used by `go test`: it is exactly the prefix, or the prefix is followed by a rune that is not lowercase.
+// So `TestdataPath` is not a test.
+func isTestName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	if len(name) == len(prefix) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(name[len(prefix):])
+	return !unicode.IsLower(r)
+}
+
+// CompileTests compiles the tests in the currently generated go files in State.TempDir to a test binary
+// (see State.TestBinaryPath), using `go test -c`. Since `go test` only considers test functions in `_test.go`
+// files, main.go is renamed to `main_test.go` during the compilation.
+//
+// If errors in compilation happen, fileToCellIdAndLines is used to adjust line numbers to their content in the
+// current cell.
+func (s *State) CompileTests(msg kernel.Message, fileToCellIdAndLines []CellIdAndLine) error {
+	if err := os.Rename(s.MainPath(), s.TestMainPath()); err != nil {
+		return errors.Wrapf(err, "failed to rename main.go to %s", testMainFile)
+	}
+	args := append([]string{"test", "-c", "-o", s.TestBinaryPath()}, s.BuildFlags()...)
+	cmd := s.goCommand(args...)
+	output, err := cmd.CombinedOutput()
+	if renameErr := os.Rename(s.TestMainPath(), s.MainPath()); renameErr != nil {
+		return errors.Wrapf(renameErr, "failed to rename %s back to main.go", testMainFile)
+	}
+	s.registerCompileTiming(cmd)
+	if err != nil {
+		s.DisplayErrorWithContext(msg, fileToCellIdAndLines, string(output))
+		return errors.Wrapf(err, "failed to run %q", cmd.String())
+	}
+	return nil
+}
+
+// ExecuteTests runs the test binary compiled by CompileTests, with the arguments in State.CellTestArgs.
+// References to the test file in the output are mapped to the corresponding cell lines.
+func (s *State) ExecuteTests(msg kernel.Message, fileToCellIdAndLine []CellIdAndLine) error {
+	start := time.Now()
+	builder := kernel.PipeExecToJupyter(msg, s.TestBinaryPath(), testBinaryArgs(s.CellTestArgs)...).
+		WithStdout(newJupyterStackTraceMapperWriter(msg, "stdout", testMainFile, fileToCellIdAndLine)).
+		WithStderr(newJupyterStackTraceMapperWriter(msg, "stderr", testMainFile, fileToCellIdAndLine)).
+		WithContext(kernel.InterruptContext(msg)).
+		WithTimeout(s.CellTimeout).
+		WithStdinContent(s.CellStdin)
+	err := builder.Exec()
+	if s.cellTiming != nil {
+		s.cellTiming.executed = true
+		s.cellTiming.runWall = time.Since(start)
+		s.cellTiming.runCPU = cpuTime(builder.ProcessState())
+	}
+	return err
+}
+
+// testBinaryArgs converts `go test` flags (e.g.: `-run=TestA`, `-v`) to the flags accepted by the test
+// binary (e.g.: `-test.run=TestA`, `-test.v`).
+func testBinaryArgs(args []string) []string {
+	converted := make([]string, 0, len(args))
+	for _, arg := range args {
+		name := strings.TrimLeft(arg, "-")
+		if name != arg && name != "" && !strings.HasPrefix(name, "test.") {
+			arg = "-test." + name
+		}
+		converted = append(converted, arg)
+	}
+	return converted
+}
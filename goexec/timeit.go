@@ -0,0 +1,86 @@
+package goexec
+
+import (
+	"strings"
+)
+
+// This file implements the code generation for `%%timeit`, which benchmarks the cell's `func main()`.
+
+// TimeIt configures the benchmarking of a cell, see State.CellTimeIt.
+type TimeIt struct {
+	// Iterations is the number of times the cell's code is run in each repeat. If <= 0, it is
+	// automatically scaled so that each repeat takes at least 0.2 seconds.
+	Iterations int
+
+	// Repeats is the number of times the measurement (of Iterations runs) is repeated. The mean, min and
+	// max are taken over the repeats.
+	Repeats int
+}
+
+// DefaultTimeItRepeats is the default number of repeats for `%%timeit`.
+const DefaultTimeItRepeats = 7
+
+const (
+	// timeItBodyFunc is the name given to the cell's `func main()`, when it is benchmarked.
+	timeItBodyFunc = "gonbTimeItBody"
+
+	// timeItTimeAlias and timeItFmtAlias are the aliases of the packages used by the generated `func main()`,
+	// chosen not to conflict with the user's imports.
+	timeItTimeAlias = "gonbTimeItTime"
+	timeItFmtAlias  = "gonbTimeItFmt"
+)
+
+// timeItMainTemplate is the `func main()` generated to benchmark the cell's code. It takes as parameters
+// the number of iterations and the number of repeats.
+var timeItMainTemplate = strings.NewReplacer(
+	"TIME", timeItTimeAlias, "FMT", timeItFmtAlias, "BODY", timeItBodyFunc).Replace(`
+func main() {
+	iterations, repeats := %d, %d
+	if iterations <= 0 {
+		// Scale iterations until a repeat takes at least 0.2 seconds.
+		for iterations = 1; iterations < 1_000_000_000; iterations *= 10 {
+			start := TIME.Now()
+			for ii := 0; ii < iterations; ii++ {
+				BODY()
+			}
+			if TIME.Since(start) >= 200*TIME.Millisecond {
+				break
+			}
+		}
+	}
+	var total, minDuration, maxDuration TIME.Duration
+	for repeat := 0; repeat < repeats; repeat++ {
+		start := TIME.Now()
+		for ii := 0; ii < iterations; ii++ {
+			BODY()
+		}
+		perIteration := TIME.Since(start) / TIME.Duration(iterations)
+		total += perIteration
+		if repeat == 0 || perIteration < minDuration {
+			minDuration = perIteration
+		}
+		if perIteration > maxDuration {
+			maxDuration = perIteration
+		}
+	}
+	FMT.Printf("%%s per loop (mean of %%d runs, %%d loops each; min %%s, max %%s)\n",
+		total/TIME.Duration(repeats), repeats, iterations, minDuration, maxDuration)
+}
+`)
+
+// timeItDecls returns a copy of decls with the imports required by the benchmarking `func main()`.
+func timeItDecls(decls *Declarations) *Declarations {
+	decls = decls.Copy()
+	for _, imp := range []*Import{NewImport("time", timeItTimeAlias), NewImport("fmt", timeItFmtAlias)} {
+		imp.Cursor = NoCursor
+		decls.Imports[imp.Key] = imp
+	}
+	return decls
+}
+
+// renderTimeItMain writes the cell's main function renamed to timeItBodyFunc, followed by the
+// `func main()` that benchmarks it.
+func (s *State) renderTimeItMain(w *WriterWithCursor, mainDef string) {
+	w.Writef("%s\n", strings.Replace(mainDef, "func main()", "func "+timeItBodyFunc+"()", 1))
+	w.Writef(timeItMainTemplate, s.CellTimeIt.Iterations, s.CellTimeIt.Repeats)
+}
@@ -37,6 +37,15 @@ type trackingInfo struct {
 
 	// go.mod and go.work last modification time, used for the AutoTrack
 	goModModTime, goWorkModTime time.Time
+
+	// go.sum and vendor/modules.txt last seen modification time and size, used for the AutoTrack.
+	goSumStamp, vendorStamp fileStamp
+}
+
+// fileStamp is a cheap fingerprint of a file, used to detect changes. It is zero if the file doesn't exist.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
 }
 
 // trackEntry has information about a file or directory.
@@ -231,6 +240,30 @@ func (s *State) lockedUntrackEntry(fileOrDirPath string) (err error) {
 	return
 }
 
+// retrackAll un-tracks and tracks again all tracked files and directories, marking all of them
+// as updated, so they are sent again to `gopls`. It also resets the go.mod and go.work
+// information used by AutoTrack.
+func (s *State) retrackAll() (err error) {
+	ti := s.trackingInfo
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+
+	ti.goModModTime, ti.goWorkModTime = time.Time{}, time.Time{}
+	s.hasGoWork, s.goWorkUsePaths = false, nil
+	tracked := common.SortedKeys(ti.tracked)
+	for _, p := range tracked {
+		if err = s.lockedUntrackEntry(p); err != nil {
+			return
+		}
+	}
+	for _, p := range tracked {
+		if err = s.lockedTrack(p, p, common.MakeSet[string]()); err != nil {
+			return
+		}
+	}
+	return
+}
+
 func (s *State) ListTracked() []string {
 	s.trackingInfo.mu.Lock()
 	defer s.trackingInfo.mu.Unlock()
@@ -277,8 +310,12 @@ func (s *State) EnumerateUpdatedFiles(fn func(filePath string) error) (err error
 
 // AutoTrack adds automatic tracked directories. It looks at go.mod and go.work for
 // redirects to the local filesystem.
+//
+// It also checks whether go.sum and the vendored dependencies (vendor/modules.txt) changed (e.g.: after
+// a `!*go get`), in which case they are marked as updated, so they are sent to `gopls`.
 func (s *State) AutoTrack() (err error) {
 	klog.V(2).Infof("AutoTrack(): ...")
+	s.autoTrackModuleFiles()
 	err = s.autoTrackGoMod()
 	if err != nil {
 		return
@@ -287,6 +324,37 @@ func (s *State) AutoTrack() (err error) {
 	return
 }
 
+// autoTrackModuleFiles marks go.sum and vendor/modules.txt as updated (see EnumerateUpdatedFiles) if their
+// modification time or size changed since the last check -- including if they were created or removed.
+func (s *State) autoTrackModuleFiles() {
+	ti := s.trackingInfo
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	for _, entry := range []struct {
+		filePath string
+		stamp    *fileStamp
+	}{
+		{path.Join(s.TempDir, "go.sum"), &ti.goSumStamp},
+		{path.Join(s.VendorPath(), "modules.txt"), &ti.vendorStamp},
+	} {
+		var stamp fileStamp
+		fileInfo, err := os.Stat(entry.filePath)
+		if err == nil {
+			stamp = fileStamp{modTime: fileInfo.ModTime(), size: fileInfo.Size()}
+		} else if !os.IsNotExist(err) {
+			klog.Warningf("goexec.AutoTrack: failed to check %q for changes: %+v", entry.filePath, err)
+			continue
+		}
+		if stamp == *entry.stamp {
+			continue
+		}
+		klog.V(2).Infof("goexec.AutoTrack: %q changed (modification time %s, size %d), re-syncing it",
+			entry.filePath, stamp.modTime, stamp.size)
+		*entry.stamp = stamp
+		ti.updated.Insert(entry.filePath)
+	}
+}
+
 // autoTrackGoMod tracks entries in `go.mod`.
 func (s *State) autoTrackGoMod() (err error) {
 	ti := s.trackingInfo
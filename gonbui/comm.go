@@ -0,0 +1,228 @@
+package gonbui
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/pkg/errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// This file implements Jupyter "comm" messages, a bidirectional channel between the program and the
+// front-end, which can be used for lightweight interactive widgets.
+
+// Comm is a channel of messages between the program and a handler (a comm target) in the front-end, see
+// OpenComm.
+type Comm struct {
+	// ID of the comm, unique.
+	ID string
+
+	// TargetName is the name of the comm target in the front-end.
+	TargetName string
+
+	mu        sync.Mutex
+	onMessage func(data map[string]any)
+	onClose   func()
+	closed    bool
+}
+
+var (
+	// muComms protects comms and commsReaderStarted.
+	muComms sync.Mutex
+
+	// comms maps the ids of the comms opened by the program.
+	comms = make(map[string]*Comm)
+
+	// commsReaderStarted indicates the goroutine reading the messages from the front-end (readComms) was started.
+	commsReaderStarted bool
+)
+
+// OpenComm opens a comm to the comm target named targetName in the front-end, sending data (it can be nil)
+// along with the `comm_open` message. onMessage (it can be nil) is called with the data of each message sent
+// by the front-end to the comm, sequentially and on a separate goroutine.
+//
+// The comm target must be registered in the front-end before the comm is opened -- the comms of GoNB are
+// plain Jupyter comms, see https://jupyter-client.readthedocs.io/en/latest/messaging.html#custom-messages.
+// For instance, in the classic Jupyter Notebook, with Javascript in the displayed HTML that calls
+// `Jupyter.notebook.kernel.comm_manager.register_target`. The comms are closed when the program exits.
+//
+// Usage example, a button that counts how many times it was clicked:
+//
+// ```go
+//
+//	buttonID, counterID := gonbui.UniqueID(), gonbui.UniqueID()
+//	gonbui.DisplayHTML(fmt.Sprintf(`<button id="%s">Click me!</button>
+//	<script>
+//	Jupyter.notebook.kernel.comm_manager.register_target("%s", (comm, msg) => {
+//	  document.getElementById("%s").onclick = () => comm.send({"event": "click"});
+//	});
+//	</script>`, buttonID, buttonID, buttonID))
+//	gonbui.UpdateHTML(counterID, "Clicks: 0")
+//
+//	clicks, done := 0, make(chan bool)
+//	_, err := gonbui.OpenComm(buttonID, nil, func(data map[string]any) {
+//	  clicks++
+//	  gonbui.UpdateHTML(counterID, fmt.Sprintf("Clicks: %d", clicks))
+//	  if clicks == 5 {
+//	    close(done)
+//	  }
+//	})
+//	if err != nil {
+//	  panic(err)
+//	}
+//	<-done  // The cell keeps running, and receiving clicks, until 5 clicks.
+//
+// ```
+func OpenComm(targetName string, data map[string]any, onMessage func(data map[string]any)) (*Comm, error) {
+	if !IsNotebook {
+		return nil, errors.New("OpenComm() only works when running in a GoNB notebook")
+	}
+	if err := startCommsReader(); err != nil {
+		return nil, err
+	}
+	c := &Comm{ID: UniqueID(), TargetName: targetName, onMessage: onMessage}
+	muComms.Lock()
+	comms[c.ID] = c
+	muComms.Unlock()
+	if err := sendComm(protocol.CommOpen, c.ID, targetName, data); err != nil {
+		muComms.Lock()
+		delete(comms, c.ID)
+		muComms.Unlock()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Send sends a message with data (it can be nil) to the comm target in the front-end.
+func (c *Comm) Send(data map[string]any) error {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return errors.Errorf("comm %q (target %q) is closed", c.ID, c.TargetName)
+	}
+	return sendComm(protocol.CommMsg, c.ID, "", data)
+}
+
+// OnClose sets a handler called when the comm is closed by the front-end.
+func (c *Comm) OnClose(handler func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onClose = handler
+}
+
+// Close closes the comm, sending data (it can be nil) with the `comm_close` message. It is a no-op if the
+// comm is already closed.
+func (c *Comm) Close(data map[string]any) error {
+	if !c.markClosed() {
+		return nil
+	}
+	return sendComm(protocol.CommClose, c.ID, "", data)
+}
+
+// markClosed marks the comm as closed and removes it from comms. It returns false if it was already closed.
+func (c *Comm) markClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.closed = true
+	muComms.Lock()
+	delete(comms, c.ID)
+	muComms.Unlock()
+	return true
+}
+
+// sendComm sends a comm message to the kernel, to be published to the front-end.
+func sendComm(msgType, commID, targetName string, data map[string]any) error {
+	var dataJSON []byte
+	if data != nil {
+		var err error
+		dataJSON, err = json.Marshal(data)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode data of %s for comm %q", msgType, commID)
+		}
+	}
+	sendData(&protocol.DisplayData{
+		Data: map[protocol.MIMEType]any{
+			protocol.MIMEJupyterComm: &protocol.CommMessage{
+				MsgType:    msgType,
+				CommID:     commID,
+				TargetName: targetName,
+				Data:       string(dataJSON),
+			},
+		},
+	})
+	return Error()
+}
+
+// startCommsReader starts the goroutine that reads the comm messages sent by the front-end (see readComms),
+// if not started yet.
+func startCommsReader() error {
+	muComms.Lock()
+	defer muComms.Unlock()
+	if commsReaderStarted {
+		return nil
+	}
+	pipePath := os.Getenv(protocol.GONB_COMM_PIPE_ENV)
+	if pipePath == "" {
+		return errors.Errorf("comms not supported by the kernel: %s is not set", protocol.GONB_COMM_PIPE_ENV)
+	}
+	pipeReader, err := os.Open(pipePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed opening comm pipe %q", pipePath)
+	}
+	commsReaderStarted = true
+	go readComms(pipeReader)
+	return nil
+}
+
+// readComms reads the comm messages sent by the front-end, and dispatches them to their comms.
+func readComms(pipeReader io.ReadCloser) {
+	defer pipeReader.Close()
+	decoder := gob.NewDecoder(pipeReader)
+	for {
+		req := &protocol.CommMessage{}
+		if err := decoder.Decode(req); err != nil {
+			if err != io.EOF {
+				log.Printf("Failed reading comm messages from GoNB: %v", err)
+			}
+			return
+		}
+		muComms.Lock()
+		c := comms[req.CommID]
+		muComms.Unlock()
+		if c == nil {
+			continue
+		}
+		var data map[string]any
+		if req.Data != "" {
+			if err := json.Unmarshal([]byte(req.Data), &data); err != nil {
+				log.Printf("Invalid data in %s for comm %q: %v", req.MsgType, req.CommID, err)
+				continue
+			}
+		}
+		switch req.MsgType {
+		case protocol.CommMsg:
+			c.mu.Lock()
+			onMessage := c.onMessage
+			c.mu.Unlock()
+			if onMessage != nil {
+				onMessage(data)
+			}
+		case protocol.CommClose:
+			if c.markClosed() {
+				c.mu.Lock()
+				onClose := c.onClose
+				c.mu.Unlock()
+				if onClose != nil {
+					onClose()
+				}
+			}
+		}
+	}
+}
@@ -10,8 +10,11 @@ import (
 	"github.com/pkg/errors"
 	"image"
 	"image/png"
+	"io"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 )
 
@@ -77,23 +80,130 @@ func sendData(data *protocol.DisplayData) {
 	}
 }
 
-// DisplayHTML will display the given HTML in the notebook, as the output of the cell being executed.
-func DisplayHTML(html string) {
+// DisplayData displays data of the given MIME type in the notebook, as the output of the cell being executed,
+// in one `display_data` message. It is the general form of DisplayHTML, DisplayMarkdown, DisplaySVG,
+// DisplayPNG, etc., and it can be used for any other MIME type supported by the front-end (e.g.:
+// "application/vnd.vegalite.v5+json", if the corresponding JupyterLab extension is installed).
+//
+// The MIME type is a plain string, since most types have no protocol.MIMEType constant. The constants
+// can be given with a conversion, e.g.: `string(protocol.MIMETextHTML)`.
+//
+// Text MIME types ("text/...", JSON, JavaScript and "...+xml") are sent as text, JSON ones as a JSON
+// object (so data must be valid JSON), and other types are sent as binary data (base64 encoded).
+//
+// To display alternative representations of the same content in one output, for instance a PNG and
+// its "text/plain" description, from which the front-end picks the richest one it supports, use
+// DisplayWithID with one entry per MIME type, and a new UniqueID:
+//
+// ```go
+//
+//	gonbui.DisplayWithID(gonbui.UniqueID(), map[protocol.MIMEType]any{
+//	  protocol.MIMEImagePNG:  pngBytes,
+//	  protocol.MIMETextPlain: "A plot of sin(x)",
+//	})
+//
+// ```
+func DisplayData(mimeType string, data []byte) {
+	displayData(protocol.MIMEType(mimeType), data)
+}
+
+// displayData implements DisplayData for the protocol.MIMEType constants used by the other Display functions.
+func displayData(mimeType protocol.MIMEType, data []byte) {
 	if !IsNotebook {
 		return
 	}
+	var content any = data
+	if isTextMIMEType(mimeType) {
+		content = string(data)
+	}
 	sendData(&protocol.DisplayData{
-		Data: map[protocol.MIMEType]any{protocol.MIMETextHTML: html},
+		Data: map[protocol.MIMEType]any{mimeType: content},
 	})
 }
 
+// DisplayDataf displays the text formatted as with fmt.Sprintf, with the given MIME type. See DisplayData.
+//
+// Usage example:
+//
+// ```go
+//
+//	gonbui.DisplayDataf("text/latex", `$$\sum_{i=1}^{%d} i = %d$$`, n, n*(n+1)/2)
+//
+// ```
+func DisplayDataf(mimeType string, format string, args ...any) {
+	DisplayData(mimeType, []byte(fmt.Sprintf(format, args...)))
+}
+
+// isTextMIMEType returns whether the content of the MIME type is text, as opposed to binary data.
+func isTextMIMEType(mimeType protocol.MIMEType) bool {
+	name := strings.ToLower(string(mimeType))
+	return strings.HasPrefix(name, "text/") || strings.HasSuffix(name, "+xml") ||
+		name == protocol.MIMEApplicationJSON || strings.HasSuffix(name, "+json") ||
+		name == "application/javascript"
+}
+
+// DisplayHTML will display the given HTML in the notebook, as the output of the cell being executed.
+func DisplayHTML(html string) {
+	displayData(protocol.MIMETextHTML, []byte(html))
+}
+
 // DisplayMarkdown will display the given markdown content in the notebook, as the output of the cell being executed.
+//
+// Usage example, a markdown table generated from a computation:
+//
+// ```go
+//
+//	parts := []string{"| n | n² | n! |", "|--:|--:|--:|"}
+//	factorial := 1
+//	for n := 1; n <= 5; n++ {
+//	  factorial *= n
+//	  parts = append(parts, fmt.Sprintf("| %d | %d | %d |", n, n*n, factorial))
+//	}
+//	gonbui.DisplayMarkdown(strings.Join(parts, "\n"))
+//
+// ```
 func DisplayMarkdown(markdown string) {
+	displayData(protocol.MIMETextMarkdown, []byte(markdown))
+}
+
+// DisplayWithID displays the given content, a map of MIME type to content (see DisplayData.Data in
+// package protocol), on an output block with the given `id`: the block is created the first time
+// the `id` is used in the cell execution, and updated thereafter.
+//
+// Usage example, a counter updated in place:
+//
+// ```go
+//
+//	counterID := gonbui.UniqueID()
+//	for ii := 0; ii < 10; ii++ {
+//	  gonbui.DisplayWithID(counterID, map[protocol.MIMEType]any{
+//	    protocol.MIMETextHTML: fmt.Sprintf("Count: <b>%d</b>\n", ii),
+//	  })
+//	  time.Sleep(time.Second)
+//	}
+//
+// ```
+func DisplayWithID(id string, mimeData map[protocol.MIMEType]any) {
 	if !IsNotebook {
 		return
 	}
 	sendData(&protocol.DisplayData{
-		Data: map[protocol.MIMEType]any{protocol.MIMETextMarkdown: markdown},
+		Data:      mimeData,
+		DisplayID: id,
+	})
+}
+
+// UpdateDisplay updates the contents of the output block with the given `id`, previously created
+// with DisplayWithID (or UpdateHTML, UpdateMarkdown) -- possibly by a previous cell. If no block
+// was created with the `id`, nothing is displayed.
+func UpdateDisplay(id string, mimeData map[protocol.MIMEType]any) {
+	if !IsNotebook {
+		return
+	}
+	sendData(&protocol.DisplayData{
+		Data:      mimeData,
+		DisplayID: id,
+		Update:    true,
 	})
 }
 
@@ -117,13 +227,7 @@ func DisplayMarkdown(markdown string) {
 //
 // ```
 func UpdateHTML(id, html string) {
-	if !IsNotebook {
-		return
-	}
-	sendData(&protocol.DisplayData{
-		Data:      map[protocol.MIMEType]any{protocol.MIMETextHTML: html},
-		DisplayID: id,
-	})
+	DisplayWithID(id, map[protocol.MIMEType]any{protocol.MIMETextHTML: html})
 }
 
 // UniqueID returns a unique id that can be used for UpdateHTML.
@@ -144,50 +248,139 @@ func UniqueID() string {
 //
 // See example in UpdateHTML, just instead this used Markdown content.
 func UpdateMarkdown(id, markdown string) {
+	DisplayWithID(id, map[protocol.MIMEType]any{protocol.MIMETextMarkdown: markdown})
+}
+
+// ImageOption configures optional parameters of the image display functions (DisplayPNG, DisplayJPEG,
+// DisplayImage and DisplayImageFile). See WithWidth and WithHeight.
+type ImageOption func(opts *imageOptions)
+
+// imageOptions holds the values set by ImageOption.
+type imageOptions struct {
+	width, height int
+}
+
+// WithWidth sets the width, in pixels, with which an image is displayed.
+func WithWidth(width int) ImageOption {
+	return func(opts *imageOptions) { opts.width = width }
+}
+
+// WithHeight sets the height, in pixels, with which an image is displayed.
+func WithHeight(height int) ImageOption {
+	return func(opts *imageOptions) { opts.height = height }
+}
+
+// displayImageBytes displays an encoded image of the given mime type. If a width or height is
+// given in options, the image is embedded in an HTML `<img>` tag of the given size, since the
+// image mime types don't carry a size.
+func displayImageBytes(mimeType protocol.MIMEType, content []byte, options []ImageOption) {
 	if !IsNotebook {
 		return
 	}
-	sendData(&protocol.DisplayData{
-		Data:      map[protocol.MIMEType]any{protocol.MIMETextMarkdown: markdown},
-		DisplayID: id,
-	})
+	var opts imageOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	if opts.width <= 0 && opts.height <= 0 {
+		displayData(mimeType, content)
+		return
+	}
+	html := fmt.Sprintf(`<img src="data:%s;base64,%s"`, mimeType, base64.StdEncoding.EncodeToString(content))
+	if opts.width > 0 {
+		html += fmt.Sprintf(` width="%d"`, opts.width)
+	}
+	if opts.height > 0 {
+		html += fmt.Sprintf(` height="%d"`, opts.height)
+	}
+	DisplayHTML(html + "/>")
 }
 
 // DisplayPNG displays the given PNG, given as raw bytes.
-func DisplayPNG(png []byte) {
-	if !IsNotebook {
-		return
-	}
-	sendData(&protocol.DisplayData{
-		Data: map[protocol.MIMEType]any{protocol.MIMEImagePNG: png},
-	})
+// Optionally, the displayed size can be set with WithWidth and WithHeight.
+func DisplayPNG(png []byte, options ...ImageOption) {
+	displayImageBytes(protocol.MIMEImagePNG, png, options)
+}
+
+// DisplayJPEG displays the given JPEG, given as raw bytes.
+// Optionally, the displayed size can be set with WithWidth and WithHeight.
+func DisplayJPEG(jpeg []byte, options ...ImageOption) {
+	displayImageBytes(protocol.MIMEImageJPEG, jpeg, options)
 }
 
 // DisplayImage displays the given image, by converting it to PNG first.
 // It returns an error if it fails to encode to the image to PNG.
-func DisplayImage(image image.Image) error {
+// Optionally, the displayed size can be set with WithWidth and WithHeight.
+func DisplayImage(image image.Image, options ...ImageOption) error {
 	buf := bytes.NewBuffer(nil)
 	err := png.Encode(buf, image)
 	if err != nil {
 		return err
 	}
-	DisplayPNG(buf.Bytes())
+	DisplayPNG(buf.Bytes(), options...)
 	return nil
 }
 
+// DisplayImageFile displays the PNG, JPEG, GIF or SVG image stored in filePath. The format is
+// detected from the contents of the file (or its extension, for SVG).
+// It returns an error if the file can't be read or if its format is not supported.
+// Optionally, the displayed size can be set with WithWidth and WithHeight.
+func DisplayImageFile(filePath string, options ...ImageOption) error {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "failed to read image file %q", filePath)
+	}
+	var mimeType protocol.MIMEType
+	switch {
+	case bytes.HasPrefix(content, []byte("\x89PNG\r\n\x1a\n")):
+		mimeType = protocol.MIMEImagePNG
+	case bytes.HasPrefix(content, []byte("\xff\xd8\xff")):
+		mimeType = protocol.MIMEImageJPEG
+	case bytes.HasPrefix(content, []byte("GIF87a")), bytes.HasPrefix(content, []byte("GIF89a")):
+		mimeType = protocol.MIMEImageGIF
+	case strings.ToLower(filepath.Ext(filePath)) == ".svg":
+		if len(options) == 0 {
+			DisplaySVG(string(content))
+			return nil
+		}
+		mimeType = protocol.MIMEImageSVG
+	default:
+		return errors.Errorf("image file %q is not a PNG, JPEG, GIF or SVG file", filePath)
+	}
+	displayImageBytes(mimeType, content, options)
+	return nil
+}
+
+// DisplaySVG displays the given SVG natively (as `image/svg+xml`), so it is rendered scalably by JupyterLab.
+//
+// If svg doesn't start with an `<svg` element (after an optional XML prolog, which is dropped), it is
+// wrapped in one, so SVG fragments (e.g.: `<circle .../>`) can also be displayed.
+//
+// Notice that some versions of Jupyter don't handle well SVG data when the notebook is converted
+// to HTML (see https://discourse.jupyter.org/t/svg-either-not-loading-right-or-not-exporting-to-html/17824),
+// in which case use DisplaySVGAsHTML.
 func DisplaySVG(svg string) {
-	if !IsNotebook {
-		return
+	displayData(protocol.MIMEImageSVG, []byte(normalizeSVG(svg)))
+}
+
+// DisplaySVGAsHTML displays the given SVG embedded in HTML. It works around the issues some versions of
+// Jupyter have with SVG data when the notebook is converted to HTML, see DisplaySVG.
+func DisplaySVGAsHTML(svg string) {
+	DisplayHTML(fmt.Sprintf("<div>%s</div>", normalizeSVG(svg)))
+}
+
+// normalizeSVG returns svg starting with its `<svg` element: an XML prolog (`<?xml ...?>`, `<!DOCTYPE ...>`
+// and comments) before it is dropped, and content that is not an `<svg>` element is wrapped in one.
+func normalizeSVG(svg string) string {
+	svg = strings.TrimSpace(svg)
+	if strings.HasPrefix(svg, "<?xml") || strings.HasPrefix(svg, "<!") {
+		if pos := strings.Index(svg, "<svg"); pos != -1 {
+			svg = svg[pos:]
+		}
+	}
+	if strings.HasPrefix(svg, "<svg") {
+		return svg
 	}
-	// This should be the implementation, but the Jupyter doesn't handle well SVG data
-	// when the notebook is converted to HTML. So we try a simple work around of embedding
-	// the SVG as HTML.
-	// (Question in Jupyter forum:
-	// https://discourse.jupyter.org/t/svg-either-not-loading-right-or-not-exporting-to-html/17824)
-	//sendData(&protocol.DisplayData{
-	//	Data: map[protocol.MIMEType]any{protocol.MIMEImageSVG: svg},
-	//})
-	DisplayHTML(fmt.Sprintf("<div>%s</div>", svg))
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg">%s</svg>`, svg)
 }
 
 // EmbedImageAsPNGSrc returns a string that can be used as in an HTML <img> tag, as its source (it's `src` field).
@@ -203,18 +396,48 @@ func EmbedImageAsPNGSrc(img image.Image) (string, error) {
 	return fmt.Sprintf("data:image/png;base64,%s", encoded), nil
 }
 
-// RequestInput from the Jupyter notebook.
+// ClearOutput clears the output area of the cell being executed. If wait is true, the output is
+// only cleared when new output is displayed, which avoids flickering when replacing it.
+func ClearOutput(wait bool) {
+	if !IsNotebook {
+		return
+	}
+	sendData(&protocol.DisplayData{
+		Data: map[protocol.MIMEType]any{
+			protocol.MIMEJupyterClearOutput: &protocol.ClearOutputRequest{Wait: wait},
+		},
+	})
+}
+
+// RequestInput from the Jupyter notebook, and returns the value typed by the user (without the
+// trailing newline).
 // It triggers the opening of a small text field in the cell output area where the user
-// can type something.
-// Whatever the user writes is written to the stdin of cell program -- and can be read,
-// for instance, with `fmt.Scanf`.
+// can type something, and blocks until the user submits it.
 //
 // Args:
 //   - prompt: string displayed in front of the field to be entered. Leave empty ("") if not needed.
 //   - password: if whatever the user is typing is not to be displayed.
-func RequestInput(prompt string, password bool) {
+//
+// It returns an error if not running in a notebook, or if the front-end doesn't allow input prompting
+// (e.g.: when executing the notebook with `nbconvert`).
+//
+// Usage example:
+//
+// ```go
+//
+//	name, err := gonbui.RequestInput("What is your name? ", false)
+//	if err != nil {
+//	  panic(err)
+//	}
+//	fmt.Printf("Hello %s!\n", name)
+//
+// ```
+func RequestInput(prompt string, password bool) (string, error) {
 	if !IsNotebook {
-		return
+		return "", errors.New("RequestInput() only works when running in a GoNB notebook")
+	}
+	if os.Getenv(protocol.GONB_ALLOW_STDIN_ENV) == "0" {
+		return "", errors.New("RequestInput(): the front-end doesn't allow input prompting")
 	}
 	req := protocol.InputRequest{
 		Prompt:   prompt,
@@ -225,4 +448,31 @@ func RequestInput(prompt string, password bool) {
 			protocol.MIMEJupyterInput: &req,
 		},
 	})
+	if err := Error(); err != nil {
+		return "", err
+	}
+	return readStdinLine()
+}
+
+// readStdinLine reads one line from the stdin, one byte at a time, so nothing beyond the line is consumed
+// (it may still be read, for instance, with `fmt.Scan`).
+func readStdinLine() (string, error) {
+	var line []byte
+	buf := make([]byte, 1)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			if buf[0] == '\n' {
+				break
+			}
+			line = append(line, buf[0])
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				break
+			}
+			return "", errors.Wrapf(err, "failed to read input from stdin")
+		}
+	}
+	return strings.TrimSuffix(string(line), "\r"), nil
 }
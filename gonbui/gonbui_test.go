@@ -0,0 +1,22 @@
+package gonbui
+
+import (
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestDisplayData(t *testing.T) {
+	sent := captureDisplayData(t)
+	DisplayData("text/latex", []byte(`$$x^2$$`))
+	DisplayDataf("application/vnd.vegalite.v5+json", `{"n": %d}`, 3)
+	DisplayData(string(protocol.MIMEImagePNG), []byte{0x89, 'P', 'N', 'G'})
+	data := sent()
+	require.Len(t, data, 3)
+
+	// Text MIME types are sent as strings, others as binary data.
+	assert.Equal(t, map[protocol.MIMEType]any{"text/latex": `$$x^2$$`}, data[0].Data)
+	assert.Equal(t, map[protocol.MIMEType]any{"application/vnd.vegalite.v5+json": `{"n": 3}`}, data[1].Data)
+	assert.Equal(t, map[protocol.MIMEType]any{protocol.MIMEImagePNG: []byte{0x89, 'P', 'N', 'G'}}, data[2].Data)
+}
@@ -0,0 +1,145 @@
+package gonbui
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/pkg/errors"
+)
+
+// JSONOption configures optional parameters of DisplayJSON. See WithMaxDepth.
+type JSONOption func(opts *jsonOptions)
+
+// jsonOptions holds the values set by JSONOption.
+type jsonOptions struct {
+	maxDepth int
+}
+
+// WithMaxDepth truncates objects and arrays nested deeper than maxDepth levels: they are replaced by a
+// string summarizing their size (e.g.: "{…3 keys}"). Use it to display huge values.
+func WithMaxDepth(maxDepth int) JSONOption {
+	return func(opts *jsonOptions) { opts.maxDepth = maxDepth }
+}
+
+// DisplayJSON displays v marshaled to JSON (see encoding/json). JupyterLab renders it with its collapsible
+// tree viewer, and other front-ends display it as indented text.
+// It returns an error if v can't be marshaled to JSON.
+//
+// Optionally, large values can be truncated with WithMaxDepth.
+func DisplayJSON(v any, options ...JSONOption) error {
+	content, err := jsonIndent(v, options)
+	if err != nil {
+		return err
+	}
+	if !IsNotebook {
+		return nil
+	}
+	sendData(&protocol.DisplayData{
+		Data: map[protocol.MIMEType]any{
+			protocol.MIMEApplicationJSON: content,
+			protocol.MIMETextPlain:       content,
+		},
+	})
+	return nil
+}
+
+// jsonIndent marshals v to indented JSON, truncated according to options.
+func jsonIndent(v any, options []JSONOption) (string, error) {
+	var opts jsonOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	content, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrapf(err, "DisplayJSON failed to marshal %T", v)
+	}
+	if opts.maxDepth > 0 {
+		var truncated bytes.Buffer
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		if err = truncateJSON(decoder, &truncated, 0, opts.maxDepth); err != nil {
+			return "", errors.WithMessagef(err, "DisplayJSON failed to truncate %T", v)
+		}
+		content = truncated.Bytes()
+	}
+	var indented bytes.Buffer
+	if err = json.Indent(&indented, content, "", "  "); err != nil {
+		return "", errors.Wrapf(err, "DisplayJSON failed to indent %T", v)
+	}
+	return indented.String(), nil
+}
+
+// truncateJSON reads one JSON value from decoder and writes it to w, replacing objects and arrays at depth
+// maxDepth by a string summarizing their size. It preserves the order of the keys of the objects.
+func truncateJSON(decoder *json.Decoder, w *bytes.Buffer, depth, maxDepth int) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	delim, isDelim := token.(json.Delim)
+	if !isDelim {
+		encoded, err := json.Marshal(token)
+		if err != nil {
+			return err
+		}
+		w.Write(encoded)
+		return nil
+	}
+
+	isObject := delim == '{'
+	if depth >= maxDepth {
+		// Skip the contents, counting its elements.
+		count := 0
+		for decoder.More() {
+			if isObject {
+				if _, err = decoder.Token(); err != nil { // Key.
+					return err
+				}
+			}
+			var skipped json.RawMessage
+			if err = decoder.Decode(&skipped); err != nil {
+				return err
+			}
+			count++
+		}
+		if _, err = decoder.Token(); err != nil { // Closing delimiter.
+			return err
+		}
+		summary := fmt.Sprintf("[…%d items]", count)
+		if isObject {
+			summary = fmt.Sprintf("{…%d keys}", count)
+		}
+		encoded, _ := json.Marshal(summary)
+		w.Write(encoded)
+		return nil
+	}
+
+	w.WriteString(delim.String())
+	for ii := 0; decoder.More(); ii++ {
+		if ii > 0 {
+			w.WriteByte(',')
+		}
+		if isObject {
+			key, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			encoded, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			w.Write(encoded)
+			w.WriteByte(':')
+		}
+		if err = truncateJSON(decoder, w, depth+1, maxDepth); err != nil {
+			return err
+		}
+	}
+	closing, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	w.WriteString(closing.(json.Delim).String())
+	return nil
+}
@@ -0,0 +1,63 @@
+package gonbui
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestTruncateJSON(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		maxDepth int
+		want     string
+	}{
+		{"scalar number", `1.50`, 1, `1.50`},
+		{"scalar string", `"x"`, 1, `"x"`},
+		{"scalar bool", `true`, 1, `true`},
+		{"scalar null", `null`, 1, `null`},
+		{"top level truncated", `{"a":1,"b":[2]}`, 0, `"{…2 keys}"`},
+		{"objects and arrays deeper than limit", `{"a":{"b":1},"c":[1,2],"d":3}`, 1,
+			`{"a":"{…1 keys}","c":"[…2 items]","d":3}`},
+		{"nested deeper than limit", `{"a":{"b":{"c":1}},"d":[[1],[2,3],4]}`, 2,
+			`{"a":{"b":"{…1 keys}"},"d":["[…1 items]","[…2 items]",4]}`},
+		{"exactly at limit", `{"a":{"b":1},"c":[[]]}`, 2, `{"a":{"b":1},"c":["[…0 items]"]}`},
+		{"within limit", `[{"z":1,"a":[true]}]`, 3, `[{"z":1,"a":[true]}]`},
+		{"empty containers", `{"a":{},"b":[]}`, 1, `{"a":"{…0 keys}","b":"[…0 items]"}`},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			decoder := json.NewDecoder(strings.NewReader(tc.input))
+			decoder.UseNumber()
+			var w bytes.Buffer
+			require.NoError(t, truncateJSON(decoder, &w, 0, tc.maxDepth))
+			assert.Equal(t, tc.want, w.String())
+		})
+	}
+
+	// Invalid JSON input.
+	for _, input := range []string{``, `{"a":`, `[1,}`, `{"a" 1}`, `{"a":{"b":[1,}}}`} {
+		decoder := json.NewDecoder(strings.NewReader(input))
+		var w bytes.Buffer
+		assert.Error(t, truncateJSON(decoder, &w, 0, 1), "input %q", input)
+	}
+}
+
+func TestJSONIndent(t *testing.T) {
+	value := map[string]any{"a": map[string]any{"b": []int{1, 2}}, "c": "x"}
+	content, err := jsonIndent(value, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "{\n  \"a\": {\n    \"b\": [\n      1,\n      2\n    ]\n  },\n  \"c\": \"x\"\n}", content)
+
+	content, err = jsonIndent(value, []JSONOption{WithMaxDepth(1)})
+	require.NoError(t, err)
+	assert.Equal(t, "{\n  \"a\": \"{…1 keys}\",\n  \"c\": \"x\"\n}", content)
+
+	// Values that can't be marshaled are reported.
+	_, err = jsonIndent(make(chan int), nil)
+	assert.ErrorContains(t, err, "failed to marshal chan int")
+}
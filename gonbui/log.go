@@ -0,0 +1,56 @@
+package gonbui
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// This file implements a simple logger that writes to the output of the cell.
+
+// muLog serializes the writes of Log and Logf, so messages from concurrent goroutines are not interleaved.
+var muLog sync.Mutex
+
+// Log writes to the cell's output (stdout) the operands formatted as with fmt.Sprint, in one line: a new line
+// is appended if missing.
+//
+// It is safe to call it concurrently, and each message is written at once, unbuffered, so it is displayed
+// promptly even when logged from background goroutines. It can also be used outside GoNB, where it simply
+// writes to stdout.
+func Log(args ...any) {
+	writeLog(fmt.Sprint(args...))
+}
+
+// Logf writes to the cell's output (stdout) the message formatted as with fmt.Sprintf, in one line: a new line
+// is appended if missing. See Log for details.
+//
+// Usage example, logging from goroutines:
+//
+// ```go
+//
+//	var wg sync.WaitGroup
+//	for ii := 0; ii < 3; ii++ {
+//	  wg.Add(1)
+//	  go func(worker int) {
+//	    defer wg.Done()
+//	    gonbui.Logf("worker #%d done", worker)
+//	  }(ii)
+//	}
+//	wg.Wait()
+//
+// ```
+func Logf(format string, args ...any) {
+	writeLog(fmt.Sprintf(format, args...))
+}
+
+// writeLog writes message to stdout, with a trailing new line, in one write.
+func writeLog(message string) {
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	muLog.Lock()
+	defer muLog.Unlock()
+	_, _ = os.Stdout.WriteString(message)
+	_ = os.Stdout.Sync() // Fails (and it's not needed) if stdout is a pipe, as when executed by GoNB.
+}
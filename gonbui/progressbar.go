@@ -0,0 +1,106 @@
+package gonbui
+
+import (
+	"fmt"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"html"
+	"sync"
+	"time"
+)
+
+// ProgressBarUpdateInterval is the minimum interval between updates of a ProgressBar displayed
+// in the notebook, to avoid flooding the Jupyter front-end.
+var ProgressBarUpdateInterval = 100 * time.Millisecond
+
+// ProgressBar displays an HTML progress bar in the notebook, updated in place as progress is made.
+// It is safe for concurrent use.
+//
+// Usage example:
+//
+// ```go
+//
+//	bar := gonbui.NewProgressBar(len(data))
+//	for _, item := range data {
+//	  process(item)
+//	  bar.Add(1)
+//	}
+//	bar.Done()
+//
+// ```
+type ProgressBar struct {
+	// Title is displayed before the progress bar, if not empty. Set it before calling Add.
+	Title string
+
+	mu           sync.Mutex
+	id           string
+	total, count int
+	start        time.Time
+	lastUpdate   time.Time
+	done         bool
+}
+
+// NewProgressBar creates and displays a ProgressBar for `total` steps. If total is <= 0, only
+// the number of steps done is displayed.
+func NewProgressBar(total int) *ProgressBar {
+	p := &ProgressBar{
+		id:    UniqueID(),
+		total: total,
+		start: time.Now(),
+	}
+	DisplayWithID(p.id, p.mimeDataLocked())
+	p.lastUpdate = p.start
+	return p
+}
+
+// Add n steps to the progress. The displayed bar is updated at most once every ProgressBarUpdateInterval.
+func (p *ProgressBar) Add(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.count += n
+	if p.done || time.Since(p.lastUpdate) < ProgressBarUpdateInterval {
+		return
+	}
+	p.updateLocked()
+}
+
+// Done marks the progress as finished, and displays its final state, independent of ProgressBarUpdateInterval.
+// Calls to Add after Done are accounted for, but no longer displayed.
+func (p *ProgressBar) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.done {
+		return
+	}
+	p.done = true
+	p.updateLocked()
+}
+
+// updateLocked updates the displayed progress bar, assuming `p.mu` is locked.
+func (p *ProgressBar) updateLocked() {
+	UpdateDisplay(p.id, p.mimeDataLocked())
+	p.lastUpdate = time.Now()
+}
+
+// mimeDataLocked renders the progress bar as HTML, assuming `p.mu` is locked.
+func (p *ProgressBar) mimeDataLocked() map[protocol.MIMEType]any {
+	var title string
+	if p.Title != "" {
+		title = fmt.Sprintf("<b>%s</b> ", html.EscapeString(p.Title))
+	}
+	var bar, status string
+	if p.total > 0 {
+		bar = fmt.Sprintf(`<progress value="%d" max="%d" style="width: 40%%"></progress>`, p.count, p.total)
+		status = fmt.Sprintf("%d/%d (%.0f%%)", p.count, p.total, 100*float64(p.count)/float64(p.total))
+	} else {
+		bar = `<progress style="width: 40%"></progress>`
+		status = fmt.Sprintf("%d", p.count)
+	}
+	if p.done {
+		bar = `<progress value="1" max="1" style="width: 40%"></progress>`
+		status += " done"
+	}
+	elapsed := time.Since(p.start).Round(time.Millisecond)
+	return map[protocol.MIMEType]any{
+		protocol.MIMETextHTML: fmt.Sprintf("<div>%s%s %s, elapsed %s</div>", title, bar, status, elapsed),
+	}
+}
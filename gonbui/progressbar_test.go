@@ -0,0 +1,87 @@
+package gonbui
+
+import (
+	"encoding/gob"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// captureDisplayData redirects the data sent to the kernel to a temporary file, and returns a function that
+// returns the data sent so far.
+func captureDisplayData(t *testing.T) func() []*protocol.DisplayData {
+	pipePath := filepath.Join(t.TempDir(), "pipe")
+	require.NoError(t, os.WriteFile(pipePath, nil, 0600))
+	t.Setenv(protocol.GONB_PIPE_ENV, pipePath)
+	reset := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if gonbPipe != nil {
+			_ = gonbPipe.Close()
+		}
+		gonbPipe, gonbPipeError, gonbEncoder = nil, nil, nil
+	}
+	reset()
+	IsNotebook = true
+	t.Cleanup(func() {
+		reset()
+		IsNotebook = false
+	})
+	return func() []*protocol.DisplayData {
+		f, err := os.Open(pipePath)
+		require.NoError(t, err)
+		defer func() { _ = f.Close() }()
+		dec := gob.NewDecoder(f)
+		var sent []*protocol.DisplayData
+		for {
+			data := &protocol.DisplayData{}
+			if err = dec.Decode(data); err == io.EOF {
+				return sent
+			}
+			require.NoError(t, err)
+			sent = append(sent, data)
+		}
+	}
+}
+
+func TestProgressBar(t *testing.T) {
+	sent := captureDisplayData(t)
+	defer func(interval time.Duration) { ProgressBarUpdateInterval = interval }(ProgressBarUpdateInterval)
+
+	// Updates are throttled, but Done always displays the final state.
+	ProgressBarUpdateInterval = time.Hour
+	bar := NewProgressBar(10)
+	for ii := 0; ii < 10; ii++ {
+		bar.Add(1)
+	}
+	require.Len(t, sent(), 1, "only the initial display should have been sent")
+	bar.Done()
+	data := sent()
+	require.Len(t, data, 2)
+	assert.False(t, data[0].Update)
+	assert.True(t, data[1].Update)
+	assert.Equal(t, data[0].DisplayID, data[1].DisplayID)
+	final := data[1].Data[protocol.MIMETextHTML].(string)
+	assert.Contains(t, final, `<progress value="1" max="1"`)
+	assert.Contains(t, final, "10/10 (100%) done")
+
+	// Calls after Done are not displayed.
+	bar.Add(1)
+	bar.Done()
+	require.Len(t, sent(), 2)
+
+	// Without throttling every step is displayed.
+	ProgressBarUpdateInterval = 0
+	bar = NewProgressBar(0)
+	bar.Add(1)
+	bar.Add(1)
+	data = sent()
+	require.Len(t, data, 5)
+	assert.Contains(t, data[4].Data[protocol.MIMETextHTML].(string), "<progress style=")
+	assert.Contains(t, data[4].Data[protocol.MIMETextHTML].(string), " 2, elapsed")
+}
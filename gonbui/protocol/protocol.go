@@ -27,6 +27,36 @@ const (
 	// This value is visible for both, Go cells, and shell script (started with the `!` or
 	// `!*` special commands.
 	GONB_TMP_DIR_ENV = "GONB_TMP_DIR"
+
+	// GONB_LAST_EXIT_CODE_ENV is the name of the environment variable holding the
+	// exit code of the last shell command executed with the `!` or `!*` special commands.
+	//
+	// This value is visible for both, Go cells, and shell scripts, so a notebook can
+	// branch on whether a previous command succeeded.
+	GONB_LAST_EXIT_CODE_ENV = "GONB_LAST_EXIT_CODE"
+
+	// GONB_GOROOT_ENV is the name of the environment variable that, if set, selects the Go
+	// toolchain (its GOROOT) used to compile and run the Go cells. See also `%goroot`.
+	GONB_GOROOT_ENV = "GONB_GOROOT"
+
+	// GONB_GO_BIN_ENV is the name of the environment variable that, if set, selects the `go`
+	// binary used to compile and run the Go cells (e.g.: `go1.21.0` installed from golang.org/dl).
+	// It takes precedence over GONB_GOROOT_ENV.
+	GONB_GO_BIN_ENV = "GONB_GO_BIN"
+
+	// GONB_ALLOW_STDIN_ENV is the name of the environment variable set for the Go cells to "1" if the
+	// front-end accepts input requests (see `gonbui.RequestInput`), and to "0" otherwise.
+	GONB_ALLOW_STDIN_ENV = "GONB_ALLOW_STDIN"
+
+	// GONB_DEBUG_LINES_ENV is the name of the environment variable that, if set (to any non-empty value),
+	// makes the kernel print the lines of each executed cell consumed by special commands. See `%debug lines`.
+	GONB_DEBUG_LINES_ENV = "GONB_DEBUG_LINES"
+
+	// GONB_COMM_PIPE_ENV is the name of the environment variable holding the path to the unix named pipe
+	// where the kernel writes the comm messages (`*CommMessage`) sent by the front-end to the program.
+	//
+	// One doesn't need to use this directly usually, just use gonbui.OpenComm instead.
+	GONB_COMM_PIPE_ENV = "GONB_COMM_PIPE"
 )
 
 type MIMEType string
@@ -36,12 +66,27 @@ const (
 	MIMETextJavascript          = "text/javascript"
 	MIMETextMarkdown            = "text/markdown"
 	MIMETextPlain               = "text/plain"
+	MIMETextLatex               = "text/latex"
 	MIMEImagePNG                = "image/png"
+	MIMEImageJPEG               = "image/jpeg"
+	MIMEImageGIF                = "image/gif"
 	MIMEImageSVG                = "image/svg+xml"
 
+	// MIMEApplicationJSON should be associated with a string with the JSON encoded content, which
+	// is sent to Jupyter as a JSON object.
+	MIMEApplicationJSON = "application/json"
+
 	// MIMEJupyterInput should be associated with an `*InputRequest`.
 	// It's a GoNB specific mime type.
 	MIMEJupyterInput = "input/jupyter"
+
+	// MIMEJupyterClearOutput should be associated with a `*ClearOutputRequest`.
+	// It's a GoNB specific mime type.
+	MIMEJupyterClearOutput = "clear_output/jupyter"
+
+	// MIMEJupyterComm should be associated with a `*CommMessage`.
+	// It's a GoNB specific mime type.
+	MIMEJupyterComm = "comm/jupyter"
 )
 
 // DisplayData mimics the contents of the "display_data" message used by Jupyter, see
@@ -59,6 +104,10 @@ type DisplayData struct {
 	// unique IDs to start with, and then re-use them to update them. If set, after the first time that it's
 	// used, it will trigger the use of the `update_display_data` as opposed to `display_data` message.
 	DisplayID string
+
+	// Update forces the use of the `update_display_data` message for the given DisplayID, even if it was not
+	// used before in the current cell execution. This allows updating blocks created by previous cells.
+	Update bool
 }
 
 // InputRequest for the front-end.
@@ -70,6 +119,38 @@ type InputRequest struct {
 	Password bool
 }
 
+// ClearOutputRequest for the front-end, to clear the output area of the cell.
+type ClearOutputRequest struct {
+	// Wait to clear the output until new output is available.
+	Wait bool
+}
+
+// Types of CommMessage, the same as the corresponding Jupyter messages.
+const (
+	CommOpen  = "comm_open"
+	CommMsg   = "comm_msg"
+	CommClose = "comm_close"
+)
+
+// CommMessage is a Jupyter "comm" message (see
+// https://jupyter-client.readthedocs.io/en/latest/messaging.html#custom-messages), exchanged between
+// the program and the front-end: sent by the program through GONB_PIPE, and received through GONB_COMM_PIPE.
+type CommMessage struct {
+	// MsgType is CommOpen, CommMsg or CommClose.
+	MsgType string
+
+	// CommID identifies the comm, it's chosen by whoever opens it.
+	CommID string
+
+	// TargetName is the name of the handler of the comm on the front-end. Only used by CommOpen.
+	TargetName string
+
+	// Data is the JSON encoded content of the message, an object. It can be left empty.
+	Data string
+}
+
 func init() {
 	gob.Register(&InputRequest{})
+	gob.Register(&ClearOutputRequest{})
+	gob.Register(&CommMessage{})
 }
@@ -0,0 +1,208 @@
+package gonbui
+
+import (
+	"fmt"
+	"github.com/pkg/errors"
+	"html"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DisplayTable displays data as an HTML table. data can be:
+//
+//   - A slice (or array) of structs, or pointers to structs: one row per element, and one column per
+//     exported field, with the field names as headers.
+//   - A slice (or array) of maps: one row per element, and one column per key found in any of the maps,
+//     sorted by the formatted key. Cells of keys missing in a map are left empty.
+//   - A slice of other values: one row per element, with a "Value" column.
+//   - A map: one row per entry, sorted by the formatted key, with a "Key" column followed by the columns
+//     of the value, as above.
+//
+// Pointers are dereferenced, and values implementing fmt.Stringer are displayed with their String() method.
+// It returns an error if data is not of one of the supported types.
+func DisplayTable(data any) error {
+	return DisplayTableWithColumns(data)
+}
+
+// DisplayTableWithColumns is like DisplayTable, but only displays the given columns, in the given order.
+// If no columns are given, all columns are displayed.
+// It returns an error if any of the columns doesn't exist.
+func DisplayTableWithColumns(data any, columns ...string) error {
+	table, err := tableHTML(data, columns)
+	if err != nil {
+		return err
+	}
+	DisplayHTML(table)
+	return nil
+}
+
+// tableHTML renders data as an HTML table, see DisplayTableWithColumns.
+func tableHTML(data any, columns []string) (string, error) {
+	value := derefValue(reflect.ValueOf(data))
+	var keys, rows []reflect.Value
+	switch value.Kind() {
+	case reflect.Slice, reflect.Array:
+		for ii := 0; ii < value.Len(); ii++ {
+			rows = append(rows, value.Index(ii))
+		}
+	case reflect.Map:
+		keys = value.MapKeys()
+		keyStrs := make([]string, len(keys))
+		for ii, key := range keys {
+			keyStrs[ii] = formatTableCell(key)
+		}
+		sort.Sort(byKeyStr{keys: keys, keyStrs: keyStrs})
+		for _, key := range keys {
+			rows = append(rows, value.MapIndex(key))
+		}
+	default:
+		return "", errors.Errorf("DisplayTable requires a slice, array or map, got %T", data)
+	}
+
+	// Find element type, dereferencing pointers, and its columns.
+	elemType := value.Type().Elem()
+	for elemType.Kind() == reflect.Pointer {
+		elemType = elemType.Elem()
+	}
+	var allColumns []string
+	fieldIndices := make(map[string][]int)
+	var rowMaps []map[string]reflect.Value // Rows that are maps, indexed by the formatted keys.
+	if keys != nil {
+		allColumns = append(allColumns, "Key")
+	}
+	if elemType.Kind() == reflect.Map {
+		rowMaps = make([]map[string]reflect.Value, len(rows))
+		mapColumns := make(map[string]bool)
+		for rowIdx, row := range rows {
+			rowMaps[rowIdx] = make(map[string]reflect.Value)
+			mapValue := derefValue(row)
+			if !mapValue.IsValid() {
+				continue
+			}
+			iter := mapValue.MapRange()
+			for iter.Next() {
+				column := formatTableCell(iter.Key())
+				rowMaps[rowIdx][column] = iter.Value()
+				mapColumns[column] = true
+			}
+		}
+		sortedColumns := make([]string, 0, len(mapColumns))
+		for column := range mapColumns {
+			sortedColumns = append(sortedColumns, column)
+		}
+		sort.Strings(sortedColumns)
+		allColumns = append(allColumns, sortedColumns...)
+	} else if elemType.Kind() == reflect.Struct {
+		for _, field := range reflect.VisibleFields(elemType) {
+			if !field.IsExported() || field.Anonymous {
+				continue
+			}
+			if _, found := fieldIndices[field.Name]; found {
+				continue
+			}
+			allColumns = append(allColumns, field.Name)
+			fieldIndices[field.Name] = field.Index
+		}
+	} else {
+		allColumns = append(allColumns, "Value")
+	}
+	if len(columns) == 0 {
+		columns = allColumns
+	} else {
+		for _, column := range columns {
+			found := false
+			for _, valid := range allColumns {
+				if column == valid {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "", errors.Errorf("DisplayTable: unknown column %q, valid columns are %q", column, allColumns)
+			}
+		}
+	}
+
+	var parts []string
+	parts = append(parts, "<table>", "<tr>")
+	for _, column := range columns {
+		parts = append(parts, fmt.Sprintf("<th>%s</th>", html.EscapeString(column)))
+	}
+	parts = append(parts, "</tr>")
+	for rowIdx, row := range rows {
+		parts = append(parts, "<tr>")
+		for _, column := range columns {
+			var cell string
+			switch {
+			case keys != nil && column == "Key":
+				cell = formatTableCell(keys[rowIdx])
+			case rowMaps != nil:
+				if mapCell, found := rowMaps[rowIdx][column]; found {
+					cell = formatTableCell(mapCell)
+				}
+			case fieldIndices[column] != nil:
+				if structValue := derefValue(row); structValue.IsValid() {
+					if field, err := structValue.FieldByIndexErr(fieldIndices[column]); err == nil {
+						cell = formatTableCell(field)
+					}
+				}
+			default:
+				cell = formatTableCell(row)
+			}
+			parts = append(parts, fmt.Sprintf("<td>%s</td>", html.EscapeString(cell)))
+		}
+		parts = append(parts, "</tr>")
+	}
+	parts = append(parts, "</table>")
+	return strings.Join(parts, "\n"), nil
+}
+
+// derefValue dereferences pointers and interfaces of value. It returns an invalid value if a nil pointer is found.
+func derefValue(value reflect.Value) reflect.Value {
+	for value.Kind() == reflect.Pointer || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return reflect.Value{}
+		}
+		value = value.Elem()
+	}
+	return value
+}
+
+// formatTableCell formats a value to be displayed in a table cell: values implementing fmt.Stringer
+// are formatted with String(), pointers are dereferenced and nil values are left empty.
+func formatTableCell(value reflect.Value) string {
+	for value.IsValid() {
+		if value.CanInterface() {
+			if stringer, ok := value.Interface().(fmt.Stringer); ok {
+				if value.Kind() != reflect.Pointer || !value.IsNil() {
+					return stringer.String()
+				}
+			}
+		}
+		if value.Kind() != reflect.Pointer && value.Kind() != reflect.Interface {
+			break
+		}
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+	if !value.IsValid() || !value.CanInterface() {
+		return ""
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// byKeyStr sorts map keys by their formatted value.
+type byKeyStr struct {
+	keys    []reflect.Value
+	keyStrs []string
+}
+
+func (b byKeyStr) Len() int           { return len(b.keys) }
+func (b byKeyStr) Less(i, j int) bool { return b.keyStrs[i] < b.keyStrs[j] }
+func (b byKeyStr) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.keyStrs[i], b.keyStrs[j] = b.keyStrs[j], b.keyStrs[i]
+}
@@ -0,0 +1,81 @@
+package gonbui
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+type tableTestPoint struct {
+	X, Y int
+}
+
+func (p tableTestPoint) String() string { return "point" }
+
+type tableTestRow struct {
+	Name     string
+	Count    *int
+	Location tableTestPoint
+	hidden   int
+}
+
+// tableRows returns the rows of the HTML table, with the cells of each row joined by "|".
+func tableRows(table string) []string {
+	var rows []string
+	var cells []string
+	for _, line := range strings.Split(table, "\n") {
+		switch {
+		case line == "<tr>":
+			cells = nil
+		case line == "</tr>":
+			rows = append(rows, strings.Join(cells, "|"))
+		case strings.HasPrefix(line, "<th>"):
+			cells = append(cells, strings.TrimSuffix(strings.TrimPrefix(line, "<th>"), "</th>"))
+		case strings.HasPrefix(line, "<td>"):
+			cells = append(cells, strings.TrimSuffix(strings.TrimPrefix(line, "<td>"), "</td>"))
+		}
+	}
+	return rows
+}
+
+func TestTableHTML(t *testing.T) {
+	count := 3
+	testCases := []struct {
+		name    string
+		data    any
+		columns []string
+		want    []string
+	}{
+		{"structs", []tableTestRow{{Name: "a", Count: &count, hidden: 1}, {Name: "<b>"}}, nil,
+			[]string{"Name|Count|Location", "a|3|point", "&lt;b&gt;||point"}},
+		{"pointers to structs", []*tableTestRow{{Name: "a"}, nil, {Name: "c", Count: &count}}, nil,
+			[]string{"Name|Count|Location", "a||point", "||", "c|3|point"}},
+		{"selected columns", []tableTestRow{{Name: "a", Count: &count}}, []string{"Count", "Name"},
+			[]string{"Count|Name", "3|a"}},
+		{"maps with missing keys", []map[string]int{{"a": 1, "b": 2}, {"c": 3}, nil}, nil,
+			[]string{"a|b|c", "1|2|", "||3", "||"}},
+		{"map of values", map[string]float64{"y": 2.5, "x": 1}, nil,
+			[]string{"Key|Value", "x|1", "y|2.5"}},
+		{"map of structs", map[int]tableTestPoint{2: {1, 2}, 1: {3, 4}}, []string{"Key", "Y"},
+			[]string{"Key|Y", "1|4", "2|2"}},
+		{"stringer values", []tableTestPoint{{1, 2}}, []string{"X"}, []string{"X", "1"}},
+		{"stringer cells", []any{tableTestPoint{}, 7, nil}, nil, []string{"Value", "point", "7", ""}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			table, err := tableHTML(tc.data, tc.columns)
+			require.NoError(t, err)
+			assert.True(t, strings.HasPrefix(table, "<table>\n") && strings.HasSuffix(table, "\n</table>"))
+			assert.Equal(t, tc.want, tableRows(table))
+		})
+	}
+
+	// Unknown or unexported columns, and unsupported types.
+	_, err := tableHTML([]tableTestRow{}, []string{"Missing"})
+	assert.ErrorContains(t, err, `unknown column "Missing"`)
+	_, err = tableHTML([]tableTestRow{}, []string{"hidden"})
+	assert.ErrorContains(t, err, `unknown column "hidden"`)
+	_, err = tableHTML(tableTestRow{}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package kernel
+
+import (
+	"strings"
+	"sync"
+)
+
+// StreamCapture buffers the contents written to the stdout and/or stderr streams (see PublishWriteStream),
+// while it is set in the Kernel with Kernel.StartCapture.
+//
+// It is used to implement the `%%capture` special command.
+type StreamCapture struct {
+	// CaptureStdout and CaptureStderr select which streams are captured.
+	CaptureStdout, CaptureStderr bool
+
+	// Show indicates that the captured contents should also be published to Jupyter.
+	Show bool
+
+	mu             sync.Mutex
+	stdout, stderr strings.Builder
+}
+
+// Stdout returns the contents captured from the stdout stream so far.
+func (c *StreamCapture) Stdout() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stdout.String()
+}
+
+// Stderr returns the contents captured from the stderr stream so far.
+func (c *StreamCapture) Stderr() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stderr.String()
+}
+
+// capture data if stream is one of the captured streams. It returns whether data was captured.
+func (c *StreamCapture) capture(stream, data string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case stream == StreamStdout && c.CaptureStdout:
+		c.stdout.WriteString(data)
+	case stream == StreamStderr && c.CaptureStderr:
+		c.stderr.WriteString(data)
+	default:
+		return false
+	}
+	return true
+}
+
+// StartCapture starts capturing the contents written to the stdout/stderr streams into capture,
+// until StopCapture is called. If a capture was already in place, it is replaced.
+func (k *Kernel) StartCapture(capture *StreamCapture) {
+	k.muCapture.Lock()
+	defer k.muCapture.Unlock()
+	k.capture = capture
+}
+
+// StopCapture stops the current capture, and returns it. It returns nil if there was no capture in place.
+func (k *Kernel) StopCapture() *StreamCapture {
+	k.muCapture.Lock()
+	defer k.muCapture.Unlock()
+	capture := k.capture
+	k.capture = nil
+	return capture
+}
+
+// currentCapture returns the capture in place, or nil if there is none.
+func (k *Kernel) currentCapture() *StreamCapture {
+	k.muCapture.Lock()
+	defer k.muCapture.Unlock()
+	return k.capture
+}
+
+// MaxCellStdoutBytes is the maximum number of bytes of the stdout of a cell kept by the Kernel, to be piped
+// into the next cell (see Kernel.LastCellStdout). Output beyond that is not kept.
+const MaxCellStdoutBytes = 1 << 20
+
+// cellStdoutBuffer holds up to MaxCellStdoutBytes of the stdout of a cell.
+type cellStdoutBuffer struct {
+	stdout    strings.Builder
+	truncated bool
+}
+
+// write appends data to the buffer, up to MaxCellStdoutBytes.
+func (b *cellStdoutBuffer) write(data string) {
+	if remaining := MaxCellStdoutBytes - b.stdout.Len(); len(data) > remaining {
+		data = data[:remaining]
+		b.truncated = true
+	}
+	b.stdout.WriteString(data)
+}
+
+// StartCellStdout should be called at the start of the execution of each cell: the stdout buffered so far
+// becomes the one of the last cell (see LastCellStdout), and a new buffer is started for the current cell.
+func (k *Kernel) StartCellStdout() {
+	k.muCellStdout.Lock()
+	defer k.muCellStdout.Unlock()
+	k.lastCellStdout = k.cellStdout
+	k.cellStdout = cellStdoutBuffer{}
+}
+
+// LastCellStdout returns the stdout of the last executed cell, as published with PublishWriteStream (including
+// the output of the Go program and of the shell commands). Only the first MaxCellStdoutBytes bytes are kept:
+// truncated is set if the output was longer than that.
+//
+// It is used to implement the `%pipe-from-last` special command.
+func (k *Kernel) LastCellStdout() (stdout string, truncated bool) {
+	k.muCellStdout.Lock()
+	defer k.muCellStdout.Unlock()
+	return k.lastCellStdout.stdout.String(), k.lastCellStdout.truncated
+}
+
+// recordCellStdout appends data written to the stdout stream to the buffer of the current cell.
+func (k *Kernel) recordCellStdout(data string) {
+	k.muCellStdout.Lock()
+	defer k.muCellStdout.Unlock()
+	k.cellStdout.write(data)
+}
@@ -0,0 +1,55 @@
+package kernel
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func TestStreamCapture(t *testing.T) {
+	k := &Kernel{}
+	msg := &MessageImpl{kernel: k}
+	k.StartCapture(&StreamCapture{CaptureStdout: true, CaptureStderr: true})
+	require.NoError(t, PublishWriteStream(msg, StreamStdout, "out 1\n"))
+	require.NoError(t, PublishWriteStream(msg, StreamStderr, "err 1\n"))
+	require.NoError(t, PublishWriteStream(msg, StreamStdout, "out 2\n"))
+	capture := k.StopCapture()
+	require.NotNil(t, capture)
+	assert.Equal(t, "out 1\nout 2\n", capture.Stdout())
+	assert.Equal(t, "err 1\n", capture.Stderr())
+	assert.Nil(t, k.StopCapture())
+
+	// Only capture one of the streams.
+	capture = &StreamCapture{CaptureStderr: true}
+	assert.False(t, capture.capture(StreamStdout, "out"))
+	assert.True(t, capture.capture(StreamStderr, "err"))
+	assert.Equal(t, "", capture.Stdout())
+	assert.Equal(t, "err", capture.Stderr())
+}
+
+func TestLastCellStdout(t *testing.T) {
+	k := &Kernel{}
+	msg := &publishRecorder{MessageImpl: MessageImpl{kernel: k}}
+	k.StartCellStdout()
+	require.NoError(t, PublishWriteStream(msg, StreamStdout, "a\n"))
+	require.NoError(t, PublishWriteStream(msg, StreamStderr, "error\n"))
+	require.NoError(t, PublishWriteStream(msg, StreamStdout, "b\n"))
+	stdout, truncated := k.LastCellStdout()
+	assert.Empty(t, stdout)
+	assert.False(t, truncated)
+
+	k.StartCellStdout()
+	stdout, truncated = k.LastCellStdout()
+	assert.Equal(t, "a\nb\n", stdout)
+	assert.False(t, truncated)
+
+	// Output beyond MaxCellStdoutBytes is not kept.
+	require.NoError(t, PublishWriteStream(msg, StreamStdout, strings.Repeat("x", MaxCellStdoutBytes-1)))
+	require.NoError(t, PublishWriteStream(msg, StreamStdout, "yz"))
+	k.StartCellStdout()
+	stdout, truncated = k.LastCellStdout()
+	assert.Len(t, stdout, MaxCellStdoutBytes)
+	assert.True(t, strings.HasSuffix(stdout, "xy"))
+	assert.True(t, truncated)
+}
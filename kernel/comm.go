@@ -0,0 +1,226 @@
+package kernel
+
+// This file implements Jupyter "comm" messages (`comm_open`, `comm_msg` and `comm_close`) exchanged between
+// the front-end and the program being executed (see gonbui.OpenComm): the program sends them through
+// GONB_PIPE, and they are published to the front-end; the ones sent by the front-end are delivered to the
+// program through a second named pipe, GONB_COMM_PIPE.
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// commConn holds the comms of one program being executed.
+type commConn struct {
+	msg     Message           // Message of the cell executing the program, used to publish comm messages.
+	encoder *gob.Encoder      // Writes to the program's GONB_COMM_PIPE, nil until the program opens it.
+	open    map[string]string // Comms opened by the program, mapped to their target names.
+}
+
+var (
+	// muComms protects currentComms.
+	muComms sync.Mutex
+
+	// currentComms are the comms of the program being executed, or nil if none is being executed.
+	currentComms *commConn
+)
+
+// startCommPipe creates the named pipe in `dir` through which the comm messages sent by the front-end are
+// delivered to the program being executed, and exports its path in the environment variable GONB_COMM_PIPE.
+//
+// When doneChan is closed the pipe is closed and removed, and the comms still open are closed.
+func startCommPipe(msg Message, dir string, doneChan <-chan struct{}) error {
+	pipePath, err := createNamedPipe(dir, "gonb_comm_pipe_")
+	if err != nil {
+		return err
+	}
+	_ = os.Setenv(protocol.GONB_COMM_PIPE_ENV, pipePath)
+	conn := &commConn{msg: msg, open: make(map[string]string)}
+	muComms.Lock()
+	currentComms = conn
+	muComms.Unlock()
+
+	// Synchronize pipe: if it's not opened by the program being executed, we open it ourselves
+	// for reading, to unblock the `os.OpenFile` for writing below. See StartNamedPipe.
+	var muFifo sync.Mutex
+	fifoOpenedForWriting := false
+	go func() {
+		<-doneChan
+		muFifo.Lock()
+		if !fifoOpenedForWriting {
+			r, err := os.OpenFile(pipePath, os.O_RDONLY|syscall.O_NONBLOCK, 0600)
+			if err == nil {
+				_ = r.Close()
+			}
+		}
+		muFifo.Unlock()
+		_ = os.Remove(pipePath)
+		conn.closeAll()
+	}()
+
+	go func() {
+		// Notice that opening pipeWriter blocks, until the other end (the program being executed) opens it too.
+		pipeWriter, err := os.OpenFile(pipePath, os.O_WRONLY, 0600)
+		if err != nil {
+			klog.Warningf("Failed to open pipe (Mkfifo) %q for writing: %+v", pipePath, err)
+			return
+		}
+		muFifo.Lock()
+		fifoOpenedForWriting = true
+		muFifo.Unlock()
+		muComms.Lock()
+		conn.encoder = gob.NewEncoder(pipeWriter)
+		muComms.Unlock()
+
+		// Wait till channel is closed and then close writer.
+		<-doneChan
+		muComms.Lock()
+		conn.encoder = nil
+		muComms.Unlock()
+		_ = pipeWriter.Close()
+	}()
+	return nil
+}
+
+// closeAll closes the comms still open when the program exits, and notifies the front-end.
+func (conn *commConn) closeAll() {
+	muComms.Lock()
+	defer muComms.Unlock()
+	if currentComms == conn {
+		currentComms = nil
+	}
+	for _, commID := range SortedKeys(conn.open) {
+		if err := publishComm(conn.msg, protocol.CommClose, commID, "", ""); err != nil {
+			klog.Errorf("Failed to publish comm_close for comm %q: %+v", commID, err)
+		}
+	}
+	conn.open = make(map[string]string)
+}
+
+// publishComm publishes a comm message to the front-end. data is the JSON encoded content, an empty object
+// if empty. It is a no-op if msg is nil (e.g.: in tests).
+func publishComm(msg Message, msgType, commID, targetName, data string) error {
+	if msg == nil {
+		return nil
+	}
+	if data == "" {
+		data = "{}"
+	}
+	content := map[string]any{
+		"comm_id": commID,
+		"data":    json.RawMessage(data),
+	}
+	if msgType == protocol.CommOpen {
+		content["target_name"] = targetName
+	}
+	return msg.Publish(msgType, content)
+}
+
+// processCommMessage publishes to the front-end a comm message sent by the program being executed.
+func processCommMessage(msg Message, req *protocol.CommMessage) {
+	klog.V(2).Infof("Received CommMessage %+v", req)
+	switch req.MsgType {
+	case protocol.CommOpen, protocol.CommMsg, protocol.CommClose:
+	default:
+		reportCellError(msg, errors.Errorf("unknown comm message type %q", req.MsgType))
+		return
+	}
+	if req.Data != "" && !json.Valid([]byte(req.Data)) {
+		reportCellError(msg, errors.Errorf("invalid JSON data in %s for comm %q", req.MsgType, req.CommID))
+		return
+	}
+	muComms.Lock()
+	conn := currentComms
+	if conn != nil {
+		switch req.MsgType {
+		case protocol.CommOpen:
+			conn.open[req.CommID] = req.TargetName
+		case protocol.CommClose:
+			delete(conn.open, req.CommID)
+		}
+	}
+	muComms.Unlock()
+	if err := publishComm(msg, req.MsgType, req.CommID, req.TargetName, req.Data); err != nil {
+		klog.Errorf("Failed to publish %s (ignoring): %+v", req.MsgType, err)
+	}
+}
+
+// DeliverComm should be called when a comm message (`comm_open`, `comm_msg` or `comm_close`) is received
+// from the front-end. Messages to comms opened by the program being executed are delivered to it, others
+// are ignored.
+//
+// Comms opened by the front-end are not supported, and are closed right away.
+func DeliverComm(msg Message) error {
+	msgType := msg.ComposedMsg().Header.MsgType
+	content, ok := msg.ComposedMsg().Content.(map[string]any)
+	if !ok {
+		return errors.Errorf("invalid %s message content", msgType)
+	}
+	commID, _ := content["comm_id"].(string)
+	if msgType == protocol.CommOpen {
+		targetName, _ := content["target_name"].(string)
+		klog.Warningf("Comm %q opened by the front-end with target %q not supported, closing it", commID, targetName)
+		return publishComm(msg, protocol.CommClose, commID, "", "")
+	}
+	data := ""
+	if dataAny, found := content["data"]; found && dataAny != nil {
+		dataJSON, err := json.Marshal(dataAny)
+		if err != nil {
+			return errors.Wrapf(err, "failed to encode data of %s for comm %q", msgType, commID)
+		}
+		data = string(dataJSON)
+	}
+
+	// The encoder is copied, and used after releasing muComms: writing to the pipe blocks until the program
+	// reads it, and it shouldn't block the publishing of the comm messages sent by the program.
+	muComms.Lock()
+	conn := currentComms
+	if conn == nil || conn.encoder == nil {
+		muComms.Unlock()
+		klog.Warningf("Received %s for comm %q, but no program is listening: ignoring", msgType, commID)
+		return nil
+	}
+	if _, found := conn.open[commID]; !found {
+		muComms.Unlock()
+		klog.Warningf("Received %s for unknown comm %q: ignoring", msgType, commID)
+		return nil
+	}
+	if msgType == protocol.CommClose {
+		delete(conn.open, commID)
+	}
+	encoder := conn.encoder
+	muComms.Unlock()
+	err := encoder.Encode(&protocol.CommMessage{MsgType: msgType, CommID: commID, Data: data})
+	if err != nil {
+		klog.Warningf("Failed to deliver %s for comm %q to the program: %+v", msgType, commID, err)
+	}
+	return nil
+}
+
+// SendCommInfo replies to a `comm_info_request` with the comms opened by the program being executed,
+// optionally filtered by the `target_name` of the request.
+func SendCommInfo(msg Message) error {
+	content, _ := msg.ComposedMsg().Content.(map[string]any)
+	targetName, _ := content["target_name"].(string)
+	commsInfo := make(map[string]any)
+	muComms.Lock()
+	if currentComms != nil {
+		for commID, commTarget := range currentComms.open {
+			if targetName == "" || targetName == commTarget {
+				commsInfo[commID] = map[string]any{"target_name": commTarget}
+			}
+		}
+	}
+	muComms.Unlock()
+	return msg.Reply("comm_info_reply", map[string]any{
+		"status": "ok",
+		"comms":  commsInfo,
+	})
+}
@@ -0,0 +1,80 @@
+package kernel
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestComms(t *testing.T) {
+	msg := &publishRecorder{}
+	doneChan := make(chan struct{})
+	require.NoError(t, startCommPipe(msg, t.TempDir(), doneChan))
+
+	// Program side of GONB_COMM_PIPE.
+	pipeReader, err := os.Open(os.Getenv(protocol.GONB_COMM_PIPE_ENV))
+	require.NoError(t, err)
+	defer func() { _ = pipeReader.Close() }()
+	require.Eventually(t, func() bool {
+		muComms.Lock()
+		defer muComms.Unlock()
+		return currentComms != nil && currentComms.encoder != nil
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// Comm opened by the program is published to the front-end.
+	processCommMessage(msg, &protocol.CommMessage{MsgType: protocol.CommOpen, CommID: "c1", TargetName: "button", Data: `{"a":1}`})
+	require.Equal(t, []string{"comm_open"}, msg.msgTypes)
+	assert.Equal(t, map[string]any{"comm_id": "c1", "target_name": "button", "data": json.RawMessage(`{"a":1}`)},
+		msg.contents[0])
+
+	// Messages from the front-end are delivered to the program, if for a known comm.
+	fromFrontEnd := func(msgType, commID string, data map[string]any) Message {
+		m := &publishRecorder{}
+		m.Composed.Header.MsgType = msgType
+		m.Composed.Content = map[string]any{"comm_id": commID, "data": data}
+		return m
+	}
+	require.NoError(t, DeliverComm(fromFrontEnd(protocol.CommMsg, "unknown", nil)))
+	require.NoError(t, DeliverComm(fromFrontEnd(protocol.CommMsg, "c1", map[string]any{"event": "click"})))
+	decoder := gob.NewDecoder(pipeReader)
+	got := &protocol.CommMessage{}
+	require.NoError(t, decoder.Decode(got))
+	assert.Equal(t, &protocol.CommMessage{MsgType: protocol.CommMsg, CommID: "c1", Data: `{"event":"click"}`}, got)
+
+	// Messages from the program are published while a delivery is blocked, waiting for the program to read it.
+	delivered := make(chan error, 1)
+	go func() {
+		bigData := map[string]any{"blob": strings.Repeat("x", 1<<20)}
+		delivered <- DeliverComm(fromFrontEnd(protocol.CommMsg, "c1", bigData))
+	}()
+	processCommMessage(msg, &protocol.CommMessage{MsgType: protocol.CommMsg, CommID: "c1", Data: `{"b":2}`})
+	require.Equal(t, []string{"comm_open", "comm_msg"}, msg.msgTypes)
+	got = &protocol.CommMessage{}
+	require.NoError(t, decoder.Decode(got))
+	assert.Len(t, got.Data, 1<<20+len(`{"blob":""}`))
+	require.NoError(t, <-delivered)
+
+	// Comms opened by the front-end are closed right away.
+	frontEndOpen := fromFrontEnd(protocol.CommOpen, "c2", nil).(*publishRecorder)
+	require.NoError(t, DeliverComm(frontEndOpen))
+	assert.Equal(t, []string{"comm_close"}, frontEndOpen.msgTypes)
+
+	// Invalid messages from the program are reported as errors (in the cell's stderr), and not published.
+	processCommMessage(msg, &protocol.CommMessage{MsgType: protocol.CommMsg, CommID: "c1", Data: `{invalid`})
+	assert.Equal(t, []string{"comm_open", "comm_msg", "stream"}, msg.msgTypes)
+
+	// Comms still open are closed when the program exits.
+	close(doneChan)
+	require.Eventually(t, func() bool {
+		muComms.Lock()
+		defer muComms.Unlock()
+		return currentComms == nil && len(msg.msgTypes) == 4
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"comm_open", "comm_msg", "stream", "comm_close"}, msg.msgTypes)
+}
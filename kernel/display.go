@@ -5,12 +5,14 @@ package kernel
 
 import (
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"github.com/janpfeifer/gonb/gonbui/protocol"
 	"github.com/pkg/errors"
 	"io"
 	"k8s.io/klog/v2"
 	"os"
+	"strings"
 )
 
 // PollGonbPipe will continuously read for incoming requests for displaying content on the notebook.
@@ -38,6 +40,26 @@ func PollGonbPipe(msg Message, pipeReader *os.File, cmdStdin io.Writer) {
 			processInputRequest(msg, cmdStdin, req)
 			continue
 		}
+		if reqAny, found := data.Data[protocol.MIMEJupyterClearOutput]; found {
+			req, ok := reqAny.(*protocol.ClearOutputRequest)
+			if !ok {
+				reportCellError(msg, errors.New("A MIMEJupyterClearOutput sent to GONB_PIPE without an associated protocol.ClearOutputRequest!?"))
+				continue
+			}
+			if err := PublishClearOutput(msg, req.Wait); err != nil {
+				klog.Errorf("Failed to clear output (ignoring): %v", err)
+			}
+			continue
+		}
+		if reqAny, found := data.Data[protocol.MIMEJupyterComm]; found {
+			req, ok := reqAny.(*protocol.CommMessage)
+			if !ok {
+				reportCellError(msg, errors.New("A MIMEJupyterComm sent to GONB_PIPE without an associated protocol.CommMessage!?"))
+				continue
+			}
+			processCommMessage(msg, req)
+			continue
+		}
 		processDisplayData(msg, data, knownBlockIds)
 	}
 }
@@ -69,6 +91,12 @@ func logDisplayData(data MIMEMap) {
 	}
 }
 
+// isJSONMIMEType returns whether the content of the MIME type is JSON: "application/json" or a type
+// with the "+json" suffix (e.g.: "application/vnd.vegalite.v5+json").
+func isJSONMIMEType(mimeType protocol.MIMEType) bool {
+	return mimeType == protocol.MIMEApplicationJSON || strings.HasSuffix(string(mimeType), "+json")
+}
+
 // processDisplayData process an incoming `protocol.DisplayData` object.
 func processDisplayData(msg Message, data *protocol.DisplayData, knownBlockIds map[string]struct{}) {
 	// Log info about what is being displayed.
@@ -78,6 +106,10 @@ func processDisplayData(msg Message, data *protocol.DisplayData, knownBlockIds m
 		Transient: make(MIMEMap),
 	}
 	for mimeType, content := range data.Data {
+		if jsonStr, ok := content.(string); ok && isJSONMIMEType(mimeType) {
+			// Jupyter expects the JSON content as an object, not as a string.
+			content = json.RawMessage(jsonStr)
+		}
 		msgData.Data[string(mimeType)] = content
 	}
 	if klog.V(1).Enabled() {
@@ -89,7 +121,7 @@ func processDisplayData(msg Message, data *protocol.DisplayData, knownBlockIds m
 	isUpdate := false
 	if data.DisplayID != "" {
 		msgData.Transient["display_id"] = data.DisplayID
-		if _, found := knownBlockIds[data.DisplayID]; found {
+		if _, found := knownBlockIds[data.DisplayID]; found || data.Update {
 			isUpdate = true
 		}
 		knownBlockIds[data.DisplayID] = struct{}{}
@@ -107,6 +139,10 @@ func processDisplayData(msg Message, data *protocol.DisplayData, knownBlockIds m
 
 func processInputRequest(msg Message, cmdStdin io.Writer, req *protocol.InputRequest) {
 	klog.V(2).Infof("Received InputRequest %+v", req)
+	if !AllowStdin(msg) {
+		reportCellError(msg, errors.New("input requested, but the front-end doesn't allow input prompting"))
+		return
+	}
 	writeStdinFn := func(original, input *MessageImpl) error {
 		content := input.Composed.Content.(map[string]any)
 		value := content["value"].(string) + "\n"
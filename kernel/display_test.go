@@ -0,0 +1,77 @@
+package kernel
+
+import (
+	"encoding/json"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+// publishRecorder is a Message that records the published messages.
+type publishRecorder struct {
+	MessageImpl
+	msgTypes []string
+	contents []any
+}
+
+func (r *publishRecorder) Publish(msgType string, content interface{}) error {
+	r.msgTypes = append(r.msgTypes, msgType)
+	r.contents = append(r.contents, content)
+	return nil
+}
+
+func TestProcessDisplayDataWithID(t *testing.T) {
+	msg := &publishRecorder{}
+	knownBlockIds := make(map[string]struct{})
+	html := func(content string) map[protocol.MIMEType]any {
+		return map[protocol.MIMEType]any{protocol.MIMETextHTML: content}
+	}
+	processDisplayData(msg, &protocol.DisplayData{Data: html("0"), DisplayID: "counter"}, knownBlockIds)
+	processDisplayData(msg, &protocol.DisplayData{Data: html("1"), DisplayID: "counter"}, knownBlockIds)
+	processDisplayData(msg, &protocol.DisplayData{Data: html("x")}, knownBlockIds)
+	// Explicit update of a block not created in this execution (e.g.: by a previous cell).
+	processDisplayData(msg, &protocol.DisplayData{Data: html("y"), DisplayID: "other", Update: true}, knownBlockIds)
+	require.Equal(t, []string{"display_data", "update_display_data", "display_data", "update_display_data"}, msg.msgTypes)
+
+	transient := func(ii int) MIMEMap {
+		return msg.contents[ii].(struct {
+			Data      MIMEMap `json:"data"`
+			Metadata  MIMEMap `json:"metadata"`
+			Transient MIMEMap `json:"transient"`
+		}).Transient
+	}
+	assert.Equal(t, MIMEMap{"display_id": "counter"}, transient(0))
+	assert.Equal(t, MIMEMap{"display_id": "counter"}, transient(1))
+	assert.Empty(t, transient(2))
+	assert.Equal(t, MIMEMap{"display_id": "other"}, transient(3))
+}
+
+func TestProcessDisplayDataJSON(t *testing.T) {
+	msg := &publishRecorder{}
+	processDisplayData(msg, &protocol.DisplayData{Data: map[protocol.MIMEType]any{
+		protocol.MIMEApplicationJSON:       `{"a": 1}`,
+		protocol.MIMETextPlain:             `{"a": 1}`,
+		"application/vnd.vegalite.v5+json": `{"b": 2}`,
+	}}, make(map[string]struct{}))
+	require.Equal(t, []string{"display_data"}, msg.msgTypes)
+	data := msg.contents[0].(struct {
+		Data      MIMEMap `json:"data"`
+		Metadata  MIMEMap `json:"metadata"`
+		Transient MIMEMap `json:"transient"`
+	}).Data
+	// JSON is sent as an object, not as a string.
+	assert.Equal(t, json.RawMessage(`{"a": 1}`), data[string(protocol.MIMEApplicationJSON)])
+	assert.Equal(t, `{"a": 1}`, data[protocol.MIMETextPlain])
+	assert.Equal(t, json.RawMessage(`{"b": 2}`), data["application/vnd.vegalite.v5+json"])
+}
+
+func TestPublishClearOutput(t *testing.T) {
+	msg := &publishRecorder{}
+	require.NoError(t, PublishClearOutput(msg, true))
+	require.Equal(t, []string{"clear_output"}, msg.msgTypes)
+	assert.Equal(t, struct {
+		Wait bool `json:"wait"`
+	}{Wait: true}, msg.contents[0])
+	require.NoError(t, PublishClearOutput(nil, false))
+}
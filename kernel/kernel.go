@@ -101,6 +101,23 @@ type Kernel struct {
 	// Interrupted indicates whether shell currently being executed was Interrupted.
 	Interrupted atomic.Bool
 
+	// interruptCtx is cancelled when the kernel is interrupted (see Kernel.Interrupt), and then
+	// replaced by a new one. It's protected by muInterrupt.
+	muInterrupt     sync.Mutex
+	interruptCtx    context.Context
+	interruptCancel context.CancelFunc
+
+	// capture, if set, buffers the contents written to the stdout/stderr streams. See Kernel.StartCapture.
+	// It's protected by muCapture.
+	muCapture sync.Mutex
+	capture   *StreamCapture
+
+	// cellStdout buffers the stdout of the cell being executed, and lastCellStdout the one of the previous cell,
+	// see Kernel.LastCellStdout. They are protected by muCellStdout.
+	muCellStdout   sync.Mutex
+	cellStdout     cellStdoutBuffer
+	lastCellStdout cellStdoutBuffer
+
 	// stdinMsg holds the MessageImpl that last asked from input from stdin (MessageImpl.PromptInput).
 	stdinMsg *MessageImpl
 	stdinFn  OnInputFn // Callback when stdin input is received.
@@ -147,8 +164,8 @@ func (k *Kernel) HandleInterrupt() {
 			for {
 				select {
 				case <-k.sigintC:
-					k.Interrupted.Store(true)
 					log.Printf("INTERRUPT received")
+					k.Interrupt()
 				case <-k.stop:
 					return // kernel stopped.
 				}
@@ -157,6 +174,36 @@ func (k *Kernel) HandleInterrupt() {
 	}
 }
 
+// Interrupt marks the kernel as Interrupted and cancels the context returned by InterruptCtx, which
+// stops the programs being executed. A new context is created for the executions that follow.
+//
+// It is called when a SIGINT is received (see HandleInterrupt) or when an `interrupt_request` message
+// is received.
+func (k *Kernel) Interrupt() {
+	k.Interrupted.Store(true)
+	k.muInterrupt.Lock()
+	defer k.muInterrupt.Unlock()
+	k.interruptCancel()
+	k.interruptCtx, k.interruptCancel = context.WithCancel(context.Background())
+}
+
+// InterruptCtx returns a context that is cancelled the next time the kernel is interrupted, see
+// Kernel.Interrupt.
+func (k *Kernel) InterruptCtx() context.Context {
+	k.muInterrupt.Lock()
+	defer k.muInterrupt.Unlock()
+	return k.interruptCtx
+}
+
+// InterruptContext returns the context that is cancelled when the kernel connected to msg is interrupted,
+// see Kernel.InterruptCtx. If msg is nil (e.g.: in tests) it returns a context that is never cancelled.
+func InterruptContext(msg Message) context.Context {
+	if msg == nil || msg.Kernel() == nil {
+		return context.Background()
+	}
+	return msg.Kernel().InterruptCtx()
+}
+
 // ExitWait will wait for the kernel to be stopped and all polling
 // goroutines to finish.
 func (k *Kernel) ExitWait() {
@@ -217,6 +264,7 @@ func NewKernel(connectionFile string) (*Kernel, error) {
 		stdin:   make(chan Message, 1),
 		control: make(chan Message, 1),
 	}
+	k.interruptCtx, k.interruptCancel = context.WithCancel(context.Background())
 
 	// Parse the connection info.
 	var connInfo connectionInfo
@@ -236,18 +284,19 @@ func NewKernel(connectionFile string) (*Kernel, error) {
 
 	// Set polling functions that will listen to the sockets and forward
 	// messages (or errors) to the corresponding channels.
-	poll := func(msgChan chan Message, sck zmq4.Socket) {
+	poll := func(msgChan chan Message, sck *SyncSocket) {
 		k.pollingWait.Add(1)
 		go func() {
 			defer close(msgChan)
 			for {
-				zmqMsg, err := sck.Recv()
-				var msg Message
+				zmqMsg, err := sck.Socket.Recv()
+				var msg *MessageImpl
 				if err != nil {
 					msg = &MessageImpl{kernel: k, err: err}
 				} else {
-					msg = k.FromWireMsg(zmqMsg)
+					msg = k.FromWireMsg(zmqMsg).(*MessageImpl)
 				}
+				msg.replySocket = sck // Replies are sent back to the socket the message came from.
 				select {
 				case msgChan <- msg:
 				case <-k.stop:
@@ -258,9 +307,9 @@ func NewKernel(connectionFile string) (*Kernel, error) {
 	}
 
 	k.pollHeartbeat()
-	poll(k.shell, k.sockets.ShellSocket.Socket)
-	poll(k.stdin, k.sockets.StdinSocket.Socket)
-	poll(k.control, k.sockets.ControlSocket.Socket)
+	poll(k.shell, &k.sockets.ShellSocket)
+	poll(k.stdin, &k.sockets.StdinSocket)
+	poll(k.control, &k.sockets.ControlSocket)
 	return k, nil
 }
 
@@ -133,7 +133,7 @@ type Message interface {
 	DeliverInput() error
 
 	// Reply creates a new ComposedMsg and sends it back to the return identities over the
-	// Shell channel.
+	// channel the message was received from (Shell or Control).
 	Reply(msgType string, content interface{}) error
 }
 
@@ -144,6 +144,10 @@ type MessageImpl struct {
 	Composed   ComposedMsg
 	Identities [][]byte
 	kernel     *Kernel
+
+	// replySocket is the socket the message was received from, where replies are sent to.
+	// If nil, replies are sent to the Shell socket.
+	replySocket *SyncSocket
 }
 
 // Error returns the error receiving the message, or nil if no error.
@@ -214,6 +218,20 @@ func (m *MessageImpl) Publish(msgType string, content interface{}) error {
 	})
 }
 
+// AllowStdin returns whether the front-end that sent msg accepts input requests (see Message.PromptInput),
+// as indicated by the `allow_stdin` field of its `execute_request`. It returns false if msg is nil.
+func AllowStdin(msg Message) bool {
+	if msg == nil {
+		return false
+	}
+	content, ok := msg.ComposedMsg().Content.(map[string]any)
+	if !ok {
+		return false
+	}
+	allowStdin, _ := content["allow_stdin"].(bool)
+	return allowStdin
+}
+
 // OnInputFn is the callback function. It receives the original shell execute
 // message and the message with the incoming input value.
 type OnInputFn func(original, input *MessageImpl) error
@@ -271,7 +289,7 @@ func (m *MessageImpl) DeliverInput() error {
 }
 
 // Reply creates a new ComposedMsg and sends it back to the return identities over the
-// Shell channel.
+// channel the message was received from (Shell or Control).
 func (m *MessageImpl) Reply(msgType string, content interface{}) error {
 	msg, err := NewComposed(msgType, m.Composed)
 	if err != nil {
@@ -280,8 +298,12 @@ func (m *MessageImpl) Reply(msgType string, content interface{}) error {
 
 	msg.Content = content
 	klog.V(1).Infof("Reply(%s):", msgType)
-	return m.kernel.sockets.ShellSocket.RunLocked(func(shell zmq4.Socket) error {
-		return m.sendMessage(shell, msg)
+	replySocket := m.replySocket
+	if replySocket == nil {
+		replySocket = &m.kernel.sockets.ShellSocket
+	}
+	return replySocket.RunLocked(func(socket zmq4.Socket) error {
+		return m.sendMessage(socket, msg)
 	})
 }
 
@@ -394,6 +416,49 @@ func PublishDisplayDataWithMarkdown(msg Message, markdown string) error {
 	return PublishDisplayData(msg, msgData)
 }
 
+// PublishDisplayDataWithLatex is a shortcut to PublishDisplayData for LaTeX content.
+func PublishDisplayDataWithLatex(msg Message, latex string) error {
+	msgData := Data{
+		Data:      make(MIMEMap, 1),
+		Metadata:  make(MIMEMap),
+		Transient: make(MIMEMap),
+	}
+	msgData.Data[string(protocol.MIMETextLatex)] = latex
+	if klog.V(1).Enabled() {
+		logDisplayData(msgData.Data)
+	}
+	return PublishDisplayData(msg, msgData)
+}
+
+// PublishDisplayDataWithSVG is a shortcut to PublishDisplayData for SVG content.
+func PublishDisplayDataWithSVG(msg Message, svg string) error {
+	msgData := Data{
+		Data:      make(MIMEMap, 1),
+		Metadata:  make(MIMEMap),
+		Transient: make(MIMEMap),
+	}
+	msgData.Data[string(protocol.MIMEImageSVG)] = svg
+	if klog.V(1).Enabled() {
+		logDisplayData(msgData.Data)
+	}
+	return PublishDisplayData(msg, msgData)
+}
+
+// PublishClearOutput clears the output area of the cell being executed. If wait is true, the front-end
+// waits until new output is available before clearing, which reduces flickering when the output
+// is being replaced.
+func PublishClearOutput(msg Message, wait bool) error {
+	if msg == nil {
+		// Ignore if there is no message to reply to.
+		return nil
+	}
+	return msg.Publish("clear_output", struct {
+		Wait bool `json:"wait"`
+	}{
+		Wait: wait,
+	})
+}
+
 const (
 	// StreamStdout defines the stream name for standard out on the front-end. It
 	// is used in `PublishWriteStream` to specify the stream to write to.
@@ -406,11 +471,22 @@ const (
 
 // PublishWriteStream prints the data string to a stream on the front-end. This is
 // either `StreamStdout` or `StreamStderr`.
+//
+// If the stream is being captured (see Kernel.StartCapture), data is buffered instead, and
+// only published if the capture is configured to show it.
 func PublishWriteStream(msg Message, stream string, data string) error {
 	if msg == nil {
 		klog.Infof("PublishWriteStream(nil, %s): %q", stream, data)
 		return nil
 	}
+	if k := msg.Kernel(); k != nil {
+		if stream == StreamStdout {
+			k.recordCellStdout(data)
+		}
+		if capture := k.currentCapture(); capture != nil && capture.capture(stream, data) && !capture.Show {
+			return nil
+		}
+	}
 	return msg.Publish("stream",
 		struct {
 			Stream string `json:"name"`
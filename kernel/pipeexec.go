@@ -1,6 +1,8 @@
 package kernel
 
 import (
+	"context"
+	"fmt"
 	"github.com/janpfeifer/gonb/gonbui/protocol"
 	"github.com/pkg/errors"
 	"io"
@@ -15,15 +17,22 @@ import (
 // PipeExecToJupyterBuilder holds the configuration to executing a command that is piped to Jupyter.
 // Use PipeExecToJupyter to create it.
 type PipeExecToJupyterBuilder struct {
-	msg     Message
-	command string
-	args    []string
-	dir     string
+	msg      Message
+	command  string
+	args     []string
+	dir      string
+	env      []string
+	ctx      context.Context
+	timeout  time.Duration
+	timedOut bool
 
 	stdoutWriter, stderrWriter io.Writer
 
+	stdinContent        string
 	millisecondsToInput int
 	inputPassword       bool
+
+	processState *os.ProcessState
 }
 
 // PipeExecToJupyter creates a builder that will execute the given command (command plus arguments)
@@ -47,6 +56,44 @@ func (builder *PipeExecToJupyterBuilder) InDir(dir string) *PipeExecToJupyterBui
 	return builder
 }
 
+// WithEnv configures the PipeExecToJupyterBuilder to execute the command with the given environment, in the
+// "KEY=value" format of os.Environ. If not set, the command inherits the environment of the kernel.
+func (builder *PipeExecToJupyterBuilder) WithEnv(env []string) *PipeExecToJupyterBuilder {
+	builder.env = env
+	return builder
+}
+
+// InterruptGracePeriod is the time given for a program to exit after it was interrupted
+// with a SIGINT, before it is killed with a SIGKILL. See PipeExecToJupyterBuilder.WithContext.
+var InterruptGracePeriod = 2 * time.Second
+
+// DefaultMaxOutputBytes is the default value of MaxOutputBytes.
+const DefaultMaxOutputBytes = 5 << 20
+
+// MaxOutputBytes is the maximum number of bytes of output (stdout and stderr combined) of a command executed
+// with PipeExecToJupyter. Further output is discarded, and a notice is written to stderr, to protect the
+// front-end from runaway programs. A value <= 0 means no limit. It can be set with `%maxoutput`.
+var MaxOutputBytes int64 = DefaultMaxOutputBytes
+
+// WithContext configures the PipeExecToJupyterBuilder to interrupt the command if ctx is cancelled:
+// a SIGINT is sent to the command process group, followed by a SIGKILL if it is still running
+// after InterruptGracePeriod.
+//
+// Usually, ctx is the one returned by InterruptContext, which is cancelled when Jupyter interrupts
+// the kernel.
+func (builder *PipeExecToJupyterBuilder) WithContext(ctx context.Context) *PipeExecToJupyterBuilder {
+	builder.ctx = ctx
+	return builder
+}
+
+// WithTimeout configures the PipeExecToJupyterBuilder to interrupt the command if it runs for longer than
+// timeout, in the same way as when the context given to WithContext is cancelled. A timeout <= 0 means
+// no timeout. A message is written to stderr when the timeout is exceeded, see also TimedOut.
+func (builder *PipeExecToJupyterBuilder) WithTimeout(timeout time.Duration) *PipeExecToJupyterBuilder {
+	builder.timeout = timeout
+	return builder
+}
+
 // WithStderr configures piping of stderr to the given `io.Writer`.
 func (builder *PipeExecToJupyterBuilder) WithStderr(stderrWriter io.Writer) *PipeExecToJupyterBuilder {
 	builder.stderrWriter = stderrWriter
@@ -81,6 +128,35 @@ func (builder *PipeExecToJupyterBuilder) WithPassword(millisecondsWait int) *Pip
 	return builder
 }
 
+// WithStdinContent configures the PipeExecToJupyterBuilder to write content to the stdin of the command.
+// The stdin is closed afterwards, unless WithInputs or WithPassword are also configured, in which case
+// it is kept open for the inputs from Jupyter.
+func (builder *PipeExecToJupyterBuilder) WithStdinContent(content string) *PipeExecToJupyterBuilder {
+	builder.stdinContent = content
+	return builder
+}
+
+// ProcessState returns the state of the executed command, available after Exec returns. It is
+// nil if the command was not executed.
+func (builder *PipeExecToJupyterBuilder) ProcessState() *os.ProcessState {
+	return builder.processState
+}
+
+// TimedOut returns whether the executed command was interrupted because it exceeded the timeout
+// configured with WithTimeout. Available after Exec returns.
+func (builder *PipeExecToJupyterBuilder) TimedOut() bool {
+	return builder.timedOut
+}
+
+// ExitCode returns the exit code of the executed command, available after Exec returns. It is
+// -1 if the command was not executed or was terminated by a signal.
+func (builder *PipeExecToJupyterBuilder) ExitCode() int {
+	if builder.processState == nil {
+		return -1
+	}
+	return builder.processState.ExitCode()
+}
+
 // Exec executes the configured PipeExecToJupyter configuration.
 //
 // It returns an error if it failed to execute or created the pipes -- but not if the executed
@@ -88,8 +164,21 @@ func (builder *PipeExecToJupyterBuilder) WithPassword(millisecondsWait int) *Pip
 func (builder *PipeExecToJupyterBuilder) Exec() error {
 	klog.Infof("Executing: %s %v", builder.command, builder.args)
 
+	if builder.timeout > 0 {
+		if builder.ctx == nil {
+			builder.ctx = context.Background()
+		}
+		var cancel context.CancelFunc
+		builder.ctx, cancel = context.WithTimeout(builder.ctx, builder.timeout)
+		defer cancel()
+	}
 	cmd := exec.Command(builder.command, builder.args...)
 	cmd.Dir = builder.dir
+	cmd.Env = builder.env
+	if builder.ctx != nil {
+		// Run on its own process group, so the interruption reaches any sub-processes.
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
 
 	cmdStdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -111,18 +200,20 @@ func (builder *PipeExecToJupyterBuilder) Exec() error {
 	if builder.stderrWriter == nil {
 		builder.stderrWriter = NewJupyterStreamWriter(builder.msg, StreamStderr)
 	}
+	limiter := newOutputLimiter(builder.msg, MaxOutputBytes)
+	stdoutWriter, stderrWriter := limiter.wrap(builder.stdoutWriter), limiter.wrap(builder.stderrWriter)
 	var streamersWG sync.WaitGroup
 	streamersWG.Add(2)
 	go func() {
 		defer streamersWG.Done()
-		_, err := io.Copy(builder.stdoutWriter, cmdStdout)
+		_, err := io.Copy(stdoutWriter, cmdStdout)
 		if err != nil {
 			klog.Errorf("Failed copying execution stdout: %+v", err)
 		}
 	}()
 	go func() {
 		defer streamersWG.Done()
-		_, err := io.Copy(builder.stderrWriter, cmdStderr)
+		_, err := io.Copy(stderrWriter, cmdStderr)
 		if err != nil && err != io.EOF {
 			klog.Errorf("Failed copying execution stderr: %+v", err)
 		}
@@ -201,11 +292,38 @@ func (builder *PipeExecToJupyterBuilder) Exec() error {
 		return errors.WithMessagef(err, "failed to start to execute command %q", builder.command)
 	}
 
+	if builder.stdinContent != "" {
+		go func() {
+			// Write concurrently, since the command may not read all of its stdin.
+			if _, err := io.WriteString(cmdStdin, builder.stdinContent); err != nil {
+				klog.Warningf("failed to write to stdin of %q %v: %+v", builder.command, builder.args, err)
+			}
+			if builder.millisecondsToInput <= 0 {
+				_ = cmdStdin.Close()
+			}
+		}()
+	}
+
+	processDone := make(chan struct{})
+	if builder.ctx != nil {
+		go builder.interruptOnCancel(cmd, processDone)
+	}
+
 	// Wait for output pipes to finish.
 	streamersWG.Wait()
-	if err := cmd.Wait(); err != nil {
-		errMsg := err.Error() + "\n"
-		if builder.msg.Kernel().Interrupted.Load() {
+	waitErr := cmd.Wait()
+	close(processDone)
+	builder.processState = cmd.ProcessState
+	if waitErr != nil {
+		errMsg := waitErr.Error() + "\n"
+		interrupted := builder.ctx != nil && builder.ctx.Err() != nil
+		if builder.msg != nil && builder.msg.Kernel() != nil && builder.msg.Kernel().Interrupted.Load() {
+			interrupted = true
+		}
+		builder.timedOut = builder.timeout > 0 && errors.Is(builder.ctx.Err(), context.DeadlineExceeded)
+		if builder.timedOut {
+			errMsg = fmt.Sprintf("Timeout: %q killed after running for more than %s\n", builder.command, builder.timeout) + errMsg
+		} else if interrupted {
 			errMsg = "^C\n" + errMsg
 		}
 		_ = PublishWriteStream(builder.msg, StreamStderr, errMsg)
@@ -216,31 +334,71 @@ func (builder *PipeExecToJupyterBuilder) Exec() error {
 	return nil
 }
 
-// StartNamedPipe creates a named pipe in `dir` and starts a listener (on a separate goroutine) that reads
-// the pipe and displays rich content. It also exports environment variable GONB_FIFO announcing the name of the
-// named pipe.
-//
-// The doneChan is listened to: when it is closed, it will trigger the listener goroutine to close the pipe,
-// remove it and quit.
-//
-// TODO: make this more secure, maybe with a secret key also passed by the environment.
-func StartNamedPipe(msg Message, dir string, doneChan <-chan struct{}, cmdStdin io.Writer) error {
+// interruptOnCancel waits for builder.ctx to be cancelled and then sends a SIGINT to the process group
+// of cmd, followed by a SIGKILL if it is still running after InterruptGracePeriod.
+// It returns as soon as processDone is closed.
+func (builder *PipeExecToJupyterBuilder) interruptOnCancel(cmd *exec.Cmd, processDone <-chan struct{}) {
+	select {
+	case <-processDone:
+		return
+	case <-builder.ctx.Done():
+	}
+	pgid := cmd.Process.Pid // Process group id is the same as the pid, since we set Setpgid.
+	klog.Infof("Interrupting %q (SIGINT)", builder.command)
+	if err := syscall.Kill(-pgid, syscall.SIGINT); err != nil {
+		klog.Warningf("Failed to send SIGINT to %q: %+v", builder.command, err)
+	}
+	select {
+	case <-processDone:
+		return
+	case <-time.After(InterruptGracePeriod):
+	}
+	klog.Warningf("%q still running %s after SIGINT, killing it (SIGKILL)", builder.command, InterruptGracePeriod)
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
+		klog.Warningf("Failed to send SIGKILL to %q: %+v", builder.command, err)
+	}
+}
+
+// createNamedPipe creates a named pipe (mkfifo(3)) with a unique name starting with prefix in `dir`, and
+// returns its path.
+func createNamedPipe(dir, prefix string) (string, error) {
 	// Create a temporary file name.
-	f, err := os.CreateTemp(dir, "gonb_pipe_")
+	f, err := os.CreateTemp(dir, prefix)
 	if err != nil {
-		return err
+		return "", err
 	}
 	pipePath := f.Name()
 	if err = f.Close(); err != nil {
-		return err
+		return "", err
 	}
 	if err = os.Remove(pipePath); err != nil {
-		return err
+		return "", err
 	}
 
 	// Create pipe.
 	if err = syscall.Mkfifo(pipePath, 0600); err != nil {
-		return errors.Wrapf(err, "failed to create pipe (Mkfifo) for %q", pipePath)
+		return "", errors.Wrapf(err, "failed to create pipe (Mkfifo) for %q", pipePath)
+	}
+	return pipePath, nil
+}
+
+// StartNamedPipe creates a named pipe in `dir` and starts a listener (on a separate goroutine) that reads
+// the pipe and displays rich content. It also exports environment variable GONB_PIPE announcing the name of the
+// named pipe, and GONB_ALLOW_STDIN announcing whether the front-end accepts input requests.
+//
+// It also creates the named pipe used to deliver comm messages to the program, see startCommPipe.
+//
+// The doneChan is listened to: when it is closed, it will trigger the listener goroutine to close the pipe,
+// remove it and quit.
+//
+// TODO: make this more secure, maybe with a secret key also passed by the environment.
+func StartNamedPipe(msg Message, dir string, doneChan <-chan struct{}, cmdStdin io.Writer) error {
+	pipePath, err := createNamedPipe(dir, "gonb_pipe_")
+	if err != nil {
+		return err
+	}
+	if err = startCommPipe(msg, dir, doneChan); err != nil {
+		return err
 	}
 
 	// Synchronize pipe: if it's not opened by the program being executed,
@@ -269,6 +427,11 @@ func StartNamedPipe(msg Message, dir string, doneChan <-chan struct{}, cmdStdin
 	}()
 
 	_ = os.Setenv(protocol.GONB_PIPE_ENV, pipePath)
+	allowStdin := "0"
+	if AllowStdin(msg) {
+		allowStdin = "1"
+	}
+	_ = os.Setenv(protocol.GONB_ALLOW_STDIN_ENV, allowStdin)
 	go func() {
 		// Notice that opening pipeReader below blocks, until the other end
 		// (the go program being executed) opens it as well.
@@ -289,3 +452,64 @@ func StartNamedPipe(msg Message, dir string, doneChan <-chan struct{}, cmdStdin
 	}()
 	return nil
 }
+
+// outputLimiter limits the output of a command, shared among its output streams, to a maximum number of
+// bytes. See MaxOutputBytes.
+type outputLimiter struct {
+	msg       Message
+	maxBytes  int64
+	mu        sync.Mutex
+	written   int64
+	truncated bool
+}
+
+// newOutputLimiter creates an outputLimiter for maxBytes bytes. If maxBytes <= 0 there is no limit.
+func newOutputLimiter(msg Message, maxBytes int64) *outputLimiter {
+	return &outputLimiter{msg: msg, maxBytes: maxBytes}
+}
+
+// wrap returns an io.Writer that writes to w, counting against the limit of l.
+func (l *outputLimiter) wrap(w io.Writer) io.Writer {
+	if l.maxBytes <= 0 {
+		return w
+	}
+	return &limitedWriter{limiter: l, writer: w}
+}
+
+// limitedWriter is an io.Writer that discards the output after the limit of its outputLimiter is reached.
+type limitedWriter struct {
+	limiter *outputLimiter
+	writer  io.Writer
+}
+
+// Write implements io.Writer. Output over the limit is silently discarded: it always reports that all of p
+// was written, so the command is not blocked or killed by a broken pipe.
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	l := w.limiter
+	n := len(p)
+	l.mu.Lock()
+	if l.truncated {
+		l.mu.Unlock()
+		return n, nil
+	}
+	justTruncated := false
+	if remaining := l.maxBytes - l.written; int64(len(p)) > remaining {
+		p = p[:remaining]
+		l.truncated, justTruncated = true, true
+	}
+	l.written += int64(len(p))
+	l.mu.Unlock()
+
+	if len(p) > 0 {
+		if _, err := w.writer.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	if justTruncated {
+		klog.Warningf("Output truncated after %d bytes", l.maxBytes)
+		_ = PublishWriteStream(l.msg, StreamStderr, fmt.Sprintf(
+			"\n... output truncated: the limit of %d bytes was reached, further output is discarded "+
+				"(see `%%maxoutput`)\n", l.maxBytes))
+	}
+	return n, nil
+}
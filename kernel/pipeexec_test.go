@@ -0,0 +1,67 @@
+package kernel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestPipeExecToJupyterInterrupt(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	builder := PipeExecToJupyter(nil, "sleep", "100").InDir(t.TempDir()).WithContext(ctx)
+	require.NoError(t, builder.Exec())
+	elapsed := time.Since(start)
+	assert.Less(t, elapsed, 10*time.Second, "\"sleep 100\" should have been interrupted")
+	require.NotNil(t, builder.ProcessState())
+	assert.False(t, builder.ProcessState().Success())
+}
+
+func TestPipeExecToJupyterTimeout(t *testing.T) {
+	start := time.Now()
+	builder := PipeExecToJupyter(nil, "sleep", "100").InDir(t.TempDir()).WithTimeout(100 * time.Millisecond)
+	require.NoError(t, builder.Exec())
+	assert.Less(t, time.Since(start), 10*time.Second, "\"sleep 100\" should have timed out")
+	assert.True(t, builder.TimedOut())
+
+	builder = PipeExecToJupyter(nil, "true").InDir(t.TempDir()).WithTimeout(10 * time.Second)
+	require.NoError(t, builder.Exec())
+	assert.False(t, builder.TimedOut())
+}
+
+func TestPipeExecToJupyterExitCode(t *testing.T) {
+	builder := PipeExecToJupyter(nil, "sh", "-c", "exit 3").InDir(t.TempDir())
+	assert.Equal(t, -1, builder.ExitCode())
+	require.NoError(t, builder.Exec())
+	assert.Equal(t, 3, builder.ExitCode())
+}
+
+func TestPipeExecToJupyterMaxOutput(t *testing.T) {
+	defer func(maxBytes int64) { MaxOutputBytes = maxBytes }(MaxOutputBytes)
+	MaxOutputBytes = 10
+	msg := &publishRecorder{}
+	var stdout, stderr bytes.Buffer
+	builder := PipeExecToJupyter(msg, "sh", "-c", "yes | head -c 100000; echo error >&2").InDir(t.TempDir()).
+		WithStdout(&stdout).WithStderr(&stderr)
+	require.NoError(t, builder.Exec())
+	assert.Equal(t, 0, builder.ExitCode())
+	assert.Equal(t, "y\ny\ny\ny\ny\n", stdout.String())
+	assert.Empty(t, stderr.String())
+	require.Equal(t, []string{"stream"}, msg.msgTypes)
+	assert.Contains(t, fmt.Sprintf("%v", msg.contents[0]), "output truncated")
+
+	MaxOutputBytes = 0
+	stdout.Reset()
+	builder = PipeExecToJupyter(nil, "sh", "-c", "yes | head -c 100000").InDir(t.TempDir()).WithStdout(&stdout)
+	require.NoError(t, builder.Exec())
+	assert.Equal(t, 100000, stdout.Len())
+}
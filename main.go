@@ -7,6 +7,7 @@ import (
 	"github.com/janpfeifer/gonb/dispatcher"
 	"github.com/janpfeifer/gonb/goexec"
 	"github.com/janpfeifer/gonb/kernel"
+	"github.com/janpfeifer/gonb/specialcmd"
 	"io"
 	klog "k8s.io/klog/v2"
 	"log"
@@ -92,12 +93,16 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create go executor: %+v", err)
 	}
+	if err = specialcmd.RestorePersisted(goExec); err != nil {
+		klog.Errorf("Failed to restore settings saved with %%persist: %+v", err)
+	}
 
 	// Orchestrate dispatching of messages.
 	dispatcher.RunKernel(k, goExec)
 
 	// Wait for all polling goroutines.
 	k.ExitWait()
+	specialcmd.StopJobs()
 	klog.Infof("Exiting...")
 }
 
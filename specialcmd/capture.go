@@ -0,0 +1,48 @@
+package specialcmd
+
+import (
+	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"go/token"
+	"strings"
+)
+
+// DefaultCaptureVariable is the name of the variable declared with the output captured by `%%capture`,
+// if no name is given.
+const DefaultCaptureVariable = "gonbCapture"
+
+// execCapture executes the "%%capture" special command. The parameter `args` excludes "%%capture".
+//
+// It starts capturing the output of the cell, and sets goexec.State.CellCaptureVar with the name of
+// the variable that will hold the captured output, once the cell finishes executing.
+func execCapture(msg kernel.Message, goExec *goexec.State, args []string) error {
+	capture := &kernel.StreamCapture{}
+	name := DefaultCaptureVariable
+	for _, arg := range args {
+		switch {
+		case arg == "--stdout":
+			capture.CaptureStdout = true
+		case arg == "--stderr":
+			capture.CaptureStderr = true
+		case arg == "--show":
+			capture.Show = true
+		case strings.HasPrefix(arg, "-"):
+			return errors.Errorf("`%%%%capture [--stdout] [--stderr] [--show] [<var_name>]`: unknown flag %q", arg)
+		default:
+			if !token.IsIdentifier(arg) {
+				return errors.Errorf("`%%%%capture`: %q is not a valid Go variable name", arg)
+			}
+			name = arg
+		}
+	}
+	if !capture.CaptureStdout && !capture.CaptureStderr {
+		// Capture both streams by default.
+		capture.CaptureStdout, capture.CaptureStderr = true, true
+	}
+	goExec.CellCaptureVar = name
+	if msg != nil && msg.Kernel() != nil {
+		msg.Kernel().StartCapture(capture)
+	}
+	return nil
+}
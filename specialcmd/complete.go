@@ -0,0 +1,97 @@
+package specialcmd
+
+import (
+	. "github.com/janpfeifer/gonb/common"
+	"os"
+	"sort"
+	"strings"
+)
+
+// This file implements auto-complete of special commands.
+
+// commandNames are the special commands offered as auto-complete options, besides the ones registered with
+// Register. It should be kept in sync with execInternal (and isCellMagic for the cell magics), since it is
+// also used by Register to detect collisions with the built-in commands.
+var commandNames = []string{
+	"%%", "%main", "%args", "%goflags", "%buildtags", "%cgo", "%vendor", "%goroot", "%gopls",
+	"%%time", "%%timeit", "%%profile", "%%test", "%%benchmark", "%%cgo", "%%capture", "%%bash", "%%script", "%%html", "%%latex", "%%dot", "%%mermaid", "%%file", "%%go.mod", "%%go.work",
+	"%env", "%envcell", "%unsetenv", "%dotenv", "%cd", "%pwd", "%tempdir", "%pushd", "%popd",
+	"%autoget", "%noautoget", "%getmodules", "%goinstall", "%modverify", "%modwhy", "%autoimport", "%noautoimport", "%autotrack", "%noautotrack", "%autodisplay", "%noautodisplay", "%govet", "%nogovet",
+	"%help", "%reset", "%savestate", "%loadstate", "%persist", "%replay", "%reload", "%ls", "%list", "%rm", "%remove", "%clear",
+	"%with_inputs", "%with_password", "%stdin", "%pipe-from-last", "%timeout", "%shell", "%which", "%bg", "%jobs", "%kill",
+	"%track", "%untrack", "%goworkfix", "%goworkuse", "%writefile", "%load", "%cat", "%verbosity", "%maxoutput", "%debug", "%generate", "%prebuild",
+}
+
+// pathCommands are the special commands (as split by splitCmd) whose arguments are completed as
+// filesystem paths.
+var pathCommands = Set[string]{
+	"cd": {}, "pushd": {}, "track": {}, "untrack": {}, "load": {}, "cat": {}, "writefile": {}, "dotenv": {},
+	"savestate": {}, "loadstate": {}, "%file": {}, "goroot": {}, "goworkuse": {}, "generate": {},
+}
+
+// Complete returns the auto-complete options for the special command in line, with the cursor
+// at cursorCol (in bytes). The matches replace the replaceLength bytes before the cursor.
+//
+// If the cursor is in the command name, it completes the name of the special commands. If it is in the
+// arguments of commands that take paths (e.g.: `%cd` or `%track`), it completes filesystem paths.
+func Complete(line string, cursorCol int) (matches []string, replaceLength int) {
+	if cursorCol > len(line) {
+		cursorCol = len(line)
+	}
+	prefix := line[:cursorCol]
+	if !strings.HasPrefix(prefix, "%") {
+		return
+	}
+	spacePos := strings.LastIndexAny(prefix, " \t")
+	if spacePos == -1 {
+		// Complete the command name.
+		names := append(append([]string(nil), commandNames...), registeredCommandNames()...)
+		for _, name := range names {
+			if strings.HasPrefix(name, prefix) && name != prefix {
+				matches = append(matches, name)
+			}
+		}
+		return matches, len(prefix)
+	}
+
+	// Complete arguments.
+	fields := strings.Fields(prefix[1:])
+	if len(fields) == 0 || !pathCommands.Has(fields[0]) {
+		return
+	}
+	toComplete := prefix[spacePos+1:]
+	return completePath(toComplete), len(toComplete)
+}
+
+// completePath returns the files and directories that complete the partial path given. Directories
+// are suffixed with "/", and hidden files are only included if the partial name starts with ".".
+func completePath(partial string) (matches []string) {
+	dirPrefix, base := "", partial
+	if pos := strings.LastIndex(partial, "/"); pos != -1 {
+		dirPrefix, base = partial[:pos+1], partial[pos+1:]
+	}
+	dir := dirPrefix
+	if dir == "" {
+		dir = "."
+	}
+	if strings.HasPrefix(dir, "~") && !strings.HasPrefix(dir, "~/") {
+		// Don't complete other users' home directories.
+		return nil
+	}
+	entries, err := os.ReadDir(ReplaceTildeInDir(dir))
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, base) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".")) {
+			continue
+		}
+		if entry.IsDir() {
+			name += "/"
+		}
+		matches = append(matches, dirPrefix+name)
+	}
+	sort.Strings(matches)
+	return
+}
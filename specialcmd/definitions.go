@@ -5,7 +5,11 @@ import (
 	"github.com/janpfeifer/gonb/common"
 	"github.com/janpfeifer/gonb/goexec"
 	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
 	"k8s.io/klog/v2"
+	"path"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -21,6 +25,101 @@ func resetDefinitions(msg kernel.Message, goExec *goexec.State) {
 	}
 }
 
+// resetTempDir removes and recreates the temporary directory where the cells are compiled. It
+// implements the "%reset --hard" command.
+func resetTempDir(msg kernel.Message, goExec *goexec.State) error {
+	removed, err := goExec.ResetTempDir()
+	if err != nil {
+		return err
+	}
+	changedEnv = common.MakeSet[string]()
+	secretEnv = common.MakeSet[string]()
+	originalEnv = make(map[string]*string)
+	lastSetEnv = make(map[string]*string)
+	if persistKinds.Has(persistEnv) {
+		// The environment variables are kept, but they are recorded again as changed, so they stay persisted.
+		settings, err := loadPersisted()
+		if err == nil && settings != nil {
+			err = applyPersistedEnv(settings)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	publishStdout(msg, fmt.Sprintf("* Temporary directory %q re-created, removed %d entries: %s\n"+
+		"* go.mod re-initialized and tracked files re-tracked.\n",
+		goExec.TempDir, len(removed), strings.Join(removed, ", ")))
+	return nil
+}
+
+// execReplay executes the "%replay [<n>]" special command, and "%reload" (with no args). The parameter `args`
+// excludes "%replay".
+//
+// It replays (see goexec.State.ReplayCell) the last n cells of the goexec.State.History, or all of them if n is
+// not given. Cells that fail are reported, and the remaining ones are still replayed.
+func execReplay(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%replay [<n>]`: it takes at most one argument, but %d were given", len(args))
+	}
+	history := goExec.History
+	if len(args) == 1 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n <= 0 {
+			return errors.Errorf("`%%replay [<n>]`: invalid number of cells %q", args[0])
+		}
+		if n < len(history) {
+			history = history[len(history)-n:]
+		}
+	}
+	if len(history) == 0 {
+		publishStdout(msg, "No cells with definitions to replay\n")
+		return nil
+	}
+	var failed []string
+	for _, cell := range history {
+		if msg != nil && msg.Kernel() != nil && msg.Kernel().Interrupted.Load() {
+			return errors.New("`%replay` interrupted")
+		}
+		if err := goExec.ReplayCell(msg, cell); err != nil {
+			publishStderr(msg, fmt.Sprintf("* %s failed: %v\n", cell, err))
+			failed = append(failed, cell.String())
+			continue
+		}
+		publishStdout(msg, fmt.Sprintf("* %s replayed\n", cell))
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("`%%replay`: %d of %d cells failed: %s", len(failed), len(history),
+			strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// execSaveState executes the "%savestate <file>" special command. The parameter `args` excludes "%savestate".
+func execSaveState(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.New("`%savestate <file>`: it takes one file path as argument")
+	}
+	filePath := common.ReplaceTildeInDir(args[0])
+	if err := goExec.SaveState(filePath); err != nil {
+		return errors.WithMessagef(err, "`%%savestate %q` failed", args[0])
+	}
+	publishStdout(msg, fmt.Sprintf("Saved memorized definitions and go.mod to %q\n", filePath))
+	return nil
+}
+
+// execLoadState executes the "%loadstate <file>" special command. The parameter `args` excludes "%loadstate".
+func execLoadState(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.New("`%loadstate <file>`: it takes one file path as argument")
+	}
+	filePath := common.ReplaceTildeInDir(args[0])
+	if err := goExec.LoadState(filePath); err != nil {
+		return errors.WithMessagef(err, "`%%loadstate %q` failed", args[0])
+	}
+	publishStdout(msg, fmt.Sprintf("Loaded memorized definitions and go.mod from %q\n", filePath))
+	return nil
+}
+
 func displayEnumeration(msg kernel.Message, title string, items []string) {
 	if len(items) == 0 {
 		return
@@ -38,14 +137,90 @@ func displayEnumeration(msg kernel.Message, title string, items []string) {
 	}
 }
 
-// listDefinitions lists all memorized definitions. It implements the "%list" (or "%ls") command.
-func listDefinitions(msg kernel.Message, goExec *goexec.State) {
+// listDefinitions lists memorized definitions. It implements the "%list" (or "%ls") command.
+// The parameter `args` excludes "%ls".
+//
+// Arguments are optional patterns to filter the definitions by their key (see matchDefinitionKey),
+// and `--type=<import|const|type|var|func>` to list only one category of definitions.
+func listDefinitions(msg kernel.Message, goExec *goexec.State, args []string) error {
+	var patterns []string
+	var typeName string
+	for _, arg := range args {
+		if value, found := strings.CutPrefix(arg, "--type="); found {
+			typeName = value
+			continue
+		}
+		patterns = append(patterns, arg)
+	}
+	listings, err := filterDefinitions(goExec.Definitions, patterns, typeName)
+	if err != nil {
+		return err
+	}
 	_ = kernel.PublishDisplayDataWithHTML(msg, "<h3>Memorized Definitions</h3>\n")
-	displayEnumeration(msg, "Imports", common.SortedKeys(goExec.Definitions.Imports))
-	displayEnumeration(msg, "Constants", common.SortedKeys(goExec.Definitions.Constants))
-	displayEnumeration(msg, "Types", common.SortedKeys(goExec.Definitions.Types))
-	displayEnumeration(msg, "Variables", common.SortedKeys(goExec.Definitions.Variables))
-	displayEnumeration(msg, "Functions", common.SortedKeys(goExec.Definitions.Functions))
+	for _, listing := range listings {
+		displayEnumeration(msg, listing.Title, listing.Keys)
+	}
+	return nil
+}
+
+// definitionsListing holds the sorted keys of one category of memorized definitions.
+type definitionsListing struct {
+	Title string
+	Keys  []string
+}
+
+// filterDefinitions returns the keys of the definitions in decls, grouped by category (in a fixed order) and
+// sorted. Only keys matching any of the patterns (if any is given) are included. If typeName is not
+// empty, only the category with that type name (import, const, type, var or func) is included.
+func filterDefinitions(decls *goexec.Declarations, patterns []string, typeName string) ([]definitionsListing, error) {
+	categories := []struct {
+		typeName, title string
+		keys            []string
+	}{
+		{"import", "Imports", common.SortedKeys(decls.Imports)},
+		{"const", "Constants", common.SortedKeys(decls.Constants)},
+		{"type", "Types", common.SortedKeys(decls.Types)},
+		{"var", "Variables", common.SortedKeys(decls.Variables)},
+		{"func", "Functions", common.SortedKeys(decls.Functions)},
+	}
+	var listings []definitionsListing
+	typeFound := typeName == ""
+	for _, category := range categories {
+		if typeName != "" && typeName != category.typeName {
+			continue
+		}
+		typeFound = true
+		listing := definitionsListing{Title: category.title}
+		for _, key := range category.keys {
+			if matchDefinitionKey(patterns, key) {
+				listing.Keys = append(listing.Keys, key)
+			}
+		}
+		listings = append(listings, listing)
+	}
+	if !typeFound {
+		return nil, errors.Errorf("`%%ls --type=%s`: unknown type, valid values are import, const, type, var or func", typeName)
+	}
+	return listings, nil
+}
+
+// matchDefinitionKey returns whether key matches any of the patterns, or true if there are no patterns.
+// Patterns with glob special characters (`*`, `?` or `[`) are matched with path.Match, other patterns
+// match keys that contain them.
+func matchDefinitionKey(patterns []string, key string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if hasGlobMeta(pattern) {
+			if matched, _ := path.Match(pattern, key); matched {
+				return true
+			}
+		} else if strings.Contains(key, pattern) {
+			return true
+		}
+	}
+	return false
 }
 
 func removeDefinitionImpl[T any](msg kernel.Message, mapName string, m *map[string]*T, key string) bool {
@@ -63,7 +238,13 @@ func removeDefinitionImpl[T any](msg kernel.Message, mapName string, m *map[stri
 }
 
 // removeDefinitions form memorized list. It implements the "%remove" (or "%rm") command.
-func removeDefinitions(msg kernel.Message, goExec *goexec.State, keys []string) {
+//
+// If the first key is "-r", the following arguments are taken as regular expressions, and all definitions
+// whose key matches any of them are removed, see removeDefinitionsByRegexp.
+func removeDefinitions(msg kernel.Message, goExec *goexec.State, keys []string) error {
+	if len(keys) > 0 && keys[0] == "-r" {
+		return removeDefinitionsByRegexp(msg, goExec, keys[1:])
+	}
 	for _, key := range keys {
 		var found bool
 		found = found || removeDefinitionImpl(msg, "import", &goExec.Definitions.Imports, key)
@@ -79,4 +260,50 @@ func removeDefinitions(msg kernel.Message, goExec *goexec.State, keys []string)
 			}
 		}
 	}
+	return nil
+}
+
+// removeDefinitionsByRegexp removes all definitions whose key matches any of the regular expressions
+// in exprs. It implements "%rm -r <regexp>...". Nothing is removed if any of the expressions is invalid.
+func removeDefinitionsByRegexp(msg kernel.Message, goExec *goexec.State, exprs []string) error {
+	if len(exprs) == 0 {
+		return errors.New("`%rm -r` requires at least one regular expression")
+	}
+	res := make([]*regexp.Regexp, 0, len(exprs))
+	for _, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return errors.Wrapf(err, "`%%rm -r`: invalid regular expression %q", expr)
+		}
+		res = append(res, re)
+	}
+	match := func(key string) bool {
+		for _, re := range res {
+			if re.MatchString(key) {
+				return true
+			}
+		}
+		return false
+	}
+	var count int
+	count += removeMatchingDefinitions(msg, "import", &goExec.Definitions.Imports, match)
+	count += removeMatchingDefinitions(msg, "const", &goExec.Definitions.Constants, match)
+	count += removeMatchingDefinitions(msg, "type", &goExec.Definitions.Types, match)
+	count += removeMatchingDefinitions(msg, "var", &goExec.Definitions.Variables, match)
+	count += removeMatchingDefinitions(msg, "func", &goExec.Definitions.Functions, match)
+	if count == 0 {
+		publishStderr(msg, ". no definition matched, nothing removed\n")
+	}
+	return nil
+}
+
+// removeMatchingDefinitions removes from m, in sorted order, the keys for which match returns true.
+// It returns the number of definitions removed.
+func removeMatchingDefinitions[T any](msg kernel.Message, mapName string, m *map[string]*T, match func(key string) bool) (count int) {
+	for _, key := range common.SortedKeys(*m) {
+		if match(key) && removeDefinitionImpl(msg, mapName, m, key) {
+			count++
+		}
+	}
+	return
 }
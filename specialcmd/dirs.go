@@ -0,0 +1,158 @@
+package specialcmd
+
+import (
+	"fmt"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/gonbui/protocol"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+)
+
+// This file implements the special commands that handle the current directory: `%cd`, `%pwd`,
+// `%pushd` and `%popd`.
+
+// changeDir changes the current directory to dir, updates the GONB_DIR environment variable
+// and reports the new directory.
+func changeDir(msg kernel.Message, dir string) error {
+	pwd, err := setCurrentDir(dir)
+	if err != nil {
+		return err
+	}
+	publishStdout(msg, fmt.Sprintf("Changed directory to %q\n", pwd))
+	return nil
+}
+
+// setCurrentDir changes the current directory to dir and updates the GONB_DIR environment variable.
+// It returns the new current directory.
+func setCurrentDir(dir string) (string, error) {
+	err := os.Chdir(ReplaceTildeInDir(dir))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to change directory to %q", dir)
+	}
+	pwd, _ := os.Getwd()
+	err = os.Setenv(protocol.GONB_DIR_ENV, pwd)
+	if err != nil {
+		klog.Errorf("Failed to set environment variable %q: %+v", protocol.GONB_DIR_ENV, err)
+	}
+	return pwd, nil
+}
+
+// execCd executes the "%cd <directory>" special command, with one argument: a directory, "--notebook"
+// or "-".
+//
+// The directory before the change is saved in goexec.State.PreviousDir, so `%cd -` can change back to it.
+func execCd(msg kernel.Message, goExec *goexec.State, arg string) error {
+	pwd, err := os.Getwd()
+	if err != nil {
+		return errors.Wrapf(err, "`%%cd %q` failed to get current directory", arg)
+	}
+	switch arg {
+	case "--notebook":
+		err = execCdNotebook(msg)
+	case "-":
+		if goExec.PreviousDir == "" {
+			return errors.Errorf("`%%cd -`: no previous directory, `%%cd` hasn't been used yet")
+		}
+		var newPwd string
+		newPwd, err = setCurrentDir(goExec.PreviousDir)
+		if err != nil {
+			return errors.WithMessagef(err, "`%%cd -` failed")
+		}
+		publishStdout(msg, fmt.Sprintf("Changed directory from %q back to %q\n", pwd, newPwd))
+	default:
+		if err = changeDir(msg, arg); err != nil {
+			err = errors.WithMessagef(err, "`%%cd %q` failed", arg)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	goExec.PreviousDir = pwd
+	return nil
+}
+
+// NotebookPathEnv is the environment variable set by recent versions of Jupyter Server with the path of the
+// notebook of the kernel.
+const NotebookPathEnv = "JPY_SESSION_NAME"
+
+// kernelStartDir is the current directory when the kernel started, which Jupyter sets to the directory of
+// the notebook.
+var kernelStartDir, _ = os.Getwd()
+
+// notebookDir returns the directory of the notebook file, taken from NotebookPathEnv. If the path is relative
+// (to the Jupyter Server root directory), it is only resolved if the notebook is in kernelStartDir.
+func notebookDir() (string, error) {
+	notebookPath := os.Getenv(NotebookPathEnv)
+	if notebookPath == "" {
+		return "", errors.Errorf("the path of the notebook is not available: %s is not set, it requires a recent "+
+			"version of Jupyter Server", NotebookPathEnv)
+	}
+	if filepath.IsAbs(notebookPath) {
+		return filepath.Dir(notebookPath), nil
+	}
+	if kernelStartDir != "" {
+		if _, err := os.Stat(filepath.Join(kernelStartDir, filepath.Base(notebookPath))); err == nil {
+			return kernelStartDir, nil
+		}
+	}
+	return "", errors.Errorf("the directory of the notebook is not available: %s=%q is relative to the "+
+		"Jupyter Server root directory", NotebookPathEnv, notebookPath)
+}
+
+// execCdNotebook executes the "%cd --notebook" special command: it changes to the directory of the notebook.
+func execCdNotebook(msg kernel.Message) error {
+	dir, err := notebookDir()
+	if err != nil {
+		return errors.WithMessagef(err, "`%%cd --notebook` failed")
+	}
+	if err = changeDir(msg, dir); err != nil {
+		return errors.WithMessagef(err, "`%%cd --notebook` failed")
+	}
+	return nil
+}
+
+// execPwd executes the "%pwd" special command (or "%cd" without arguments): it prints the current directory.
+func execPwd(msg kernel.Message) {
+	pwd, _ := os.Getwd()
+	publishStdout(msg, fmt.Sprintf("Current directory: %q\n", pwd))
+}
+
+// execPushd executes the "%pushd" special command. The parameter `args` excludes "%pushd".
+//
+// It saves the current directory in goexec.State.DirStack and changes to the given directory.
+func execPushd(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) != 1 {
+		return errors.Errorf("`%%pushd <directory>`: it takes exactly one argument, but %d were given", len(args))
+	}
+	pwd, err := os.Getwd()
+	if err != nil {
+		return errors.Wrapf(err, "`%%pushd %q` failed to get current directory", args[0])
+	}
+	if err = changeDir(msg, args[0]); err != nil {
+		return errors.WithMessagef(err, "`%%pushd %q` failed", args[0])
+	}
+	goExec.DirStack = append(goExec.DirStack, pwd)
+	return nil
+}
+
+// execPopd executes the "%popd" special command. The parameter `args` excludes "%popd".
+//
+// It changes back to the last directory saved in goexec.State.DirStack by `%pushd`.
+func execPopd(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) != 0 {
+		return errors.Errorf("`%%popd`: it takes no arguments, but %d were given", len(args))
+	}
+	if len(goExec.DirStack) == 0 {
+		return errors.Errorf("`%%popd`: directory stack is empty")
+	}
+	last := len(goExec.DirStack) - 1
+	if err := changeDir(msg, goExec.DirStack[last]); err != nil {
+		return errors.WithMessagef(err, "`%%popd` failed")
+	}
+	goExec.DirStack = goExec.DirStack[:last]
+	return nil
+}
@@ -0,0 +1,49 @@
+package specialcmd
+
+import (
+	"bytes"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os/exec"
+	"strings"
+)
+
+// This file implements the `%%dot` cell magic, that renders Graphviz graphs.
+
+// dotBinary is the Graphviz program used to render the graphs of `%%dot`, looked up in the PATH.
+const dotBinary = "dot"
+
+// execDotCell executes the "%%dot [-K<engine>] [-G|-N|-E<attr>=<value>...]" cell magic: body, the rest of the
+// cell, is a graph in Graphviz's DOT language, rendered to SVG with dotBinary and displayed.
+func execDotCell(msg kernel.Message, args []string, body string) error {
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") || len(arg) < 3 || !strings.ContainsRune("KGNE", rune(arg[1])) {
+			return errors.Errorf("`%%%%dot [-K<engine>] [-G|-N|-E<attr>=<value>...]`: invalid argument %q", arg)
+		}
+	}
+	dotPath, err := exec.LookPath(dotBinary)
+	if err != nil {
+		return errors.Errorf("`%%%%dot` requires Graphviz's %q program, not found in PATH: install Graphviz "+
+			"(e.g.: `sudo apt install graphviz` or `brew install graphviz`), see https://graphviz.org/download/",
+			dotBinary)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(kernel.InterruptContext(msg), dotPath, append([]string{"-Tsvg"}, args...)...)
+	cmd.Stdin = strings.NewReader(body)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err = cmd.Run(); err != nil {
+		return errors.Wrapf(err, "`%%%%dot` failed to render the graph: %s", strings.TrimSpace(stderr.String()))
+	}
+	if stderr.Len() > 0 {
+		publishStderr(msg, stderr.String()) // Warnings.
+	}
+	svg := stdout.String()
+	if pos := strings.Index(svg, "<svg"); pos != -1 {
+		svg = svg[pos:] // Drop the XML prolog.
+	}
+	if err = kernel.PublishDisplayDataWithSVG(msg, svg); err != nil {
+		klog.Errorf("Failed to publish %%%%dot graph: %+v", err)
+	}
+	return nil
+}
@@ -0,0 +1,749 @@
+package specialcmd
+
+import (
+	"fmt"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// This file implements the `%env`, `%envcell`, `%unsetenv` and `%dotenv` special commands, that manipulate the
+// environment variables visible to the Go programs and shell commands executed by GoNB.
+
+// changedEnv holds the names of the environment variables set or unset by the special commands (see setEnv
+// and unsetEnv), listed by `%env --list-changed`. It is cleared by `%reset --hard`.
+var changedEnv = MakeSet[string]()
+
+// originalEnv holds the values of the variables in changedEnv before they were first changed by the special
+// commands (nil if they were not set), restored by `%env --unset-all`. It is cleared by `%reset --hard`.
+var originalEnv = make(map[string]*string)
+
+// lastSetEnv holds the values last set by the special commands to the variables in changedEnv (nil if they
+// were unset), used by `%env --unset-all` to detect the variables modified since. It is cleared by
+// `%reset --hard`.
+var lastSetEnv = make(map[string]*string)
+
+// secretEnv holds the names of the environment variables set with `%env --secret`, whose values are
+// not printed, see isSecretEnv. It is cleared by `%reset --hard`.
+var secretEnv = MakeSet[string]()
+
+// cellEnv holds the values, before the current cell, of the environment variables set with `%envcell`: nil
+// if the variable was not set. They are restored by RestoreCellEnv at the end of the cell.
+var cellEnv = make(map[string]*string)
+
+// secretEnvSuffixes are the suffixes of the names of environment variables considered secrets, whose
+// values are not printed unless `%env --show` is used.
+var secretEnvSuffixes = []string{"_TOKEN", "_SECRET", "_PASSWORD"}
+
+// hiddenEnvValue is printed in place of the values of secret environment variables.
+const hiddenEnvValue = "(hidden)"
+
+// isSecretEnv returns whether the value of the environment variable name should not be printed: if it was
+// set with `%env --secret`, or if its name ends with one of secretEnvSuffixes.
+func isSecretEnv(name string) bool {
+	if secretEnv.Has(name) {
+		return true
+	}
+	upperName := strings.ToUpper(name)
+	for _, suffix := range secretEnvSuffixes {
+		if strings.HasSuffix(upperName, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatEnv formats the environment variable as `NAME="value"`, or `NAME=(hidden)` if it is a secret
+// (see isSecretEnv) and show is false.
+func formatEnv(name, value string, show bool) string {
+	if !show && isSecretEnv(name) {
+		return name + "=" + hiddenEnvValue
+	}
+	return fmt.Sprintf("%s=%q", name, value)
+}
+
+// reEnvName matches valid (POSIX) environment variable names.
+var reEnvName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateEnvName returns an error if name is not a valid environment variable name (see reEnvName): names
+// with spaces or `=`, for instance, wouldn't be seen as intended by the programs executed.
+func validateEnvName(name string) error {
+	if !reEnvName.MatchString(name) {
+		return errors.Errorf("invalid environment variable name %q: it must start with a letter or `_`, "+
+			"followed by letters, digits or `_`", name)
+	}
+	return nil
+}
+
+// setEnv sets the environment variable, and records it in changedEnv. It fails if name is not a valid
+// environment variable name, see validateEnvName.
+func setEnv(name, value string) error {
+	if err := validateEnvName(name); err != nil {
+		return err
+	}
+	recordOriginalEnv(name)
+	if err := os.Setenv(name, value); err != nil {
+		return err
+	}
+	changedEnv.Insert(name)
+	lastSetEnv[name] = &value
+	return nil
+}
+
+// unsetEnv unsets the environment variable, and records it in changedEnv.
+func unsetEnv(name string) error {
+	recordOriginalEnv(name)
+	if err := os.Unsetenv(name); err != nil {
+		return err
+	}
+	changedEnv.Insert(name)
+	lastSetEnv[name] = nil
+	return nil
+}
+
+// recordOriginalEnv saves the current value of the environment variable in originalEnv, if it was not
+// changed before.
+func recordOriginalEnv(name string) {
+	if _, found := originalEnv[name]; !found {
+		originalEnv[name] = lookupEnv(name)
+	}
+}
+
+// lookupEnv returns the value of the environment variable, or nil if it is not set.
+func lookupEnv(name string) *string {
+	if value, found := os.LookupEnv(name); found {
+		return &value
+	}
+	return nil
+}
+
+// equalEnvValues returns whether both values are unset (nil), or set to the same value.
+func equalEnvValues(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// unsetAllEnv restores the variables in changedEnv to their values before the special commands changed them
+// (see originalEnv), unsetting them if they were not set, and stops tracking them. It implements
+// `%env --unset-all`.
+//
+// Variables modified since the last special command that changed them (see lastSetEnv), e.g. by `%envcell`,
+// are skipped, unless force is set. It returns the report of the restored and skipped variables, with the
+// values of secrets hidden unless show is set.
+func unsetAllEnv(force, show bool) (string, error) {
+	if len(changedEnv) == 0 {
+		return "No environment variables changed.\n", nil
+	}
+	var restored, skipped []string
+	for _, name := range SortedKeys(changedEnv) {
+		if !force && !equalEnvValues(lookupEnv(name), lastSetEnv[name]) {
+			skipped = append(skipped, name)
+			continue
+		}
+		var err error
+		original := originalEnv[name]
+		if original != nil {
+			err = os.Setenv(name, *original)
+			restored = append(restored, "Restored: "+formatEnv(name, *original, show))
+		} else {
+			err = os.Unsetenv(name)
+			restored = append(restored, "Unset: "+name)
+		}
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to restore environment variable %q", name)
+		}
+		changedEnv.Delete(name)
+		secretEnv.Delete(name)
+		delete(originalEnv, name)
+		delete(lastSetEnv, name)
+	}
+	report := strings.Join(restored, "\n")
+	if len(skipped) > 0 {
+		if report != "" {
+			report += "\n"
+		}
+		report += fmt.Sprintf("Skipped, modified since set by GoNB (use --force to restore them): %s",
+			strings.Join(skipped, ", "))
+	}
+	return report + "\n", nil
+}
+
+// listChangedEnv returns the variables in changedEnv, sorted by name, formatted with their current value
+// (see formatEnv) or as "is not set" if they were unset.
+func listChangedEnv(show bool) string {
+	if len(changedEnv) == 0 {
+		return "No environment variables changed.\n"
+	}
+	var parts []string
+	for _, name := range SortedKeys(changedEnv) {
+		if value, found := os.LookupEnv(name); found {
+			parts = append(parts, formatEnv(name, value, show))
+		} else {
+			parts = append(parts, fmt.Sprintf("%s is not set", name))
+		}
+	}
+	return strings.Join(parts, "\n") + "\n"
+}
+
+// execEnv executes the "%env" special command. The parameter `args` excludes "%env".
+//
+//   - `%env`: lists all environment variables, sorted by name.
+//   - `%env VAR`: prints the current value of VAR.
+//   - `%env VAR value`: sets VAR to value, after expanding it with expandEnvTemplate and expandEnvValue.
+//   - `%env --literal VAR value`: sets VAR to value as is, without any expansion.
+//   - `%env --no-template VAR value`: sets VAR to value expanded with expandEnvValue only.
+//   - `%env --append VAR value` (or `--prepend`): joins value to the end (or the start) of the current
+//     value of VAR, see joinEnvValue. The separator can be set with `--separator=<sep>`.
+//   - `%env --list-changed`: lists the variables set or unset by GoNB's special commands, see changedEnv.
+//   - `%env --unset-all [--force]`: restores the variables set or unset by GoNB's special commands to their
+//     original values, see unsetAllEnv.
+//   - `%env --secret VAR value`: sets VAR, and marks it as a secret, see secretEnv.
+//   - `%env --from-shell <command>`: sets the variables printed by the shell command, see execEnvFromShell.
+//   - `%env --export [--all] <path>`: writes the variables to a dotenv file, see execEnvExport.
+//
+// The values of secret variables (see isSecretEnv) are printed as hiddenEnvValue, unless `--show` is given.
+func execEnv(msg kernel.Message, args []string) error {
+	var literal, noTemplate, appendValue, prependValue, listChanged, secret, show, fromShell, export, all bool
+	var unsetAll, force bool
+	var separator *string
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		flag := args[0]
+		args = args[1:]
+		switch {
+		case flag == "--literal":
+			literal = true
+		case flag == "--no-template":
+			noTemplate = true
+		case flag == "--append":
+			appendValue = true
+		case flag == "--prepend":
+			prependValue = true
+		case flag == "--list-changed":
+			listChanged = true
+		case flag == "--secret":
+			secret = true
+		case flag == "--show":
+			show = true
+		case flag == "--from-shell":
+			fromShell = true
+		case flag == "--export":
+			export = true
+		case flag == "--all":
+			all = true
+		case flag == "--unset-all":
+			unsetAll = true
+		case flag == "--force":
+			force = true
+		case strings.HasPrefix(flag, "--separator="):
+			sep := strings.TrimPrefix(flag, "--separator=")
+			separator = &sep
+		default:
+			return errors.Errorf("`%%env`: unknown flag %q, valid flags are --literal, --no-template, --append, --prepend, "+
+				"--separator=<sep>, --list-changed, --secret, --show, --from-shell, --export, --all, --unset-all "+
+				"and --force", flag)
+		}
+	}
+	if unsetAll {
+		if len(args) > 0 || literal || noTemplate || appendValue || prependValue || separator != nil ||
+			listChanged || secret || fromShell || export || all {
+			return errors.Errorf("`%%env --unset-all [--force] [--show]`: it takes no other arguments")
+		}
+		report, err := unsetAllEnv(force, show)
+		if err != nil {
+			return errors.WithMessage(err, "`%env --unset-all`")
+		}
+		publishStdout(msg, report)
+		return nil
+	}
+	if force {
+		return errors.Errorf("`%%env`: --force can only be used with --unset-all")
+	}
+	if export {
+		if len(args) != 1 || literal || noTemplate || appendValue || prependValue || separator != nil ||
+			listChanged || secret || fromShell {
+			return errors.Errorf("`%%env --export [--all] [--show] <path>`: it takes exactly one file path")
+		}
+		return execEnvExport(msg, ReplaceTildeInDir(args[0]), all, show)
+	}
+	if all {
+		return errors.Errorf("`%%env`: --all can only be used with --export")
+	}
+	if fromShell {
+		if len(args) != 1 || literal || appendValue || prependValue || separator != nil || listChanged {
+			return errors.Errorf("`%%env --from-shell <command>`: it takes exactly one (quoted) shell command")
+		}
+		return execEnvFromShell(msg, args[0], secret)
+	}
+	if listChanged {
+		if len(args) > 0 || literal || appendValue || prependValue || separator != nil || secret {
+			return errors.Errorf("`%%env --list-changed [--show]`: it takes no other arguments")
+		}
+		publishStdout(msg, listChangedEnv(show))
+		return nil
+	}
+	if secret && len(args) != 2 {
+		return errors.Errorf("`%%env --secret <VAR_NAME> <value>`: it takes exactly 2 arguments, but %d were given", len(args))
+	}
+	if appendValue && prependValue {
+		return errors.Errorf("`%%env`: only one of --append or --prepend can be used")
+	}
+	if (appendValue || prependValue) && len(args) != 2 {
+		return errors.Errorf("`%%env --append|--prepend <VAR_NAME> <value>`: it takes exactly 2 arguments, but %d were given", len(args))
+	}
+	if separator != nil && !appendValue && !prependValue {
+		return errors.Errorf("`%%env`: --separator can only be used with --append or --prepend")
+	}
+
+	switch len(args) {
+	case 0:
+		environ := sortedEnviron()
+		for ii, keyValue := range environ {
+			if name, _, _ := strings.Cut(keyValue, "="); !show && isSecretEnv(name) {
+				environ[ii] = name + "=" + hiddenEnvValue
+			}
+		}
+		publishStdout(msg, strings.Join(environ, "\n")+"\n")
+	case 1:
+		value, found := os.LookupEnv(args[0])
+		if !found {
+			publishStdout(msg, fmt.Sprintf("%s is not set\n", args[0]))
+		} else {
+			publishStdout(msg, formatEnv(args[0], value, show)+"\n")
+		}
+	case 2:
+		if err := validateEnvName(args[0]); err != nil {
+			return errors.WithMessage(err, "`%env`")
+		}
+		value := args[1]
+		if !literal {
+			if !noTemplate {
+				var err error
+				value, err = expandEnvTemplate(value)
+				if err != nil {
+					return errors.WithMessagef(err, "`%%env %s`", args[0])
+				}
+			}
+			value = expandEnvValue(value)
+		}
+		if appendValue || prependValue {
+			value = joinEnvValue(args[0], value, prependValue, separator)
+		}
+		err := setEnv(args[0], value)
+		if err != nil {
+			return errors.Wrapf(err, "`%%env %q` failed", args[0])
+		}
+		if secret {
+			secretEnv.Insert(args[0])
+		}
+		publishStdout(msg, "Set: "+formatEnv(args[0], value, show)+"\n")
+	default:
+		return errors.Errorf("`%%env [--literal] [<VAR_NAME> [<value>]]`: it takes at most 2 arguments, the variable name and it's content, but %d were given", len(args))
+	}
+	return nil
+}
+
+// execEnvFromShell executes "%env --from-shell <command>": it runs the shell command and sets the environment
+// variables in the `KEY=VALUE` lines printed to its stdout (in the same format as dotenv files, see parseDotEnv).
+// Other lines are ignored, and the stderr of the command is displayed in the cell.
+//
+// If secret is set the imported variables are marked as secrets, see secretEnv.
+func execEnvFromShell(msg kernel.Message, cmdStr string, secret bool) error {
+	shell, args := shellCommand(runtime.GOOS, cmdStr)
+	cmd := exec.CommandContext(kernel.InterruptContext(msg), shell, args...)
+	cmd.Stderr = kernel.NewJupyterStreamWriter(msg, kernel.StreamStderr)
+	output, err := cmd.Output()
+	if err != nil {
+		return errors.Wrapf(err, "`%%env --from-shell %q` failed", cmdStr)
+	}
+	vars := parseShellEnv(string(output))
+	var names []string
+	for _, keyValue := range vars {
+		if err = setEnv(keyValue[0], keyValue[1]); err != nil {
+			return errors.Wrapf(err, "`%%env --from-shell %q` failed to set %q", cmdStr, keyValue[0])
+		}
+		if secret {
+			secretEnv.Insert(keyValue[0])
+		}
+		names = append(names, keyValue[0])
+	}
+	if len(names) == 0 {
+		publishStdout(msg, "No environment variables imported from shell command.\n")
+		return nil
+	}
+	publishStdout(msg, fmt.Sprintf("Imported %d environment variables from shell command: %s\n",
+		len(names), strings.Join(names, ", ")))
+	return nil
+}
+
+// parseShellEnv parses the `KEY=VALUE` lines (in the same format as dotenv files, see parseDotEnv) of the
+// output of a shell command, and returns the key/value pairs, in the order they appear. Lines not in this
+// format, or with invalid variable names (see validateEnvName), like the `BASH_FUNC_<name>%%` of the functions
+// exported by bash, are ignored.
+//
+// Indented lines are continuations of a multi-line value, as printed by `env`: they are appended to the
+// value of the previous variable (or ignored, if it was ignored), and never imported as variables.
+func parseShellEnv(output string) (vars [][2]string) {
+	var continued bool // Whether the previous line was imported, and can be continued.
+	for _, line := range strings.Split(output, "\n") {
+		if line != "" && (line[0] == ' ' || line[0] == '\t') {
+			if continued {
+				vars[len(vars)-1][1] += "\n" + line
+			} else {
+				klog.V(1).Infof("Ignoring line %q of shell command output: continuation of an ignored line", line)
+			}
+			continue
+		}
+		continued = false
+		lineVars, err := parseDotEnv(line)
+		if err == nil {
+			for _, keyValue := range lineVars {
+				if err = validateEnvName(keyValue[0]); err != nil {
+					break
+				}
+			}
+		}
+		if err != nil {
+			klog.V(1).Infof("Ignoring line %q of shell command output: %v", line, err)
+			continue
+		}
+		vars = append(vars, lineVars...)
+		continued = len(lineVars) > 0
+	}
+	return
+}
+
+// joinEnvValue returns the current value of the environment variable name joined with value, at the
+// end, or at the start if prepend is true. If the variable is not set or empty, value is returned as is.
+//
+// If separator is nil, the OS path list separator (":" in Unix) is used for variables that look like
+// path lists (see isPathListEnv), and no separator (plain concatenation) otherwise.
+func joinEnvValue(name, value string, prepend bool, separator *string) string {
+	current := os.Getenv(name)
+	if current == "" {
+		return value
+	}
+	var sep string
+	if separator != nil {
+		sep = *separator
+	} else if isPathListEnv(name, current) {
+		sep = string(os.PathListSeparator)
+	}
+	if prepend {
+		return value + sep + current
+	}
+	return current + sep + value
+}
+
+// isPathListEnv returns whether the environment variable name, with the given current value, looks
+// like a list of paths: if its name ends with "PATH" (e.g.: `PATH`, `GOPATH`, `LD_LIBRARY_PATH`), or if
+// its value already contains the OS path list separator.
+func isPathListEnv(name, value string) bool {
+	return strings.HasSuffix(name, "PATH") || strings.ContainsRune(value, os.PathListSeparator)
+}
+
+// expandEnvValue expands the value given to `%env VAR value`: first a leading `~` or `~user` is
+// replaced by the corresponding home directory (see ReplaceTildeInDir), and then `$VAR` and `${VAR}`
+// references are replaced by the current values of the environment variables (see os.ExpandEnv).
+//
+// Since the tilde is replaced first, a `~` that results from the expansion of a variable is kept as is.
+func expandEnvValue(value string) string {
+	if value != "" {
+		value = ReplaceTildeInDir(value)
+	}
+	return os.ExpandEnv(value)
+}
+
+// expandEnvTemplate executes value as a Go text/template, with the environment variables as data: so
+// `{{.HOST}}` is replaced by the value of the environment variable HOST. Values without `{{` are returned as is.
+//
+// It returns an error if the template is invalid, or if it references a variable that is not set.
+func expandEnvTemplate(value string) (string, error) {
+	if !strings.Contains(value, "{{") {
+		return value, nil
+	}
+	tmpl, err := template.New("value").Option("missingkey=error").Parse(value)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid template in value %q (use --no-template to set it as is)", value)
+	}
+	vars := make(map[string]string)
+	for _, keyValue := range os.Environ() {
+		if name, varValue, found := strings.Cut(keyValue, "="); found {
+			vars[name] = varValue
+		}
+	}
+	var sb strings.Builder
+	if err = tmpl.Execute(&sb, vars); err != nil {
+		return "", errors.Wrapf(err, "failed to expand template in value %q", value)
+	}
+	return sb.String(), nil
+}
+
+// execUnsetEnv executes the "%unsetenv" special command. The parameter `args` excludes "%unsetenv".
+//
+// Variables that are not set are simply ignored.
+func execUnsetEnv(msg kernel.Message, args []string) error {
+	if len(args) == 0 {
+		return errors.Errorf("`%%unsetenv <VAR_NAME> [<VAR_NAME>...]`: it takes at least one variable name")
+	}
+	for _, name := range args {
+		if _, found := os.LookupEnv(name); !found {
+			continue
+		}
+		err := unsetEnv(name)
+		if err != nil {
+			return errors.Wrapf(err, "`%%unsetenv %q` failed", name)
+		}
+		publishStdout(msg, fmt.Sprintf("Unset: %s\n", name))
+	}
+	return nil
+}
+
+// execEnvCell executes the "%envcell <VAR_NAME> <value> [<VAR_NAME> <value>...]" special command. The
+// parameter `args` excludes "%envcell".
+//
+// It sets the environment variables only for the Go program and the shell commands of the current cell: their
+// previous values are saved in cellEnv, and restored by RestoreCellEnv once the cell is executed. The values are
+// expanded as with `%env`, see expandEnvValue.
+func execEnvCell(msg kernel.Message, args []string) error {
+	if len(args) == 0 || len(args)%2 != 0 {
+		return errors.Errorf("`%%envcell <VAR_NAME> <value> [<VAR_NAME> <value>...]`: it takes pairs of variable "+
+			"name and value, but %d arguments were given", len(args))
+	}
+	for ii := 0; ii < len(args); ii += 2 {
+		name, value := args[ii], expandEnvValue(args[ii+1])
+		if err := validateEnvName(name); err != nil {
+			return errors.WithMessage(err, "`%envcell`")
+		}
+		if _, saved := cellEnv[name]; !saved {
+			var previous *string
+			if current, found := os.LookupEnv(name); found {
+				previous = &current
+			}
+			cellEnv[name] = previous
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return errors.Wrapf(err, "`%%envcell %q` failed", name)
+		}
+		publishStdout(msg, "Set for this cell: "+formatEnv(name, value, false)+"\n")
+	}
+	return nil
+}
+
+// RestoreCellEnv restores the environment variables set with `%envcell` to their values before the cell. It
+// should be called once the execution of the cell is finished.
+func RestoreCellEnv() {
+	for _, name := range SortedKeys(cellEnv) {
+		var err error
+		if previous := cellEnv[name]; previous != nil {
+			err = os.Setenv(name, *previous)
+		} else {
+			err = os.Unsetenv(name)
+		}
+		if err != nil {
+			klog.Errorf("Failed to restore environment variable %q after the cell: %+v", name, err)
+		}
+	}
+	cellEnv = make(map[string]*string)
+}
+
+// DefaultDotEnvPath is the file loaded by `%dotenv`, if no path is given.
+const DefaultDotEnvPath = ".env"
+
+// execDotEnv executes the "%dotenv" special command. The parameter `args` excludes "%dotenv".
+//
+// It loads the environment variables defined in a dotenv file (DefaultDotEnvPath if not given).
+func execDotEnv(msg kernel.Message, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%dotenv [<path>]`: it takes at most one argument, but %d were given", len(args))
+	}
+	filePath := DefaultDotEnvPath
+	if len(args) == 1 {
+		filePath = ReplaceTildeInDir(args[0])
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "`%%dotenv %q` failed to read file", filePath)
+	}
+	vars, err := parseDotEnv(string(content))
+	if err != nil {
+		return errors.WithMessagef(err, "`%%dotenv %q` failed to parse file", filePath)
+	}
+	for _, keyValue := range vars {
+		if err = setEnv(keyValue[0], keyValue[1]); err != nil {
+			return errors.Wrapf(err, "`%%dotenv %q` failed to set %q", filePath, keyValue[0])
+		}
+	}
+	publishStdout(msg, fmt.Sprintf("Loaded %d environment variables from %q\n", len(vars), filePath))
+	return nil
+}
+
+// parseDotEnv parses the contents of a dotenv file, and returns the list of key/value pairs defined,
+// in the order they appear.
+//
+// Each line has the format `KEY=VALUE`, optionally prefixed with `export `. Empty lines and lines starting
+// with `#` are ignored. Values can be double-quoted (with Go escape sequences), single-quoted (taken
+// literally) or unquoted, in which case anything after a ` #` is considered a comment.
+func parseDotEnv(content string) (vars [][2]string, err error) {
+	for lineNum, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, errors.Errorf("line %d: invalid format, expected `KEY=VALUE`, got %q", lineNum+1, line)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"':
+			end := strings.LastIndex(value, "\"")
+			unquoted, unquoteErr := strconv.Unquote(value[:end+1])
+			if end == 0 || unquoteErr != nil {
+				return nil, errors.Errorf("line %d: invalid double-quoted value for %q", lineNum+1, key)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'':
+			end := strings.LastIndex(value, "'")
+			if end == 0 {
+				return nil, errors.Errorf("line %d: unterminated single-quoted value for %q", lineNum+1, key)
+			}
+			value = value[1:end]
+		default:
+			if idx := strings.Index(value, " #"); idx >= 0 {
+				value = strings.TrimSpace(value[:idx])
+			}
+		}
+		vars = append(vars, [2]string{key, value})
+	}
+	return vars, nil
+}
+
+// execEnvExport executes "%env --export [--all] [--show] <path>": it writes the environment variables changed
+// by GoNB's special commands (see changedEnv), or all of them if all is set, to filePath in the dotenv format
+// read by `%dotenv` (see formatDotEnv).
+//
+// Secret variables (see isSecretEnv) are not written, unless show is set, and changed variables that are
+// currently unset are written as comments.
+func execEnvExport(msg kernel.Message, filePath string, all, show bool) error {
+	var names []string
+	if all {
+		for _, keyValue := range sortedEnviron() {
+			name, _, _ := strings.Cut(keyValue, "=")
+			names = append(names, name)
+		}
+	} else {
+		names = SortedKeys(changedEnv)
+	}
+	var lines, skipped []string
+	var count int
+	for _, name := range names {
+		value, found := os.LookupEnv(name)
+		switch {
+		case !found:
+			lines = append(lines, fmt.Sprintf("# %s is not set", name))
+		case !show && isSecretEnv(name):
+			skipped = append(skipped, name)
+		default:
+			lines = append(lines, formatDotEnv(name, value))
+			count++
+		}
+	}
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+		return errors.Wrapf(err, "`%%env --export %q` failed to write file", filePath)
+	}
+	publishStdout(msg, fmt.Sprintf("Exported %d environment variables to %q\n", count, filePath))
+	if len(skipped) > 0 {
+		publishStderr(msg, fmt.Sprintf("Secret variables not exported (use --show to export them): %s\n",
+			strings.Join(skipped, ", ")))
+	}
+	return nil
+}
+
+// reDotEnvUnquoted matches the values that can be written unquoted in a dotenv file.
+var reDotEnvUnquoted = regexp.MustCompile(`^[\w./:@%+,=~-]*$`)
+
+// formatDotEnv returns the `KEY=VALUE` line of a dotenv file, as parsed by parseDotEnv: values with spaces,
+// quotes or other special characters are double-quoted, with Go escape sequences.
+func formatDotEnv(name, value string) string {
+	if !reDotEnvUnquoted.MatchString(value) {
+		value = strconv.Quote(value)
+	}
+	return name + "=" + value
+}
+
+// debugGoEnvNames are the Go environment variables reported by `%debug env`, with the values (including the
+// defaults) seen by the Go toolchain.
+var debugGoEnvNames = []string{"GOROOT", "GOPATH", "GOMODCACHE", "GOCACHE", "GOFLAGS", "GOPROXY", "GOPRIVATE",
+	"GOWORK", "GOOS", "GOARCH", "CGO_ENABLED"}
+
+// debugEnvReport returns the report printed by `%debug env`: the Go toolchain command, the build flags, the
+// values of debugGoEnvNames reported by `go env`, and the environment passed to the toolchain subprocesses
+// (see goexec.State.GoCommandEnv), sorted by name, with the values of secrets hidden (see formatEnv).
+func debugEnvReport(goExec *goexec.State) string {
+	var sb strings.Builder
+	_, _ = fmt.Fprintf(&sb, "Go toolchain: %q, executed in %q\n", goexec.GoBinary(), goExec.TempDir)
+	_, _ = fmt.Fprintf(&sb, "Build flags: %q\n", goExec.BuildFlags())
+	if goEnv, err := goExec.GoEnv(debugGoEnvNames...); err != nil {
+		_, _ = fmt.Fprintf(&sb, "Failed to get Go environment: %v\n", err)
+	} else {
+		sb.WriteString("\nGo environment (`go env`):\n")
+		for _, name := range debugGoEnvNames {
+			_, _ = fmt.Fprintf(&sb, "  %s\n", formatEnv(name, goEnv[name], false))
+		}
+	}
+	environ := goExec.GoCommandEnv()
+	sort.Strings(environ)
+	sb.WriteString("\nEnvironment of the Go toolchain subprocesses:\n")
+	for _, keyValue := range environ {
+		name, value, _ := strings.Cut(keyValue, "=")
+		_, _ = fmt.Fprintf(&sb, "  %s\n", formatEnv(name, value, false))
+	}
+	return sb.String()
+}
+
+// sortedEnviron returns the current environment variables, in the "KEY=VALUE" format, sorted by KEY.
+func sortedEnviron() []string {
+	environ := os.Environ()
+	sort.Slice(environ, func(i, j int) bool {
+		keyI, _, _ := strings.Cut(environ[i], "=")
+		keyJ, _, _ := strings.Cut(environ[j], "=")
+		return keyI < keyJ
+	})
+	return environ
+}
+
+// publishStderr publishes the text to the cell's stderr. Failures to publish are only logged,
+// since there is nothing else to be done.
+func publishStderr(msg kernel.Message, text string) {
+	err := kernel.PublishWriteStream(msg, kernel.StreamStderr, text)
+	if err != nil {
+		klog.Errorf("Failed to output: %+v", err)
+	}
+}
+
+// publishStdout publishes the text to the cell's stdout. Failures to publish are only logged,
+// since there is nothing else to be done.
+func publishStdout(msg kernel.Message, text string) {
+	err := kernel.PublishWriteStream(msg, kernel.StreamStdout, text)
+	if err != nil {
+		klog.Errorf("Failed to output: %+v", err)
+	}
+}
@@ -0,0 +1,333 @@
+package specialcmd
+
+import (
+	"bufio"
+	"fmt"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"io"
+	"k8s.io/klog/v2"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// This file implements special commands that read or write the cell contents from/to files, and `%cat`,
+// that displays files.
+
+// execWriteFile parses the "%writefile [-a] <path>" special command. The parameter `args` excludes
+// "%writefile".
+//
+// Since it requires all the special commands of the cell to be known, the actual writing is
+// delayed until the end of Parse, see writeCellToFile.
+func execWriteFile(args []string, status *cellStatus) error {
+	usage := "`%%writefile [-a] <path>`"
+	var appendToFile bool
+	if len(args) > 0 && args[0] == "-a" {
+		appendToFile = true
+		args = args[1:]
+	}
+	if len(args) != 1 || args[0] == "" {
+		return errors.Errorf("%s: it takes one file path as argument", usage)
+	}
+	status.writeFileCmd = "%writefile"
+	status.writeFilePath = ReplaceTildeInDir(args[0])
+	status.writeFileAppend = appendToFile
+	return nil
+}
+
+// writeCellToFile writes the lines of the cell that are not special commands (not in usedLines)
+// to the file configured by `%writefile` (or `%%file --run`).
+func writeCellToFile(msg kernel.Message, status *cellStatus, codeLines []string, usedLines Set[int]) error {
+	var goLines []string
+	for lineNum, line := range codeLines {
+		if !usedLines.Has(lineNum) {
+			goLines = append(goLines, line)
+		}
+	}
+	content := strings.Join(goLines, "\n") + "\n"
+	return writeContentToFile(msg, status.writeFileCmd, status.writeFilePath, status.writeFileAppend, content)
+}
+
+// writeContentToFile writes (or appends) content to filePath, and reports it. cmdName is the special
+// command used in error messages.
+func writeContentToFile(msg kernel.Message, cmdName, filePath string, appendToFile bool, content string) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	verb := "Wrote"
+	if appendToFile {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		verb = "Appended"
+	}
+	f, err := os.OpenFile(filePath, flags, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "`%s` failed to open %q", cmdName, filePath)
+	}
+	n, err := f.WriteString(content)
+	if err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "`%s` failed to write to %q", cmdName, filePath)
+	}
+	if err = f.Close(); err != nil {
+		return errors.Wrapf(err, "`%s` failed to close %q", cmdName, filePath)
+	}
+	publishStdout(msg, fmt.Sprintf("%s %d bytes to %q\n", verb, n, filePath))
+	return nil
+}
+
+// parseFileCellArgs parses the arguments of the "%%file [--run] <path>" cell magic. A path prefixed
+// with `*` is relative to the temporary directory where the cells are compiled, like with `!*`.
+func parseFileCellArgs(goExec *goexec.State, args []string) (filePath string, run bool, err error) {
+	var paths []string
+	for _, arg := range args {
+		if arg == "--run" {
+			run = true
+		} else {
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) != 1 || paths[0] == "" || paths[0] == "*" {
+		err = errors.New("`%%file [--run] <path>`: it takes one file path as argument")
+		return
+	}
+	filePath = paths[0]
+	if strings.HasPrefix(filePath, "*") {
+		filePath = path.Join(goExec.TempDir, filePath[1:])
+	} else {
+		filePath = ReplaceTildeInDir(filePath)
+	}
+	return
+}
+
+// execFileCell executes the "%%file <path>" cell magic: body, the rest of the cell, is written verbatim
+// to the file. With `--run` the cell is instead handled by execFileRun.
+func execFileCell(msg kernel.Message, goExec *goexec.State, args []string, body string) error {
+	filePath, _, err := parseFileCellArgs(goExec, args)
+	if err != nil {
+		return err
+	}
+	return writeContentToFile(msg, "%%file", filePath, false, body+"\n")
+}
+
+// execFileRun executes the "%%file --run <path>" special command: like `%writefile`, the Go code of
+// the cell is written to the file, and the cell is still executed.
+func execFileRun(goExec *goexec.State, args []string, status *cellStatus) error {
+	filePath, _, err := parseFileCellArgs(goExec, args)
+	if err != nil {
+		return err
+	}
+	status.writeFileCmd = "%%file"
+	status.writeFilePath = filePath
+	status.writeFileAppend = false
+	return nil
+}
+
+// LoadURLTimeout is the maximum time `%load` waits for the contents of a URL.
+var LoadURLTimeout = 30 * time.Second
+
+// execLoad executes the "%load <path_or_url>" special command. The parameter `args` excludes
+// "%load".
+//
+// The Go code loaded is executed along with the cell, see goexec.State.CellLoadedLines.
+func execLoad(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) != 1 || args[0] == "" {
+		return errors.Errorf("`%%load <path_or_url>`: it takes one file path or URL as argument")
+	}
+	content, err := readFileOrURL(args[0])
+	if err != nil {
+		return err
+	}
+	lines := stripPackageClause(strings.Split(strings.TrimRight(content, "\n"), "\n"))
+	goExec.CellLoadedLines = append(goExec.CellLoadedLines, lines...)
+	publishStdout(msg, fmt.Sprintf("Loaded %d lines from %q\n", len(lines), args[0]))
+	return nil
+}
+
+// readFileOrURL returns the contents of the given file, or of the URL if it starts with
+// "http://" or "https://".
+func readFileOrURL(pathOrURL string) (string, error) {
+	if !strings.HasPrefix(pathOrURL, "http://") && !strings.HasPrefix(pathOrURL, "https://") {
+		filePath := ReplaceTildeInDir(pathOrURL)
+		content, err := os.ReadFile(filePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return "", errors.Errorf("file %q not found", filePath)
+			}
+			return "", errors.Wrapf(err, "failed to read %q", filePath)
+		}
+		return string(content), nil
+	}
+
+	client := &http.Client{Timeout: LoadURLTimeout}
+	resp, err := client.Get(pathOrURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to fetch %q", pathOrURL)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to fetch %q: %s", pathOrURL, resp.Status)
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read contents of %q", pathOrURL)
+	}
+	return string(content), nil
+}
+
+// stripPackageClause removes the `package` clause of Go code, if it is the first statement
+// (after empty lines and line comments), since GoNB creates its own `package main`.
+func stripPackageClause(lines []string) []string {
+	for ii, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "//") {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "package ") {
+			return append(lines[:ii:ii], lines[ii+1:]...)
+		}
+		break
+	}
+	return lines
+}
+
+// MaxCatBytes is the maximum number of bytes of a file displayed by `%cat`: the rest is truncated.
+const MaxCatBytes = 256 * 1024
+
+// catLanguages maps file extensions (and some file names) to the language used to highlight them by `%cat`.
+var catLanguages = map[string]string{
+	".go": "go", ".mod": "go", ".work": "go", ".py": "python", ".js": "javascript", ".ts": "typescript",
+	".sh": "bash", ".bash": "bash", ".json": "json", ".yaml": "yaml", ".yml": "yaml", ".toml": "toml",
+	".md": "markdown", ".html": "html", ".css": "css", ".xml": "xml", ".svg": "xml", ".sql": "sql",
+	".c": "c", ".h": "c", ".cc": "cpp", ".cpp": "cpp", ".hpp": "cpp", ".rs": "rust", ".java": "java",
+	".proto": "protobuf", ".dot": "dot", "Dockerfile": "dockerfile", "Makefile": "makefile",
+}
+
+// execCat executes the "%cat [--lines <from>:<to>] <path>" special command. The parameter `args` excludes
+// "%cat".
+//
+// It displays the contents of the file as a Markdown code block, highlighted according to its language
+// (see catLanguages). With `--lines` only the given range of lines (starting from 1, inclusive) is displayed,
+// and either end can be omitted. At most MaxCatBytes are displayed.
+func execCat(msg kernel.Message, args []string) error {
+	usage := "`%cat [--lines <from>:<to>] <path>`"
+	fromLine, toLine := 1, -1
+	var filePath string
+	for ii := 0; ii < len(args); ii++ {
+		arg := args[ii]
+		if arg == "--lines" || strings.HasPrefix(arg, "--lines=") {
+			linesRange := strings.TrimPrefix(arg, "--lines=")
+			if arg == "--lines" {
+				if ii+1 >= len(args) {
+					return errors.Errorf("%s: missing range for --lines", usage)
+				}
+				ii++
+				linesRange = args[ii]
+			}
+			var err error
+			fromLine, toLine, err = parseLinesRange(linesRange)
+			if err != nil {
+				return errors.WithMessage(err, usage)
+			}
+			continue
+		}
+		if strings.HasPrefix(arg, "--") || filePath != "" {
+			return errors.Errorf("%s: invalid argument %q", usage, arg)
+		}
+		filePath = ReplaceTildeInDir(arg)
+	}
+	if filePath == "" {
+		return errors.Errorf("%s: missing file path", usage)
+	}
+
+	markdown, err := catMarkdown(filePath, fromLine, toLine)
+	if err != nil {
+		return errors.WithMessage(err, "`%cat` failed")
+	}
+	if err = kernel.PublishDisplayDataWithMarkdown(msg, markdown); err != nil {
+		klog.Errorf("Failed to publish %%cat contents: %+v", err)
+	}
+	return nil
+}
+
+// catMarkdown returns the lines fromLine to toLine (inclusive, or until the end if toLine < 0) of the file
+// as a Markdown code block, truncated after MaxCatBytes. See execCat.
+func catMarkdown(filePath string, fromLine, toLine int) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errors.Errorf("file %q not found", filePath)
+		}
+		return "", errors.Wrapf(err, "failed to open %q", filePath)
+	}
+	defer func() { _ = f.Close() }()
+	var sb strings.Builder
+	reader := bufio.NewReader(f)
+	truncated := false
+	for lineNum := 1; toLine < 0 || lineNum <= toLine; lineNum++ {
+		line, err := reader.ReadString('\n')
+		if lineNum >= fromLine {
+			if sb.Len()+len(line) > MaxCatBytes {
+				truncated = true
+				break
+			}
+			sb.WriteString(line)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", errors.Wrapf(err, "failed to read %q", filePath)
+		}
+	}
+	content := sb.String()
+	if content != "" && !strings.HasSuffix(content, "\n") {
+		content += "\n"
+	}
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	markdown := fmt.Sprintf("%s%s\n%s%s\n", fence, catLanguage(filePath), content, fence)
+	if truncated {
+		markdown += fmt.Sprintf("\n*Truncated after %d bytes, use `--lines` to display other parts of the file.*\n",
+			sb.Len())
+	}
+	return markdown, nil
+}
+
+// parseLinesRange parses a range of lines in the format `<from>:<to>`, both ends inclusive and starting
+// from 1. Either end can be omitted, in which case it returns fromLine=1 or toLine=-1 (until the end).
+func parseLinesRange(linesRange string) (fromLine, toLine int, err error) {
+	fromStr, toStr, found := strings.Cut(linesRange, ":")
+	if !found {
+		return 0, 0, errors.Errorf("invalid range of lines %q, it must be in the format <from>:<to>", linesRange)
+	}
+	fromLine, toLine = 1, -1
+	if fromStr != "" {
+		if fromLine, err = strconv.Atoi(fromStr); err != nil || fromLine < 1 {
+			return 0, 0, errors.Errorf("invalid first line %q in range %q, it must be a positive number",
+				fromStr, linesRange)
+		}
+	}
+	if toStr != "" {
+		if toLine, err = strconv.Atoi(toStr); err != nil || toLine < fromLine {
+			return 0, 0, errors.Errorf("invalid last line %q in range %q, it must be a number >= %d",
+				toStr, linesRange, fromLine)
+		}
+	}
+	return fromLine, toLine, nil
+}
+
+// catLanguage returns the language of the file, used to highlight its contents, or "" if not known.
+func catLanguage(filePath string) string {
+	if language, found := catLanguages[filepath.Base(filePath)]; found {
+		return language
+	}
+	return catLanguages[strings.ToLower(filepath.Ext(filePath))]
+}
@@ -0,0 +1,162 @@
+package specialcmd
+
+import (
+	"fmt"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file implements the `%%go.mod` and `%%go.work` cell magics and the `%goworkuse` special command,
+// that edit the module files of the notebook, `%modverify` and `%modwhy`, to audit its dependencies, and
+// `%goinstall`, that installs Go tools.
+
+// execGoModCell executes the "%%go.mod [--append]" cell magic: body, the rest of the cell, replaces the
+// contents of `go.mod`, or is appended to it with `--append`. See goexec.State.SetGoMod.
+func execGoModCell(msg kernel.Message, goExec *goexec.State, args []string, body string) error {
+	var appendContent bool
+	for _, arg := range args {
+		if arg != "--append" {
+			return errors.Errorf("`%%%%go.mod [--append]`: unknown argument %q", arg)
+		}
+		appendContent = true
+	}
+	if err := goExec.SetGoMod(body, appendContent); err != nil {
+		return errors.WithMessagef(err, "`%%%%go.mod` failed, go.mod was not changed")
+	}
+	if appendContent {
+		publishStdout(msg, "go.mod updated\n")
+	} else {
+		publishStdout(msg, "go.mod replaced\n")
+	}
+	return nil
+}
+
+// execGoWorkCell executes the "%%go.work" cell magic: body, the rest of the cell, replaces the contents of
+// `go.work` (see goexec.State.SetGoWork), and then the modules in it are added as `replace` rules to `go.mod`
+// (see goexec.State.GoWorkFix).
+func execGoWorkCell(msg kernel.Message, goExec *goexec.State, args []string, body string) error {
+	if len(args) > 0 {
+		return errors.Errorf("`%%%%go.work` takes no arguments, got %q", args)
+	}
+	if err := goExec.SetGoWork(body); err != nil {
+		return errors.WithMessagef(err, "`%%%%go.work` failed, go.work was not changed")
+	}
+	return goWorkFixAndReport(msg, goExec)
+}
+
+// execGoWorkUse executes the "%goworkuse <dir>" special command. The parameter `args` excludes "%goworkuse".
+//
+// It adds `use <dir>` to `go.work`, creating it if needed (see goexec.State.GoWorkUse), and then the modules
+// in it are added as `replace` rules to `go.mod` (see goexec.State.GoWorkFix).
+func execGoWorkUse(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) != 1 {
+		return errors.Errorf("`%%goworkuse <dir>`: it takes one directory as argument, but %d were given", len(args))
+	}
+	if err := goExec.GoWorkUse(args[0]); err != nil {
+		return errors.WithMessagef(err, "`%%goworkuse %q` failed", args[0])
+	}
+	return goWorkFixAndReport(msg, goExec)
+}
+
+// goWorkFixAndReport runs goexec.State.GoWorkFix after `go.work` was changed, and prints the modules that
+// are now in the workspace.
+func goWorkFixAndReport(msg kernel.Message, goExec *goexec.State) error {
+	if err := goExec.GoWorkFix(msg); err != nil {
+		return err
+	}
+	modToPath, err := goExec.GoWorkModules()
+	if err != nil {
+		return err
+	}
+	if len(modToPath) == 0 {
+		publishStdout(msg, "go.work updated, no modules besides the notebook's are in the workspace\n")
+		return nil
+	}
+	text := "go.work updated, modules in the workspace:\n"
+	for _, mod := range SortedKeys(modToPath) {
+		text += fmt.Sprintf("\t- %s: %s\n", mod, modToPath[mod])
+	}
+	publishStdout(msg, text)
+	return nil
+}
+
+// execGoInstall executes the "%goinstall [--path] <pkg>@<version>..." special command. The parameter `args`
+// excludes "%goinstall".
+//
+// It runs `go install` for the packages (see goexec.State.GoInstall) and prints the paths of the installed
+// binaries. With `--path`, the directory of the binaries is prepended to `PATH`, if not there yet, so
+// they can be used by shell commands in the following cells.
+func execGoInstall(msg kernel.Message, goExec *goexec.State, args []string) error {
+	var addToPath bool
+	var packages []string
+	for _, arg := range args {
+		if arg == "--path" {
+			addToPath = true
+			continue
+		}
+		if strings.HasPrefix(arg, "-") {
+			return errors.Errorf("`%%goinstall [--path] <pkg>@<version>...`: unknown flag %q", arg)
+		}
+		packages = append(packages, arg)
+	}
+	if len(packages) == 0 {
+		return errors.Errorf("`%%goinstall [--path] <pkg>@<version>...`: no package given to install")
+	}
+	binPaths, err := goExec.GoInstall(msg, packages)
+	if err != nil {
+		return errors.WithMessagef(err, "`%%goinstall` failed")
+	}
+	for _, binPath := range binPaths {
+		publishStdout(msg, fmt.Sprintf("Installed %s\n", binPath))
+	}
+	if !addToPath {
+		return nil
+	}
+	binDir := filepath.Dir(binPaths[0])
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == binDir {
+			return nil
+		}
+	}
+	if err = setEnv("PATH", joinEnvValue("PATH", binDir, true, nil)); err != nil {
+		return errors.Wrapf(err, "`%%goinstall --path`: failed to prepend %q to PATH", binDir)
+	}
+	publishStdout(msg, fmt.Sprintf("Prepended %s to PATH\n", binDir))
+	return nil
+}
+
+// execModVerify executes the "%modverify" special command: it runs `go mod verify`, see goexec.State.ModVerify.
+// The parameter `args` excludes "%modverify".
+func execModVerify(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf("`%%modverify` takes no arguments, got %q", args)
+	}
+	if err := goExec.ModVerify(msg); err != nil {
+		return errors.WithMessagef(err, "`%%modverify` failed, the module cache may have been modified")
+	}
+	return nil
+}
+
+// execModWhy executes the "%modwhy [-m] <pkg>..." special command: it runs `go mod why`, see
+// goexec.State.ModWhy. The parameter `args` excludes "%modwhy".
+func execModWhy(msg kernel.Message, goExec *goexec.State, args []string) error {
+	var packages []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			if arg != "-m" && arg != "-vendor" {
+				return errors.Errorf("`%%modwhy [-m] [-vendor] <pkg>...`: unknown flag %q", arg)
+			}
+			continue
+		}
+		packages = append(packages, arg)
+	}
+	if len(packages) == 0 {
+		return errors.Errorf("`%%modwhy [-m] [-vendor] <pkg>...`: no package (or module, with -m) given")
+	}
+	return goExec.ModWhy(msg, args)
+}
@@ -0,0 +1,161 @@
+package specialcmd
+
+import (
+	"fmt"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"regexp"
+	"strings"
+)
+
+// This file implements `%help [<command>|--search <term>]`, which displays all or parts of HelpMessage.
+
+// helpEntry is a block of HelpMessage: a list item (e.g.: the description of a special command) or a
+// paragraph, along with the heading of the section it belongs to.
+type helpEntry struct {
+	Heading, Text string
+}
+
+// parseHelpEntries splits the markdown help message into its entries. Headings are not entries themselves,
+// and code blocks are kept within one entry.
+func parseHelpEntries(help string) (entries []helpEntry) {
+	var heading string
+	var current []string
+	flush := func() {
+		if len(current) > 0 {
+			entries = append(entries, helpEntry{Heading: heading, Text: strings.Join(current, "\n")})
+			current = nil
+		}
+	}
+	inCode := false
+	for _, line := range strings.Split(help, "\n") {
+		switch {
+		case strings.HasPrefix(line, "```"):
+			inCode = !inCode
+		case inCode:
+		case strings.HasPrefix(line, "#"):
+			flush()
+			heading = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			continue
+		case strings.TrimSpace(line) == "":
+			flush()
+			continue
+		case strings.HasPrefix(line, "- "):
+			flush()
+		}
+		current = append(current, line)
+	}
+	flush()
+	return
+}
+
+// reHelpCodeSpan matches the inline code spans (e.g.: "`%cd [<directory>]`") in markdown.
+var reHelpCodeSpan = regexp.MustCompile("`([^`]+)`")
+
+// helpEntryCommands returns the commands documented by a list item entry: the code spans before the
+// first ":" (e.g.: "- `%autoget` and `%noautoget`: ..." documents "autoget" and "noautoget"). The
+// leading "%" and the arguments are dropped.
+func helpEntryCommands(entry helpEntry) (commands []string) {
+	if !strings.HasPrefix(entry.Text, "- `") {
+		return nil
+	}
+	head, _, found := strings.Cut(entry.Text, "`:")
+	if !found {
+		return nil
+	}
+	for _, match := range reHelpCodeSpan.FindAllStringSubmatch(head+"`", -1) {
+		fields := strings.Fields(match[1])
+		if len(fields) == 0 {
+			continue
+		}
+		command, _, _ := strings.Cut(fields[0], "<")
+		commands = append(commands, strings.TrimLeft(command, "%"))
+	}
+	return
+}
+
+// helpForCommand returns the help for the given command (e.g.: "cd", "%cd" or "%%cgo"), or, if no
+// command matches it, the sections whose heading contains it.
+func helpForCommand(help, command string) (string, error) {
+	entries := parseHelpEntries(help)
+	name := strings.TrimLeft(command, "%")
+	var parts []string
+	for _, entry := range entries {
+		for _, entryCommand := range helpEntryCommands(entry) {
+			if entryCommand == name {
+				parts = append(parts, entry.Text)
+				break
+			}
+		}
+	}
+	if len(parts) > 0 {
+		return strings.Join(parts, "\n"), nil
+	}
+
+	// Try matching section headings instead.
+	lowerName := strings.ToLower(command)
+	lastHeading := ""
+	for _, entry := range entries {
+		if entry.Heading == "" || !strings.Contains(strings.ToLower(entry.Heading), lowerName) {
+			continue
+		}
+		if entry.Heading != lastHeading {
+			parts = append(parts, "### "+entry.Heading)
+			lastHeading = entry.Heading
+		}
+		parts = append(parts, entry.Text)
+	}
+	if len(parts) > 0 {
+		return strings.Join(parts, "\n\n"), nil
+	}
+	return "", errors.Errorf("`%%help`: no help found for %q, try `%%help --search <term>`", command)
+}
+
+// searchHelp returns the entries of the help that contain term (case-insensitive), grouped by their
+// section heading.
+func searchHelp(help, term string) string {
+	lowerTerm := strings.ToLower(term)
+	var parts []string
+	lastHeading := ""
+	for _, entry := range parseHelpEntries(help) {
+		if !strings.Contains(strings.ToLower(entry.Text), lowerTerm) {
+			continue
+		}
+		if entry.Heading != lastHeading && entry.Heading != "" {
+			parts = append(parts, "### "+entry.Heading)
+			lastHeading = entry.Heading
+		}
+		parts = append(parts, entry.Text)
+	}
+	if len(parts) == 0 {
+		return fmt.Sprintf("No help found containing %q.", term)
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+// execHelp executes the "%help [<command>|--search <term>]" special command. The parameter `args` excludes
+// "%help". Without arguments, it displays the whole HelpMessage.
+func execHelp(msg kernel.Message, args []string) error {
+	content := HelpMessage
+	switch {
+	case len(args) == 0:
+	case args[0] == "--search":
+		if len(args) == 1 {
+			return errors.Errorf("`%%help --search <term>`: missing search term")
+		}
+		content = searchHelp(HelpMessage, strings.Join(args[1:], " "))
+	case len(args) == 1:
+		var err error
+		content, err = helpForCommand(HelpMessage, args[0])
+		if err != nil {
+			return err
+		}
+	default:
+		return errors.Errorf("`%%help [<command>|--search <term>]`: invalid arguments %q", args)
+	}
+	if err := kernel.PublishDisplayDataWithMarkdown(msg, content); err != nil {
+		klog.Errorf("Failed publishing %%help contents: %+v", err)
+	}
+	return nil
+}
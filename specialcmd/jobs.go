@@ -0,0 +1,231 @@
+package specialcmd
+
+import (
+	"fmt"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// This file implements the shell commands running in the background, started with `%bg`, and
+// managed with `%jobs` and `%kill`.
+
+// MaxJobLogSize is the maximum number of bytes of the output (stdout and stderr) kept for each
+// background job. Only the last MaxJobLogSize bytes are kept.
+const MaxJobLogSize = 1 << 20
+
+// job is a shell command running in the background, see `%bg`.
+type job struct {
+	id      int
+	command string
+	started time.Time
+	cmd     *exec.Cmd
+	done    chan struct{} // Closed when the command exits.
+
+	mu       sync.Mutex
+	logs     []byte // Last MaxJobLogSize bytes of the combined stdout and stderr.
+	exitCode int
+}
+
+// Write implements io.Writer, and appends the output of the command to the job's logs.
+func (j *job) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.logs = append(j.logs, p...)
+	if len(j.logs) > MaxJobLogSize {
+		j.logs = append([]byte(nil), j.logs[len(j.logs)-MaxJobLogSize:]...)
+	}
+	return len(p), nil
+}
+
+// isRunning returns whether the command of the job is still running.
+func (j *job) isRunning() bool {
+	select {
+	case <-j.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// status returns a one-line description of the job, used by `%jobs`.
+func (j *job) status() string {
+	state := fmt.Sprintf("running for %s", time.Since(j.started).Round(time.Second))
+	if !j.isRunning() {
+		j.mu.Lock()
+		state = fmt.Sprintf("exited (exit code %d)", j.exitCode)
+		if j.exitCode == -1 {
+			state = "terminated by a signal"
+		}
+		j.mu.Unlock()
+	}
+	return fmt.Sprintf("[%d] pid=%d %s: %s", j.id, j.cmd.Process.Pid, state, j.command)
+}
+
+var (
+	// muJobs protects jobs and lastJobId.
+	muJobs sync.Mutex
+
+	// jobs maps the job ids to the background jobs started with `%bg`, including those that have
+	// already exited.
+	jobs      = make(map[int]*job)
+	lastJobId int
+)
+
+// startJob starts the shell command cmdStr in the background, in the current directory, and registers it in jobs.
+func startJob(cmdStr string) (*job, error) {
+	shell, args := shellCommand(runtime.GOOS, cmdStr)
+	j := &job{command: cmdStr, done: make(chan struct{}), exitCode: -1}
+	j.cmd = exec.Command(shell, args...)
+	j.cmd.Stdout = j
+	j.cmd.Stderr = j
+	// Run on its own process group, so `%kill` reaches any sub-processes.
+	j.cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := j.cmd.Start(); err != nil {
+		return nil, errors.Wrapf(err, "failed to start %q in the background", cmdStr)
+	}
+	j.started = time.Now()
+
+	muJobs.Lock()
+	lastJobId++
+	j.id = lastJobId
+	jobs[j.id] = j
+	muJobs.Unlock()
+
+	go func() {
+		err := j.cmd.Wait()
+		j.mu.Lock()
+		j.exitCode = j.cmd.ProcessState.ExitCode()
+		j.mu.Unlock()
+		close(j.done)
+		klog.V(1).Infof("Background job [%d] %q exited: %v", j.id, j.command, err)
+	}()
+	return j, nil
+}
+
+// getJob returns the job with the id given as a string, optionally prefixed with "%" (e.g.: "%1"), as in shells.
+func getJob(idStr string) (*job, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(idStr, "%"))
+	if err != nil {
+		return nil, errors.Errorf("invalid job id %q", idStr)
+	}
+	muJobs.Lock()
+	defer muJobs.Unlock()
+	j, found := jobs[id]
+	if !found {
+		return nil, errors.Errorf("no background job with id %d, see `%%jobs`", id)
+	}
+	return j, nil
+}
+
+// killJob interrupts the job with a SIGTERM sent to its process group, followed by a SIGKILL if it is still
+// running after kernel.InterruptGracePeriod. It waits for the job to exit.
+func killJob(j *job) error {
+	if !j.isRunning() {
+		return errors.Errorf("background job [%d] already exited", j.id)
+	}
+	pgid := j.cmd.Process.Pid // Process group id is the same as the pid, since we set Setpgid.
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+		return errors.Wrapf(err, "failed to send SIGTERM to background job [%d]", j.id)
+	}
+	select {
+	case <-j.done:
+		return nil
+	case <-time.After(kernel.InterruptGracePeriod):
+	}
+	klog.Warningf("Background job [%d] still running %s after SIGTERM, killing it (SIGKILL)", j.id, kernel.InterruptGracePeriod)
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil {
+		return errors.Wrapf(err, "failed to send SIGKILL to background job [%d]", j.id)
+	}
+	<-j.done
+	return nil
+}
+
+// StopJobs kills all background jobs still running. It should be called when the kernel exits.
+func StopJobs() {
+	muJobs.Lock()
+	var running []*job
+	for _, id := range SortedKeys(jobs) {
+		if jobs[id].isRunning() {
+			running = append(running, jobs[id])
+		}
+	}
+	muJobs.Unlock()
+	for _, j := range running {
+		if err := killJob(j); err != nil {
+			klog.Errorf("Failed to stop background job: %+v", err)
+		}
+	}
+}
+
+// execBackground executes the "%bg <shell command>" special command. The parameter cmdStr is the shell
+// command, as is.
+func execBackground(msg kernel.Message, cmdStr string) error {
+	if cmdStr == "" {
+		return errors.Errorf("`%%bg <shell command>`: missing the shell command to run in the background")
+	}
+	j, err := startJob(cmdStr)
+	if err != nil {
+		return err
+	}
+	publishStdout(msg, fmt.Sprintf("[%d] pid=%d\n", j.id, j.cmd.Process.Pid))
+	return nil
+}
+
+// execJobs executes the "%jobs [--logs <id>]" special command. The parameter `args` excludes "%jobs".
+func execJobs(msg kernel.Message, args []string) error {
+	if len(args) == 2 && args[0] == "--logs" {
+		j, err := getJob(args[1])
+		if err != nil {
+			return err
+		}
+		j.mu.Lock()
+		logs := string(j.logs)
+		j.mu.Unlock()
+		publishStdout(msg, logs)
+		return nil
+	}
+	if len(args) != 0 {
+		return errors.Errorf("`%%jobs [--logs <id>]`: invalid arguments %q", args)
+	}
+	publishStdout(msg, listJobs())
+	return nil
+}
+
+// listJobs returns the status of each background job, sorted by id.
+func listJobs() string {
+	muJobs.Lock()
+	defer muJobs.Unlock()
+	if len(jobs) == 0 {
+		return "No background jobs.\n"
+	}
+	var parts []string
+	for _, id := range SortedKeys(jobs) {
+		parts = append(parts, jobs[id].status())
+	}
+	return strings.Join(parts, "\n") + "\n"
+}
+
+// execKill executes the "%kill <id>" special command. The parameter `args` excludes "%kill".
+func execKill(msg kernel.Message, args []string) error {
+	if len(args) != 1 {
+		return errors.Errorf("`%%kill <id>`: it takes exactly one job id, see `%%jobs`")
+	}
+	j, err := getJob(args[0])
+	if err != nil {
+		return err
+	}
+	if err = killJob(j); err != nil {
+		return err
+	}
+	publishStdout(msg, j.status()+"\n")
+	return nil
+}
@@ -0,0 +1,92 @@
+package specialcmd
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"html"
+	"k8s.io/klog/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// This file implements the `%%mermaid` cell magic, that renders Mermaid diagrams.
+
+const (
+	// mermaidBinary is the Mermaid CLI program used to render the diagrams of `%%mermaid`, if found in the PATH.
+	mermaidBinary = "mmdc"
+
+	// mermaidModuleURL is the Mermaid JavaScript module used to render the diagrams of `%%mermaid` in the
+	// browser, if mermaidBinary is not available.
+	mermaidModuleURL = "https://cdn.jsdelivr.net/npm/mermaid@10/dist/mermaid.esm.min.mjs"
+)
+
+// mermaidCount is used to give unique ids to the diagrams rendered by `%%mermaid`.
+var mermaidCount atomic.Int64
+
+// execMermaidCell executes the "%%mermaid" cell magic: body, the rest of the cell, is a Mermaid diagram,
+// displayed as HTML.
+//
+// If mermaidBinary is in the PATH, it is used to render the diagram to SVG. Otherwise, the HTML includes the
+// JavaScript that renders the diagram in the browser, using mermaidModuleURL.
+func execMermaidCell(msg kernel.Message, args []string, body string) error {
+	if len(args) > 0 {
+		return errors.Errorf("`%%%%mermaid` takes no arguments, got %q", args)
+	}
+	id := fmt.Sprintf("gonb-mermaid-%d", mermaidCount.Add(1))
+	var content string
+	if mmdcPath, err := exec.LookPath(mermaidBinary); err == nil {
+		content, err = renderMermaid(msg, mmdcPath, id, body)
+		if err != nil {
+			return err
+		}
+	} else {
+		content = mermaidHTML(id, body)
+	}
+	if err := kernel.PublishDisplayDataWithHTML(msg, content); err != nil {
+		klog.Errorf("Failed to publish %%%%mermaid diagram: %+v", err)
+	}
+	return nil
+}
+
+// renderMermaid renders the diagram to SVG with the mermaidBinary in mmdcPath, using id as the id of the
+// `<svg>` element.
+func renderMermaid(msg kernel.Message, mmdcPath, id, diagram string) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "gonb_mermaid_")
+	if err != nil {
+		return "", errors.Wrapf(err, "`%%%%mermaid` failed to create temporary directory")
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+	inputPath, outputPath := filepath.Join(tmpDir, "diagram.mmd"), filepath.Join(tmpDir, "diagram.svg")
+	if err = os.WriteFile(inputPath, []byte(diagram), 0600); err != nil {
+		return "", errors.Wrapf(err, "`%%%%mermaid` failed to write diagram to %q", inputPath)
+	}
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(kernel.InterruptContext(msg), mmdcPath,
+		"--input", inputPath, "--output", outputPath, "--svgId", id, "--quiet")
+	cmd.Stdout, cmd.Stderr = &stderr, &stderr
+	if err = cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "`%%%%mermaid` failed to render the diagram: %s",
+			strings.TrimSpace(stderr.String()))
+	}
+	svg, err := os.ReadFile(outputPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "`%%%%mermaid` failed to read the rendered diagram")
+	}
+	return string(svg), nil
+}
+
+// mermaidHTML returns the HTML that renders the diagram in the browser, with the Mermaid JavaScript module.
+func mermaidHTML(id, diagram string) string {
+	return fmt.Sprintf(`<pre class="mermaid" id="%s">%s</pre>
+<script type="module">
+import mermaid from %q;
+mermaid.initialize({ startOnLoad: false });
+await mermaid.run({ nodes: [document.getElementById(%q)] });
+</script>
+`, id, html.EscapeString(diagram), mermaidModuleURL, id)
+}
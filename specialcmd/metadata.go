@@ -0,0 +1,92 @@
+package specialcmd
+
+import (
+	"fmt"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// This file implements the configuration of cells through the metadata of the `execute_request`, so
+// notebook tooling can set defaults for cells without repeating special commands in them.
+
+// CellMetadataKey is the key in the metadata of the `execute_request` with the special commands to apply
+// to the cell. Its value is an object mapping the special command names (without the `%`) to their
+// arguments, e.g.: `{"gonb": {"goflags": "-race", "timeout": "10s", "args": ["--name", "hello world"]}}`.
+const CellMetadataKey = "gonb"
+
+// metadataCommands are the special commands that can be set in the cell metadata, see CellMetadataKey.
+var metadataCommands = Set[string]{
+	"args": {}, "goflags": {}, "buildtags": {}, "timeout": {}, "cgo": {}, "env": {},
+	"autoget": {}, "noautoget": {}, "autoimport": {}, "noautoimport": {}, "autotrack": {}, "noautotrack": {},
+	"autodisplay": {}, "noautodisplay": {},
+	"govet": {}, "nogovet": {},
+}
+
+// cellMetadata returns the special commands in the metadata of the `execute_request` msg (see CellMetadataKey),
+// or nil if there are none.
+func cellMetadata(msg kernel.Message) any {
+	if msg == nil {
+		return nil
+	}
+	return msg.ComposedMsg().Metadata[CellMetadataKey]
+}
+
+// applyCellMetadata executes the special commands in the cell metadata (see CellMetadataKey), in the order
+// of their names, as if they were given at the start of the cell -- so special commands in the cell override
+// them.
+//
+// The arguments of each command can be given as a string, as typed after the command in a cell, or as a
+// list of strings, one per argument. Commands without arguments (e.g.: `autoget`) take a boolean, and are
+// only executed if true.
+func applyCellMetadata(msg kernel.Message, goExec *goexec.State, metadata any, status *cellStatus) error {
+	if metadata == nil {
+		return nil
+	}
+	commands, ok := metadata.(map[string]any)
+	if !ok {
+		return errors.Errorf("cell metadata %q must be an object mapping special commands to their arguments, "+
+			"got %T", CellMetadataKey, metadata)
+	}
+	for _, name := range SortedKeys(commands) {
+		if !metadataCommands.Has(name) {
+			return errors.Errorf("cell metadata %q: special command %q can't be set in the metadata, valid "+
+				"commands are %q", CellMetadataKey, name, SortedKeys(metadataCommands))
+		}
+		var cmdStr string
+		switch value := commands[name].(type) {
+		case string:
+			cmdStr = strings.TrimSpace(name + " " + value)
+		case bool:
+			if !value {
+				continue
+			}
+			cmdStr = name
+		case []any:
+			parts := []string{name}
+			for _, arg := range value {
+				argStr, ok := arg.(string)
+				if !ok {
+					return errors.Errorf("cell metadata %q: arguments of %q must be strings, got %T",
+						CellMetadataKey, name, arg)
+				}
+				parts = append(parts, quoteArg(argStr))
+			}
+			cmdStr = strings.Join(parts, " ")
+		default:
+			return errors.Errorf("cell metadata %q: invalid value for %q, it must be a string, a list of "+
+				"strings or a boolean, got %T", CellMetadataKey, name, value)
+		}
+		if err := execInternal(msg, goExec, cmdStr, status); err != nil {
+			return errors.WithMessagef(err, "cell metadata %q: `%%%s` failed", CellMetadataKey, cmdStr)
+		}
+	}
+	return nil
+}
+
+// quoteArg quotes arg with single quotes, so splitCmd parses it back verbatim as one argument.
+func quoteArg(arg string) string {
+	return fmt.Sprintf("'%s'", strings.ReplaceAll(arg, `'`, `'"'"'`))
+}
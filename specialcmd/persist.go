@@ -0,0 +1,199 @@
+package specialcmd
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/janpfeifer/gonb/common"
+	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"k8s.io/klog/v2"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// This file implements `%persist`, that saves some settings of the kernel to disk, so they are re-applied
+// when the kernel is restarted.
+
+// PersistFileName is the file, in the directory where the kernel was started (usually the notebook's
+// directory), where the settings selected with `%persist` are saved.
+const PersistFileName = ".gonb_persist.json"
+
+const (
+	// persistEnv selects the persistence of the environment variables set or unset by special commands (see
+	// changedEnv), except secrets (see isSecretEnv).
+	persistEnv = "env"
+
+	// persistTracked selects the persistence of the tracked files and directories (see `%track`).
+	persistTracked = "tracked"
+)
+
+// persistedSettings is the contents of PersistFileName, in JSON.
+type persistedSettings struct {
+	// Kinds of settings persisted: persistEnv and/or persistTracked.
+	Kinds []string `json:"persist"`
+
+	// Env maps the names of the environment variables to their values, or to nil if they were unset.
+	Env map[string]*string `json:"env,omitempty"`
+
+	// Tracked files and directories.
+	Tracked []string `json:"tracked,omitempty"`
+}
+
+// persistKinds are the kinds of settings persisted, selected with `%persist`. Empty if persistence is disabled.
+var persistKinds = MakeSet[string]()
+
+// persistFilePath returns the path to PersistFileName.
+func persistFilePath() string {
+	return filepath.Join(kernelStartDir, PersistFileName)
+}
+
+// execPersist executes the "%persist [<kinds>|off]" special command. The parameter `args` excludes "%persist".
+//
+// With kinds (persistEnv and/or persistTracked, separated by commas), it enables the persistence of those
+// settings, and saves them right away -- they are saved again after each cell (see savePersisted). With "off"
+// it disables persistence and removes the saved settings. Without arguments, it prints what is persisted.
+func execPersist(msg kernel.Message, goExec *goexec.State, args []string) error {
+	usage := "`%persist [env,tracked|off]`"
+	if len(args) > 1 {
+		return errors.Errorf("%s: it takes at most one argument, but %d were given", usage, len(args))
+	}
+	if len(args) == 0 {
+		if len(persistKinds) == 0 {
+			publishStdout(msg, "Persistence disabled\n")
+		} else {
+			publishStdout(msg, fmt.Sprintf("Persisting %s in %q\n",
+				strings.Join(SortedKeys(persistKinds), ","), persistFilePath()))
+		}
+		return nil
+	}
+	if args[0] == "off" {
+		persistKinds = MakeSet[string]()
+		if err := os.Remove(persistFilePath()); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "`%%persist off`: failed to remove %q", persistFilePath())
+		}
+		publishStdout(msg, "Persistence disabled\n")
+		return nil
+	}
+	kinds := MakeSet[string]()
+	for _, kind := range strings.Split(args[0], ",") {
+		if kind != persistEnv && kind != persistTracked {
+			return errors.Errorf("%s: invalid kind of setting %q, valid kinds are %q and %q", usage, kind,
+				persistEnv, persistTracked)
+		}
+		kinds.Insert(kind)
+	}
+	persistKinds = kinds
+	if err := savePersisted(goExec); err != nil {
+		return err
+	}
+	publishStdout(msg, fmt.Sprintf("Persisting %s in %q\n", strings.Join(SortedKeys(persistKinds), ","),
+		persistFilePath()))
+	return nil
+}
+
+// savePersisted saves the settings selected with `%persist` to persistFilePath. It is a no-op if persistence
+// is disabled.
+func savePersisted(goExec *goexec.State) error {
+	if len(persistKinds) == 0 {
+		return nil
+	}
+	settings := &persistedSettings{Kinds: SortedKeys(persistKinds)}
+	if persistKinds.Has(persistEnv) {
+		settings.Env = make(map[string]*string)
+		for name := range changedEnv {
+			if isSecretEnv(name) {
+				continue
+			}
+			value, found := os.LookupEnv(name)
+			if previous, isCellEnv := cellEnv[name]; isCellEnv {
+				// Set with `%envcell`, save the value it will be restored to.
+				value, found = "", previous != nil
+				if found {
+					value = *previous
+				}
+			}
+			if found {
+				settings.Env[name] = &value
+			} else {
+				settings.Env[name] = nil
+			}
+		}
+	}
+	if persistKinds.Has(persistTracked) {
+		settings.Tracked = goExec.ListTracked()
+	}
+	content, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return errors.Wrapf(err, "failed to serialize persisted settings")
+	}
+	if err = os.WriteFile(persistFilePath(), content, 0600); err != nil {
+		return errors.Wrapf(err, "failed to write persisted settings to %q", persistFilePath())
+	}
+	return nil
+}
+
+// loadPersisted reads the settings saved in persistFilePath, or returns nil if there are none.
+func loadPersisted() (*persistedSettings, error) {
+	content, err := os.ReadFile(persistFilePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to read persisted settings from %q", persistFilePath())
+	}
+	settings := &persistedSettings{}
+	if err = json.Unmarshal(content, settings); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse persisted settings in %q", persistFilePath())
+	}
+	return settings, nil
+}
+
+// applyPersistedEnv sets (or unsets) the environment variables of settings, recording them in changedEnv.
+func applyPersistedEnv(settings *persistedSettings) error {
+	for _, name := range SortedKeys(settings.Env) {
+		var err error
+		if value := settings.Env[name]; value != nil {
+			err = setEnv(name, *value)
+		} else {
+			err = unsetEnv(name)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to restore environment variable %q", name)
+		}
+	}
+	return nil
+}
+
+// RestorePersisted re-applies the settings saved with `%persist` (if any) in a previous execution of the kernel
+// started in the same directory, and re-enables their persistence. It should be called when the kernel starts.
+//
+// Tracked files or directories that no longer exist are skipped, with a warning in the logs.
+func RestorePersisted(goExec *goexec.State) error {
+	settings, err := loadPersisted()
+	if err != nil || settings == nil {
+		return err
+	}
+	persistKinds = MakeSet[string]()
+	for _, kind := range settings.Kinds {
+		if kind == persistEnv || kind == persistTracked {
+			persistKinds.Insert(kind)
+		}
+	}
+	if persistKinds.Has(persistEnv) {
+		if err = applyPersistedEnv(settings); err != nil {
+			return err
+		}
+	}
+	if persistKinds.Has(persistTracked) {
+		for _, fileOrDirPath := range settings.Tracked {
+			if err = goExec.Track(fileOrDirPath); err != nil {
+				klog.Warningf("Failed to re-track %q persisted with `%%persist`: %+v", fileOrDirPath, err)
+			}
+		}
+	}
+	klog.Infof("Restored settings (%s) persisted in %q", strings.Join(SortedKeys(persistKinds), ","),
+		persistFilePath())
+	return nil
+}
@@ -0,0 +1,84 @@
+package specialcmd
+
+import (
+	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// This file implements the registry of custom special commands, that allows extending GoNB with new
+// `%<name>` commands without changing this package.
+
+// CommandHandler executes a custom special command registered with Register. The parameter `args` are the
+// arguments of the command, excluding the name, split as the built-in commands' (quotes are respected).
+//
+// It has the same error semantics as the built-in special commands: an error is reported to the user, and
+// fails the execution of the cell. The handler can write to the cell's output with kernel.PublishWriteStream,
+// or display rich content with kernel.PublishDisplayData.
+type CommandHandler func(msg kernel.Message, goExec *goexec.State, args []string) error
+
+var (
+	// muRegistry protects registeredCommands.
+	muRegistry sync.Mutex
+
+	// registeredCommands maps the names (without the `%`) of the custom special commands to their handlers.
+	registeredCommands = make(map[string]CommandHandler)
+)
+
+// reCommandName matches valid names of custom special commands.
+var reCommandName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// Register registers a custom special command `%<name>`, executed by handler. The name can be given with
+// or without the leading `%`.
+//
+// Built-in special commands take precedence: registering a name that collides with one of them (or with a
+// command previously registered) returns an error, and the registry is left unchanged. Cell magics (`%%`)
+// can't be registered.
+//
+// It is safe to call it concurrently, and custom commands are also offered as auto-complete options.
+func Register(name string, handler CommandHandler) error {
+	name = strings.TrimPrefix(name, "%")
+	if !reCommandName.MatchString(name) {
+		return errors.Errorf("invalid special command name %q: it must start with a letter or `_`, followed by "+
+			"letters, digits, `_`, `.` or `-`", name)
+	}
+	if handler == nil {
+		return errors.Errorf("nil handler for special command %q", "%"+name)
+	}
+	for _, builtin := range commandNames {
+		if builtin == "%"+name {
+			return errors.Errorf("special command %q is built-in, it can't be registered", builtin)
+		}
+	}
+	muRegistry.Lock()
+	defer muRegistry.Unlock()
+	if _, found := registeredCommands[name]; found {
+		return errors.Errorf("special command %q is already registered", "%"+name)
+	}
+	registeredCommands[name] = handler
+	return nil
+}
+
+// registeredCommand returns the handler of the custom special command registered with the name (without `%`),
+// or nil if there is none.
+func registeredCommand(name string) CommandHandler {
+	muRegistry.Lock()
+	defer muRegistry.Unlock()
+	return registeredCommands[name]
+}
+
+// registeredCommandNames returns the names, prefixed with `%`, of the custom special commands, sorted.
+func registeredCommandNames() []string {
+	muRegistry.Lock()
+	defer muRegistry.Unlock()
+	names := make([]string, 0, len(registeredCommands))
+	for name := range registeredCommands {
+		names = append(names, "%"+name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,6 +1,7 @@
 // Package specialcmd handles special commands, that come in two flavors:
 //
 //   - `%<cmd> {...args...}`: Control the environment (variables) and configure gonb.
+//     They can also be given as directive comments, `// gonb:<cmd> {...args...}`, see DirectivePrefix.
 //   - `!<shell commands>`: Execute shell commands.
 //     Similar to the ipython kernel.
 //
@@ -9,20 +10,28 @@ package specialcmd
 
 import (
 	_ "embed"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	. "github.com/janpfeifer/gonb/common"
 	"github.com/janpfeifer/gonb/goexec"
+	"github.com/janpfeifer/gonb/goexec/goplsclient"
 	"github.com/janpfeifer/gonb/gonbui/protocol"
 	"github.com/janpfeifer/gonb/kernel"
 	"github.com/pkg/errors"
 	"k8s.io/klog/v2"
 )
 
-// MillisecondsWaitForInput is the wait time for a bash script (started with `!` or `!*`
+// MillisecondsWaitForInput is the default wait time for a bash script (started with `!` or `!*`
 // special commands, when `%with_inputs` or `%with_password` is used) to run, before an
-// input is prompted to the Jupyter Notebook.
+// input is prompted to the Jupyter Notebook. It can be changed with `%with_inputs <ms>`.
 const MillisecondsWaitForInput = 200
 
 //go:embed help.md
@@ -31,37 +40,195 @@ var HelpMessage string
 // cellStatus holds temporary status for the execution of the current cell.
 type cellStatus struct {
 	withInputs, withPassword bool
+
+	// debugLines is set by `%debug lines`, and the lines consumed by special commands are printed
+	// after the cell is parsed.
+	debugLines bool
+
+	// millisecondsWaitForInput is the wait set with `%with_inputs <ms>` or `%with_password <ms>`. If 0,
+	// MillisecondsWaitForInput is used.
+	millisecondsWaitForInput int
+
+	// writeFilePath is set by `%writefile` (or `%%file --run`), and the cell contents are written
+	// to it after all special commands are parsed. writeFileCmd is the command used, for error messages.
+	writeFileCmd    string
+	writeFilePath   string
+	writeFileAppend bool
 }
 
 // Parse will check whether the given code to be executed has any special commands.
 //
 // Any special commands found in the code will be executed (if execute is set to true) and the corresponding lines used
 // from the code will be returned in usedLines -- so they can be excluded from other executors (goexec).
+// When executing, the special commands in the metadata of the `execute_request` are executed first, see
+// CellMetadataKey.
 //
 // If any errors happen, it is returned in err.
+//
+// See ParseCommands to list the special commands of a cell, without executing them.
 func Parse(msg kernel.Message, goExec *goexec.State, execute bool, codeLines []string, usedLines Set[int]) (err error) {
+	return parse(msg, goExec, execute, codeLines, usedLines, nil)
+}
+
+// Command is a special command (or shell command) found in a cell, as listed by ParseCommands.
+type Command struct {
+	// Type is '%' for special commands (including cell magics) or '!' for shell commands.
+	Type byte
+
+	// Parts of the command: its name (without the `%`, so cell magics start with "%", e.g.: "%bash") and
+	// arguments, as split by splitCmd. For shell commands, it holds only the command line (prefixed with `*`
+	// for `!*`).
+	//
+	// For `%args ... <<MARKER` the last argument is the content of the heredoc, as when executed.
+	Parts []string
+
+	// Body is the rest of the cell for cell magics, or the content of `%stdin`.
+	Body string
+
+	// Line where the command starts, starting from 0.
+	Line int
+}
+
+// ParseCommands returns the special commands (and shell commands) of the cell, with their parsed arguments,
+// without executing them -- e.g.: to lint notebooks without side effects.
+//
+// It returns an error if the special commands can't be parsed (e.g.: a `%stdin` without its end marker), but it
+// doesn't validate their arguments.
+func ParseCommands(codeLines []string) (commands []Command, err error) {
+	commands = []Command{}
+	err = parse(nil, nil, false, codeLines, MakeSet[int](), &commands)
+	return
+}
+
+// parse implements Parse. If commands is not nil, the special commands found are appended to it, see
+// ParseCommands.
+func parse(msg kernel.Message, goExec *goexec.State, execute bool, codeLines []string, usedLines Set[int],
+	commands *[]Command) (err error) {
+	record := func(command Command) {
+		if commands != nil {
+			*commands = append(*commands, command)
+		}
+	}
 	status := &cellStatus{}
+	if execute {
+		// Reset configuration that only applies to one cell.
+		goExec.CellIsTimed = false
+		goExec.CellLoadedLines = nil
+		goExec.CellCaptureVar = ""
+		goExec.CellTimeIt = nil
+		goExec.CellProfile = nil
+		goExec.CellIsTest = false
+		goExec.CellTestArgs = nil
+		goExec.CellTimeout = 0
+		goExec.CellIsCgo = false
+		goExec.CellStdin = ""
+		goExec.CellGenerateDirs = nil
+		goExec.CellMainAppend = false
+		RestoreCellEnv()
+		// Special commands may change the results of inspect and auto-complete (e.g.: `%rm`, `%%go.mod`).
+		goExec.InvalidateQueryCache()
+		defer func() {
+			if status.debugLines || os.Getenv(protocol.GONB_DEBUG_LINES_ENV) != "" {
+				publishStdout(msg, usedLinesReport(codeLines, usedLines))
+			}
+		}()
+		defer func() {
+			// Settings selected with `%persist` may have changed.
+			if err := savePersisted(goExec); err != nil {
+				klog.Errorf("Failed to save settings selected with %%persist: %+v", err)
+				publishStderr(msg, fmt.Sprintf("Failed to save settings selected with `%%persist`: %v\n", err))
+			}
+		}()
+		// Special commands set in the cell metadata are applied first, so the ones in the cell override them.
+		if err = applyCellMetadata(msg, goExec, cellMetadata(msg), status); err != nil {
+			return err
+		}
+	}
 	for lineNum := 0; lineNum < len(codeLines); lineNum++ {
 		if _, found := usedLines[lineNum]; found {
 			continue
 		}
 		line := codeLines[lineNum]
+		if cmdStr, found := directiveCommand(line); found {
+			// Directive comments are not added to usedLines: they are kept in the Go code, as comments.
+			parts := splitCmd(cmdStr)
+			if len(parts) == 0 || isCellMagic(parts) || parts[0] == "stdin" || isArgsHeredoc(parts) {
+				return errors.Errorf("line %d: %q can't be used in a `// %s` directive comment, only "+
+					"special commands that take one line can", lineNum+1, cmdStr, DirectivePrefix)
+			}
+			record(Command{Type: '%', Parts: parts, Line: lineNum})
+			if execute {
+				if err = execSpecialCommand(msg, goExec, cmdStr, status); err != nil {
+					return
+				}
+			}
+			continue
+		}
 		if len(line) > 1 && (line[0] == '%' || line[0] == '!') {
 			var cmdStr string
 			cmdStr = joinLine(codeLines, lineNum, usedLines)
 			cmdType := cmdStr[0]
 			cmdStr = cmdStr[1:]
-			for cmdStr[0] == ' ' {
+			for len(cmdStr) > 0 && cmdStr[0] == ' ' {
 				cmdStr = cmdStr[1:] // Skip initial space
 			}
-			if len(cmdStr) == 0 {
-				// Skip empty commands.
+			parts := splitCmd(cmdStr)
+			if len(cmdStr) == 0 || (cmdType == '%' && len(parts) == 0) {
+				// Skip empty commands (or only with whitespace).
+				continue
+			}
+			if cmdType == '%' && isCellMagic(parts) {
+				// Cell magics (e.g.: `%%bash`) take the rest of the cell as their contents.
+				var bodyLines []string
+				for ii := lineNum + 1; ii < len(codeLines); ii++ {
+					if !usedLines.Has(ii) {
+						bodyLines = append(bodyLines, codeLines[ii])
+						usedLines.Insert(ii)
+					}
+				}
+				record(Command{Type: cmdType, Parts: parts, Body: strings.Join(bodyLines, "\n"), Line: lineNum})
+				if execute {
+					err = execCellMagic(msg, goExec, parts, strings.Join(bodyLines, "\n"), status)
+				}
+				break
+			}
+			if cmdType == '%' && parts[0] == "stdin" {
+				// `%stdin` takes the following lines, up to its end marker, as the stdin of the programs of the cell.
+				var content string
+				content, err = consumeStdinLines(parts[1:], codeLines, lineNum+1, usedLines)
+				if err != nil {
+					return
+				}
+				record(Command{Type: cmdType, Parts: parts, Body: content, Line: lineNum})
+				if execute {
+					goExec.CellStdin += content
+				}
+				continue
+			}
+			if cmdType == '%' && isArgsHeredoc(parts) {
+				// `%args ... <<MARKER` takes the following lines, up to its end marker, as its last argument.
+				var content []string
+				content, err = consumeHeredocLines("%args", parts[len(parts)-1][2:], codeLines, lineNum+1, usedLines)
+				if err != nil {
+					return
+				}
+				record(Command{Type: cmdType, Parts: append(parts[:len(parts)-1:len(parts)-1], strings.Join(content, "\n")),
+					Line: lineNum})
+				if execute {
+					goExec.Args = append(parts[1:len(parts)-1], strings.Join(content, "\n"))
+					klog.V(2).Infof("Program args to use (%%args): %+q", goExec.Args)
+				}
 				continue
 			}
+			if cmdType == '!' {
+				record(Command{Type: cmdType, Parts: []string{cmdStr}, Line: lineNum})
+			} else {
+				record(Command{Type: cmdType, Parts: parts, Line: lineNum})
+			}
 			if execute {
 				switch cmdType {
 				case '%':
-					err = execInternal(msg, goExec, cmdStr, status)
+					err = execSpecialCommand(msg, goExec, cmdStr, status)
 					if err != nil {
 						return
 					}
@@ -72,132 +239,358 @@ func Parse(msg kernel.Message, goExec *goexec.State, execute bool, codeLines []s
 					}
 
 					// Runs AutoTrack, in case go.mod has changed.
-					err = goExec.AutoTrack()
-					if err != nil {
+					if !goExec.AutoTrackAfterShell {
+						klog.V(1).Infof("AutoTrack after shell command skipped (%%noautotrack)")
+					} else if err = goExec.AutoTrack(); err != nil {
 						klog.Errorf("goExec.AutoTrack failed: %+v", err)
 					}
 				}
 			}
 		}
 	}
+	if execute && status.writeFilePath != "" {
+		err = writeCellToFile(msg, status, codeLines, usedLines)
+	}
 	return
 }
 
+// execSpecialCommand executes a special command of the cell with execInternal. Unknown commands are
+// reported, but they don't fail the cell.
+func execSpecialCommand(msg kernel.Message, goExec *goexec.State, cmdStr string, status *cellStatus) error {
+	err := execInternal(msg, goExec, cmdStr, status)
+	if errors.Is(err, ErrUnknownCommand) {
+		publishStderr(msg, err.Error()+", see `%help`\n")
+		return nil
+	}
+	return err
+}
+
+// DirectivePrefix starts the directive comments (`// gonb:<cmd> <args...>`, e.g.: `// gonb:args --flag value`),
+// which are executed as the special command `%<cmd> <args...>`. They allow cells to stay valid Go code, for
+// `gofmt` and editors.
+//
+// Directive comments are executed in the order they appear in the cell, along with the `%` special commands,
+// and they are kept in the Go code, since they are comments.
+const DirectivePrefix = "gonb:"
+
+// directiveCommand returns the special command (without the `%`) of a directive comment (see DirectivePrefix),
+// or found=false if line is not a directive comment. Both `// gonb:` and `//gonb:` are accepted, and the line may
+// be indented.
+func directiveCommand(line string) (cmdStr string, found bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "//") {
+		return "", false
+	}
+	line = strings.TrimLeft(line[2:], " \t")
+	if !strings.HasPrefix(line, DirectivePrefix) {
+		return "", false
+	}
+	return strings.TrimSpace(line[len(DirectivePrefix):]), true
+}
+
+// DefaultStdinMarker is the line that ends the contents of `%stdin`, if no other marker is given
+// with `%stdin <<MARKER`.
+const DefaultStdinMarker = "EOF"
+
+// consumeStdinLines returns the lines of a `%stdin [<<MARKER]` special command, starting at fromLine up to the
+// line with the end marker, and appends them (including the marker line) to usedLines.
+// The parameter `args` excludes "%stdin".
+func consumeStdinLines(args []string, lines []string, fromLine int, usedLines Set[int]) (string, error) {
+	marker := DefaultStdinMarker
+	if len(args) > 1 || (len(args) == 1 && (!strings.HasPrefix(args[0], "<<") || len(args[0]) == 2)) {
+		return "", errors.Errorf("`%%stdin [<<MARKER]`: invalid arguments %q", args)
+	}
+	if len(args) == 1 {
+		marker = args[0][2:]
+	}
+	content, err := consumeHeredocLines("%stdin", marker, lines, fromLine, usedLines)
+	if err != nil {
+		return "", err
+	}
+	return strings.Join(append(content, ""), "\n"), nil
+}
+
+// execPipeFromLast executes the "%pipe-from-last" special command: the stdout of the previous cell (see
+// kernel.Kernel.LastCellStdout) is fed to the stdin of the Go program and of the shell commands of the
+// current cell, appended to the content of `%stdin`, if any. The parameter `args` excludes "%pipe-from-last".
+//
+// Only the first kernel.MaxCellStdoutBytes of the output of the previous cell are kept: a warning is
+// printed if it was truncated.
+func execPipeFromLast(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) > 0 {
+		return errors.Errorf("`%%pipe-from-last` takes no arguments, but %d were given", len(args))
+	}
+	if msg == nil || msg.Kernel() == nil {
+		return nil // Testing, without a kernel.
+	}
+	stdout, truncated := msg.Kernel().LastCellStdout()
+	if truncated {
+		publishStderr(msg, fmt.Sprintf("`%%pipe-from-last`: output of the previous cell truncated to its "+
+			"first %d bytes\n", kernel.MaxCellStdoutBytes))
+	}
+	goExec.CellStdin += stdout
+	return nil
+}
+
+// isArgsHeredoc returns whether parts (as split by splitCmd) is a `%args ... <<MARKER` special command,
+// whose last argument is given by the lines that follow, up to the marker.
+func isArgsHeredoc(parts []string) bool {
+	if len(parts) < 2 || parts[0] != "args" {
+		return false
+	}
+	last := parts[len(parts)-1]
+	return strings.HasPrefix(last, "<<") && len(last) > 2
+}
+
+// consumeHeredocLines returns the lines starting at fromLine up to the line with the end marker, and appends
+// them (including the marker line) to usedLines. cmdName is used in the error message, if the marker is missing.
+func consumeHeredocLines(cmdName, marker string, lines []string, fromLine int, usedLines Set[int]) ([]string, error) {
+	var content []string
+	for ii := fromLine; ii < len(lines); ii++ {
+		if usedLines.Has(ii) {
+			continue
+		}
+		usedLines.Insert(ii)
+		if lines[ii] == marker {
+			return content, nil
+		}
+		content = append(content, lines[ii])
+	}
+	return nil, errors.Errorf("`%s`: missing line with the end marker %q", cmdName, marker)
+}
+
 // joinLine starts from fromLine and joins consecutive lines if the current line terminates with a `\n`,
 // allowing multi-line commands to be issued.
 //
 // It returns the joined lines with the '\\\n' replaced by a space, and appends the used lines (including
-// fromLine) to usedLines.
+// fromLine) to usedLines. For special commands (starting with `%`), a '\\\n' within quotes (see splitCmd)
+// is replaced by a newline instead, so multi-line quoted arguments are preserved.
 func joinLine(lines []string, fromLine int, usedLines Set[int]) (cmdStr string) {
+	isSpecialCmd := strings.HasPrefix(lines[fromLine], "%")
 	for ; fromLine < len(lines); fromLine++ {
 		cmdStr += lines[fromLine]
 		usedLines[fromLine] = struct{}{}
 		if cmdStr[len(cmdStr)-1] != '\\' {
 			return
 		}
-		cmdStr = cmdStr[:len(cmdStr)-1] + " "
+		cmdStr = cmdStr[:len(cmdStr)-1]
+		if isSpecialCmd && openQuote(cmdStr) != 0 {
+			cmdStr += "\n"
+		} else {
+			cmdStr += " "
+		}
 	}
 	return
 }
 
+// openQuote returns the quote character (`"` or `'`) left open at the end of cmd, following the same
+// quoting rules as splitCmd, or 0 if cmd has no open quotes.
+func openQuote(cmd string) byte {
+	var quote byte
+	for pos := 0; pos < len(cmd); pos++ {
+		c := cmd[pos]
+		switch {
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == '"' && c == '\\':
+			pos++ // Skip escaped character.
+		}
+	}
+	return quote
+}
+
+// ErrUnknownCommand is returned (wrapped with the name of the command) by execInternal for unknown special
+// commands. Parse reports them to the user, but it doesn't fail the cell. Use errors.Is to check for it.
+var ErrUnknownCommand = errors.New("unknown or not implemented special command")
+
 // execInternal executes internal configuration commands, see HelpMessage for details.
 //
-// It only returns errors for system errors that will lead to the kernel restart. Syntax errors
-// on the command themselves are simply reported back to jupyter and are not returned here.
+// It returns an error if the command fails, or an error wrapping ErrUnknownCommand if the command is not known.
 //
 // It supports msg == nil for testing.
 func execInternal(msg kernel.Message, goExec *goexec.State, cmdStr string, status *cellStatus) error {
 	_ = goExec
-	var content map[string]any
-	if msg != nil && msg.ComposedMsg().Content != nil {
-		content = msg.ComposedMsg().Content.(map[string]any)
-	}
 	parts := splitCmd(cmdStr)
+	if len(parts) == 0 {
+		return errors.Errorf("empty special command")
+	}
 	switch parts[0] {
 	case "%", "main", "args":
 		// Set arguments for execution, allows one to set flags, etc.
+		if parts[0] == "args" && len(parts) > 1 && parts[1] == "--from-file" {
+			return execArgsFromFile(goExec, parts[2:])
+		}
+		if parts[0] != "args" && len(parts) > 1 && parts[1] == "--append" {
+			// Statements of this cell's `func main()` are appended to the previous one.
+			goExec.CellMainAppend = true
+			parts = parts[1:]
+		}
 		goExec.Args = parts[1:]
 		klog.V(2).Infof("Program args to use (%%): %+q", parts)
 		// %% and %main are also handled specially by goexec, where it starts a main() clause.
+	case "buildtags":
+		// Set build tags.
+		execBuildTags(msg, goExec, parts[1:])
+	case "vendor":
+		// Use vendored dependencies.
+		return execVendor(msg, goExec, parts[1:])
+	case "cgo":
+		// Enable or disable cgo.
+		return execCgo(msg, goExec, parts[1:])
+	case "goroot":
+		// Select or print the Go toolchain.
+		return execGoRoot(msg, goExec, parts[1:])
+	case "gopls":
+		// Restart or report the status of `gopls`.
+		return execGopls(msg, goExec, parts[1:])
+	case "goflags":
+		// Set or print the flags passed to `go build`.
+		execGoFlags(msg, goExec, parts[1:])
+	case "%time":
+		// Report compilation and execution times of the cell.
+		goExec.CellIsTimed = true
+	case "%timeit":
+		// Benchmark the cell's `func main()`.
+		return execTimeIt(goExec, parts[1:])
+	case "%profile":
+		// Profile the cell's `func main()` with `pprof`.
+		return execProfile(goExec, parts[1:])
+	case "%test":
+		// Run the cell's `func TestXxx(t *testing.T)` with `go test`.
+		goExec.CellIsTest = true
+		goExec.CellTestArgs = parts[1:]
+	case "%benchmark":
+		// Run the cell's `func BenchmarkXxx(b *testing.B)` with `go test -bench`: flags given by the user
+		// are appended, so they take precedence over the defaults.
+		goExec.CellIsTest = true
+		goExec.CellTestArgs = append([]string{"-run=^$", "-bench=.", "-benchmem"}, parts[1:]...)
+	case "%cgo":
+		// Build the cell, with a cgo preamble and `import "C"`, with CGO_ENABLED=1.
+		goExec.CellIsCgo = true
+	case "%capture":
+		// Capture the output of the cell into a variable.
+		return execCapture(msg, goExec, parts[1:])
 
 	case "env":
-		// Set environment variables.
-		if len(parts) != 3 {
-			return errors.Errorf("`%%env <VAR_NAME> <value>`: it takes 2 arguments, the variable name and it's content, but %d were given", len(parts)-1)
-		}
-		err := os.Setenv(parts[1], parts[2])
-		if err != nil {
-			return errors.Wrapf(err, "`%%env %q %q` failed", parts[1], parts[2])
-		}
-		err = kernel.PublishWriteStream(msg, kernel.StreamStdout,
-			fmt.Sprintf("Set: %s=%q\n", parts[1], parts[2]))
-		if err != nil {
-			klog.Errorf("Failed to output: %+v", err)
-		}
+		// Set, print or list environment variables.
+		return execEnv(msg, parts[1:])
+	case "envcell":
+		return execEnvCell(msg, parts[1:])
+	case "unsetenv":
+		return execUnsetEnv(msg, parts[1:])
+	case "dotenv":
+		return execDotEnv(msg, parts[1:])
 
 	case "cd":
 		if len(parts) == 1 {
-			pwd, _ := os.Getwd()
-			_ = kernel.PublishWriteStream(msg, kernel.StreamStdout,
-				fmt.Sprintf("Current directory: %q\n", pwd))
+			execPwd(msg)
 		} else if len(parts) > 2 {
 			return errors.Errorf("`%%cd [<directory>]`: it takes none or one argument, but %d were given", len(parts)-1)
 		} else {
-			err := os.Chdir(ReplaceTildeInDir(parts[1]))
-			if err != nil {
-				return errors.Wrapf(err, "`%%cd %q` failed", parts[1])
-			}
-			pwd, _ := os.Getwd()
-			err = kernel.PublishWriteStream(msg, kernel.StreamStdout,
-				fmt.Sprintf("Changed directory to %q\n", pwd))
-			if err != nil {
-				klog.Errorf("Failed to output: %+v", err)
-			}
-			err = os.Setenv(protocol.GONB_DIR_ENV, pwd)
-			if err != nil {
-				klog.Errorf("Failed to set environment variable %q: %+v", protocol.GONB_DIR_ENV, err)
-			}
+			return execCd(msg, goExec, parts[1])
+		}
+	case "pwd":
+		execPwd(msg)
+	case "tempdir":
+		if len(parts) > 1 {
+			return errors.Errorf("`%%tempdir` takes no arguments, got %q", parts[1:])
 		}
+		goExec.ExportTempDir()
+		publishStdout(msg, goExec.TempDir+"\n")
+	case "pushd":
+		return execPushd(msg, goExec, parts[1:])
+	case "popd":
+		return execPopd(msg, goExec, parts[1:])
 
+	case "getmodules":
+		return goExec.GetModules(msg, parts[1:])
+	case "modverify":
+		return execModVerify(msg, goExec, parts[1:])
+	case "modwhy":
+		return execModWhy(msg, goExec, parts[1:])
+	case "cat":
+		return execCat(msg, parts[1:])
+	case "persist":
+		return execPersist(msg, goExec, parts[1:])
+	case "goinstall":
+		return execGoInstall(msg, goExec, parts[1:])
 	case "autoget":
 		goExec.AutoGet = true
 	case "noautoget":
 		goExec.AutoGet = false
-	case "help":
-		//_ = kernel.PublishWriteStream(msg, kernel.StreamStdout, HelpMessage)
-		err := kernel.PublishDisplayDataWithMarkdown(msg, HelpMessage)
-		if err != nil {
-			klog.Errorf("Failed publishing %help contents: %+v", err)
+	case "autodisplay":
+		goExec.AutoDisplay = true
+	case "noautodisplay":
+		goExec.AutoDisplay = false
+	case "autotrack":
+		goExec.AutoTrackAfterShell = true
+	case "noautotrack":
+		goExec.AutoTrackAfterShell = false
+	case "autoimport":
+		goExec.AutoImport = true
+	case "noautoimport":
+		goExec.AutoImport = false
+	case "govet":
+		if len(parts) > 2 || (len(parts) == 2 && parts[1] != "--strict") {
+			return errors.Errorf("`%%govet [--strict]` only takes the optional flag \"--strict\"")
 		}
+		goExec.GoVet = true
+		goExec.GoVetStrict = len(parts) == 2
+	case "nogovet":
+		goExec.GoVet = false
+		goExec.GoVetStrict = false
+	case "help":
+		return execHelp(msg, parts[1:])
 
 		// Definitions management.
 	case "reset":
-		if len(parts) == 1 {
+		if len(parts) > 2 || (len(parts) == 2 && parts[1] != "go.mod" && parts[1] != "--hard") {
+			return errors.Errorf("%%reset only take one optional parameter \"go.mod\" or \"--hard\"")
+		}
+		if len(parts) == 1 || parts[1] == "--hard" {
 			resetDefinitions(msg, goExec)
-		} else {
-			if len(parts) > 2 || parts[1] != "go.mod" {
-				return errors.Errorf("%%reset only take one optional parameter \"go.mod\"")
-			}
+		}
+		if len(parts) == 2 && parts[1] == "--hard" {
+			return resetTempDir(msg, goExec)
 		}
 		return goExec.GoModInit()
+	case "savestate":
+		return execSaveState(msg, goExec, parts[1:])
+	case "loadstate":
+		return execLoadState(msg, goExec, parts[1:])
 	case "ls", "list":
-		listDefinitions(msg, goExec)
+		return listDefinitions(msg, goExec, parts[1:])
+	case "replay":
+		return execReplay(msg, goExec, parts[1:])
+	case "reload":
+		if len(parts) > 1 {
+			return errors.New("`%reload` takes no arguments, use `%replay <n>` to replay only the last cells")
+		}
+		return execReplay(msg, goExec, nil)
 	case "rm", "remove":
-		removeDefinitions(msg, goExec, parts[1:])
+		return removeDefinitions(msg, goExec, parts[1:])
+
+		// Output handling.
+	case "clear":
+		return execClear(msg, parts[1:])
 
 		// Input handling.
 	case "with_inputs":
-		allowInput := content["allow_stdin"].(bool)
+		allowInput := kernel.AllowStdin(msg)
 		if !allowInput && (status.withInputs || status.withPassword) {
 			return errors.Errorf("%%with_inputs not available in this notebook, it doesn't allow input prompting")
 		}
 		status.withInputs = true
+		return parseWaitForInput(parts, status)
 	case "with_password":
-		allowInput := content["allow_stdin"].(bool)
+		allowInput := kernel.AllowStdin(msg)
 		if !allowInput && (status.withInputs || status.withPassword) {
 			return errors.Errorf("%%with_password not available in this notebook, it doesn't allow input prompting")
 		}
 		status.withPassword = true
+		return parseWaitForInput(parts, status)
 
 		// Files that need tracking for `gopls` (for auto-complete and contextual help).
 	case "track":
@@ -205,20 +598,218 @@ func execInternal(msg kernel.Message, goExec *goexec.State, cmdStr string, statu
 	case "untrack":
 		execUntrack(msg, goExec, parts[1:])
 
+		// Reading and writing the cell contents.
+	case "writefile":
+		return execWriteFile(parts[1:], status)
+	case "%file":
+		// Only `%%file --run`, otherwise it's a cell magic, see isCellMagic.
+		return execFileRun(goExec, parts[1:], status)
+	case "load":
+		return execLoad(msg, goExec, parts[1:])
+
 		// Others.
+	case "pipe-from-last":
+		return execPipeFromLast(msg, goExec, parts[1:])
+	case "timeout":
+		return execTimeout(goExec, parts[1:])
+	case "shell":
+		return execSetShell(msg, parts[1:])
+	case "which":
+		return execWhich(msg, parts[1:])
 	case "goworkfix":
 		return goExec.GoWorkFix(msg)
+	case "goworkuse":
+		return execGoWorkUse(msg, goExec, parts[1:])
+	case "verbosity":
+		return execVerbosity(msg, parts[1:])
+	case "maxoutput":
+		return execMaxOutput(msg, parts[1:])
+	case "bg":
+		return execBackground(msg, strings.TrimSpace(strings.TrimPrefix(cmdStr, "bg")))
+	case "jobs":
+		return execJobs(msg, parts[1:])
+	case "kill":
+		return execKill(msg, parts[1:])
+	case "debug":
+		if len(parts) != 2 || (parts[1] != "lines" && parts[1] != "env") {
+			return errors.Errorf("`%%debug lines|env`: invalid arguments %q", parts[1:])
+		}
+		if parts[1] == "env" {
+			publishStdout(msg, debugEnvReport(goExec))
+		} else {
+			status.debugLines = true
+		}
+	case "generate":
+		return execGenerate(goExec, parts[1:])
+	case "prebuild":
+		return execPreBuild(msg, goExec, strings.TrimSpace(strings.TrimPrefix(cmdStr, "prebuild")))
 
 	default:
-		err := kernel.PublishWriteStream(msg, kernel.StreamStderr, fmt.Sprintf("\"%%%s\" unknown or not implemented yet.", parts[0]))
-		if err != nil {
-			klog.Errorf("Error while reporting back on unimplemented message command \"%%%s\" kernel: %+v", parts[0], err)
+		if handler := registeredCommand(parts[0]); handler != nil {
+			// Custom special command, see Register.
+			return handler(msg, goExec, parts[1:])
 		}
+		return errors.WithMessagef(ErrUnknownCommand, "\"%%%s\"", parts[0])
 	}
 	return nil
 }
 
-// execInternal executes internal configuration commands, see HelpMessage for details.
+// execTimeout executes the "%timeout <duration>" special command. The parameter `args` excludes "%timeout".
+//
+// It sets the maximum time the Go program and each of the following shell commands of the cell can run.
+func execTimeout(goExec *goexec.State, args []string) error {
+	if len(args) != 1 {
+		return errors.Errorf("`%%timeout <duration>`: it takes one argument (e.g.: `30s`), but %d were given", len(args))
+	}
+	timeout, err := time.ParseDuration(args[0])
+	if err != nil || timeout <= 0 {
+		return errors.Errorf("`%%timeout <duration>`: invalid duration %q, use for instance `30s` or `5m`", args[0])
+	}
+	goExec.CellTimeout = timeout
+	return nil
+}
+
+// execMaxOutput executes the "%maxoutput [<bytes>]" special command. The parameter `args` excludes "%maxoutput".
+//
+// It sets the maximum number of bytes of output of the Go program and of each shell command (see
+// kernel.MaxOutputBytes), for the rest of the session, and prints it. Without arguments, it only prints the
+// current limit.
+func execMaxOutput(msg kernel.Message, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%maxoutput [<bytes>]`: it takes none or one argument, but %d were given", len(args))
+	}
+	if len(args) == 1 {
+		maxBytes, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil || maxBytes < 0 {
+			return errors.Errorf("`%%maxoutput <bytes>`: invalid number of bytes %q, it must be a non-negative "+
+				"integer (0 for no limit)", args[0])
+		}
+		kernel.MaxOutputBytes = maxBytes
+	}
+	if kernel.MaxOutputBytes <= 0 {
+		publishStdout(msg, "maxoutput=0 (no limit)\n")
+	} else {
+		publishStdout(msg, fmt.Sprintf("maxoutput=%d bytes\n", kernel.MaxOutputBytes))
+	}
+	return nil
+}
+
+// execGenerate executes the "%generate [<dir>]" special command. The parameter `args` excludes "%generate".
+//
+// It schedules `go generate ./...` to run before the cell is compiled, in the temporary directory where the cells
+// are compiled, or in the given directory.
+func execGenerate(goExec *goexec.State, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%generate [<dir>]`: it takes none or one argument, but %d were given", len(args))
+	}
+	dir := goExec.TempDir
+	if len(args) == 1 {
+		dir = ReplaceTildeInDir(args[0])
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return errors.Errorf("`%%generate %q`: directory doesn't exist", args[0])
+		}
+	}
+	goExec.CellGenerateDirs = append(goExec.CellGenerateDirs, dir)
+	return nil
+}
+
+// execPreBuild executes the "%prebuild [--clear | <shell command>]" special command. The parameter `cmdStr`
+// excludes "%prebuild".
+//
+// It registers a shell command to run before each compilation of the cells: prefixed with `*` (like `!*`) it
+// runs in the temporary directory where the cells are compiled, otherwise in the current directory.
+// Without arguments, it lists the registered commands, and `--clear` removes all of them.
+func execPreBuild(msg kernel.Message, goExec *goexec.State, cmdStr string) error {
+	switch cmdStr {
+	case "":
+		if len(goExec.PreBuildCommands) == 0 {
+			publishStdout(msg, "No pre-build commands registered.\n")
+			return nil
+		}
+		var parts []string
+		for _, cmd := range goExec.PreBuildCommands {
+			if cmd.Dir == goExec.TempDir {
+				parts = append(parts, "%prebuild *"+cmd.Command)
+			} else {
+				parts = append(parts, "%prebuild "+cmd.Command)
+			}
+		}
+		publishStdout(msg, strings.Join(parts, "\n")+"\n")
+		return nil
+	case "--clear":
+		goExec.PreBuildCommands = nil
+		return nil
+	}
+	var dir string
+	if cmdStr[0] == '*' {
+		cmdStr = strings.TrimSpace(cmdStr[1:])
+		dir = goExec.TempDir
+	}
+	if cmdStr == "" {
+		return errors.Errorf("`%%prebuild *<shell command>`: missing shell command")
+	}
+	shell, args := shellCommand(runtime.GOOS, cmdStr)
+	goExec.PreBuildCommands = append(goExec.PreBuildCommands, goexec.PreBuildCommand{
+		Command: cmdStr,
+		Args:    append([]string{shell}, args...),
+		Dir:     dir,
+	})
+	return nil
+}
+
+// execVerbosity executes the "%verbosity [<level>]" special command. The parameter `args` excludes "%verbosity".
+//
+// It sets klog's verbosity level (the `--v` flag) of the kernel, at runtime, and prints the new level.
+// Without arguments, it only prints the current level.
+func execVerbosity(msg kernel.Message, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%verbosity [<level>]`: it takes none or one argument, but %d were given", len(args))
+	}
+	vFlag := klogVerbosityFlag()
+	if len(args) == 1 {
+		level, err := strconv.Atoi(args[0])
+		if err != nil || level < 0 {
+			return errors.Errorf("`%%verbosity <level>`: invalid level %q, it must be a non-negative integer", args[0])
+		}
+		if err = vFlag.Value.Set(args[0]); err != nil {
+			return errors.Wrapf(err, "`%%verbosity %s` failed", args[0])
+		}
+		klog.Infof("Logging verbosity set to %d", level)
+	}
+	publishStdout(msg, fmt.Sprintf("verbosity=%s\n", vFlag.Value.String()))
+	return nil
+}
+
+// usedLinesReport returns the lines of the cell consumed by special commands (usedLines), with their
+// line numbers (starting from 1), for debugging. See `%debug lines`.
+func usedLinesReport(codeLines []string, usedLines Set[int]) string {
+	var sb strings.Builder
+	if len(usedLines) == 0 {
+		sb.WriteString("No lines used by special commands\n")
+		return sb.String()
+	}
+	sb.WriteString("Lines used by special commands:\n")
+	for _, lineNum := range SortedKeys(usedLines) {
+		if lineNum < 0 || lineNum >= len(codeLines) {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("%4d: %s\n", lineNum+1, codeLines[lineNum]))
+	}
+	return sb.String()
+}
+
+// klogVerbosityFlag returns klog's `--v` flag. It is registered in the default flag set by the kernel's
+// main(), otherwise (e.g.: in tests) it registers klog's flags in a new flag set to access it.
+func klogVerbosityFlag() *flag.Flag {
+	if vFlag := flag.Lookup("v"); vFlag != nil {
+		return vFlag
+	}
+	flagSet := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flagSet)
+	return flagSet.Lookup("v")
+}
+
+// execShell executes shell commands (`!` and `!*` special commands), see HelpMessage for details.
 //
 // It only returns errors for system errors that will lead to the kernel restart. Syntax errors
 // on the command themselves are simply reported back to jupyter and are not returned here.
@@ -228,22 +819,477 @@ func execShell(msg kernel.Message, goExec *goexec.State, cmdStr string, status *
 		cmdStr = cmdStr[1:]
 		execDir = goExec.TempDir
 	}
+	shell, args := shellCommand(runtime.GOOS, cmdStr)
+	return runShell(msg, goExec, shell, args, execDir, goExec.CellStdin, status)
+}
+
+// isCellMagic returns whether the special command, as split by splitCmd (so `%%bash` is "%bash"),
+// takes the rest of the cell as its contents.
+func isCellMagic(parts []string) bool {
+	switch parts[0] {
+	case "%bash", "%script", "%html", "%latex", "%dot", "%mermaid", "%go.mod", "%go.work":
+		return true
+	case "%file":
+		// With `--run` the rest of the cell is still executed, see execFileRun.
+		for _, arg := range parts[1:] {
+			if arg == "--run" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// execCellMagic executes the cell magic in parts[0] (see isCellMagic) with the rest of the cell in body.
+func execCellMagic(msg kernel.Message, goExec *goexec.State, parts []string, body string, status *cellStatus) error {
+	switch parts[0] {
+	case "%bash":
+		return execBashCell(msg, goExec, parts[1:], body, status)
+	case "%script":
+		return execScriptCell(msg, goExec, parts[1:], body, status)
+	case "%file":
+		return execFileCell(msg, goExec, parts[1:], body)
+	case "%go.mod":
+		return execGoModCell(msg, goExec, parts[1:], body)
+	case "%go.work":
+		return execGoWorkCell(msg, goExec, parts[1:], body)
+	case "%dot":
+		return execDotCell(msg, parts[1:], body)
+	case "%mermaid":
+		return execMermaidCell(msg, parts[1:], body)
+	case "%html", "%latex":
+		if len(parts) > 1 {
+			return errors.Errorf("`%%%s` takes no arguments, got %q", parts[0], parts[1:])
+		}
+		var err error
+		if parts[0] == "%html" {
+			err = kernel.PublishDisplayDataWithHTML(msg, body)
+		} else {
+			err = kernel.PublishDisplayDataWithLatex(msg, body)
+		}
+		if err != nil {
+			klog.Errorf("Failed to publish %%%s contents: %+v", parts[0], err)
+		}
+		return nil
+	}
+	return errors.Errorf("unknown cell magic `%%%s`", parts[0])
+}
+
+// execBashCell executes the script in the rest of a cell started with `%%bash`, see HelpMessage for details.
+// The parameter `args` are the arguments of `%%bash`, excluding "%%bash".
+func execBashCell(msg kernel.Message, goExec *goexec.State, args []string, script string, status *cellStatus) error {
+	var execDir string // Default "", means current directory.
+	for _, arg := range args {
+		if arg != "--dir" {
+			return errors.Errorf("`%%%%bash [--dir]`: unknown argument %q", arg)
+		}
+		execDir = goExec.TempDir
+	}
+	return runShell(msg, goExec, "bash", []string{"-c", script}, execDir, goExec.CellStdin, status)
+}
+
+// execScriptCell executes the rest of a cell started with `%%script <interpreter> [args...]`, by piping it
+// to the stdin of the interpreter. The parameter `args` are the arguments of `%%script`, excluding "%%script".
+func execScriptCell(msg kernel.Message, goExec *goexec.State, args []string, script string, status *cellStatus) error {
+	if len(args) == 0 {
+		return errors.Errorf("`%%%%script <interpreter> [args...]`: missing interpreter (e.g.: `python3`)")
+	}
+	if !strings.HasSuffix(script, "\n") {
+		script += "\n"
+	}
+	return runShell(msg, goExec, args[0], args[1:], "", script, status)
+}
+
+// parseWaitForInput parses the optional `<ms>` argument of `%with_inputs [<ms>]` and `%with_password [<ms>]`,
+// the time to wait before prompting for input. The parameter parts includes the command name.
+func parseWaitForInput(parts []string, status *cellStatus) error {
+	if len(parts) == 1 {
+		return nil
+	}
+	if len(parts) > 2 {
+		return errors.Errorf("`%%%s [<ms>]`: too many arguments %q", parts[0], parts[1:])
+	}
+	ms, err := strconv.Atoi(parts[1])
+	if err != nil || ms <= 0 {
+		return errors.Errorf("`%%%s [<ms>]`: invalid wait %q, it must be a positive number of milliseconds",
+			parts[0], parts[1])
+	}
+	status.millisecondsWaitForInput = ms
+	return nil
+}
+
+// runShell runs the shell program with the given arguments in execDir (or the current directory if empty),
+// piping its input and output to Jupyter. If stdin is not empty, it is written to the program's stdin.
+// It is used by execShell, execBashCell and execScriptCell.
+//
+// The exit code of the command is stored in the environment variable GONB_LAST_EXIT_CODE, and
+// a warning is printed if it is not zero.
+func runShell(msg kernel.Message, goExec *goexec.State, shell string, args []string, execDir, stdin string, status *cellStatus) error {
+	builder := kernel.PipeExecToJupyter(msg, shell, args...).InDir(execDir).
+		WithContext(kernel.InterruptContext(msg)).
+		WithTimeout(goExec.CellTimeout).
+		WithStdinContent(stdin)
+	millisecondsWait := status.millisecondsWaitForInput
+	if millisecondsWait == 0 {
+		millisecondsWait = MillisecondsWaitForInput
+	}
 	if status.withInputs {
-		status.withInputs = false
-		status.withPassword = false
-		return kernel.PipeExecToJupyter(msg, "/bin/bash", "-c", cmdStr).InDir(execDir).WithInputs(MillisecondsWaitForInput).Exec()
+		builder.WithInputs(millisecondsWait)
 	} else if status.withPassword {
-		status.withInputs = false
-		status.withPassword = false
-		return kernel.PipeExecToJupyter(msg, "/bin/bash", "-c", cmdStr).InDir(execDir).WithPassword(MillisecondsWaitForInput).Exec()
+		builder.WithPassword(millisecondsWait)
+	}
+	status.withInputs = false
+	status.withPassword = false
+	status.millisecondsWaitForInput = 0
+	if err := builder.Exec(); err != nil {
+		return err
+	}
+	exitCode := builder.ExitCode()
+	if err := os.Setenv(protocol.GONB_LAST_EXIT_CODE_ENV, strconv.Itoa(exitCode)); err != nil {
+		klog.Errorf("Failed to set environment variable %q: %+v", protocol.GONB_LAST_EXIT_CODE_ENV, err)
+	}
+	if exitCode != 0 {
+		err := kernel.PublishWriteStream(msg, kernel.StreamStderr,
+			fmt.Sprintf("Warning: shell command exited with code %d\n", exitCode))
+		if err != nil {
+			klog.Errorf("Failed to output: %+v", err)
+		}
+	}
+	return nil
+}
+
+// ShellEnv is the name of the environment variable that, if set, holds the shell used to execute
+// the `!` and `!*` special commands. It can also be set with the `%shell` special command.
+const ShellEnv = "GONB_SHELL"
+
+// shellCommand returns the shell program and its arguments to execute cmdStr, for the given operating
+// system `goos` (usually `runtime.GOOS`).
+//
+// The shell is taken from the environment variable GONB_SHELL (see ShellEnv) if set. Otherwise,
+// it defaults to `cmd` on Windows, and to `$SHELL` (or `/bin/bash` if not set) elsewhere.
+func shellCommand(goos, cmdStr string) (shell string, args []string) {
+	shell = os.Getenv(ShellEnv)
+	if shell == "" {
+		if goos == "windows" {
+			shell = "cmd"
+		} else if shell = os.Getenv("SHELL"); shell == "" {
+			shell = "/bin/bash"
+		}
+	}
+
+	// Find the shell program name, without directory or extension, to select the flag that
+	// takes the command string.
+	name := shell
+	if idx := strings.LastIndexAny(name, `/\`); idx != -1 {
+		name = name[idx+1:]
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".exe")
+	switch name {
+	case "cmd":
+		args = []string{"/C", cmdStr}
+	case "powershell", "pwsh":
+		args = []string{"-Command", cmdStr}
+	default:
+		args = []string{"-c", cmdStr}
+	}
+	return
+}
+
+// execSetShell executes the "%shell" special command. The parameter `args` excludes "%shell".
+func execSetShell(msg kernel.Message, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%shell [<shell_program>]`: it takes none or one argument, but %d were given", len(args))
+	}
+	if len(args) == 1 {
+		err := setEnv(ShellEnv, args[0])
+		if err != nil {
+			return errors.Wrapf(err, "`%%shell %q` failed", args[0])
+		}
+	}
+	shell, args := shellCommand(runtime.GOOS, "")
+	publishStdout(msg, fmt.Sprintf("Shell: %s %s\n", shell, args[0]))
+	return nil
+}
+
+// execWhich executes the "%which <name...>" special command. The parameter `args` excludes "%which".
+//
+// It prints the path of the executable of each name, found with exec.LookPath in the current PATH (including
+// changes made with `%env`), or a not-found message.
+func execWhich(msg kernel.Message, args []string) error {
+	if len(args) == 0 {
+		return errors.Errorf("`%%which <name...>`: missing the name of the executable(s) to locate")
+	}
+	for _, name := range args {
+		filePath, err := exec.LookPath(name)
+		if err != nil && !errors.Is(err, exec.ErrDot) {
+			publishStderr(msg, fmt.Sprintf("%s not found\n", name))
+			continue
+		}
+		publishStdout(msg, filePath+"\n")
+	}
+	return nil
+}
+
+// execTimeIt executes the "%%timeit" special command. The parameter `args` excludes "%%timeit".
+//
+// It configures goexec.State.CellTimeIt with the number of iterations (`-n`) and repeats (`-r`).
+func execTimeIt(goExec *goexec.State, args []string) error {
+	timeIt := &goexec.TimeIt{Repeats: goexec.DefaultTimeItRepeats}
+	for ii := 0; ii < len(args); ii++ {
+		var value *int
+		switch args[ii] {
+		case "-n":
+			value = &timeIt.Iterations
+		case "-r":
+			value = &timeIt.Repeats
+		default:
+			return errors.Errorf("`%%%%timeit [-n <iterations>] [-r <repeats>]`: unknown argument %q", args[ii])
+		}
+		if ii+1 >= len(args) {
+			return errors.Errorf("`%%%%timeit`: missing value for %q", args[ii])
+		}
+		ii++
+		var err error
+		*value, err = strconv.Atoi(args[ii])
+		if err != nil || *value <= 0 {
+			return errors.Errorf("`%%%%timeit`: invalid value %q for %q, it must be a positive integer", args[ii], args[ii-1])
+		}
+	}
+	goExec.CellTimeIt = timeIt
+	return nil
+}
+
+// execProfile executes the "%%profile cpu|mem [-n <top>]" special command. The parameter `args` excludes
+// "%%profile".
+//
+// It configures goexec.State.CellProfile with the kind of profile and the number of entries of the summary (`-n`).
+func execProfile(goExec *goexec.State, args []string) error {
+	if len(args) == 0 || (args[0] != goexec.ProfileCPU && args[0] != goexec.ProfileMem) {
+		return errors.Errorf("`%%%%profile cpu|mem [-n <top>]`: the kind of profile (cpu or mem) must be given")
+	}
+	profile := &goexec.Profile{Kind: args[0], TopN: goexec.DefaultProfileTopN}
+	args = args[1:]
+	if len(args) > 0 {
+		if len(args) != 2 || args[0] != "-n" {
+			return errors.Errorf("`%%%%profile cpu|mem [-n <top>]`: invalid arguments %q", args)
+		}
+		var err error
+		profile.TopN, err = strconv.Atoi(args[1])
+		if err != nil || profile.TopN <= 0 {
+			return errors.Errorf("`%%%%profile`: invalid value %q for -n, it must be a positive integer", args[1])
+		}
+	}
+	goExec.CellProfile = profile
+	return nil
+}
+
+// execArgsFromFile executes "%args --from-file <path>": it sets the arguments passed to the program
+// from a file with a JSON array of strings. The parameter `args` excludes "%args --from-file".
+func execArgsFromFile(goExec *goexec.State, args []string) error {
+	if len(args) != 1 {
+		return errors.Errorf("`%%args --from-file <path>`: it takes exactly one path, but %d were given", len(args))
+	}
+	filePath := ReplaceTildeInDir(args[0])
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return errors.Wrapf(err, "`%%args --from-file %q` failed to read file", filePath)
+	}
+	var programArgs []string
+	if err = json.Unmarshal(content, &programArgs); err != nil {
+		return errors.Wrapf(err, "`%%args --from-file %q`: file must contain a JSON array of strings", filePath)
+	}
+	goExec.Args = programArgs
+	klog.V(2).Infof("Program args to use (%%args --from-file %q): %+q", filePath, programArgs)
+	return nil
+}
+
+// execGoFlags executes the "%goflags" special command. The parameter `args` excludes "%goflags".
+//
+// If no arguments are given, it prints the current flags. Empty arguments are dropped, so `%goflags ""`
+// clears the flags.
+func execGoFlags(msg kernel.Message, goExec *goexec.State, args []string) {
+	if len(args) > 0 {
+		goExec.GoBuildFlags = nil
+		for _, arg := range args {
+			if arg != "" {
+				goExec.GoBuildFlags = append(goExec.GoBuildFlags, arg)
+			}
+		}
+		klog.V(2).Infof("Go build flags to use: %+q", goExec.GoBuildFlags)
+	}
+	publishStdout(msg, fmt.Sprintf("%%goflags=%q\n", goExec.GoBuildFlags))
+}
+
+// execBuildTags executes the "%buildtags" special command. The parameter `args` excludes "%buildtags".
+//
+// If no arguments are given, it prints the current build tags. Tags can be separated by commas or spaces,
+// and `%buildtags ""` clears them.
+func execBuildTags(msg kernel.Message, goExec *goexec.State, args []string) {
+	if len(args) > 0 {
+		goExec.BuildTags = goexec.SplitBuildTags(strings.Join(args, ","))
+		klog.V(2).Infof("Build tags to use: %+q", goExec.BuildTags)
+	}
+	publishStdout(msg, fmt.Sprintf("%%buildtags=%q\n", strings.Join(goExec.BuildTags, ",")))
+}
+
+// execVendor executes the "%vendor [on|off]" special command. The parameter `args` excludes "%vendor".
+//
+// It enables or disables building with vendored dependencies (`-mod=vendor`), and prints the current mode.
+func execVendor(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%vendor [on|off]`: it takes none or one argument, but %d were given", len(args))
+	}
+	if len(args) == 1 {
+		switch args[0] {
+		case "on":
+			if err := goExec.SetVendor(true); err != nil {
+				return errors.WithMessagef(err, "`%%vendor on` failed")
+			}
+		case "off":
+			_ = goExec.SetVendor(false)
+		default:
+			return errors.Errorf("`%%vendor [on|off]`: invalid argument %q", args[0])
+		}
+	}
+	if goExec.Vendor {
+		publishStdout(msg, "%vendor on: building with `-mod=vendor`, `go get` is disabled\n")
+	} else {
+		publishStdout(msg, "%vendor off\n")
+	}
+	return nil
+}
+
+// execCgo executes the "%cgo [on|off|default]" special command. The parameter `args` excludes "%cgo".
+//
+// It sets CGO_ENABLED for the invocations of the Go toolchain, and prints the effective setting.
+func execCgo(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%cgo [on|off|default]`: it takes none or one argument, but %d were given", len(args))
+	}
+	if len(args) == 1 {
+		switch args[0] {
+		case "on":
+			goExec.CgoEnabled = "1"
+		case "off":
+			goExec.CgoEnabled = "0"
+		case "default":
+			goExec.CgoEnabled = ""
+		default:
+			return errors.Errorf("`%%cgo [on|off|default]`: invalid argument %q", args[0])
+		}
+	}
+	cgoEnabled, err := goExec.CgoEffective()
+	if err != nil {
+		return err
+	}
+	source := "set with %cgo"
+	if goExec.CgoEnabled == "" {
+		source = "default"
+	}
+	publishStdout(msg, fmt.Sprintf("CGO_ENABLED=%s (%s)\n", cgoEnabled, source))
+	return nil
+}
+
+// execGoRoot executes the "%goroot [<path>]" special command. The parameter `args` excludes "%goroot".
+//
+// With a path, it selects the Go toolchain installed there. In any case, it prints the effective GOROOT
+// and the Go version.
+func execGoRoot(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) > 1 {
+		return errors.Errorf("`%%goroot [<path>]`: it takes none or one argument, but %d were given", len(args))
+	}
+	if len(args) == 1 {
+		if err := goExec.SetGoRoot(ReplaceTildeInDir(args[0])); err != nil {
+			return errors.WithMessagef(err, "`%%goroot %q` failed", args[0])
+		}
+	}
+	goRoot, err := goexec.GoRoot()
+	if err != nil {
+		return err
+	}
+	version, err := goexec.GoVersion()
+	if err != nil {
+		return err
+	}
+	publishStdout(msg, fmt.Sprintf("GOROOT=%s\n%s\n", goRoot, version))
+	return nil
+}
+
+// execGopls executes the "%gopls <restart|status>" special command. The parameter `args` excludes "%gopls".
+//
+// `%gopls restart` restarts `gopls` (and the connection to it), and `%gopls status` prints whether it is
+// running and connected, its version and the number of files it tracks.
+func execGopls(msg kernel.Message, goExec *goexec.State, args []string) error {
+	if len(args) != 1 {
+		return errors.Errorf("`%%gopls <restart|status>`: it takes one argument, but %d were given", len(args))
+	}
+	switch args[0] {
+	case "restart":
+		if err := goExec.RestartGopls(); err != nil {
+			return errors.WithMessagef(err, "`%%gopls restart` failed")
+		}
+		publishStdout(msg, "gopls restarted\n")
+		return nil
+	case "status":
+		publishStdout(msg, goplsStatusText(goExec))
+		return nil
+	default:
+		return errors.Errorf("`%%gopls <restart|status>`: unknown sub-command %q", args[0])
+	}
+}
+
+// goplsStatusText formats the status of `gopls`, see execGopls.
+func goplsStatusText(goExec *goexec.State) string {
+	status := goExec.GoplsStatus()
+	if status == nil {
+		return "gopls: not started (is it installed?)\n"
+	}
+	var parts []string
+	switch {
+	case status.Connected:
+		parts = append(parts, "gopls: connected")
+	case status.Connecting:
+		parts = append(parts, "gopls: connecting")
+	case status.Running:
+		parts = append(parts, "gopls: running, not connected")
+	default:
+		parts = append(parts, "gopls: stopped, use `%gopls restart` to restart it")
+	}
+	if version, err := goplsclient.Version(); err == nil {
+		parts = append(parts, version)
 	} else {
-		return kernel.PipeExecToJupyter(msg, "/bin/bash", "-c", cmdStr).InDir(execDir).Exec()
+		parts = append(parts, fmt.Sprintf("version: unknown (%v)", err))
+	}
+	parts = append(parts, fmt.Sprintf("address: %s", status.Address),
+		fmt.Sprintf("tracked files: %d", status.TrackedFiles))
+	return strings.Join(parts, "\n") + "\n"
+}
+
+// execClear executes the "%clear" special command. The parameter `args` excludes "%clear".
+//
+// It clears the output of the cell. With `--wait` the output is only cleared when new output is available.
+func execClear(msg kernel.Message, args []string) error {
+	var wait bool
+	for _, arg := range args {
+		if arg != "--wait" {
+			return errors.Errorf("`%%clear [--wait]`: unknown argument %q", arg)
+		}
+		wait = true
 	}
+	if err := kernel.PublishClearOutput(msg, wait); err != nil {
+		klog.Errorf("Failed to publish clear_output: %+v", err)
+	}
+	return nil
 }
 
 // splitCmd split the special command into it's parts separated by space(s). It also
 // accepts quotes to allow spaces to be included in a part. E.g.: `%args --text "hello world"`
 // should be split into ["%args", "--text", "hello world"].
+//
+// Within double quotes `\n`, `\t` and `\"` are interpreted. Like in POSIX shells, text within
+// single quotes is taken verbatim (no escape processing), and quoted segments next to each other
+// are concatenated: `'a'"b"` is split into ["ab"].
 func splitCmd(cmd string) (parts []string) {
 	partStarted := false
 	inQuotes := false
@@ -251,6 +1297,18 @@ func splitCmd(cmd string) (parts []string) {
 	for pos := 0; pos < len(cmd); pos++ {
 		c := cmd[pos]
 
+		if c == '\'' && !inQuotes {
+			// Single-quoted text: take it verbatim until the closing single quote (or the end of cmd).
+			end := strings.IndexByte(cmd[pos+1:], '\'')
+			if end == -1 {
+				end = len(cmd) - pos - 1
+			}
+			part += cmd[pos+1 : pos+1+end]
+			partStarted = true // Allows for empty argument.
+			pos += end + 1
+			continue
+		}
+
 		isSpace := c == ' ' || c == '\t' || c == '\n'
 		if !inQuotes && isSpace {
 			if partStarted {
@@ -7,10 +7,15 @@ import (
 	"github.com/janpfeifer/gonb/goexec"
 	"github.com/janpfeifer/gonb/gonbui/protocol"
 	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2"
 	"os"
+	"os/exec"
+	"path"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -24,6 +29,35 @@ func TestJoinLine(t *testing.T) {
 	assert.EqualValues(t, map[int]struct{}{1: empty, 2: empty, 3: empty}, updatedLines, "Joining consecutive lines ended in '\\'")
 }
 
+func TestJoinLineQuoted(t *testing.T) {
+	// Continuation within double quotes is preserved as a newline in special commands.
+	lines := []string{`%args --config="a: 1\`, `b: 2\`, `c: \"x y\"" \`, `--n=3`}
+	got := joinLine(lines, 0, MakeSet[int]())
+	assert.Equal(t, "%args --config=\"a: 1\nb: 2\nc: \\\"x y\\\"\"  --n=3", got)
+	assert.Equal(t, []string{"args", "--config=a: 1\nb: 2\nc: \"x y\"", "--n=3"}, splitCmd(got[1:]))
+
+	// Within single quotes too.
+	lines = []string{`%args 'first\`, `second' third`}
+	assert.Equal(t, []string{"args", "first\nsecond", "third"}, splitCmd(joinLine(lines, 0, MakeSet[int]())[1:]))
+
+	// Shell commands are joined with spaces, quotes are left to the shell.
+	lines = []string{`!echo "a\`, `b"`}
+	assert.Equal(t, `!echo "a b"`, joinLine(lines, 0, MakeSet[int]()))
+}
+
+func TestArgsMultiLineQuoted(t *testing.T) {
+	s := newEmptyState(t)
+	lines := []string{
+		`%args --config="name: test\`,
+		`values:\`,
+		`  - 1" --verbose`,
+	}
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(nil, s, true, lines, usedLines))
+	assert.Equal(t, []string{"--config=name: test\nvalues:\n  - 1", "--verbose"}, s.Args)
+	assert.Equal(t, 3, len(usedLines))
+}
+
 func TestSplitCmd(t *testing.T) {
 	parts := splitCmd("--msg=\"hello world\" \t\n --msg2=\"it replied \\\"\\nhello\\t\\\"\" \"")
 	fmt.Printf("Parts=%+q\n", parts)
@@ -33,6 +67,24 @@ func TestSplitCmd(t *testing.T) {
 	assert.Equal(t, "", parts[2])
 }
 
+func TestSplitCmdSingleQuotes(t *testing.T) {
+	testCases := []struct {
+		cmd  string
+		want []string
+	}{
+		{`args 'hello world'`, []string{"args", "hello world"}},
+		{`'a\nb' "a\nb"`, []string{`a\nb`, "a\nb"}},
+		{`'a'"b"`, []string{"ab"}},
+		{`x'a b'"c d"y`, []string{"xa bc dy"}},
+		{`"it's" 'say "hi"'`, []string{"it's", `say "hi"`}},
+		{`'' ""`, []string{"", ""}},
+		{`'unterminated quote`, []string{"unterminated quote"}},
+	}
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, splitCmd(tc.cmd), "splitCmd(%q)", tc.cmd)
+	}
+}
+
 // newEmptyState returns an empty state with a temporary directory created.
 func newEmptyState(t *testing.T) *goexec.State {
 	uuidTmp, _ := uuid.NewV7()
@@ -60,3 +112,1885 @@ func TestDirEnv(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, "/tmp", os.Getenv(protocol.GONB_DIR_ENV))
 }
+
+func TestExpandGlob(t *testing.T) {
+	root := t.TempDir()
+	for _, p := range []string{"a.go", "a.txt", "pkg/b.go", "pkg/sub/c.go", "pkg/sub/c_test.go"} {
+		p = path.Join(root, p)
+		require.NoError(t, os.MkdirAll(path.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte("package x\n"), 0644))
+	}
+	matches, err := expandGlob(path.Join(root, "*.go"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{path.Join(root, "a.go")}, matches)
+
+	matches, err = expandGlob(path.Join(root, "**/*.go"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		path.Join(root, "a.go"), path.Join(root, "pkg/b.go"),
+		path.Join(root, "pkg/sub/c.go"), path.Join(root, "pkg/sub/c_test.go")}, matches)
+
+	matches, err = expandGlob(path.Join(root, "pkg/**/c*.go"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{path.Join(root, "pkg/sub/c.go"), path.Join(root, "pkg/sub/c_test.go")}, matches)
+
+	matches, err = expandGlob(path.Join(root, "**/*.rs"))
+	require.NoError(t, err)
+	assert.Empty(t, matches)
+
+	assert.True(t, matchGlob("/x/**", "/x/y/z.go"))
+	assert.True(t, matchGlob("/x/**/z.go", "/x/z.go"))
+	assert.False(t, matchGlob("/x/*/z.go", "/x/y/w/z.go"))
+
+	// Track and untrack with patterns.
+	s := newEmptyState(t)
+	var msg kernel.Message
+	err = Parse(msg, s, true, []string{"%track " + path.Join(root, "pkg/**/*.go")}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		path.Join(root, "pkg/b.go"), path.Join(root, "pkg/sub/c.go"), path.Join(root, "pkg/sub/c_test.go")},
+		s.ListTracked())
+	err = Parse(msg, s, true, []string{"%untrack " + path.Join(root, "**/c*.go")}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, []string{path.Join(root, "pkg/b.go")}, s.ListTracked())
+}
+
+func TestFilterDefinitions(t *testing.T) {
+	decls := goexec.NewDeclarations()
+	decls.Imports["fmt"] = &goexec.Import{}
+	decls.Imports["strings"] = &goexec.Import{}
+	decls.Types["Plot"] = &goexec.TypeDecl{}
+	decls.Variables["plotSize"] = &goexec.Variable{}
+	decls.Functions["PlotLine"] = &goexec.Function{}
+	decls.Functions["Plot~Draw"] = &goexec.Function{}
+	decls.Functions["main"] = &goexec.Function{}
+
+	listings, err := filterDefinitions(decls, nil, "")
+	require.NoError(t, err)
+	require.Equal(t, []definitionsListing{
+		{Title: "Imports", Keys: []string{"fmt", "strings"}},
+		{Title: "Constants"},
+		{Title: "Types", Keys: []string{"Plot"}},
+		{Title: "Variables", Keys: []string{"plotSize"}},
+		{Title: "Functions", Keys: []string{"PlotLine", "Plot~Draw", "main"}},
+	}, listings)
+
+	// Substring and glob patterns.
+	listings, err = filterDefinitions(decls, []string{"lot"}, "func")
+	require.NoError(t, err)
+	require.Equal(t, []definitionsListing{{Title: "Functions", Keys: []string{"PlotLine", "Plot~Draw"}}}, listings)
+	listings, err = filterDefinitions(decls, []string{"Plot*", "str"}, "")
+	require.NoError(t, err)
+	require.Equal(t, []definitionsListing{
+		{Title: "Imports", Keys: []string{"strings"}},
+		{Title: "Constants"},
+		{Title: "Types", Keys: []string{"Plot"}},
+		{Title: "Variables"},
+		{Title: "Functions", Keys: []string{"PlotLine", "Plot~Draw"}},
+	}, listings)
+
+	_, err = filterDefinitions(decls, nil, "method")
+	require.Error(t, err)
+}
+
+func TestRemoveByRegexp(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	s.Definitions.Functions["helperA"] = &goexec.Function{}
+	s.Definitions.Functions["helperB"] = &goexec.Function{}
+	s.Definitions.Functions["main"] = &goexec.Function{}
+	s.Definitions.Variables["helperCount"] = &goexec.Variable{}
+	s.Definitions.Imports["fmt"] = &goexec.Import{}
+
+	// Invalid regexp: nothing is removed.
+	err := Parse(msg, s, true, []string{"%rm -r ^helper ("}, MakeSet[int]())
+	require.Error(t, err)
+	assert.Len(t, s.Definitions.Functions, 3)
+
+	err = Parse(msg, s, true, []string{"%rm -r ^helper"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"main"}, SortedKeys(s.Definitions.Functions))
+	assert.Empty(t, s.Definitions.Variables)
+	assert.Len(t, s.Definitions.Imports, 1)
+
+	// Explicit names still work.
+	err = Parse(msg, s, true, []string{"%rm fmt"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Empty(t, s.Definitions.Imports)
+}
+
+func TestSaveLoadState(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	s.Definitions.Functions["f"] = &goexec.Function{Key: "f", Name: "f", Definition: "func f() {}"}
+	filePath := path.Join(t.TempDir(), "state.json")
+	require.NoError(t, Parse(msg, s, true, []string{"%savestate " + filePath}, MakeSet[int]()))
+
+	s2 := newEmptyState(t)
+	defer func() { require.NoError(t, s2.Finalize()) }()
+	require.NoError(t, Parse(msg, s2, true, []string{"%loadstate " + filePath}, MakeSet[int]()))
+	require.Contains(t, s2.Definitions.Functions, "f")
+	assert.Equal(t, "func f() {}", s2.Definitions.Functions["f"].Definition)
+
+	require.Error(t, Parse(msg, s2, true, []string{"%loadstate"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s2, true, []string{"%loadstate " + path.Join(t.TempDir(), "missing.json")}, MakeSet[int]()))
+}
+
+func TestComplete(t *testing.T) {
+	matches, replaceLength := Complete("%unt", 4)
+	assert.Equal(t, []string{"%untrack"}, matches)
+	assert.Equal(t, 4, replaceLength)
+	matches, _ = Complete("%%time", 6)
+	assert.Equal(t, []string{"%%timeit"}, matches)
+	matches, _ = Complete("x := 1", 2)
+	assert.Empty(t, matches)
+
+	// Paths.
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(path.Join(dir, "data"), 0755))
+	require.NoError(t, os.WriteFile(path.Join(dir, "data.go"), []byte("package data"), 0644))
+	require.NoError(t, os.WriteFile(path.Join(dir, ".hidden"), nil, 0644))
+	line := "%track " + dir + "/da"
+	matches, replaceLength = Complete(line, len(line))
+	assert.Equal(t, []string{dir + "/data.go", dir + "/data/"}, matches)
+	assert.Equal(t, len(dir)+3, replaceLength)
+	line = "%cd " + dir + "/"
+	matches, _ = Complete(line, len(line))
+	assert.Equal(t, []string{dir + "/data.go", dir + "/data/"}, matches)
+
+	// Commands that don't take paths.
+	line = "%env " + dir + "/"
+	matches, _ = Complete(line, len(line))
+	assert.Empty(t, matches)
+}
+
+func TestGoRootCommand(t *testing.T) {
+	s := newEmptyState(t)
+	// Invalid toolchains are rejected and the current one is kept.
+	err := Parse(nil, s, true, []string{"%goroot " + t.TempDir()}, MakeSet[int]())
+	require.Error(t, err)
+	err = Parse(nil, s, true, []string{"%goroot a b"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestGopls(t *testing.T) {
+	s := newEmptyState(t)
+	require.NoError(t, Parse(nil, s, true, []string{"%gopls status"}, MakeSet[int]()))
+	if _, err := exec.LookPath("gopls"); err != nil {
+		// Without `gopls` installed, it is not started, and restarting it reports it.
+		assert.Contains(t, goplsStatusText(s), "not started")
+		require.Error(t, Parse(nil, s, true, []string{"%gopls restart"}, MakeSet[int]()))
+	} else {
+		require.NoError(t, Parse(nil, s, true, []string{"%gopls restart"}, MakeSet[int]()))
+		assert.Contains(t, goplsStatusText(s), "gopls: connected")
+	}
+	require.Error(t, Parse(nil, s, true, []string{"%gopls"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%gopls stop"}, MakeSet[int]()))
+}
+
+func TestVerbosity(t *testing.T) {
+	s := newEmptyState(t)
+	vFlag := klogVerbosityFlag()
+	original := vFlag.Value.String()
+	defer func() { _ = vFlag.Value.Set(original) }()
+
+	require.NoError(t, Parse(nil, s, true, []string{"%verbosity 2"}, MakeSet[int]()))
+	assert.Equal(t, "2", vFlag.Value.String())
+	assert.True(t, klog.V(2).Enabled())
+	require.NoError(t, Parse(nil, s, true, []string{"%verbosity 0", "%verbosity"}, MakeSet[int]()))
+	assert.Equal(t, "0", vFlag.Value.String())
+	assert.False(t, klog.V(1).Enabled())
+
+	require.Error(t, Parse(nil, s, true, []string{"%verbosity high"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%verbosity -1"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%verbosity 1 2"}, MakeSet[int]()))
+}
+
+func TestMaxOutput(t *testing.T) {
+	s := newEmptyState(t)
+	defer func(maxBytes int64) { kernel.MaxOutputBytes = maxBytes }(kernel.MaxOutputBytes)
+
+	require.NoError(t, Parse(nil, s, true, []string{"%maxoutput 1024", "%maxoutput"}, MakeSet[int]()))
+	assert.Equal(t, int64(1024), kernel.MaxOutputBytes)
+	require.NoError(t, Parse(nil, s, true, []string{"%maxoutput 0"}, MakeSet[int]()))
+	assert.Equal(t, int64(0), kernel.MaxOutputBytes)
+
+	require.Error(t, Parse(nil, s, true, []string{"%maxoutput 1MB"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%maxoutput -1"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%maxoutput 1 2"}, MakeSet[int]()))
+	assert.Equal(t, int64(0), kernel.MaxOutputBytes)
+}
+
+func TestGenerateAndPreBuild(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	genDir := t.TempDir()
+	require.NoError(t, Parse(nil, s, true, []string{"%generate", "%generate " + genDir}, MakeSet[int]()))
+	assert.Equal(t, []string{s.TempDir, genDir}, s.CellGenerateDirs)
+	require.Error(t, Parse(nil, s, true, []string{"%generate " + path.Join(genDir, "missing")}, MakeSet[int]()))
+
+	// CellGenerateDirs is reset at every cell, but pre-build commands are kept.
+	require.NoError(t, Parse(nil, s, true, []string{
+		"%prebuild protoc --go_out=. *.proto",
+		"%prebuild *go run ./gen",
+	}, MakeSet[int]()))
+	assert.Empty(t, s.CellGenerateDirs)
+	require.Len(t, s.PreBuildCommands, 2)
+	assert.Equal(t, "protoc --go_out=. *.proto", s.PreBuildCommands[0].Command)
+	assert.Equal(t, "", s.PreBuildCommands[0].Dir)
+	assert.Equal(t, "go run ./gen", s.PreBuildCommands[1].Command)
+	assert.Equal(t, s.TempDir, s.PreBuildCommands[1].Dir)
+	require.NoError(t, Parse(nil, s, true, []string{"%prebuild"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%prebuild *"}, MakeSet[int]()))
+	require.NoError(t, Parse(nil, s, true, []string{"%prebuild --clear"}, MakeSet[int]()))
+	assert.Empty(t, s.PreBuildCommands)
+}
+
+func TestGoVet(t *testing.T) {
+	s := newEmptyState(t)
+	require.NoError(t, Parse(nil, s, true, []string{"%govet"}, MakeSet[int]()))
+	assert.True(t, s.GoVet)
+	assert.False(t, s.GoVetStrict)
+	require.NoError(t, Parse(nil, s, true, []string{"%govet --strict"}, MakeSet[int]()))
+	assert.True(t, s.GoVet)
+	assert.True(t, s.GoVetStrict)
+	require.NoError(t, Parse(nil, s, true, []string{"%nogovet"}, MakeSet[int]()))
+	assert.False(t, s.GoVet)
+	assert.False(t, s.GoVetStrict)
+	require.Error(t, Parse(nil, s, true, []string{"%govet --lenient"}, MakeSet[int]()))
+}
+
+func TestBuildTags(t *testing.T) {
+	s := newEmptyState(t)
+	require.NoError(t, Parse(nil, s, true, []string{"%buildtags linux,cgo integration"}, MakeSet[int]()))
+	assert.Equal(t, []string{"linux", "cgo", "integration"}, s.BuildTags)
+	require.NoError(t, Parse(nil, s, true, []string{"%buildtags"}, MakeSet[int]()))
+	assert.Equal(t, []string{"linux", "cgo", "integration"}, s.BuildTags)
+	require.NoError(t, Parse(nil, s, true, []string{`%buildtags ""`}, MakeSet[int]()))
+	assert.Empty(t, s.BuildTags)
+}
+
+func TestCgo(t *testing.T) {
+	s := newEmptyState(t)
+	require.NoError(t, Parse(nil, s, true, []string{"%cgo off"}, MakeSet[int]()))
+	assert.Equal(t, "0", s.CgoEnabled)
+	cgoEnabled, err := s.CgoEffective()
+	require.NoError(t, err)
+	assert.Equal(t, "0", cgoEnabled)
+	require.NoError(t, Parse(nil, s, true, []string{"%cgo on"}, MakeSet[int]()))
+	assert.Equal(t, "1", s.CgoEnabled)
+	require.NoError(t, Parse(nil, s, true, []string{"%cgo default"}, MakeSet[int]()))
+	assert.Empty(t, s.CgoEnabled)
+	require.Error(t, Parse(nil, s, true, []string{"%cgo maybe"}, MakeSet[int]()))
+}
+
+func TestVendor(t *testing.T) {
+	s := newEmptyState(t)
+	// No vendor directory yet.
+	require.Error(t, Parse(nil, s, true, []string{"%vendor on"}, MakeSet[int]()))
+	assert.False(t, s.Vendor)
+
+	require.NoError(t, os.Mkdir(s.VendorPath(), 0755))
+	require.NoError(t, Parse(nil, s, true, []string{"%vendor on"}, MakeSet[int]()))
+	assert.True(t, s.Vendor)
+	assert.Equal(t, "-mod=vendor", s.BuildFlags()[0])
+	require.NoError(t, Parse(nil, s, true, []string{"%vendor off"}, MakeSet[int]()))
+	assert.False(t, s.Vendor)
+	require.Error(t, Parse(nil, s, true, []string{"%vendor yes"}, MakeSet[int]()))
+}
+
+func TestTimeout(t *testing.T) {
+	s := newEmptyState(t)
+	start := time.Now()
+	require.NoError(t, Parse(nil, s, true, []string{"%timeout 100ms", "!sleep 100"}, MakeSet[int]()))
+	assert.Less(t, time.Since(start), 10*time.Second, "\"sleep 100\" should have timed out")
+	assert.Equal(t, 100*time.Millisecond, s.CellTimeout)
+	assert.Equal(t, "-1", os.Getenv(protocol.GONB_LAST_EXIT_CODE_ENV))
+
+	// Timeout is reset at every cell.
+	require.NoError(t, Parse(nil, s, true, []string{"%%"}, MakeSet[int]()))
+	assert.Zero(t, s.CellTimeout)
+
+	require.Error(t, Parse(nil, s, true, []string{"%timeout forever"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%timeout"}, MakeSet[int]()))
+}
+
+func TestCgoCellMagic(t *testing.T) {
+	s := newEmptyState(t)
+	require.NoError(t, Parse(nil, s, false, []string{"%%cgo"}, MakeSet[int]()))
+	assert.False(t, s.CellIsCgo)
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(nil, s, true, []string{"%%cgo", "// int one() { return 1; }", `import "C"`}, usedLines))
+	assert.True(t, s.CellIsCgo)
+	assert.Len(t, usedLines, 1, "%%cgo should only consume its own line")
+
+	// Reset at every cell.
+	require.NoError(t, Parse(nil, s, true, []string{"%%"}, MakeSet[int]()))
+	assert.False(t, s.CellIsCgo)
+}
+
+func TestStdin(t *testing.T) {
+	s := newEmptyState(t)
+	outputPath := path.Join(t.TempDir(), "stdin.txt")
+	lines := []string{
+		"%stdin",
+		"hello",
+		"!not a shell command",
+		"EOF",
+		"%stdin <<END",
+		"world",
+		"END",
+		"!cat > " + outputPath,
+		"func main() {}",
+	}
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(nil, s, true, lines, usedLines))
+	assert.Len(t, usedLines, len(lines)-1, "All lines but the Go code should be used")
+	assert.Equal(t, "hello\n!not a shell command\nworld\n", s.CellStdin)
+	content, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	assert.Equal(t, s.CellStdin, string(content))
+
+	// Lines are consumed even if not executing.
+	usedLines = MakeSet[int]()
+	require.NoError(t, Parse(nil, s, false, lines[:4], usedLines))
+	assert.Len(t, usedLines, 4)
+
+	// Missing end marker and invalid arguments.
+	require.Error(t, Parse(nil, s, true, []string{"%stdin", "hello"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%stdin END", "hello", "END"}, MakeSet[int]()))
+}
+
+func TestEmptyCommands(t *testing.T) {
+	s := newEmptyState(t)
+	lines := []string{"%\t", "% ", "%  \t ", "func main() {}"}
+	for _, execute := range []bool{false, true} {
+		usedLines := MakeSet[int]()
+		require.NoError(t, Parse(nil, s, execute, lines, usedLines))
+		assert.Len(t, usedLines, 3, "execute=%v", execute)
+	}
+	require.Error(t, execInternal(nil, s, " \t", &cellStatus{}))
+}
+
+func TestHelp(t *testing.T) {
+	help, err := helpForCommand(HelpMessage, "%cd")
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(help, "- `%cd [<directory>]`:"), "Got %q", help)
+	assert.NotContains(t, help, "%pwd")
+
+	// Multiple commands documented in one entry.
+	help, err = helpForCommand(HelpMessage, "noautoget")
+	require.NoError(t, err)
+	assert.Contains(t, help, "`%autoget` and `%noautoget`")
+
+	help, err = helpForCommand(HelpMessage, "%%cgo")
+	require.NoError(t, err)
+	assert.Contains(t, help, "CGO_ENABLED=1")
+
+	// Section headings.
+	help, err = helpForCommand(HelpMessage, "environment")
+	require.NoError(t, err)
+	assert.Contains(t, help, "### Environment Variables")
+	assert.Contains(t, help, "GONB_TMP_DIR")
+
+	_, err = helpForCommand(HelpMessage, "%not_a_command")
+	require.Error(t, err)
+
+	help = searchHelp(HelpMessage, "gopls")
+	assert.Contains(t, help, "%track")
+	assert.NotContains(t, help, "%cd [<directory>]")
+
+	require.NoError(t, Parse(nil, newEmptyState(t), true, []string{"%help --search go.mod"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, newEmptyState(t), true, []string{"%help --search"}, MakeSet[int]()))
+}
+
+func TestPushdPopd(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.Chdir(pwd)) }()
+
+	dir := t.TempDir()
+	err = Parse(msg, s, true, []string{"%pushd " + dir, "%pwd"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, dir, os.Getenv(protocol.GONB_DIR_ENV))
+	assert.Equal(t, []string{pwd}, s.DirStack)
+
+	err = Parse(msg, s, true, []string{"%popd"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, pwd, os.Getenv(protocol.GONB_DIR_ENV))
+	newPwd, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, pwd, newPwd)
+	assert.Empty(t, s.DirStack)
+
+	// Empty stack.
+	err = Parse(msg, s, true, []string{"%popd"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestCdPrevious(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.Chdir(pwd)) }()
+	t.Setenv(protocol.GONB_DIR_ENV, pwd)
+
+	// No previous directory yet.
+	require.Error(t, Parse(msg, s, true, []string{"%cd -"}, MakeSet[int]()))
+
+	dir := t.TempDir()
+	require.NoError(t, Parse(msg, s, true, []string{"%cd " + dir}, MakeSet[int]()))
+	assert.Equal(t, pwd, s.PreviousDir)
+
+	require.NoError(t, Parse(msg, s, true, []string{"%cd -"}, MakeSet[int]()))
+	got, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, pwd, got)
+	assert.Equal(t, pwd, os.Getenv(protocol.GONB_DIR_ENV))
+	assert.Equal(t, dir, s.PreviousDir)
+
+	// Toggles back.
+	require.NoError(t, Parse(msg, s, true, []string{"%cd -"}, MakeSet[int]()))
+	got, err = os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, dir, got)
+}
+
+func TestResetHard(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	strayPath := path.Join(s.TempDir, "stray.txt")
+	require.NoError(t, os.WriteFile(strayPath, []byte("stray"), 0600))
+
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"%reset --hard"}, MakeSet[int]())
+	require.NoError(t, err)
+	_, err = os.Stat(strayPath)
+	assert.True(t, os.IsNotExist(err), "%q should have been removed by `%%reset --hard`", strayPath)
+	_, err = os.Stat(path.Join(s.TempDir, "go.mod"))
+	assert.NoError(t, err, "go.mod should have been re-created by `%%reset --hard`")
+
+	// Invalid parameter.
+	err = Parse(msg, s, true, []string{"%reset --soft"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestEnv(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	usedLines := MakeSet[int]()
+	err := Parse(msg, s, true, []string{"%env GONB_TEST_ENV_B \"b value\""}, usedLines)
+	require.NoError(t, err)
+	assert.Equal(t, "b value", os.Getenv("GONB_TEST_ENV_B"))
+
+	// Printing a value or listing all values should not fail.
+	t.Setenv("GONB_TEST_ENV_A", "a")
+	err = Parse(msg, s, true, []string{"%env GONB_TEST_ENV_A", "%env"}, MakeSet[int]())
+	require.NoError(t, err)
+
+	// Listing is sorted by variable name.
+	environ := sortedEnviron()
+	idxA, idxB := -1, -1
+	for ii, entry := range environ {
+		switch entry {
+		case "GONB_TEST_ENV_A=a":
+			idxA = ii
+		case "GONB_TEST_ENV_B=b value":
+			idxB = ii
+		}
+	}
+	require.NotEqual(t, -1, idxA)
+	require.NotEqual(t, -1, idxB)
+	assert.Less(t, idxA, idxB)
+
+	// Too many arguments.
+	err = Parse(msg, s, true, []string{"%env A B C"}, MakeSet[int]())
+	require.Error(t, err)
+	require.NoError(t, os.Unsetenv("GONB_TEST_ENV_B"))
+}
+
+func TestEnvExpansion(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	t.Setenv("HOME", "/home/gonb_test")
+	t.Setenv("GONB_TEST_ENV_EXPANDED", "")
+	t.Setenv("GONB_TEST_ENV_SUFFIX", "bin")
+
+	err := Parse(msg, s, true, []string{"%env GONB_TEST_ENV_EXPANDED $HOME/${GONB_TEST_ENV_SUFFIX}"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, "/home/gonb_test/bin", os.Getenv("GONB_TEST_ENV_EXPANDED"))
+
+	// Tilde is replaced by the home directory of the current user.
+	err = Parse(msg, s, true, []string{"%env GONB_TEST_ENV_EXPANDED ~/bin"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, ReplaceTildeInDir("~/bin"), os.Getenv("GONB_TEST_ENV_EXPANDED"))
+
+	// Undefined variables are expanded to empty.
+	err = Parse(msg, s, true, []string{"%env GONB_TEST_ENV_EXPANDED \"$GONB_TEST_ENV_UNDEFINED:$HOME\""}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, ":/home/gonb_test", os.Getenv("GONB_TEST_ENV_EXPANDED"))
+
+	// With --literal the value is set as is.
+	err = Parse(msg, s, true, []string{"%env --literal GONB_TEST_ENV_EXPANDED ~/$HOME"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, "~/$HOME", os.Getenv("GONB_TEST_ENV_EXPANDED"))
+}
+
+func TestEnvAppend(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	sep := string(os.PathListSeparator)
+	t.Setenv("GONB_TEST_PATH", "/usr/bin")
+	t.Setenv("GONB_TEST_FLAGS", "-a")
+	t.Setenv("GONB_TEST_UNSET_PATH", "")
+
+	err := Parse(msg, s, true, []string{
+		"%env --append GONB_TEST_PATH /opt/tool/bin",
+		"%env --prepend GONB_TEST_PATH /first/bin",
+		"%env --append GONB_TEST_UNSET_PATH /only/bin",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, "/first/bin"+sep+"/usr/bin"+sep+"/opt/tool/bin", os.Getenv("GONB_TEST_PATH"))
+	assert.Equal(t, "/only/bin", os.Getenv("GONB_TEST_UNSET_PATH"))
+
+	// Variables that don't look like a path list are concatenated, unless a separator is given.
+	err = Parse(msg, s, true, []string{
+		"%env --append GONB_TEST_FLAGS b",
+		"%env --append --separator=\" \" GONB_TEST_FLAGS -c",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, "-ab -c", os.Getenv("GONB_TEST_FLAGS"))
+
+	// Invalid combinations of flags.
+	for _, line := range []string{
+		"%env --append --prepend GONB_TEST_PATH x",
+		"%env --append GONB_TEST_PATH",
+		"%env --separator=, GONB_TEST_PATH x",
+		"%env --unknown GONB_TEST_PATH x",
+	} {
+		err = Parse(msg, s, true, []string{line}, MakeSet[int]())
+		require.Errorf(t, err, "%q should have failed", line)
+	}
+}
+
+func TestEnvListChanged(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	changedEnv = MakeSet[string]()
+	t.Setenv("GONB_TEST_CHANGED_B", "b")
+	t.Setenv("GONB_TEST_CHANGED_A", "")
+	assert.Equal(t, "No environment variables changed.\n", listChangedEnv(false))
+
+	require.NoError(t, Parse(msg, s, true, []string{
+		"%env GONB_TEST_CHANGED_A a",
+		"%unsetenv GONB_TEST_CHANGED_B",
+		"%env --list-changed",
+	}, MakeSet[int]()))
+	assert.Equal(t, "GONB_TEST_CHANGED_A=\"a\"\nGONB_TEST_CHANGED_B is not set\n", listChangedEnv(false))
+	require.Error(t, Parse(msg, s, true, []string{"%env --list-changed GONB_TEST_CHANGED_A"}, MakeSet[int]()))
+
+	// `%reset --hard` clears the list, but keeps the variables.
+	require.NoError(t, Parse(msg, s, true, []string{"%reset --hard"}, MakeSet[int]()))
+	assert.Empty(t, changedEnv)
+	assert.Equal(t, "a", os.Getenv("GONB_TEST_CHANGED_A"))
+}
+
+func TestEnvUnsetAll(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	changedEnv, originalEnv, lastSetEnv = MakeSet[string](), make(map[string]*string), make(map[string]*string)
+	t.Setenv("GONB_TEST_UNSETALL_A", "original")
+	t.Setenv("GONB_TEST_UNSETALL_B", "")
+	require.NoError(t, os.Unsetenv("GONB_TEST_UNSETALL_B"))
+	t.Setenv("GONB_TEST_UNSETALL_C", "c")
+	report, err := unsetAllEnv(false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "No environment variables changed.\n", report)
+
+	require.NoError(t, Parse(msg, s, true, []string{
+		"%env GONB_TEST_UNSETALL_A first",
+		"%env GONB_TEST_UNSETALL_A second",
+		"%env GONB_TEST_UNSETALL_B b",
+		"%unsetenv GONB_TEST_UNSETALL_C",
+	}, MakeSet[int]()))
+	// Modified by other means than the special commands.
+	require.NoError(t, os.Setenv("GONB_TEST_UNSETALL_B", "modified"))
+	report, err = unsetAllEnv(false, false)
+	require.NoError(t, err)
+	assert.Equal(t, "Restored: GONB_TEST_UNSETALL_A=\"original\"\nRestored: GONB_TEST_UNSETALL_C=\"c\"\n"+
+		"Skipped, modified since set by GoNB (use --force to restore them): GONB_TEST_UNSETALL_B\n", report)
+	assert.Equal(t, "original", os.Getenv("GONB_TEST_UNSETALL_A"))
+	assert.Equal(t, "c", os.Getenv("GONB_TEST_UNSETALL_C"))
+	assert.Equal(t, "modified", os.Getenv("GONB_TEST_UNSETALL_B"))
+	assert.Equal(t, []string{"GONB_TEST_UNSETALL_B"}, SortedKeys(changedEnv))
+
+	require.NoError(t, Parse(msg, s, true, []string{"%env --unset-all --force"}, MakeSet[int]()))
+	_, found := os.LookupEnv("GONB_TEST_UNSETALL_B")
+	assert.False(t, found)
+	assert.Empty(t, changedEnv)
+
+	// Invalid combinations.
+	require.Error(t, Parse(msg, s, true, []string{"%env --unset-all GONB_TEST_UNSETALL_A"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%env --force GONB_TEST_UNSETALL_A a"}, MakeSet[int]()))
+}
+
+func TestEnvCell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	t.Setenv(protocol.GONB_LAST_EXIT_CODE_ENV, "")
+	t.Setenv("GONB_TEST_ENVCELL_A", "before")
+	t.Setenv("GONB_TEST_ENVCELL_B", "")
+	require.NoError(t, os.Unsetenv("GONB_TEST_ENVCELL_B"))
+
+	require.NoError(t, Parse(msg, s, true, []string{
+		"%envcell GONB_TEST_ENVCELL_A during GONB_TEST_ENVCELL_B '$GONB_TEST_ENVCELL_A-b'",
+		"!test \"$GONB_TEST_ENVCELL_B\" = \"during-b\"",
+	}, MakeSet[int]()))
+	assert.Equal(t, "0", os.Getenv(protocol.GONB_LAST_EXIT_CODE_ENV), "shell command didn't see the variable")
+	assert.Equal(t, "during", os.Getenv("GONB_TEST_ENVCELL_A"))
+	assert.Equal(t, "during-b", os.Getenv("GONB_TEST_ENVCELL_B"))
+	RestoreCellEnv()
+	assert.Equal(t, "before", os.Getenv("GONB_TEST_ENVCELL_A"))
+	_, found := os.LookupEnv("GONB_TEST_ENVCELL_B")
+	assert.False(t, found)
+
+	// Set twice in the same cell: the value before the cell is restored, also by the next cell.
+	require.NoError(t, Parse(msg, s, true, []string{
+		"%envcell GONB_TEST_ENVCELL_A one",
+		"%envcell GONB_TEST_ENVCELL_A two",
+	}, MakeSet[int]()))
+	assert.Equal(t, "two", os.Getenv("GONB_TEST_ENVCELL_A"))
+	require.NoError(t, Parse(msg, s, true, []string{"%pwd"}, MakeSet[int]()))
+	assert.Equal(t, "before", os.Getenv("GONB_TEST_ENVCELL_A"))
+
+	require.Error(t, Parse(msg, s, true, []string{"%envcell"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%envcell GONB_TEST_ENVCELL_A"}, MakeSet[int]()))
+}
+
+func TestEnvSecret(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	changedEnv = MakeSet[string]()
+	secretEnv = MakeSet[string]()
+	t.Setenv("GONB_TEST_SECRET_VAR", "")
+	t.Setenv("GONB_TEST_API_TOKEN", "")
+	t.Setenv("GONB_TEST_PLAIN", "")
+
+	require.NoError(t, Parse(msg, s, true, []string{
+		"%env --secret GONB_TEST_SECRET_VAR s3cr3t",
+		"%env GONB_TEST_API_TOKEN abc",
+		"%env GONB_TEST_PLAIN plain",
+	}, MakeSet[int]()))
+	assert.Equal(t, "s3cr3t", os.Getenv("GONB_TEST_SECRET_VAR"))
+	assert.True(t, secretEnv.Has("GONB_TEST_SECRET_VAR"))
+	assert.Equal(t, "GONB_TEST_API_TOKEN=(hidden)\nGONB_TEST_PLAIN=\"plain\"\nGONB_TEST_SECRET_VAR=(hidden)\n",
+		listChangedEnv(false))
+	assert.Equal(t, "GONB_TEST_API_TOKEN=\"abc\"\nGONB_TEST_PLAIN=\"plain\"\nGONB_TEST_SECRET_VAR=\"s3cr3t\"\n",
+		listChangedEnv(true))
+	assert.Equal(t, "GONB_TEST_MY_PASSWORD=(hidden)", formatEnv("GONB_TEST_MY_PASSWORD", "x", false))
+	assert.Equal(t, "GONB_TEST_MY_PASSWORD=\"x\"", formatEnv("GONB_TEST_MY_PASSWORD", "x", true))
+
+	// Invalid uses.
+	require.Error(t, Parse(msg, s, true, []string{"%env --secret GONB_TEST_SECRET_VAR"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%env --list-changed --secret"}, MakeSet[int]()))
+
+	// `%reset --hard` clears the secrets.
+	require.NoError(t, Parse(msg, s, true, []string{"%reset --hard"}, MakeSet[int]()))
+	assert.Empty(t, secretEnv)
+}
+
+func TestEnvFromShell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	secretEnv = MakeSet[string]()
+	t.Setenv("GONB_TEST_SHELL_A", "")
+	t.Setenv("GONB_TEST_SHELL_B", "")
+	t.Setenv("GONB_TEST_SHELL_C", "")
+
+	require.NoError(t, Parse(msg, s, true, []string{
+		`%env --from-shell 'echo GONB_TEST_SHELL_A=1; echo "export GONB_TEST_SHELL_B=\"x y\""; echo some other output'`,
+	}, MakeSet[int]()))
+	assert.Equal(t, "1", os.Getenv("GONB_TEST_SHELL_A"))
+	assert.Equal(t, "x y", os.Getenv("GONB_TEST_SHELL_B"))
+
+	require.NoError(t, Parse(msg, s, true, []string{
+		`%env --secret --from-shell 'echo GONB_TEST_SHELL_C=hidden'`,
+	}, MakeSet[int]()))
+	assert.Equal(t, "hidden", os.Getenv("GONB_TEST_SHELL_C"))
+	assert.True(t, secretEnv.Has("GONB_TEST_SHELL_C"))
+
+	// Failing command, or invalid arguments.
+	require.Error(t, Parse(msg, s, true, []string{`%env --from-shell 'echo GONB_TEST_SHELL_A=2; exit 1'`}, MakeSet[int]()))
+	assert.Equal(t, "1", os.Getenv("GONB_TEST_SHELL_A"))
+	require.Error(t, Parse(msg, s, true, []string{`%env --from-shell`}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{`%env --from-shell echo A=1`}, MakeSet[int]()))
+
+	// Functions exported by bash, as printed by `env`, are skipped, and don't prevent the other variables
+	// from being imported.
+	assert.Equal(t, [][2]string{{"GONB_TEST_SHELL_A", "3"}}, parseShellEnv(
+		"BASH_FUNC_foo%%=() {  echo foo\n}\nGONB_TEST_SHELL_A=3\n"))
+	require.NoError(t, Parse(msg, s, true, []string{
+		`%env --from-shell 'printf "BASH_FUNC_foo%%%%=() {  echo foo\n}\nGONB_TEST_SHELL_A=3\n"'`,
+	}, MakeSet[int]()))
+	assert.Equal(t, "3", os.Getenv("GONB_TEST_SHELL_A"))
+
+	// Multi-line values: the continuation lines are not imported as variables.
+	t.Setenv("x", "")
+	require.NoError(t, os.Unsetenv("x"))
+	assert.Equal(t, [][2]string{{"GONB_TEST_SHELL_B", "line1\n  x=1"}, {"GONB_TEST_SHELL_C", "c"}},
+		parseShellEnv("GONB_TEST_SHELL_B=line1\n  x=1\nGONB_TEST_SHELL_C=c\n"))
+	require.NoError(t, Parse(msg, s, true, []string{
+		`%env --from-shell 'printf "GONB_TEST_SHELL_B=line1\n  x=1\n"'`,
+	}, MakeSet[int]()))
+	assert.Equal(t, "line1\n  x=1", os.Getenv("GONB_TEST_SHELL_B"))
+	_, found := os.LookupEnv("x")
+	assert.False(t, found)
+}
+
+func TestUnsetEnv(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	require.NoError(t, os.Setenv("GONB_TEST_UNSET", "x"))
+	err := Parse(msg, s, true, []string{"%unsetenv GONB_TEST_UNSET GONB_TEST_NEVER_SET"}, MakeSet[int]())
+	require.NoError(t, err)
+	_, found := os.LookupEnv("GONB_TEST_UNSET")
+	assert.False(t, found)
+
+	// At least one variable name is required.
+	err = Parse(msg, s, true, []string{"%unsetenv"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestParseDotEnv(t *testing.T) {
+	vars, err := parseDotEnv(`
+# Comment.
+A=1
+export B = two words # comment
+C="quoted\tvalue" # comment
+D='single # quoted'
+E=
+`)
+	require.NoError(t, err)
+	assert.Equal(t, [][2]string{
+		{"A", "1"},
+		{"B", "two words"},
+		{"C", "quoted\tvalue"},
+		{"D", "single # quoted"},
+		{"E", ""},
+	}, vars)
+
+	_, err = parseDotEnv("A")
+	require.Error(t, err)
+	_, err = parseDotEnv("A=\"unterminated")
+	require.Error(t, err)
+}
+
+func TestDotEnv(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	filePath := path.Join(t.TempDir(), "test.env")
+	require.NoError(t, os.WriteFile(filePath, []byte("GONB_TEST_DOTENV_A=a\nexport GONB_TEST_DOTENV_B=\"b value\"\n"), 0644))
+	t.Setenv("GONB_TEST_DOTENV_A", "")
+	t.Setenv("GONB_TEST_DOTENV_B", "")
+	err := Parse(msg, s, true, []string{"%dotenv " + filePath}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, "a", os.Getenv("GONB_TEST_DOTENV_A"))
+	assert.Equal(t, "b value", os.Getenv("GONB_TEST_DOTENV_B"))
+
+	// Missing file.
+	err = Parse(msg, s, true, []string{"%dotenv " + filePath + ".missing"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestEnvExport(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	filePath := path.Join(t.TempDir(), "export.env")
+	t.Setenv("GONB_TEST_EXPORT_A", "")
+	t.Setenv("GONB_TEST_EXPORT_B", "")
+	t.Setenv("GONB_TEST_EXPORT_TOKEN", "")
+	t.Setenv("GONB_TEST_EXPORT_UNSET", "x")
+	require.NoError(t, Parse(nil, s, true, []string{
+		"%env --literal GONB_TEST_EXPORT_A /usr/bin:~/go",
+		`%env --literal GONB_TEST_EXPORT_B 'a "b" #c'`,
+		"%env GONB_TEST_EXPORT_TOKEN secret",
+		"%unsetenv GONB_TEST_EXPORT_UNSET",
+		"%env --export " + filePath,
+	}, MakeSet[int]()))
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "GONB_TEST_EXPORT_A=/usr/bin:~/go\n")
+	assert.Contains(t, string(content), `GONB_TEST_EXPORT_B="a \"b\" #c"`+"\n")
+	assert.Contains(t, string(content), "# GONB_TEST_EXPORT_UNSET is not set\n")
+	assert.NotContains(t, string(content), "GONB_TEST_EXPORT_TOKEN")
+
+	// It is read back by `%dotenv`.
+	vars, err := parseDotEnv(string(content))
+	require.NoError(t, err)
+	assert.Contains(t, vars, [2]string{"GONB_TEST_EXPORT_B", `a "b" #c`})
+
+	require.NoError(t, Parse(nil, s, true, []string{"%env --export --all --show " + filePath}, MakeSet[int]()))
+	content, err = os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "GONB_TEST_EXPORT_TOKEN=secret\n")
+	assert.Contains(t, string(content), "PATH=")
+
+	require.Error(t, Parse(nil, s, true, []string{"%env --export"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%env --all"}, MakeSet[int]()))
+}
+
+func TestShellCommand(t *testing.T) {
+	t.Setenv(ShellEnv, "")
+	t.Setenv("SHELL", "/bin/zsh")
+	shell, args := shellCommand("linux", "ls -l")
+	assert.Equal(t, "/bin/zsh", shell)
+	assert.Equal(t, []string{"-c", "ls -l"}, args)
+
+	t.Setenv("SHELL", "")
+	shell, args = shellCommand("linux", "ls -l")
+	assert.Equal(t, "/bin/bash", shell)
+	assert.Equal(t, []string{"-c", "ls -l"}, args)
+
+	shell, args = shellCommand("windows", "dir")
+	assert.Equal(t, "cmd", shell)
+	assert.Equal(t, []string{"/C", "dir"}, args)
+
+	t.Setenv(ShellEnv, `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`)
+	shell, args = shellCommand("windows", "dir")
+	assert.Equal(t, `C:\Windows\System32\WindowsPowerShell\v1.0\powershell.exe`, shell)
+	assert.Equal(t, []string{"-Command", "dir"}, args)
+
+	// Set with `%shell`.
+	s := newEmptyState(t)
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"%shell /bin/sh"}, MakeSet[int]())
+	require.NoError(t, err)
+	shell, args = shellCommand("linux", "echo")
+	assert.Equal(t, "/bin/sh", shell)
+	assert.Equal(t, []string{"-c", "echo"}, args)
+}
+
+func TestArgsFromFile(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	filePath := path.Join(t.TempDir(), "args.json")
+	require.NoError(t, os.WriteFile(filePath, []byte(`["--n=10", "hello world"]`), 0644))
+	err := Parse(msg, s, true, []string{"%args --from-file " + filePath}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"--n=10", "hello world"}, s.Args)
+
+	// Not an array of strings.
+	require.NoError(t, os.WriteFile(filePath, []byte(`{"n": 10}`), 0644))
+	err = Parse(msg, s, true, []string{"%args --from-file " + filePath}, MakeSet[int]())
+	require.Error(t, err)
+	require.NoError(t, os.WriteFile(filePath, []byte(`["a", 1]`), 0644))
+	err = Parse(msg, s, true, []string{"%args --from-file " + filePath}, MakeSet[int]())
+	require.Error(t, err)
+
+	// Inline form still works.
+	err = Parse(msg, s, true, []string{"%args a \"b c\""}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b c"}, s.Args)
+}
+
+func TestArgsHeredoc(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	lines := []string{
+		"%args -v --config <<EOF",
+		"a: 1",
+		"%not a special command",
+		"EOF",
+		"%args \\",
+		"  --name=x <<END",
+		"line",
+		"END",
+		"func main() {}",
+	}
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(msg, s, true, lines[:4], usedLines))
+	assert.Len(t, usedLines, 4)
+	assert.Equal(t, []string{"-v", "--config", "a: 1\n%not a special command"}, s.Args)
+
+	// Heredoc combined with line continuation.
+	usedLines = MakeSet[int]()
+	require.NoError(t, Parse(msg, s, true, lines, usedLines))
+	assert.Len(t, usedLines, len(lines)-1, "All lines but the Go code should be used")
+	assert.Equal(t, []string{"--name=x", "line"}, s.Args)
+
+	// Missing end marker.
+	require.Error(t, Parse(msg, s, true, []string{"%args <<EOF", "a"}, MakeSet[int]()))
+}
+
+func TestDebugLines(t *testing.T) {
+	s := newEmptyState(t)
+	lines := []string{
+		"%debug lines",
+		"%args a \\",
+		"  b",
+		"func main() {}",
+	}
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(nil, s, true, lines, usedLines))
+	assert.Equal(t, "Lines used by special commands:\n   1: %debug lines\n   2: %args a \\\n   3:   b\n",
+		usedLinesReport(lines, usedLines))
+	assert.Equal(t, "No lines used by special commands\n", usedLinesReport(lines, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%debug"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%debug imports"}, MakeSet[int]()))
+}
+
+func TestDebugEnv(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	t.Setenv("GONB_TEST_DEBUG_VAR", "visible")
+	t.Setenv("GONB_TEST_DEBUG_TOKEN", "hidden-value")
+	s.CgoEnabled = "0"
+	t.Setenv("CGO_ENABLED", "1")
+
+	report := debugEnvReport(s)
+	assert.Contains(t, report, `GONB_TEST_DEBUG_VAR="visible"`)
+	assert.Contains(t, report, "GONB_TEST_DEBUG_TOKEN="+hiddenEnvValue)
+	assert.NotContains(t, report, "hidden-value")
+	assert.Contains(t, report, `  GOMODCACHE="`)
+	assert.Contains(t, report, `  CGO_ENABLED="0"`)
+	assert.NotContains(t, report, `CGO_ENABLED="1"`)
+	require.NoError(t, Parse(nil, s, true, []string{"%debug env"}, MakeSet[int]()))
+}
+
+func TestBackgroundJobs(t *testing.T) {
+	s := newEmptyState(t)
+	require.NoError(t, Parse(nil, s, true, []string{"%bg echo hello && sleep 60"}, MakeSet[int]()))
+	j, err := getJob("1")
+	require.NoError(t, err)
+	assert.True(t, j.isRunning())
+	assert.Contains(t, listJobs(), "[1] pid=")
+	require.Eventually(t, func() bool {
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		return string(j.logs) == "hello\n"
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(t, Parse(nil, s, true, []string{"%jobs", "%jobs --logs 1"}, MakeSet[int]()))
+
+	// Kill it.
+	require.NoError(t, Parse(nil, s, true, []string{"%kill %1"}, MakeSet[int]()))
+	assert.False(t, j.isRunning())
+	assert.Contains(t, j.status(), "terminated by a signal")
+	require.Error(t, Parse(nil, s, true, []string{"%kill 1"}, MakeSet[int]()), "Job already exited")
+
+	// Jobs that exit by themselves.
+	require.NoError(t, Parse(nil, s, true, []string{"%bg exit 3"}, MakeSet[int]()))
+	j, err = getJob("2")
+	require.NoError(t, err)
+	<-j.done
+	assert.Contains(t, j.status(), "exit code 3")
+	StopJobs()
+
+	// Invalid arguments.
+	require.Error(t, Parse(nil, s, true, []string{"%bg"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%kill 10"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%kill x"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%jobs --logs"}, MakeSet[int]()))
+}
+
+func TestWhich(t *testing.T) {
+	s := newEmptyState(t)
+	binDir := t.TempDir()
+	toolPath := path.Join(binDir, "mytool")
+	require.NoError(t, os.WriteFile(toolPath, []byte("#!/bin/sh\n"), 0755))
+
+	// PATH changed with `%env` is used. t.Setenv restores the original PATH at the end of the test.
+	t.Setenv("PATH", os.Getenv("PATH"))
+	require.NoError(t, Parse(nil, s, true, []string{"%env PATH " + binDir}, MakeSet[int]()))
+	require.NoError(t, Parse(nil, s, true, []string{"%which mytool missing"}, MakeSet[int]()))
+	found, err := exec.LookPath("mytool")
+	require.NoError(t, err)
+	assert.Equal(t, toolPath, found)
+	require.Error(t, Parse(nil, s, true, []string{"%which"}, MakeSet[int]()))
+}
+
+func TestMainAppendFlag(t *testing.T) {
+	s := newEmptyState(t)
+	require.NoError(t, Parse(nil, s, true, []string{"%% --append --n=3"}, MakeSet[int]()))
+	assert.True(t, s.CellMainAppend)
+	assert.Equal(t, []string{"--n=3"}, s.Args)
+
+	// Reset at every cell, and `--append` is only special right after `%%` or `%main`.
+	require.NoError(t, Parse(nil, s, true, []string{"%main --n=3 --append"}, MakeSet[int]()))
+	assert.False(t, s.CellMainAppend)
+	assert.Equal(t, []string{"--n=3", "--append"}, s.Args)
+	require.NoError(t, Parse(nil, s, true, []string{"%args --append"}, MakeSet[int]()))
+	assert.False(t, s.CellMainAppend)
+	assert.Equal(t, []string{"--append"}, s.Args)
+}
+
+func TestCdNotebook(t *testing.T) {
+	s := newEmptyState(t)
+	pwd, err := os.Getwd()
+	require.NoError(t, err)
+	defer func() { require.NoError(t, os.Chdir(pwd)) }()
+	t.Setenv(protocol.GONB_DIR_ENV, pwd)
+
+	notebookDir := t.TempDir()
+	t.Setenv(NotebookPathEnv, path.Join(notebookDir, "test.ipynb"))
+	require.NoError(t, Parse(nil, s, true, []string{"%cd --notebook"}, MakeSet[int]()))
+	got, err := os.Getwd()
+	require.NoError(t, err)
+	assert.Equal(t, notebookDir, got)
+	assert.Equal(t, notebookDir, os.Getenv(protocol.GONB_DIR_ENV))
+
+	// Path not available.
+	t.Setenv(NotebookPathEnv, "")
+	require.Error(t, Parse(nil, s, true, []string{"%cd --notebook"}, MakeSet[int]()))
+	t.Setenv(NotebookPathEnv, "some/dir/test.ipynb")
+	require.Error(t, Parse(nil, s, true, []string{"%cd --notebook"}, MakeSet[int]()))
+}
+
+func TestGoFlags(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"%goflags -race \"-tags=integration\""}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-race", "-tags=integration"}, s.GoBuildFlags)
+
+	// Printing the current flags doesn't change them.
+	err = Parse(msg, s, true, []string{"%goflags"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"-race", "-tags=integration"}, s.GoBuildFlags)
+
+	// Clear flags.
+	err = Parse(msg, s, true, []string{"%goflags \"\""}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Empty(t, s.GoBuildFlags)
+}
+
+func TestShellExitCode(t *testing.T) {
+	t.Setenv(ShellEnv, "/bin/sh")
+	s := newEmptyState(t)
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"!exit 3"}, MakeSet[int]())
+	require.NoError(t, err, "Non-zero exit codes should not be reported as errors")
+	assert.Equal(t, "3", os.Getenv(protocol.GONB_LAST_EXIT_CODE_ENV))
+
+	err = Parse(msg, s, true, []string{"!true"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, "0", os.Getenv(protocol.GONB_LAST_EXIT_CODE_ENV))
+}
+
+func TestBashCell(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skipf("bash not installed, skipping test")
+	}
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	lines := []string{
+		"%%bash --dir",
+		"X=hello",
+		"%not_a_special_command",
+		"echo \"$X\" > bash_cell.txt",
+	}
+	usedLines := MakeSet[int]()
+	err := Parse(msg, s, true, lines, usedLines)
+	require.NoError(t, err)
+	assert.Len(t, usedLines, len(lines), "All lines of a %%bash cell should be used")
+	content, err := os.ReadFile(path.Join(s.TempDir, "bash_cell.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(content))
+
+	// Invalid argument.
+	err = Parse(msg, s, true, []string{"%%bash --foo", "echo"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestScriptCell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	outputPath := path.Join(t.TempDir(), "script_cell.txt")
+	lines := []string{
+		"%%script sh -s " + outputPath,
+		"%not_a_special_command",
+		"echo hello > \"$1\"",
+		"exit 3",
+	}
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(msg, s, true, lines, usedLines))
+	assert.Len(t, usedLines, len(lines), "All lines of a %%script cell should be used")
+	content, err := os.ReadFile(outputPath)
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", string(content))
+	assert.Equal(t, "3", os.Getenv(protocol.GONB_LAST_EXIT_CODE_ENV))
+
+	// Missing interpreter.
+	require.Error(t, Parse(msg, s, true, []string{"%%script", "echo"}, MakeSet[int]()))
+}
+
+func TestGoModCell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	replaceDir := t.TempDir()
+
+	// Appending to the go.mod created by `go mod init`.
+	require.NoError(t, Parse(msg, s, true, []string{"%%go.mod --append", "require example.com/baz v0.1.0"}, MakeSet[int]()))
+	content, err := os.ReadFile(s.GoModPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "require example.com/baz v0.1.0")
+
+	lines := []string{
+		"%%go.mod",
+		"go 1.20",
+		"",
+		"require example.com/foo v1.2.3",
+	}
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(msg, s, true, lines, usedLines))
+	assert.Len(t, usedLines, len(lines), "All lines of a %%go.mod cell should be used")
+	content, err = os.ReadFile(s.GoModPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "module "+s.Package+"\n")
+	assert.Contains(t, string(content), "require example.com/foo v1.2.3")
+
+	// Appending keeps the previous contents.
+	require.NoError(t, Parse(msg, s, true, []string{
+		"%%go.mod --append", "replace example.com/foo => " + replaceDir}, MakeSet[int]()))
+	content, err = os.ReadFile(s.GoModPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "require example.com/foo v1.2.3")
+	assert.Contains(t, string(content), "replace example.com/foo => "+replaceDir)
+
+	// Syntax errors are reported, and go.mod is left unchanged.
+	err = Parse(msg, s, true, []string{"%%go.mod", "go 1.20", "requirez example.com/bar v1.0.0"}, MakeSet[int]())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "go.mod:2")
+	newContent, err := os.ReadFile(s.GoModPath())
+	require.NoError(t, err)
+	assert.Equal(t, string(content), string(newContent))
+	require.Error(t, Parse(msg, s, true, []string{"%%go.mod --replace", "go 1.20"}, MakeSet[int]()))
+}
+
+func TestGoWork(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	newModule := func(name string) string {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(path.Join(dir, "go.mod"), []byte("module "+name+"\n\ngo 1.20\n"), 0644))
+		return dir
+	}
+	libA, libB := newModule("example.com/liba"), newModule("example.com/libb")
+
+	lines := []string{"%%go.work", "go 1.20", "", "use " + libA}
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(msg, s, true, lines, usedLines))
+	assert.Len(t, usedLines, len(lines), "All lines of a %%go.work cell should be used")
+	content, err := os.ReadFile(s.GoWorkPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(content), libA)
+	assert.Regexp(t, `(?m)^\s*(use\s+)?\.$`, string(content), "`use .` should have been added")
+	modToPath, err := s.GoWorkModules()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.com/liba": libA}, modToPath)
+	goMod, err := os.ReadFile(s.GoModPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(goMod), "replace example.com/liba => "+libA)
+
+	// %goworkuse adds a module to the workspace.
+	require.NoError(t, Parse(msg, s, true, []string{"%goworkuse " + libB}, MakeSet[int]()))
+	modToPath, err = s.GoWorkModules()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.com/liba": libA, "example.com/libb": libB}, modToPath)
+
+	// Missing directories are rejected, and go.work is kept.
+	content, err = os.ReadFile(s.GoWorkPath())
+	require.NoError(t, err)
+	missingDir := path.Join(t.TempDir(), "missing")
+	require.Error(t, Parse(msg, s, true, []string{"%goworkuse " + missingDir}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%%go.work", "use " + missingDir}, MakeSet[int]()))
+	newContent, err := os.ReadFile(s.GoWorkPath())
+	require.NoError(t, err)
+	assert.Equal(t, string(content), string(newContent))
+}
+
+func TestHTMLAndLatexCells(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	for _, magic := range []string{"%%html", "%%latex"} {
+		lines := []string{magic, "<b>not Go</b>", "%not_a_special_command", "$x^2$"}
+		usedLines := MakeSet[int]()
+		require.NoError(t, Parse(msg, s, true, lines, usedLines))
+		assert.Len(t, usedLines, len(lines), "All lines of a %s cell should be used", magic)
+
+		// Arguments are not accepted.
+		require.Error(t, Parse(msg, s, true, []string{magic + " foo", "x"}, MakeSet[int]()))
+	}
+}
+
+func TestTime(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"%%time", "%%", "fmt.Println(1)"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.True(t, s.CellIsTimed)
+
+	// Reset at the next cell.
+	err = Parse(msg, s, true, []string{"%%"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.False(t, s.CellIsTimed)
+}
+
+func TestTimeIt(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"%%timeit", "%%", "fmt.Println(1)"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, &goexec.TimeIt{Iterations: 0, Repeats: goexec.DefaultTimeItRepeats}, s.CellTimeIt)
+
+	err = Parse(msg, s, true, []string{"%%timeit -n 100 -r 3", "%%", "fmt.Println(1)"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, &goexec.TimeIt{Iterations: 100, Repeats: 3}, s.CellTimeIt)
+
+	// Reset at the next cell.
+	err = Parse(msg, s, true, []string{"%%"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Nil(t, s.CellTimeIt)
+
+	// Invalid arguments.
+	require.Error(t, Parse(msg, s, true, []string{"%%timeit -n"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%%timeit -n 0"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%%timeit -x 1"}, MakeSet[int]()))
+}
+
+func TestProfile(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"%%profile cpu", "%%", "fmt.Println(1)"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, &goexec.Profile{Kind: goexec.ProfileCPU, TopN: goexec.DefaultProfileTopN}, s.CellProfile)
+
+	err = Parse(msg, s, true, []string{"%%profile mem -n 5", "%%", "fmt.Println(1)"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, &goexec.Profile{Kind: goexec.ProfileMem, TopN: 5}, s.CellProfile)
+
+	// Reset at the next cell.
+	err = Parse(msg, s, true, []string{"%%"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Nil(t, s.CellProfile)
+
+	// Invalid arguments.
+	require.Error(t, Parse(msg, s, true, []string{"%%profile"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%%profile gpu"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%%profile cpu -n 0"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%%profile cpu -x 1"}, MakeSet[int]()))
+}
+
+func TestCellTest(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"%%test -run TestA -v", "func TestA(t *testing.T) {}"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.True(t, s.CellIsTest)
+	assert.Equal(t, []string{"-run", "TestA", "-v"}, s.CellTestArgs)
+
+	// Reset at the next cell.
+	require.NoError(t, Parse(msg, s, true, []string{"%%"}, MakeSet[int]()))
+	assert.False(t, s.CellIsTest)
+	assert.Nil(t, s.CellTestArgs)
+
+	err = Parse(msg, s, true, []string{"%%benchmark -benchtime=2s"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.True(t, s.CellIsTest)
+	assert.Equal(t, []string{"-run=^$", "-bench=.", "-benchmem", "-benchtime=2s"}, s.CellTestArgs)
+}
+
+func TestCapture(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	err := Parse(msg, s, true, []string{"%%capture --stdout --show", "fmt.Println(1)"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, DefaultCaptureVariable, s.CellCaptureVar)
+
+	err = Parse(msg, s, true, []string{"%%capture out", "fmt.Println(1)"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, "out", s.CellCaptureVar)
+
+	// Reset at the next cell.
+	err = Parse(msg, s, true, []string{"%%"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, "", s.CellCaptureVar)
+
+	// Invalid arguments.
+	require.Error(t, Parse(msg, s, true, []string{"%%capture --foo"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%%capture 1out"}, MakeSet[int]()))
+}
+
+func TestWriteFile(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	filePath := path.Join(t.TempDir(), "cell.go")
+	err := Parse(msg, s, true, []string{
+		"%writefile " + filePath,
+		"func f() int { return 1 }",
+		"%autoget",
+	}, MakeSet[int]())
+	require.NoError(t, err)
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, "func f() int { return 1 }\n", string(content))
+
+	// Append.
+	err = Parse(msg, s, true, []string{"func g() int { return 2 }", "%writefile -a " + filePath}, MakeSet[int]())
+	require.NoError(t, err)
+	content, err = os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, "func f() int { return 1 }\nfunc g() int { return 2 }\n", string(content))
+
+	// Missing path.
+	err = Parse(msg, s, true, []string{"%writefile -a"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestFileCell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+
+	// Contents are written verbatim, and no lines are left to execute.
+	filePath := path.Join(t.TempDir(), "config.yaml")
+	lines := []string{"%%file " + filePath, "name: x", "%autoget"}
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(msg, s, true, lines, usedLines))
+	assert.Len(t, usedLines, len(lines))
+	assert.True(t, s.AutoGet)
+	content, err := os.ReadFile(filePath)
+	require.NoError(t, err)
+	assert.Equal(t, "name: x\n%autoget\n", string(content))
+
+	// `*` prefix writes to the temporary directory, and `--run` keeps the Go code to be executed.
+	lines = []string{"%%file --run *helper.go", "func f() int { return 1 }", "%noautoget"}
+	usedLines = MakeSet[int]()
+	require.NoError(t, Parse(msg, s, true, lines, usedLines))
+	assert.Len(t, usedLines, 2)
+	assert.False(t, usedLines.Has(1))
+	assert.False(t, s.AutoGet)
+	content, err = os.ReadFile(path.Join(s.TempDir, "helper.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "func f() int { return 1 }\n", string(content))
+
+	// Missing path.
+	require.Error(t, Parse(msg, s, true, []string{"%%file", "x"}, MakeSet[int]()))
+}
+
+func TestLoad(t *testing.T) {
+	s := newEmptyState(t)
+	var msg kernel.Message
+	filePath := path.Join(t.TempDir(), "snippet.go")
+	require.NoError(t, os.WriteFile(filePath, []byte("// Snippet.\npackage snippet\n\nfunc f() int { return 1 }\n"), 0644))
+	err := Parse(msg, s, true, []string{"%load " + filePath}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"// Snippet.", "", "func f() int { return 1 }"}, s.CellLoadedLines)
+
+	// Loaded lines are reset at the next cell.
+	err = Parse(msg, s, true, []string{"%%"}, MakeSet[int]())
+	require.NoError(t, err)
+	assert.Empty(t, s.CellLoadedLines)
+
+	// Missing file.
+	err = Parse(msg, s, true, []string{"%load " + filePath + ".missing"}, MakeSet[int]())
+	require.Error(t, err)
+}
+
+func TestCellMetadata(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	status := &cellStatus{}
+	t.Setenv("GONB_TEST_METADATA", "")
+
+	metadata := map[string]any{
+		"goflags":   "-race",
+		"timeout":   "10s",
+		"args":      []any{"--name", "it's a test"},
+		"env":       "GONB_TEST_METADATA abc",
+		"noautoget": true,
+		"autoget":   false,
+	}
+	require.NoError(t, applyCellMetadata(msg, s, metadata, status))
+	assert.Equal(t, []string{"-race"}, s.GoBuildFlags)
+	assert.Equal(t, 10*time.Second, s.CellTimeout)
+	assert.Equal(t, []string{"--name", "it's a test"}, s.Args)
+	assert.Equal(t, "abc", os.Getenv("GONB_TEST_METADATA"))
+	assert.False(t, s.AutoGet)
+
+	// Invalid metadata.
+	require.Error(t, applyCellMetadata(msg, s, "goflags", status))
+	require.Error(t, applyCellMetadata(msg, s, map[string]any{"reset": true}, status))
+	require.Error(t, applyCellMetadata(msg, s, map[string]any{"timeout": 10}, status))
+	require.Error(t, applyCellMetadata(msg, s, map[string]any{"args": []any{1}}, status))
+	require.Error(t, applyCellMetadata(msg, s, map[string]any{"timeout": "x"}, status))
+	require.NoError(t, applyCellMetadata(msg, s, nil, status))
+}
+
+func TestGoInstall(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	goBin := t.TempDir()
+	t.Setenv("GOBIN", goBin)
+	t.Setenv("PATH", os.Getenv("PATH"))
+
+	// Installs a tool from a package in the notebook's module, so it doesn't require network access.
+	require.NoError(t, os.MkdirAll(path.Join(s.TempDir, "tool"), 0755))
+	require.NoError(t, os.WriteFile(path.Join(s.TempDir, "tool", "main.go"),
+		[]byte("package main\n\nfunc main() {}\n"), 0644))
+	require.NoError(t, Parse(msg, s, true, []string{"%goinstall --path ./tool"}, MakeSet[int]()))
+	_, err := os.Stat(path.Join(goBin, goexec.InstalledBinaryName("./tool")))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(os.Getenv("PATH"), goBin+string(os.PathListSeparator)))
+
+	// PATH is not changed if it already includes GOBIN.
+	pathEnv := os.Getenv("PATH")
+	require.NoError(t, Parse(msg, s, true, []string{"%goinstall --path ./tool"}, MakeSet[int]()))
+	assert.Equal(t, pathEnv, os.Getenv("PATH"))
+
+	// Invalid arguments, or failed installation.
+	require.Error(t, Parse(msg, s, true, []string{"%goinstall"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%goinstall --unknown ./tool"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%goinstall ./missing"}, MakeSet[int]()))
+
+	// `go install` is executed with the CGO_ENABLED set with `%cgo`.
+	recordPath := path.Join(t.TempDir(), "record")
+	goBinPath := path.Join(t.TempDir(), "go")
+	require.NoError(t, os.WriteFile(goBinPath, []byte(fmt.Sprintf(
+		"#!/bin/sh\nif [ \"$1\" = env ]; then echo \"$GOBIN\"; exit 0; fi\necho \"$CGO_ENABLED\" > %s\n",
+		recordPath)), 0755))
+	t.Setenv("CGO_ENABLED", "1")
+	require.NoError(t, Parse(msg, s, true, []string{"%cgo off"}, MakeSet[int]()))
+	t.Setenv(protocol.GONB_GO_BIN_ENV, goBinPath)
+	require.NoError(t, Parse(msg, s, true, []string{"%goinstall ./tool"}, MakeSet[int]()))
+	record, err := os.ReadFile(recordPath)
+	require.NoError(t, err)
+	assert.Equal(t, "0\n", string(record))
+}
+
+func TestModVerifyAndWhy(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+
+	// Without dependencies, so it doesn't require network access.
+	require.NoError(t, Parse(msg, s, true, []string{"%modverify", "%modwhy fmt"}, MakeSet[int]()))
+
+	// Invalid arguments.
+	require.Error(t, Parse(msg, s, true, []string{"%modverify all"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%modwhy"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%modwhy -m"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%modwhy --unknown fmt"}, MakeSet[int]()))
+}
+
+func TestAutoTrackAfterShell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	assert.True(t, s.AutoTrackAfterShell)
+	localModule := t.TempDir()
+	require.NoError(t, os.WriteFile(path.Join(localModule, "go.mod"), []byte("module example.com/local\n"), 0644))
+
+	require.NoError(t, Parse(msg, s, true, []string{
+		"%noautotrack",
+		"!*go mod edit -replace example.com/local=" + localModule,
+	}, MakeSet[int]()))
+	assert.False(t, s.AutoTrackAfterShell)
+	assert.NotContains(t, s.ListTracked(), localModule)
+
+	require.NoError(t, Parse(msg, s, true, []string{"%autotrack", "!true"}, MakeSet[int]()))
+	assert.True(t, s.AutoTrackAfterShell)
+	assert.Contains(t, s.ListTracked(), localModule)
+}
+
+func TestDotCell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+
+	// Without `dot` in the PATH.
+	binDir, originalPath := t.TempDir(), os.Getenv("PATH")
+	t.Setenv("PATH", binDir)
+	err := Parse(msg, s, true, []string{"%%dot", "digraph { a -> b }"}, MakeSet[int]())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "install Graphviz")
+
+	// With a fake `dot`, that records its arguments and input.
+	recordPath := path.Join(t.TempDir(), "record")
+	script := fmt.Sprintf("#!/bin/sh\necho \"$@\" > %s\ncat >> %s\necho '<?xml version=\"1.0\"?><svg></svg>'\n",
+		recordPath, recordPath)
+	require.NoError(t, os.WriteFile(path.Join(binDir, "dot"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+originalPath)
+	require.NoError(t, Parse(msg, s, true, []string{"%%dot -Kneato -Grankdir=LR", "digraph { a -> b }"}, MakeSet[int]()))
+	record, err := os.ReadFile(recordPath)
+	require.NoError(t, err)
+	assert.Equal(t, "-Tsvg -Kneato -Grankdir=LR\ndigraph { a -> b }", string(record))
+
+	// Invalid arguments, or failure to render.
+	require.Error(t, Parse(msg, s, true, []string{"%%dot -Tpng", "digraph { a -> b }"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s, true, []string{"%%dot out.svg", "digraph { a -> b }"}, MakeSet[int]()))
+	require.NoError(t, os.WriteFile(path.Join(binDir, "dot"), []byte("#!/bin/sh\necho 'syntax error' >&2\nexit 1\n"), 0755))
+	err = Parse(msg, s, true, []string{"%%dot", "digraph {"}, MakeSet[int]())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "syntax error")
+}
+
+func TestMermaidCell(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+
+	// Without `mmdc` in the PATH, rendered in the browser.
+	binDir, originalPath := t.TempDir(), os.Getenv("PATH")
+	t.Setenv("PATH", binDir)
+	require.NoError(t, Parse(msg, s, true, []string{"%%mermaid", "graph TD", "  A-->B"}, MakeSet[int]()))
+	content := mermaidHTML("gonb-mermaid-1", "graph TD\n  A-->B")
+	assert.Contains(t, content, `<pre class="mermaid" id="gonb-mermaid-1">graph TD`+"\n  A--&gt;B</pre>")
+	assert.Contains(t, content, mermaidModuleURL)
+	require.Error(t, Parse(msg, s, true, []string{"%%mermaid out.svg", "graph TD"}, MakeSet[int]()))
+
+	// With a fake `mmdc`, that records its input.
+	recordPath := path.Join(t.TempDir(), "record")
+	script := fmt.Sprintf("#!/bin/sh\ncat \"$2\" > %s\necho '<svg></svg>' > \"$4\"\n", recordPath)
+	require.NoError(t, os.WriteFile(path.Join(binDir, "mmdc"), []byte(script), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+originalPath)
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(msg, s, true, []string{"%%mermaid", "graph TD", "  A-->B"}, usedLines))
+	record, err := os.ReadFile(recordPath)
+	require.NoError(t, err)
+	assert.Equal(t, "graph TD\n  A-->B", string(record))
+	assert.Equal(t, 3, len(usedLines))
+
+	// Failure to render.
+	require.NoError(t, os.WriteFile(path.Join(binDir, "mmdc"), []byte("#!/bin/sh\necho 'parse error' >&2\nexit 1\n"), 0755))
+	err = Parse(msg, s, true, []string{"%%mermaid", "graph"}, MakeSet[int]())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "parse error")
+}
+
+func TestRegister(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var gotArgs []string
+	require.NoError(t, Register("%test_custom", func(msg kernel.Message, goExec *goexec.State, args []string) error {
+		assert.Equal(t, s, goExec)
+		gotArgs = args
+		if len(args) > 0 && args[0] == "fail" {
+			return errors.New("custom failure")
+		}
+		return nil
+	}))
+	require.NoError(t, Parse(nil, s, true, []string{`%test_custom a "b c"`}, MakeSet[int]()))
+	assert.Equal(t, []string{"a", "b c"}, gotArgs)
+	err := Parse(nil, s, true, []string{"%test_custom fail"}, MakeSet[int]())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "custom failure")
+
+	// Offered as auto-complete option.
+	matches, _ := Complete("%test_cu", len("%test_cu"))
+	assert.Equal(t, []string{"%test_custom"}, matches)
+
+	// Collisions and invalid names.
+	noop := func(kernel.Message, *goexec.State, []string) error { return nil }
+	require.Error(t, Register("test_custom", noop))
+	require.Error(t, Register("cd", noop))
+	require.Error(t, Register("%env", noop))
+	require.Error(t, Register("%%mine", noop))
+	require.Error(t, Register("my cmd", noop))
+	require.Error(t, Register("test_nil", nil))
+}
+
+func TestUnknownCommand(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	err := execInternal(nil, s, "bogus --flag", &cellStatus{})
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrUnknownCommand))
+	assert.Contains(t, err.Error(), `"%bogus"`)
+	require.NoError(t, execInternal(nil, s, "pwd", &cellStatus{}))
+
+	// Parse reports it, but it doesn't fail the cell: the following commands are still executed.
+	require.NoError(t, Parse(nil, s, true, []string{"%bogus", "%args a"}, MakeSet[int]()))
+	assert.Equal(t, []string{"a"}, s.Args)
+}
+
+func TestCat(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	dir := t.TempDir()
+	goFile := path.Join(dir, "main.go")
+	require.NoError(t, os.WriteFile(goFile, []byte("package main\n\nfunc main() {\n}"), 0644))
+
+	markdown, err := catMarkdown(goFile, 1, -1)
+	require.NoError(t, err)
+	assert.Equal(t, "```go\npackage main\n\nfunc main() {\n}\n```\n", markdown)
+	markdown, err = catMarkdown(goFile, 3, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "```go\nfunc main() {\n```\n", markdown)
+
+	// Unknown language, and contents with a fence.
+	mdFile := path.Join(dir, "notes.txt")
+	require.NoError(t, os.WriteFile(mdFile, []byte("```\ncode\n```\n"), 0644))
+	markdown, err = catMarkdown(mdFile, 1, -1)
+	require.NoError(t, err)
+	assert.Equal(t, "````\n```\ncode\n```\n````\n", markdown)
+
+	// Large files are truncated.
+	largeFile := path.Join(dir, "large.py")
+	require.NoError(t, os.WriteFile(largeFile, []byte(strings.Repeat("print(1)\n", MaxCatBytes)), 0644))
+	markdown, err = catMarkdown(largeFile, 1, -1)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(markdown, "```python\n"))
+	assert.Contains(t, markdown, "Truncated after")
+	assert.Less(t, len(markdown), MaxCatBytes+200)
+
+	from, to, err := parseLinesRange("10:")
+	require.NoError(t, err)
+	assert.Equal(t, []int{10, -1}, []int{from, to})
+	from, to, err = parseLinesRange(":20")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 20}, []int{from, to})
+	for _, invalid := range []string{"10", "0:5", "5:4", "a:b"} {
+		_, _, err = parseLinesRange(invalid)
+		assert.Error(t, err, "range %q", invalid)
+	}
+
+	require.NoError(t, Parse(nil, s, true, []string{"%cat --lines 2:3 " + goFile, "%cat --lines=:1 " + goFile}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%cat"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%cat " + path.Join(dir, "missing.go")}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%cat --lines " + goFile}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%cat " + goFile + " " + mdFile}, MakeSet[int]()))
+}
+
+func TestParseCommands(t *testing.T) {
+	commands, err := ParseCommands([]string{
+		"import \"fmt\"",
+		"%env NAME 'hello world'",
+		"!*ls \\",
+		"  -l",
+		"%args --text <<END",
+		"a",
+		"b",
+		"END",
+		"%stdin",
+		"input",
+		"EOF",
+		"%bogus 1",
+		"%%bash --dir",
+		"echo hi",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []Command{
+		{Type: '%', Parts: []string{"env", "NAME", "hello world"}, Line: 1},
+		{Type: '!', Parts: []string{"*ls    -l"}, Line: 2},
+		{Type: '%', Parts: []string{"args", "--text", "a\nb"}, Line: 4},
+		{Type: '%', Parts: []string{"stdin"}, Body: "input\n", Line: 8},
+		{Type: '%', Parts: []string{"bogus", "1"}, Line: 11},
+		{Type: '%', Parts: []string{"%bash", "--dir"}, Body: "echo hi", Line: 12},
+	}, commands)
+
+	commands, err = ParseCommands([]string{"func main() {}"})
+	require.NoError(t, err)
+	assert.Empty(t, commands)
+	_, err = ParseCommands([]string{"%stdin", "no end marker"})
+	require.Error(t, err)
+}
+
+func TestEnvTemplate(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	t.Setenv("GONB_TEST_HOST", "localhost")
+	t.Setenv("GONB_TEST_PORT", "8080")
+	t.Setenv("GONB_TEST_URL", "")
+
+	require.NoError(t, Parse(nil, s, true, []string{
+		`%env GONB_TEST_URL "https://{{.GONB_TEST_HOST}}:{{.GONB_TEST_PORT}}/"`}, MakeSet[int]()))
+	assert.Equal(t, "https://localhost:8080/", os.Getenv("GONB_TEST_URL"))
+	require.NoError(t, Parse(nil, s, true, []string{
+		`%env --no-template GONB_TEST_URL "{{.GONB_TEST_HOST}}:$GONB_TEST_PORT"`}, MakeSet[int]()))
+	assert.Equal(t, "{{.GONB_TEST_HOST}}:8080", os.Getenv("GONB_TEST_URL"))
+	require.NoError(t, Parse(nil, s, true, []string{
+		`%env --literal GONB_TEST_URL "{{.GONB_TEST_HOST}}"`}, MakeSet[int]()))
+	assert.Equal(t, "{{.GONB_TEST_HOST}}", os.Getenv("GONB_TEST_URL"))
+
+	// Invalid templates, or missing variables, are errors and the variable is not changed.
+	require.Error(t, Parse(nil, s, true, []string{`%env GONB_TEST_URL "{{.GONB_TEST_HOST"`}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{`%env GONB_TEST_URL "{{.GONB_TEST_MISSING}}"`}, MakeSet[int]()))
+	assert.Equal(t, "{{.GONB_TEST_HOST}}", os.Getenv("GONB_TEST_URL"))
+}
+
+func TestPersist(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	var msg kernel.Message
+	defer func(dir string) { kernelStartDir = dir }(kernelStartDir)
+	kernelStartDir = t.TempDir()
+	defer func(kinds, changed, secret Set[string], original, lastSet map[string]*string) {
+		persistKinds, changedEnv, secretEnv, originalEnv, lastSetEnv = kinds, changed, secret, original, lastSet
+	}(persistKinds, changedEnv, secretEnv, originalEnv, lastSetEnv)
+	persistKinds = MakeSet[string]()
+	changedEnv = MakeSet[string]()
+	secretEnv = MakeSet[string]()
+	originalEnv, lastSetEnv = make(map[string]*string), make(map[string]*string)
+	t.Setenv("GONB_TEST_PERSIST", "")
+	t.Setenv("GONB_TEST_PERSIST_TOKEN", "")
+	trackedDir := t.TempDir()
+
+	require.NoError(t, Parse(msg, s, true, []string{"%persist env,tracked"}, MakeSet[int]()))
+	require.NoError(t, Parse(msg, s, true, []string{
+		"%env GONB_TEST_PERSIST value",
+		"%env GONB_TEST_PERSIST_TOKEN secret",
+		"%track " + trackedDir,
+	}, MakeSet[int]()))
+	settings, err := loadPersisted()
+	require.NoError(t, err)
+	require.NotNil(t, settings)
+	assert.Equal(t, []string{"env", "tracked"}, settings.Kinds)
+	require.Contains(t, settings.Env, "GONB_TEST_PERSIST")
+	assert.Equal(t, "value", *settings.Env["GONB_TEST_PERSIST"])
+	assert.NotContains(t, settings.Env, "GONB_TEST_PERSIST_TOKEN", "secrets should not be persisted")
+	assert.Contains(t, settings.Tracked, trackedDir)
+
+	// Simulates a kernel restart.
+	s2 := newEmptyState(t)
+	defer func() { require.NoError(t, s2.Finalize()) }()
+	persistKinds = MakeSet[string]()
+	changedEnv = MakeSet[string]()
+	require.NoError(t, os.Unsetenv("GONB_TEST_PERSIST"))
+	require.NoError(t, RestorePersisted(s2))
+	assert.Equal(t, "value", os.Getenv("GONB_TEST_PERSIST"))
+	assert.True(t, changedEnv.Has("GONB_TEST_PERSIST"))
+	assert.Contains(t, s2.ListTracked(), trackedDir)
+	assert.True(t, persistKinds.Has(persistEnv))
+
+	// Disabling it removes the file.
+	require.NoError(t, Parse(msg, s2, true, []string{"%persist off"}, MakeSet[int]()))
+	_, err = os.Stat(path.Join(kernelStartDir, PersistFileName))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, RestorePersisted(s2))
+	assert.Empty(t, persistKinds)
+
+	require.Error(t, Parse(msg, s2, true, []string{"%persist definitions"}, MakeSet[int]()))
+	require.Error(t, Parse(msg, s2, true, []string{"%persist env tracked"}, MakeSet[int]()))
+}
+
+func TestTempDir(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	t.Setenv(protocol.GONB_TMP_DIR_ENV, "")
+
+	require.NoError(t, Parse(nil, s, true, []string{"%tempdir"}, MakeSet[int]()))
+	assert.Equal(t, s.TempDir, os.Getenv(protocol.GONB_TMP_DIR_ENV))
+	require.Error(t, Parse(nil, s, true, []string{"%tempdir /tmp"}, MakeSet[int]()))
+
+	// Kept in sync when the temporary directory is re-created.
+	require.NoError(t, os.Unsetenv(protocol.GONB_TMP_DIR_ENV))
+	require.NoError(t, Parse(nil, s, true, []string{"%reset --hard"}, MakeSet[int]()))
+	assert.Equal(t, s.TempDir, os.Getenv(protocol.GONB_TMP_DIR_ENV))
+}
+
+func TestDirectiveComments(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	t.Setenv("GONB_TEST_DIRECTIVE", "")
+
+	usedLines := MakeSet[int]()
+	require.NoError(t, Parse(nil, s, true, []string{
+		"// gonb:args --x=1",
+		"func main() {",
+		"\t//gonb:env GONB_TEST_DIRECTIVE first",
+		"}",
+		"%env GONB_TEST_DIRECTIVE second",
+		"// gonbui is not a directive",
+	}, usedLines))
+	assert.Equal(t, []string{"--x=1"}, s.Args)
+	// Executed in order: the `%env` comes last.
+	assert.Equal(t, "second", os.Getenv("GONB_TEST_DIRECTIVE"))
+	// Directive comments are kept in the Go code.
+	assert.False(t, usedLines.Has(0))
+	assert.False(t, usedLines.Has(2))
+	assert.True(t, usedLines.Has(4))
+
+	commands, err := ParseCommands([]string{"x := 1 // gonb:args no", "  // gonb:env A b"})
+	require.NoError(t, err)
+	assert.Equal(t, []Command{{Type: '%', Parts: []string{"env", "A", "b"}, Line: 1}}, commands)
+
+	// Multi-line special commands can't be used as directives.
+	require.Error(t, Parse(nil, s, true, []string{"// gonb:%bash", "echo hi"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"// gonb:stdin", "EOF"}, MakeSet[int]()))
+}
+
+func TestReplay(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	s.AutoGet = false
+	s.AutoImport = false
+
+	require.NoError(t, s.ExecuteCell(nil, 1, []string{"func one() int { return 1 }"}, MakeSet[int]()))
+	require.NoError(t, s.ExecuteCell(nil, 2, []string{"func two() int { return one() + 1 }"}, MakeSet[int]()))
+	require.NoError(t, Parse(nil, s, true, []string{"%reset"}, MakeSet[int]()))
+	require.Empty(t, s.Definitions.Functions)
+
+	// Replaying only the last cell fails, since it depends on the first.
+	require.Error(t, Parse(nil, s, true, []string{"%replay 1"}, MakeSet[int]()))
+	require.NoError(t, Parse(nil, s, true, []string{"%reload"}, MakeSet[int]()))
+	assert.Contains(t, s.Definitions.Functions, "one")
+	assert.Contains(t, s.Definitions.Functions, "two")
+
+	require.Error(t, Parse(nil, s, true, []string{"%replay 0"}, MakeSet[int]()))
+	require.Error(t, Parse(nil, s, true, []string{"%reload 2"}, MakeSet[int]()))
+}
+
+func TestPipeFromLast(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	// Without a kernel there is no previous output: only the `%stdin` content is used.
+	require.NoError(t, Parse(nil, s, true, []string{"%stdin", "a", "EOF", "%pipe-from-last"}, MakeSet[int]()))
+	assert.Equal(t, "a\n", s.CellStdin)
+	require.Error(t, Parse(nil, s, true, []string{"%pipe-from-last 1"}, MakeSet[int]()))
+}
+
+func TestAutoDisplayCommand(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	assert.False(t, s.AutoDisplay)
+	require.NoError(t, Parse(nil, s, true, []string{"%autodisplay"}, MakeSet[int]()))
+	assert.True(t, s.AutoDisplay)
+	require.NoError(t, Parse(nil, s, true, []string{"%noautodisplay"}, MakeSet[int]()))
+	assert.False(t, s.AutoDisplay)
+}
+
+func TestEnvInvalidName(t *testing.T) {
+	s := newEmptyState(t)
+	defer func() { require.NoError(t, s.Finalize()) }()
+	for _, name := range []string{"'A B'", "A=B", "1A", "A-B", "'A.B'", "''"} {
+		err := Parse(nil, s, true, []string{"%env " + name + " value"}, MakeSet[int]())
+		require.Errorf(t, err, "%%env with name %s should fail", name)
+		assert.Contains(t, err.Error(), "invalid environment variable name")
+		require.Errorf(t, Parse(nil, s, true, []string{"%envcell " + name + " value"}, MakeSet[int]()),
+			"%%envcell with name %s should fail", name)
+	}
+	t.Setenv("_GONB_TEST_VALID_1", "")
+	require.NoError(t, Parse(nil, s, true, []string{"%env _GONB_TEST_VALID_1 value"}, MakeSet[int]()))
+	assert.Equal(t, "value", os.Getenv("_GONB_TEST_VALID_1"))
+
+	filePath := path.Join(t.TempDir(), "invalid.env")
+	require.NoError(t, os.WriteFile(filePath, []byte("GONB.TEST=1\n"), 0600))
+	require.Error(t, Parse(nil, s, true, []string{"%dotenv " + filePath}, MakeSet[int]()))
+}
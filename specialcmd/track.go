@@ -4,18 +4,41 @@ import (
 	"fmt"
 	"github.com/janpfeifer/gonb/goexec"
 	"github.com/janpfeifer/gonb/kernel"
+	"github.com/pkg/errors"
+	"io/fs"
 	"k8s.io/klog/v2"
+	"path"
+	"path/filepath"
 	"strings"
 )
 
 // execTrack executes the "%track" special command. The parameter `args` excludes
 // "%track".
+//
+// Arguments can be glob patterns (see expandGlob), in which case all matching files and
+// directories are tracked.
 func execTrack(msg kernel.Message, goExec *goexec.State, args []string) {
 	if len(args) == 0 {
 		showTrackedList(msg, goExec)
 		return
 	}
-	for _, fileOrDirPath := range args {
+	var paths []string
+	for _, arg := range args {
+		if !hasGlobMeta(arg) {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := expandGlob(arg)
+		if err == nil && len(matches) == 0 {
+			err = errors.Errorf("Warning: pattern %q matched no files", arg)
+		}
+		if err != nil {
+			publishStderr(msg, err.Error()+"\n")
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	for _, fileOrDirPath := range paths {
 		err := goExec.Track(fileOrDirPath)
 		if err != nil {
 			err = kernel.PublishWriteStream(msg, kernel.StreamStderr, err.Error()+"\n")
@@ -30,14 +53,35 @@ func execTrack(msg kernel.Message, goExec *goexec.State, args []string) {
 	}
 }
 
-// execUntrack executes the "%track" special command. The parameter `args` excludes
+// execUntrack executes the "%untrack" special command. The parameter `args` excludes
 // "%untrack".
+//
+// Arguments can be glob patterns (see expandGlob), in which case they are matched against the
+// tracked files and directories.
 func execUntrack(msg kernel.Message, goExec *goexec.State, args []string) {
 	if len(args) == 0 {
 		showTrackedList(msg, goExec)
 		return
 	}
-	for _, fileOrDirPath := range args {
+	var paths []string
+	for _, arg := range args {
+		if !hasGlobMeta(arg) {
+			paths = append(paths, arg)
+			continue
+		}
+		var matches []string
+		for _, tracked := range goExec.ListTracked() {
+			if matchGlob(arg, tracked) {
+				matches = append(matches, tracked)
+			}
+		}
+		if len(matches) == 0 {
+			publishStderr(msg, fmt.Sprintf("Warning: pattern %q matched no tracked files\n", arg))
+			continue
+		}
+		paths = append(paths, matches...)
+	}
+	for _, fileOrDirPath := range paths {
 		err := goExec.Untrack(fileOrDirPath)
 		if err != nil {
 			err = kernel.PublishWriteStream(msg, kernel.StreamStderr, err.Error()+"\n")
@@ -53,6 +97,79 @@ func execUntrack(msg kernel.Message, goExec *goexec.State, args []string) {
 
 }
 
+// hasGlobMeta returns whether pattern has any of the glob special characters.
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// expandGlob returns the files and directories that match the glob pattern. Besides the syntax
+// of filepath.Match, a `**` path component matches any number of directories (including none),
+// so `pkg/**/*.go` matches all Go files under `pkg`.
+func expandGlob(pattern string) (matches []string, err error) {
+	pattern = filepath.Clean(pattern)
+	if !strings.Contains(pattern, "**") {
+		matches, err = filepath.Glob(pattern)
+		if err != nil {
+			err = errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+		return
+	}
+
+	// Walk from the longest prefix without special characters.
+	parts := strings.Split(pattern, "/")
+	rootLen := 0
+	for rootLen < len(parts) && !hasGlobMeta(parts[rootLen]) {
+		rootLen++
+	}
+	root := strings.Join(parts[:rootLen], "/")
+	if root == "" {
+		root = "."
+		if rootLen > 0 {
+			root = "/"
+		}
+	}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root && matchGlob(pattern, p) {
+			matches = append(matches, p)
+		}
+		return nil
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "failed to expand pattern %q", pattern)
+	}
+	return
+}
+
+// matchGlob returns whether the filePath matches the glob pattern, see expandGlob for the syntax.
+func matchGlob(pattern, filePath string) bool {
+	return matchGlobParts(strings.Split(filepath.Clean(pattern), "/"), strings.Split(filepath.Clean(filePath), "/"))
+}
+
+// matchGlobParts implements matchGlob, with the pattern and the path split in their components.
+func matchGlobParts(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for ii := 0; ii <= len(parts); ii++ {
+			if matchGlobParts(pattern[1:], parts[ii:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], parts[0]); !matched {
+		return false
+	}
+	return matchGlobParts(pattern[1:], parts[1:])
+}
+
 func showTrackedList(msg kernel.Message, goExec *goexec.State) {
 	tracked := goExec.ListTracked()
 	htmlParts := make([]string, 0, len(tracked)+5)